@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessLogQueueSize is the number of access log lines buffered in memory. If
+// the disk can't keep up, further lines are dropped instead of blocking
+// requests.
+const accessLogQueueSize = 4096
+
+// accessLog receives the access log lines of all served requests. It is nil if
+// the access log is disabled.
+var accessLog *accessLogger
+
+// accessLogger writes access log lines in the background.
+type accessLogger struct {
+	lines   chan []byte
+	out     io.WriteCloser
+	dropped atomic.Uint64
+	done    chan struct{}
+
+	mux    sync.RWMutex // Guards closed and sending to lines
+	closed bool
+}
+
+func newAccessLogger(out io.WriteCloser) *accessLogger {
+	l := &accessLogger{
+		lines: make(chan []byte, accessLogQueueSize),
+		out:   out,
+		done:  make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// initAccessLog opens the configured access log file. It does nothing if the
+// access log is disabled.
+func initAccessLog() error {
+	if !config.AccessLog.Enable {
+		return nil
+	}
+
+	out, err := openRotatingFile(
+		config.AccessLog.File,
+		int64(config.AccessLog.MaxSizeMB)<<20,
+		time.Duration(config.AccessLog.RotateIntervalHours)*time.Hour,
+		config.AccessLog.MaxBackups,
+	)
+	if err != nil {
+		return err
+	}
+
+	accessLog = newAccessLogger(out)
+	slog.Info("Access log enabled", "event", "access_log", "path", config.AccessLog.File)
+	return nil
+}
+
+// run writes queued lines until the logger is closed. Lines which are queued
+// at the same time are written at once.
+func (l *accessLogger) run() {
+	defer close(l.done)
+
+	var buf []byte
+	for line := range l.lines {
+		buf = append(buf[:0], line...)
+	drain:
+		for {
+			select {
+			case line, ok := <-l.lines:
+				if !ok {
+					break drain
+				}
+				buf = append(buf, line...)
+			default:
+				break drain
+			}
+		}
+
+		if dropped := l.dropped.Swap(0); dropped > 0 {
+			slog.Warn("Dropped access log lines, the log file can't keep up", "event", "access_log", "dropped", dropped)
+		}
+		if _, err := l.out.Write(buf); err != nil {
+			slog.Error("Error writing access log", "event", "access_log", "error", err)
+		}
+	}
+}
+
+// log queues a line without blocking. If the queue is full, the line is
+// dropped. Lines logged after Close are discarded.
+func (l *accessLogger) log(line []byte) {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	if l.closed {
+		return
+	}
+
+	select {
+	case l.lines <- line:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// Close writes all queued lines and closes the log file.
+func (l *accessLogger) Close() error {
+	l.mux.Lock()
+	if l.closed {
+		l.mux.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.lines)
+	l.mux.Unlock()
+
+	<-l.done
+	return l.out.Close()
+}
+
+// withAccessLog wraps next and writes an access log line for every request
+// once it has been served. The client and user are determined with c.
+func withAccessLog(c *Config, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := accessLog
+		if logger == nil {
+			next(w, r)
+			return
+		}
+
+		// The proxy credentials are removed from the request once checked.
+		user, _ := validProxyAuthorization(r.Header.Get("Proxy-Authorization"), c.ProxyAuth.Users)
+		start := time.Now()
+		recorder := &accessLogResponseWriter{ResponseWriter: w}
+
+		// Aborted responses are logged as well.
+		defer func() {
+			logger.log(formatAccessLogLine(c, r, user, recorder, start, time.Since(start)))
+		}()
+		next(recorder, r)
+	}
+}
+
+// formatAccessLogLine formats a request in the combined log format, followed
+// by the cache result (X-Cache header, "-" if the request wasn't served from
+// the cache) and the duration in seconds.
+func formatAccessLogLine(c *Config, r *http.Request, user string, recorder *accessLogResponseWriter, start time.Time, duration time.Duration) []byte {
+	client := r.RemoteAddr
+	if addr, ok := c.clientIP(r); ok {
+		client = addr.String()
+	}
+
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+
+	cacheResult := recorder.Header().Get("X-Cache")
+	if cacheResult == "" {
+		cacheResult = "-"
+	}
+
+	var b strings.Builder
+	b.WriteString(client)
+	b.WriteString(" - ")
+	b.WriteString(accessLogQuote(accessLogField(strings.ReplaceAll(user, " ", "%20"))))
+	b.WriteString(" [")
+	b.WriteString(start.Format("02/Jan/2006:15:04:05 -0700"))
+	b.WriteString(`] "`)
+	b.WriteString(accessLogQuote(r.Method + " " + target + " " + r.Proto))
+	b.WriteString(`" `)
+	b.WriteString(strconv.Itoa(recorder.statusCode()))
+	b.WriteString(" ")
+	if recorder.bytes > 0 {
+		b.WriteString(strconv.FormatInt(recorder.bytes, 10))
+	} else {
+		b.WriteString("-")
+	}
+	b.WriteString(` "`)
+	b.WriteString(accessLogQuote(accessLogField(r.Referer())))
+	b.WriteString(`" "`)
+	b.WriteString(accessLogQuote(accessLogField(r.UserAgent())))
+	b.WriteString(`" `)
+	b.WriteString(accessLogQuote(cacheResult))
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatFloat(duration.Seconds(), 'f', 3, 64))
+	b.WriteString("\n")
+
+	return []byte(b.String())
+}
+
+// accessLogField returns value or "-" if it is empty.
+func accessLogField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// accessLogQuote escapes quotes, backslashes and control characters so a
+// client can't inject additional log lines or fields.
+func accessLogQuote(value string) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// accessLogResponseWriter records the status code and the number of written
+// body bytes of a response.
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *accessLogResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom copies src using the ReadFrom of the wrapped response writer if
+// available, which allows the server to send cached files with sendfile.
+func (w *accessLogResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.bytes += n
+	return n, err
+}
+
+func (w *accessLogResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("webserver doesn't support hijacking")
+	}
+	return hj.Hijack()
+}
+
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// statusCode returns the status code sent to the client. Hijacked connections
+// (CONNECT tunnels) are logged as 200.
+func (w *accessLogResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// rotatingFile is a log file which is rotated once it exceeds maxSize bytes or
+// when a new rotation interval starts. Rotated files get the time of the
+// rotation as suffix, only the newest maxBackups rotated files are kept.
+type rotatingFile struct {
+	mux sync.Mutex
+
+	path       string
+	maxSize    int64         // 0 = no size limit
+	interval   time.Duration // 0 = no time based rotation
+	maxBackups int           // 0 = keep all rotated files
+	now        func() time.Time
+
+	file   *os.File
+	size   int64
+	period time.Time // start of the interval the current file belongs to
+}
+
+// openRotatingFile opens or creates the log file at path.
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	// A file kept from a previous run belongs to the interval it was last
+	// written in.
+	f.period = f.intervalStart(info.ModTime())
+	if info.Size() == 0 {
+		f.period = f.intervalStart(f.now())
+	}
+	return nil
+}
+
+func (f *rotatingFile) intervalStart(t time.Time) time.Time {
+	if f.interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.interval)
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) ||
+		(f.interval > 0 && !f.intervalStart(f.now()).Equal(f.period))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	rotated := f.path + "." + f.now().Format("20060102-150405")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s.%d", f.path, f.now().Format("20060102-150405"), i)
+	}
+	if err := os.Rename(f.path, rotated); err != nil {
+		return err
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.period = f.intervalStart(f.now())
+
+	return f.removeOldBackups()
+}
+
+// removeOldBackups deletes the oldest rotated files exceeding maxBackups.
+func (f *rotatingFile) removeOldBackups() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	backups := slices.DeleteFunc(matches, func(match string) bool {
+		suffix := strings.TrimPrefix(match, f.path+".")
+		return suffix == "" || suffix[0] < '0' || suffix[0] > '9'
+	})
+	if len(backups) <= f.maxBackups {
+		return nil
+	}
+
+	// The suffix sorts chronologically.
+	slices.Sort(backups)
+	for _, backup := range backups[:len(backups)-f.maxBackups] {
+		if err := os.Remove(backup); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
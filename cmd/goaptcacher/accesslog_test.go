@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bufferCloser collects the access log output of tests.
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (b *bufferCloser) Close() error { return nil }
+
+func TestWithAccessLogWritesCombinedFormat(t *testing.T) {
+	var out bufferCloser
+	logger := newAccessLogger(&out)
+	old := accessLog
+	accessLog = logger
+	t.Cleanup(func() {
+		accessLog = old
+	})
+
+	handler := withAccessLog(&Config{}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("payload"))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/stable/InRelease", nil)
+	req.RemoteAddr = "192.0.2.10:41234"
+	req.Header.Set("User-Agent", `Debian APT-HTTP/1.3 "quoted"`)
+	handler(httptest.NewRecorder(), req)
+
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	line := out.String()
+	for _, want := range []string{
+		"192.0.2.10 - - [",
+		`] "GET http://deb.debian.org/debian/dists/stable/InRelease HTTP/1.1" 200 7 "-" "Debian APT-HTTP/1.3 \"quoted\"" HIT `,
+	} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("access log line = %q, want it to contain %q", line, want)
+		}
+	}
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("expected a single access log line, got %q", line)
+	}
+}
+
+func TestWithAccessLogRecordsUserAndMissingBody(t *testing.T) {
+	cfg := &Config{}
+	cfg.ProxyAuth.Users = map[string]string{"apt": "secret"}
+	var out bufferCloser
+	logger := newAccessLogger(&out)
+	old := accessLog
+	accessLog = logger
+	t.Cleanup(func() {
+		accessLog = old
+	})
+
+	handler := withAccessLog(cfg, func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("Proxy-Authorization")
+		w.WriteHeader(http.StatusNotModified)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/pool/main/a.deb", nil)
+	req.SetBasicAuth("apt", "secret")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	handler(httptest.NewRecorder(), req)
+
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	if line := out.String(); !strings.Contains(line, " - apt [") || !strings.Contains(line, `" 304 - "-" "-" - `) {
+		t.Fatalf("unexpected access log line %q", line)
+	}
+}
+
+func TestAccessLoggerDropsLinesWhenQueueIsFull(t *testing.T) {
+	logger := &accessLogger{lines: make(chan []byte, 1)}
+
+	logger.log([]byte("first\n"))
+	logger.log([]byte("second\n"))
+
+	if got := logger.dropped.Load(); got != 1 {
+		t.Fatalf("dropped = %d, want 1", got)
+	}
+}
+
+func TestAccessLogQuote(t *testing.T) {
+	if got, want := accessLogQuote("a\"b\\c\nd"), `a\"b\\c\x0ad`; got != want {
+		t.Fatalf("accessLogQuote() = %q, want %q", got, want)
+	}
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+	f, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+
+	for i := range 4 {
+		now = now.Add(time.Second)
+		if _, err := f.Write([]byte("0123456789")); err != nil {
+			t.Fatalf("Write(%d) error = %v", i, err)
+		}
+	}
+
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want 2 files", backups)
+	}
+	if !strings.HasSuffix(backups[1], ".20261015-120004") {
+		t.Fatalf("newest backup = %q, want suffix of the last rotation", backups[1])
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != "0123456789" {
+		t.Fatalf("current log = %q, want the last line only", data)
+	}
+}
+
+func TestRotatingFileRotatesByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	now := time.Date(2026, 10, 15, 23, 59, 0, 0, time.UTC)
+
+	f, err := openRotatingFile(path, 0, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("openRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+	f.now = func() time.Time { return now }
+	f.period = f.intervalStart(now)
+
+	if _, err := f.Write([]byte("day one\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	now = now.Add(30 * time.Second)
+	if _, err := f.Write([]byte("day one again\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := f.Write([]byte("day two\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	rotated, err := os.ReadFile(path + ".20261016-000030")
+	if err != nil {
+		t.Fatalf("ReadFile(rotated) error = %v", err)
+	}
+	if string(rotated) != "day one\nday one again\n" {
+		t.Fatalf("rotated log = %q", rotated)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(current) != "day two\n" {
+		t.Fatalf("current log = %q, want %q", current, "day two\n")
+	}
+}
+
+func TestReadConfigAccessLogDefaults(t *testing.T) {
+	path := writeTempConfig(t, `
+cache_directory: /var/cache/goaptcacher
+access_log:
+  enable: true
+  max_backups: -1
+`)
+
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if cfg.AccessLog.File != filepath.Join("/var/cache/goaptcacher", "access.log") {
+		t.Fatalf("AccessLog.File = %q", cfg.AccessLog.File)
+	}
+	if cfg.AccessLog.MaxSizeMB != 100 || cfg.AccessLog.RotateIntervalHours != 24 || cfg.AccessLog.MaxBackups != 0 {
+		t.Fatalf("unexpected access log defaults %+v", cfg.AccessLog)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configDomainCounts is the number of configured domains returned by the
+// config API.
+type configDomainCounts struct {
+	Cached      int  `json:"cached"`
+	Passthrough int  `json:"passthrough"`
+	Denied      int  `json:"denied"`
+	OpenProxy   bool `json:"open_proxy"`
+}
+
+// configResponse is the JSON document served by /_goaptcacher/api/config.
+type configResponse struct {
+	Config        any                `json:"config"`
+	IncludedFiles []string           `json:"included_files"`
+	Domains       configDomainCounts `json:"domains"`
+}
+
+// httpServeAPIConfig serves the effective config with secrets redacted as
+// JSON, with the same keys as the config file. Domain lists are the ones of
+// the last reload.
+func httpServeAPIConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeManagement(w, r, managementRemoteAllowed()) {
+		return
+	}
+
+	response, err := newConfigResponse()
+	if err != nil {
+		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+		return
+	}
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+// newConfigResponse builds the config API response from the running config.
+func newConfigResponse() (*configResponse, error) {
+	// A reload replaces the domain lists.
+	reloadMux.RLock()
+	redacted, err := redactedConfig(config)
+	reloadMux.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// The config is converted through YAML to keep the keys of the config
+	// file.
+	data, err := yaml.Marshal(redacted)
+	if err != nil {
+		return nil, err
+	}
+	var document any
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	domains := config.currentDomains()
+	return &configResponse{
+		Config:        jsonValue(document),
+		IncludedFiles: append([]string{}, config.IncludedFiles...),
+		Domains: configDomainCounts{
+			Cached:      len(domains.domains),
+			Passthrough: len(domains.passthrough),
+			Denied:      len(domains.denied),
+			OpenProxy:   domains.openProxy,
+		},
+	}, nil
+}
+
+// jsonValue converts the maps decoded by yaml, which have keys of any type,
+// to maps with string keys, which can be encoded as JSON.
+func jsonValue(v any) any {
+	switch v := v.(type) {
+	case map[any]any:
+		converted := make(map[string]any, len(v))
+		for key, value := range v {
+			converted[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return converted
+	case []any:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
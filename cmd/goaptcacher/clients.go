@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses a list of CIDR ranges. Plain IP addresses are accepted
+// as well and treated as single host ranges.
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", entry, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range %q: %w", entry, err)
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// prefixesContain checks if addr is part of any of the given ranges.
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteAddrIP parses the IP address of a RemoteAddr value which may contain a
+// port.
+func remoteAddrIP(remoteAddr string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// clientIP returns the IP address of the client which sent the request. If the
+// direct peer is a trusted proxy, the X-Forwarded-For header is evaluated from
+// right to left and the first address which is not a trusted proxy is used.
+func (c *Config) clientIP(r *http.Request) (netip.Addr, bool) {
+	addr, ok := remoteAddrIP(r.RemoteAddr)
+	if !ok || !prefixesContain(c.trustedProxies, addr) {
+		return addr, ok
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !prefixesContain(c.trustedProxies, addr) {
+			break
+		}
+	}
+
+	return addr, true
+}
+
+// isClientAllowed checks if the client of the request is allowed to use the
+// proxy. Loopback clients are always allowed, if no ranges are configured all
+// clients are allowed.
+func (c *Config) isClientAllowed(r *http.Request) bool {
+	if len(c.allowedClients) == 0 {
+		return true
+	}
+
+	addr, ok := c.clientIP(r)
+	if !ok {
+		return false
+	}
+	if addr.IsLoopback() {
+		return true
+	}
+
+	return prefixesContain(c.allowedClients, addr)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePrefixesRejectsInvalidRange(t *testing.T) {
+	if _, err := parsePrefixes([]string{"192.168.0.0/33"}); err == nil {
+		t.Fatalf("expected error for invalid CIDR range")
+	}
+	if _, err := parsePrefixes([]string{"not-an-ip"}); err == nil {
+		t.Fatalf("expected error for invalid address")
+	}
+}
+
+func TestIsClientAllowed(t *testing.T) {
+	cfg := &Config{
+		AllowedClients: []string{"192.168.1.0/24", "2001:db8::/32", "10.1.2.3"},
+		TrustedProxies: []string{"10.0.0.10/32"},
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	tcs := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       bool
+	}{
+		{"ipv4 allowed", "192.168.1.20:40000", "", true},
+		{"ipv4 denied", "192.168.2.20:40000", "", false},
+		{"ipv4 single host", "10.1.2.3:40000", "", true},
+		{"ipv4 mapped ipv6", "[::ffff:192.168.1.20]:40000", "", true},
+		{"ipv6 allowed", "[2001:db8::1]:40000", "", true},
+		{"ipv6 denied", "[2001:db9::1]:40000", "", false},
+		{"ipv4 loopback", "127.0.0.1:40000", "", true},
+		{"ipv6 loopback", "[::1]:40000", "", true},
+		{"forwarded header from untrusted peer", "192.168.2.20:40000", "192.168.1.20", false},
+		{"trusted proxy forwards allowed client", "10.0.0.10:40000", "192.168.1.20", true},
+		{"trusted proxy forwards denied client", "10.0.0.10:40000", "192.168.2.20", false},
+		{"spoofed leftmost entry is ignored", "10.0.0.10:40000", "192.168.1.20, 192.168.2.20", false},
+		{"trusted proxy without header", "10.0.0.10:40000", "", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+
+			if got := cfg.isClientAllowed(req); got != tc.want {
+				t.Fatalf("isClientAllowed(%q, %q) = %v, want %v", tc.remoteAddr, tc.forwarded, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRejectsDisallowedClient(t *testing.T) {
+	cfg := &Config{AllowedClients: []string{"192.168.1.0/24"}}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_goaptcacher/", nil)
+	req.RemoteAddr = "192.168.2.20:40000"
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"html"
+	htmltemplate "html/template"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+)
+
+// contactAllowedTags are the HTML elements which may be used in the configured
+// contact information. All other elements are removed, their text is kept.
+var contactAllowedTags = []string{"a", "b", "br", "code", "em", "i", "li", "ol", "p", "small", "span", "strong", "ul"}
+
+// contactDroppedTags are elements whose content is removed together with the
+// element itself.
+var contactDroppedTags = []string{"iframe", "noscript", "object", "script", "style", "template", "textarea", "title"}
+
+// contactAllowedSchemes are the URL schemes allowed in links.
+var contactAllowedSchemes = []string{"http", "https", "mailto", "tel"}
+
+// sanitizeContactHTML returns the configured contact information as HTML which
+// is safe to embed into the web interface. Only basic formatting and links are
+// kept, scripts, event handlers and unsafe links are removed.
+func sanitizeContactHTML(input string) htmltemplate.HTML {
+	tokenizer := nethtml.NewTokenizer(strings.NewReader(strings.TrimSpace(input)))
+
+	var builder strings.Builder
+	var open []string // Currently open allowed elements
+	skipDepth := 0    // Nesting depth inside of dropped elements
+
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == nethtml.ErrorToken {
+			if tokenizer.Err() != io.EOF {
+				return ""
+			}
+			break
+		}
+
+		token := tokenizer.Token()
+		switch tokenType {
+		case nethtml.StartTagToken, nethtml.SelfClosingTagToken:
+			if slices.Contains(contactDroppedTags, token.Data) {
+				if tokenType == nethtml.StartTagToken {
+					skipDepth++
+				}
+				continue
+			}
+			if skipDepth > 0 || !slices.Contains(contactAllowedTags, token.Data) {
+				continue
+			}
+
+			builder.WriteString("<" + token.Data)
+			if token.Data == "a" {
+				for _, attr := range token.Attr {
+					if attr.Key == "href" && isSafeContactURL(attr.Val) {
+						builder.WriteString(` href="` + html.EscapeString(attr.Val) + `" rel="noopener noreferrer"`)
+						break
+					}
+				}
+			}
+			builder.WriteString(">")
+
+			if token.Data != "br" && tokenType == nethtml.StartTagToken {
+				open = append(open, token.Data)
+			}
+		case nethtml.EndTagToken:
+			if slices.Contains(contactDroppedTags, token.Data) {
+				skipDepth = max(skipDepth-1, 0)
+				continue
+			}
+			if skipDepth > 0 {
+				continue
+			}
+
+			// Close the element and all elements opened within it, end tags
+			// without a matching start tag are ignored.
+			if index := slices.Index(open, token.Data); index >= 0 {
+				for i := len(open) - 1; i >= index; i-- {
+					builder.WriteString("</" + open[i] + ">")
+				}
+				open = open[:index]
+			}
+		case nethtml.TextToken:
+			if skipDepth == 0 {
+				builder.WriteString(html.EscapeString(token.Data))
+			}
+		}
+	}
+
+	for i := len(open) - 1; i >= 0; i-- {
+		builder.WriteString("</" + open[i] + ">")
+	}
+
+	return htmltemplate.HTML(builder.String())
+}
+
+// isSafeContactURL reports if rawURL can be used as link target. Relative URLs
+// and URLs with an allowed scheme are accepted.
+func isSafeContactURL(rawURL string) bool {
+	parsed, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return false
+	}
+
+	return parsed.Scheme == "" || slices.Contains(contactAllowedSchemes, strings.ToLower(parsed.Scheme))
+}
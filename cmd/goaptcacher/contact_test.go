@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestSanitizeContactHTML(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{
+			name:  "plain text",
+			input: "  Call 1234 & ask for IT  ",
+			want:  "Call 1234 &amp; ask for IT",
+		},
+		{
+			name:  "allowed formatting",
+			input: "Contact <strong>IT</strong><br>or <em>ops</em>",
+			want:  "Contact <strong>IT</strong><br>or <em>ops</em>",
+		},
+		{
+			name:  "mailto link",
+			input: `<a href="mailto:support@example.com" target="_blank" class="x">IT support</a>`,
+			want:  `<a href="mailto:support@example.com" rel="noopener noreferrer">IT support</a>`,
+		},
+		{
+			name:  "script removed with content",
+			input: `Hello<script>alert(1)</script> world`,
+			want:  "Hello world",
+		},
+		{
+			name:  "event handler removed",
+			input: `<span onclick="alert(1)" style="color:red">IT</span>`,
+			want:  "<span>IT</span>",
+		},
+		{
+			name:  "javascript link removed",
+			input: `<a href="javascript:alert(1)">click</a>`,
+			want:  "<a>click</a>",
+		},
+		{
+			name:  "encoded javascript link removed",
+			input: `<a href="&#106;avascript:alert(1)">click</a>`,
+			want:  "<a>click</a>",
+		},
+		{
+			name:  "unknown element removed",
+			input: `<img src="x" onerror="alert(1)"><div>text</div>`,
+			want:  "text",
+		},
+		{
+			name:  "unclosed elements closed",
+			input: `<p><b>bold`,
+			want:  "<p><b>bold</b></p>",
+		},
+		{
+			name:  "stray end tags ignored",
+			input: `</div></p>text`,
+			want:  "text",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(sanitizeContactHTML(tt.input)); got != tt.want {
+				t.Fatalf("sanitizeContactHTML(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
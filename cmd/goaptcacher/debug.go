@@ -2,8 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"expvar"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	httppprof "net/http/pprof"
@@ -16,14 +17,132 @@ import (
 	"time"
 
 	"gitlab.com/bella.network/goaptcacher/pkg/buildinfo"
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
 )
 
+// startTime is the time the process was started, used to report the uptime.
+var startTime = time.Now()
+
+// debugVars holds the counters published with expvar under the name
+// "goaptcacher". They are served at /debug/vars together with the runtime
+// variables of expvar.
+var debugVars = newDebugVars()
+
+// requestsByMethod counts the handled requests per HTTP method.
+var requestsByMethod = new(expvar.Map)
+
+func newDebugVars() *expvar.Map {
+	vars := expvar.NewMap("goaptcacher")
+	vars.Set("uptime_seconds", expvar.Func(func() any {
+		return int64(time.Since(startTime) / time.Second)
+	}))
+	vars.Set("active_downloads", expvar.Func(func() any {
+		if cache == nil {
+			return 0
+		}
+		return cache.ActiveDownloads()
+	}))
+	vars.Set("cache", expvar.Func(func() any {
+		hits, misses, ratio := cacheHitRatio()
+		return map[string]any{"hits": hits, "misses": misses, "hit_ratio": ratio}
+	}))
+	vars.Set("gauges", expvar.Func(func() any {
+		return gaugeValues()
+	}))
+	vars.Set("repairs", expvar.Func(func() any {
+		return repairValues()
+	}))
+	vars.Set("upstream_status", expvar.Func(func() any {
+		return upstreamStatusValues()
+	}))
+	vars.Set("requests_by_method", requestsByMethod)
+	return vars
+}
+
+// upstreamStatusValues returns the recorded responses of upstream servers by
+// host and status code, e.g. to spot a mirror answering with 502 from time to
+// time.
+func upstreamStatusValues() map[string]map[int]uint64 {
+	values := map[string]map[int]uint64{}
+	if cache == nil {
+		return values
+	}
+
+	for host, stats := range cache.GetStatsSnapshot(1).Totals.Domains {
+		if len(stats.UpstreamStatus) > 0 {
+			values[host] = stats.UpstreamStatus
+		}
+	}
+	return values
+}
+
+// repairValues returns the number of broken cached files which were deleted
+// to be fetched again by reason, e.g. to alert when a disk starts failing.
+func repairValues() map[string]uint64 {
+	if cache == nil {
+		return map[string]uint64{}
+	}
+	return cache.Repairs()
+}
+
+// gaugeValues returns the current gauges of the cache for alerting, e.g. on a
+// collapsing hit ratio when refreshes from a changed mirror fail.
+func gaugeValues() map[string]any {
+	var gauges fscache.Gauges
+	if cache != nil {
+		gauges = cache.Gauges()
+	}
+
+	return map[string]any{
+		"active_downloads":         gauges.ActiveDownloads,
+		"window_seconds":           int64(gauges.Window / time.Second),
+		"hits":                     gauges.Hits,
+		"misses":                   gauges.Misses,
+		"hit_ratio":                gauges.HitRatio,
+		"bytes_down_per_second":    gauges.BytesDownPerSecond,
+		"bytes_up_per_second":      gauges.BytesUpPerSecond,
+		"metadata_max_age_seconds": int64(gauges.MetadataMaxAge / time.Second),
+		"metadata_max_age_url":     gauges.MetadataMaxAgeURL,
+		"pending_deletions":        gauges.PendingDeletions,
+		"hijacked_connections":     hijackedConnections.Load(),
+		"prefetch_downloads":       prefetchDownloads(),
+	}
+}
+
+// countRequest adds the request to the request counters. Unknown methods are
+// counted as OTHER, so clients can't create an unlimited number of counters.
+func countRequest(r *http.Request) {
+	debugVars.Add("requests", 1)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		requestsByMethod.Add(r.Method, 1)
+	default:
+		requestsByMethod.Add("OTHER", 1)
+	}
+}
+
+// cacheHitRatio returns the recorded cache hits and misses and the share of
+// hits among them.
+func cacheHitRatio() (uint64, uint64, float64) {
+	if cache == nil {
+		return 0, 0, 0
+	}
+
+	totals := cache.GetStatsSnapshot(1).Totals
+	if totals.Hits+totals.Misses == 0 {
+		return totals.Hits, totals.Misses, 0
+	}
+	return totals.Hits, totals.Misses, float64(totals.Hits) / float64(totals.Hits+totals.Misses)
+}
+
 func initDebug() {
 	if !config.Debug.Enable {
 		return
 	}
 
-	log.Printf("[INFO] Debug output enabled")
+	slog.Info("Debug output enabled", "event", "debug")
 
 	if config.Debug.LogIntervalSeconds > 0 {
 		go debugLogger(time.Duration(config.Debug.LogIntervalSeconds) * time.Second)
@@ -31,9 +150,9 @@ func initDebug() {
 
 	if config.Debug.Pprof.Enable {
 		if err := os.MkdirAll(config.Debug.Pprof.Directory, 0o755); err != nil {
-			log.Printf("[WARN:DEBUG] Unable to create pprof directory %s: %v", config.Debug.Pprof.Directory, err)
+			slog.Warn("Unable to create pprof directory", "event", "debug", "path", config.Debug.Pprof.Directory, "error", err)
 		} else {
-			log.Printf("[INFO] Pprof snapshots enabled: every %ds in %s", config.Debug.Pprof.IntervalSeconds, config.Debug.Pprof.Directory)
+			slog.Info("Pprof snapshots enabled", "event", "debug", "path", config.Debug.Pprof.Directory, "interval", time.Duration(config.Debug.Pprof.IntervalSeconds)*time.Second)
 			go pprofSnapshotter(
 				config.Debug.Pprof.Directory,
 				time.Duration(config.Debug.Pprof.IntervalSeconds)*time.Second,
@@ -57,16 +176,18 @@ func logDebugStats() {
 	var mem runtime.MemStats
 	runtime.ReadMemStats(&mem)
 
-	log.Printf(
-		"[DEBUG:MEM] goroutines=%d heap_alloc=%s heap_inuse=%s heap_idle=%s heap_released=%s sys=%s gc_num=%d pause_total=%s",
-		runtime.NumGoroutine(),
-		formatBytes(mem.HeapAlloc),
-		formatBytes(mem.HeapInuse),
-		formatBytes(mem.HeapIdle),
-		formatBytes(mem.HeapReleased),
-		formatBytes(mem.Sys),
-		mem.NumGC,
-		time.Duration(mem.PauseTotalNs), //nolint:gosec
+	// Logged as info, the periodic output is enabled explicitly by
+	// debug.log_interval_seconds.
+	slog.Info("Memory statistics",
+		"event", "debug_mem",
+		"goroutines", runtime.NumGoroutine(),
+		"heap_alloc", formatBytes(mem.HeapAlloc),
+		"heap_inuse", formatBytes(mem.HeapInuse),
+		"heap_idle", formatBytes(mem.HeapIdle),
+		"heap_released", formatBytes(mem.HeapReleased),
+		"sys", formatBytes(mem.Sys),
+		"gc_num", mem.NumGC,
+		"pause_total", time.Duration(mem.PauseTotalNs), //nolint:gosec
 	)
 }
 
@@ -84,6 +205,9 @@ func handleDebugRequests(w http.ResponseWriter, r *http.Request, requestedPath s
 	case requestedPath == "/debug" || requestedPath == "/debug/":
 		writeDebugJSON(w)
 		return true
+	case requestedPath == "/debug/vars":
+		expvar.Handler().ServeHTTP(w, r)
+		return true
 	case strings.HasPrefix(requestedPath, "/debug/pprof"):
 		servePprof(w, r, requestedPath)
 		return true
@@ -96,14 +220,36 @@ func writeDebugJSON(w http.ResponseWriter) {
 	var mem runtime.MemStats
 	runtime.ReadMemStats(&mem)
 
+	var requestCount int64
+	if requests, ok := debugVars.Get("requests").(*expvar.Int); ok {
+		requestCount = requests.Value()
+	}
+	activeDownloads := 0
+	if cache != nil {
+		activeDownloads = cache.ActiveDownloads()
+	}
+	hits, misses, hitRatio := cacheHitRatio()
+
 	resp := map[string]any{
-		"time":       time.Now().UTC().Format(time.RFC3339),
-		"version":    buildinfo.Version,
-		"commit":     buildinfo.Commit,
-		"built_at":   buildinfo.Date,
-		"go_version": runtime.Version(),
-		"goroutines": runtime.NumGoroutine(),
-		"gomaxprocs": runtime.GOMAXPROCS(0),
+		"time":             time.Now().UTC().Format(time.RFC3339),
+		"version":          buildinfo.Version,
+		"commit":           buildinfo.Commit,
+		"built_at":         buildinfo.Date,
+		"go_version":       runtime.Version(),
+		"goroutines":       runtime.NumGoroutine(),
+		"gomaxprocs":       runtime.GOMAXPROCS(0),
+		"started_at":       startTime.UTC().Format(time.RFC3339),
+		"uptime_seconds":   int64(time.Since(startTime) / time.Second),
+		"requests":         requestCount,
+		"active_downloads": activeDownloads,
+		"gauges":           gaugeValues(),
+		"cache": map[string]any{
+			"hits":      hits,
+			"misses":    misses,
+			"hit_ratio": hitRatio,
+		},
+		"upstream_status": upstreamStatusValues(),
+		"repairs":         repairValues(),
 		"pprof": map[string]any{
 			"enabled":           config.Debug.Pprof.Enable,
 			"directory":         config.Debug.Pprof.Directory,
@@ -187,15 +333,15 @@ func writePprofSnapshot(dir string, retain int) {
 	ts := time.Now().UTC().Format("20060102-150405")
 
 	if err := writeHeapProfile(filepath.Join(dir, fmt.Sprintf("heap-%s.pprof", ts))); err != nil {
-		log.Printf("[WARN:PPROF] heap snapshot failed: %v", err)
+		slog.Warn("Heap snapshot failed", "event", "pprof", "error", err)
 	}
 	if err := writeProfile("goroutine", filepath.Join(dir, fmt.Sprintf("goroutine-%s.pprof", ts))); err != nil {
-		log.Printf("[WARN:PPROF] goroutine snapshot failed: %v", err)
+		slog.Warn("Goroutine snapshot failed", "event", "pprof", "error", err)
 	}
 
 	if retain > 0 {
 		if err := cleanupOldProfiles(dir, retain); err != nil {
-			log.Printf("[WARN:PPROF] cleanup failed: %v", err)
+			slog.Warn("Pprof cleanup failed", "event", "pprof", "error", err)
 		}
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleDebugRequestsServesExpvar(t *testing.T) {
+	cfg := &Config{}
+	cfg.Debug.Enable = true
+	withTestConfig(t, cfg)
+
+	countRequest(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	countRequest(httptest.NewRequest("BREW", "http://example.com/", nil))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://localhost/_goaptcacher/debug/vars", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	if !handleDebugRequests(rr, req, "/debug/vars") {
+		t.Fatalf("expected /debug/vars to be handled")
+	}
+
+	var vars struct {
+		GoAPTCacher struct {
+			Requests         int64            `json:"requests"`
+			RequestsByMethod map[string]int64 `json:"requests_by_method"`
+			UptimeSeconds    *int64           `json:"uptime_seconds"`
+			ActiveDownloads  *int             `json:"active_downloads"`
+			Cache            map[string]any   `json:"cache"`
+			Gauges           map[string]any   `json:"gauges"`
+		} `json:"goaptcacher"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("invalid expvar JSON: %v", err)
+	}
+
+	counters := vars.GoAPTCacher
+	if counters.Requests < 2 || counters.RequestsByMethod["GET"] < 1 || counters.RequestsByMethod["OTHER"] < 1 {
+		t.Fatalf("unexpected request counters %+v", counters)
+	}
+	if _, ok := counters.RequestsByMethod["BREW"]; ok {
+		t.Fatalf("unknown method counted separately: %+v", counters.RequestsByMethod)
+	}
+	if counters.UptimeSeconds == nil || counters.ActiveDownloads == nil || counters.Cache["hit_ratio"] == nil || counters.Gauges["hit_ratio"] == nil || counters.Gauges["bytes_down_per_second"] == nil {
+		t.Fatalf("missing counters %+v", counters)
+	}
+}
+
+func TestHandleDebugRequestsRejectsRemoteClients(t *testing.T) {
+	cfg := &Config{}
+	cfg.Debug.Enable = true
+	withTestConfig(t, cfg)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://proxy/_goaptcacher/debug/vars", nil)
+	req.RemoteAddr = "192.0.2.10:40000"
+	handleDebugRequests(rr, req, "/debug/vars")
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestWriteDebugJSONIncludesCounters(t *testing.T) {
+	withTestConfig(t, &Config{})
+
+	rr := httptest.NewRecorder()
+	writeDebugJSON(rr)
+
+	var resp map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid debug JSON: %v", err)
+	}
+	for _, key := range []string{"started_at", "uptime_seconds", "requests", "active_downloads", "gauges", "cache", "upstream_status", "repairs"} {
+		if _, ok := resp[key]; !ok {
+			t.Fatalf("debug JSON misses %q: %v", key, resp)
+		}
+	}
+}
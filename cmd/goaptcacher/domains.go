@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// normalizeHost lowercases the given host and strips an optional port and a
+// trailing dot so it can be compared against configured domains.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+
+	return strings.TrimSuffix(host, ".")
+}
+
+// matchDomain checks if host matches a configured domain entry. Matching is
+// done on label boundaries:
+//   - "example.com" matches example.com and all of its subdomains
+//   - ".example.com" and "*.example.com" only match subdomains of example.com
+//
+// A host like notexample.com never matches the entry example.com.
+func matchDomain(host, domain string) bool {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimSuffix(domain, ".")
+
+	switch {
+	case domain == "" || host == "":
+		return false
+	case strings.HasPrefix(domain, "*."):
+		return strings.HasSuffix(host, domain[1:])
+	case strings.HasPrefix(domain, "."):
+		return strings.HasSuffix(host, domain)
+	default:
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+}
+
+// matchDomainList checks if the host (which may contain a port) matches any of
+// the given domain entries.
+func matchDomainList(host string, domains []string) bool {
+	host = normalizeHost(host)
+	for _, domain := range domains {
+		if matchDomain(host, domain) {
+			return true
+		}
+	}
+
+	return false
+}
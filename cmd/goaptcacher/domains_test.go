@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tcs := []struct {
+		in   string
+		want string
+	}{
+		{"Example.COM", "example.com"},
+		{"example.com:443", "example.com"},
+		{"example.com.", "example.com"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+	}
+
+	for _, tc := range tcs {
+		if got := normalizeHost(tc.in); got != tc.want {
+			t.Fatalf("normalizeHost(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMatchDomainList(t *testing.T) {
+	tcs := []struct {
+		name    string
+		host    string
+		domains []string
+		want    bool
+	}{
+		{"exact", "example.com", []string{"example.com"}, true},
+		{"subdomain of bare entry", "mirror.example.com", []string{"example.com"}, true},
+		{"label boundary false positive", "notexample.com", []string{"example.com"}, false},
+		{"port is ignored", "example.com:443", []string{"example.com"}, true},
+		{"case insensitive", "Mirror.Example.com", []string{"EXAMPLE.com"}, true},
+		{"leading dot matches subdomain", "deb.debian.org", []string{".debian.org"}, true},
+		{"leading dot does not match apex", "debian.org", []string{".debian.org"}, false},
+		{"leading dot label boundary", "notdebian.org", []string{".debian.org"}, false},
+		{"wildcard matches subdomain", "security.ubuntu.com", []string{"*.ubuntu.com"}, true},
+		{"wildcard matches nested subdomain", "de.archive.ubuntu.com", []string{"*.ubuntu.com"}, true},
+		{"wildcard does not match apex", "ubuntu.com", []string{"*.ubuntu.com"}, false},
+		{"wildcard label boundary", "evilubuntu.com", []string{"*.ubuntu.com"}, false},
+		{"empty list", "example.com", nil, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := matchDomainList(tc.host, tc.domains); got != tc.want {
+				t.Fatalf("matchDomainList(%q, %v) = %v, want %v", tc.host, tc.domains, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRejectsSuffixLookalikeDomain(t *testing.T) {
+	cfg := &Config{Domains: []string{"example.com"}}
+	s := newTestServer(t, cfg, nil)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://notexample.com/dists/stable/InRelease", nil)
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestHandleRequestDeniedDomainTakesPrecedence(t *testing.T) {
+	cfg := &Config{
+		Domains:            []string{"*.example.com", "example.org"},
+		PassthroughDomains: []string{"example.net"},
+		DeniedDomains:      []string{"secret.example.com", "*.internal.example.org", "example.net"},
+	}
+	s := newTestServer(t, cfg, nil)
+
+	tcs := []struct {
+		name string
+		url  string
+	}{
+		{"exact deny inside allowed wildcard", "http://secret.example.com/dists/stable/InRelease"},
+		{"subdomain of denied domain", "http://a.secret.example.com/dists/stable/InRelease"},
+		{"denied wildcard inside allowed domain", "http://host.internal.example.org/dists/stable/InRelease"},
+		{"denied passthrough domain", "http://example.net/dists/stable/InRelease"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			s.handleRequest(rr, req)
+
+			if rr.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestHandleRequestDeniedDomainWithoutAllowList(t *testing.T) {
+	cfg := &Config{DeniedDomains: []string{"example.com"}, AllowOpenProxy: true}
+	s := newTestServer(t, cfg, nil)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodConnect, "http://mirror.example.com:443", nil)
+	req.Host = "mirror.example.com:443"
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+func TestHandleRequestRefusesOpenProxyWithoutOptIn(t *testing.T) {
+	s := newTestServer(t, &Config{}, nil)
+
+	for _, method := range []string{http.MethodGet, http.MethodConnect} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "http://mirror.example.com/debian/", nil)
+		s.handleRequest(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("%s status = %d, want %d", method, rr.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestConfigCheckOpenProxy(t *testing.T) {
+	if err := (&Config{}).checkOpenProxy(); !errors.Is(err, errOpenProxy) {
+		t.Fatalf("checkOpenProxy() without domains = %v, want %v", err, errOpenProxy)
+	}
+	if err := (&Config{AllowOpenProxy: true}).checkOpenProxy(); err != nil {
+		t.Fatalf("checkOpenProxy() with allow_open_proxy = %v", err)
+	}
+	if err := (&Config{PassthroughDomains: []string{"example.com"}}).checkOpenProxy(); err != nil {
+		t.Fatalf("checkOpenProxy() with passthrough domain = %v", err)
+	}
+}
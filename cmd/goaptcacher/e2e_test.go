@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// fakeUpstream is an upstream server for all hosts which serves the files
+// set by host and path and counts the requests per file.
+type fakeUpstream struct {
+	*httptest.Server
+
+	mux      sync.Mutex
+	files    map[string]string // Content by host + path
+	modified time.Time         // Last-Modified of all files
+	requests map[string]int    // Requests by host + path
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	t.Helper()
+
+	upstream := &fakeUpstream{
+		files:    map[string]string{},
+		modified: time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+		requests: map[string]int{},
+	}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(upstream.serveHTTP))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func (u *fakeUpstream) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mux.Lock()
+	key := r.Host + r.URL.Path
+	u.requests[key]++
+	content, ok := u.files[key]
+	modified := u.modified
+	u.mux.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	_, _ = io.WriteString(w, content)
+}
+
+// setFile publishes content at host and path. All files are marked as
+// modified now, so they are downloaded again on the next revalidation.
+func (u *fakeUpstream) setFile(hostPath, content string) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if _, ok := u.files[hostPath]; ok {
+		u.modified = time.Now().UTC().Truncate(time.Second)
+	}
+	u.files[hostPath] = content
+}
+
+func (u *fakeUpstream) requestCount(hostPath string) int {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+	return u.requests[hostPath]
+}
+
+// proxyHarness runs the proxy handler in a test server with the configuration
+// read like at startup. All upstream requests are sent to a fake upstream
+// server, the client uses the test server as HTTP proxy.
+type proxyHarness struct {
+	upstream *fakeUpstream
+	cache    *fscache.FSCache
+	client   *http.Client
+}
+
+func newProxyHarness(t *testing.T, configYAML string) *proxyHarness {
+	t.Helper()
+
+	cfg, err := ReadConfig(writeTempConfig(t, configYAML))
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	upstream := newFakeUpstream(t)
+	s := newTestServer(t, cfg, upstream.Server)
+
+	proxy := httptest.NewServer(http.HandlerFunc(s.handleRequest))
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	return &proxyHarness{
+		upstream: upstream,
+		cache:    s.cache,
+		client:   &http.Client{Transport: transport},
+	}
+}
+
+// get requests rawURL through the proxy and returns the response with the
+// body read.
+func (h *proxyHarness) get(t *testing.T, rawURL string) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := h.client.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s error = %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body of %s: %v", rawURL, err)
+	}
+	return resp, string(body)
+}
+
+func TestProxyEndToEndCachesFiles(t *testing.T) {
+	h := newProxyHarness(t, "domains:\n  - deb.debian.org\n")
+	h.upstream.setFile("deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb", "package")
+
+	for i, want := range []string{"MISS", "HIT"} {
+		resp, body := h.get(t, "http://deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb")
+		if resp.StatusCode != http.StatusOK || body != "package" {
+			t.Fatalf("request %d = %d %q, want 200 %q", i, resp.StatusCode, body, "package")
+		}
+		if got := resp.Header.Get("X-Cache"); got != want {
+			t.Fatalf("request %d X-Cache = %q, want %q", i, got, want)
+		}
+	}
+	if got := h.upstream.requestCount("deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb"); got != 1 {
+		t.Fatalf("upstream requests = %d, want 1", got)
+	}
+}
+
+func TestProxyEndToEndRejectsDomains(t *testing.T) {
+	h := newProxyHarness(t, "domains:\n  - debian.org\ndenied_domains:\n  - internal.debian.org\n")
+	h.upstream.setFile("example.com/debian/dists/stable/InRelease", "release")
+	h.upstream.setFile("internal.debian.org/debian/dists/stable/InRelease", "release")
+
+	for _, rawURL := range []string{
+		"http://example.com/debian/dists/stable/InRelease",
+		"http://internal.debian.org/debian/dists/stable/InRelease",
+	} {
+		resp, _ := h.get(t, rawURL)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("GET %s status = %d, want %d", rawURL, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+	if h.upstream.requestCount("example.com/debian/dists/stable/InRelease") != 0 || h.upstream.requestCount("internal.debian.org/debian/dists/stable/InRelease") != 0 {
+		t.Fatalf("rejected requests reached the upstream server")
+	}
+}
+
+func TestProxyEndToEndReportsErrorsAsJSON(t *testing.T) {
+	h := newProxyHarness(t, "domains:\n  - debian.org\ndenied_domains:\n  - internal.debian.org\n")
+
+	for rawURL, code := range map[string]string{
+		"http://example.com/debian/dists/stable/InRelease":         "domain_not_allowed",
+		"http://internal.debian.org/debian/dists/stable/InRelease": "domain_denied",
+	} {
+		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest() error = %v", err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := h.client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s error = %v", rawURL, err)
+		}
+		var body fscache.ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("GET %s returned invalid JSON: %v", rawURL, err)
+		}
+		if resp.StatusCode != http.StatusForbidden || body.Error != code || body.Status != http.StatusForbidden {
+			t.Fatalf("GET %s = %d %+v, want 403 with code %q", rawURL, resp.StatusCode, body, code)
+		}
+	}
+}
+
+func TestProxyEndToEndAppliesOverrides(t *testing.T) {
+	h := newProxyHarness(t, `
+domains:
+  - debian.org
+  - mirror.example.com
+overrides:
+  debian_server: mirror.example.com/debian-mirror
+`)
+	h.upstream.setFile("mirror.example.com/debian-mirror/debian/dists/stable/InRelease", "mirror release")
+
+	resp, body := h.get(t, "http://ftp.de.debian.org/debian/dists/stable/InRelease")
+	if resp.StatusCode != http.StatusOK || body != "mirror release" {
+		t.Fatalf("response = %d %q, want 200 %q", resp.StatusCode, body, "mirror release")
+	}
+	if _, err := os.Stat(filepath.Join(h.cache.CachePath, "mirror.example.com", "debian-mirror", "debian", "dists", "stable", "InRelease")); err != nil {
+		t.Fatalf("expected file to be cached under the mirror: %v", err)
+	}
+}
+
+func TestProxyEndToEndRefreshesMetadata(t *testing.T) {
+	const rawURL = "http://deb.debian.org/debian/dists/stable/InRelease"
+
+	h := newProxyHarness(t, "domains:\n  - deb.debian.org\n")
+	h.upstream.setFile("deb.debian.org/debian/dists/stable/InRelease", "release 1")
+
+	if _, body := h.get(t, rawURL); body != "release 1" {
+		t.Fatalf("body = %q, want %q", body, "release 1")
+	}
+
+	// Within the recheck interval, the cached file is served.
+	h.upstream.setFile("deb.debian.org/debian/dists/stable/InRelease", "release 2")
+	if _, body := h.get(t, rawURL); body != "release 1" {
+		t.Fatalf("body = %q, want the cached %q", body, "release 1")
+	}
+
+	// Once the interval passed, the file is revalidated before serving it.
+	entry, ok := h.cache.Get(0, "deb.debian.org", "/debian/dists/stable/InRelease")
+	if !ok {
+		t.Fatalf("no metadata for %s", rawURL)
+	}
+	entry.LastChecked = time.Now().Add(-time.Hour)
+	if err := h.cache.Set(0, "deb.debian.org", "/debian/dists/stable/InRelease", entry); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, body := h.get(t, rawURL); body != "release 2" {
+		t.Fatalf("body = %q, want the refreshed %q", body, "release 2")
+	}
+}
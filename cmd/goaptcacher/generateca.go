@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/httpsintercept"
+)
+
+// generateCA creates a CA for HTTPS interception and writes it to the paths
+// configured in https.cert and https.key. Existing files are not overwritten.
+// The fingerprint and install instructions are written to w.
+func generateCA(w io.Writer, c *Config, keyType string, validityDays int) error {
+	certPath, keyPath := c.HTTPS.CertificatePublicKey, c.HTTPS.CertificatePrivateKey
+	if certPath == "" || keyPath == "" {
+		return errors.New("https.cert and https.key have to be set to the paths the CA is written to")
+	}
+	for _, path := range []string{certPath, keyPath} {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists, remove it to generate a new CA", path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if validityDays <= 0 {
+		return errors.New("validity has to be at least one day")
+	}
+
+	commonName := "GoAPTCacher Interception CA"
+	if c.HTTPS.CertificateDomain != "" {
+		commonName += " " + c.HTTPS.CertificateDomain
+	}
+	certPEM, keyPEM, err := httpsintercept.GenerateCA(httpsintercept.CAOptions{
+		CommonName: commonName,
+		KeyType:    keyType,
+		Validity:   time.Duration(validityDays) * 24 * time.Hour,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The key is written first, so a failure doesn't leave a certificate
+	// without key behind.
+	if err := writeNewFile(keyPath, keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := writeNewFile(certPath, certPEM, 0o644); err != nil {
+		_ = os.Remove(keyPath)
+		return err
+	}
+
+	fingerprint, err := httpsintercept.Fingerprint(certPEM)
+	if err != nil {
+		return err
+	}
+
+	host := c.HTTPS.CertificateDomain
+	if host == "" {
+		host = "<proxy>"
+	}
+	fmt.Fprintf(w, "Generated CA %q, valid for %d days\n", commonName, validityDays)
+	fmt.Fprintf(w, "  Certificate: %s\n", certPath)
+	fmt.Fprintf(w, "  Private key: %s\n", keyPath)
+	fmt.Fprintf(w, "  SHA-256 fingerprint: %s\n", fingerprint)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Enable interception with https.intercept: true and install the certificate on")
+	fmt.Fprintln(w, "every client, on Debian and Ubuntu:")
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "  curl -o /usr/local/share/ca-certificates/goaptcacher.crt http://%s:%d/_goaptcacher/goaptcacher.crt\n", host, c.ListenPort)
+	fmt.Fprintln(w, "  update-ca-certificates")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Compare the fingerprint of the downloaded certificate before trusting it:")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "  openssl x509 -noout -fingerprint -sha256 -in /usr/local/share/ca-certificates/goaptcacher.crt")
+	if c.HTTPS.CertificatePassword != "" {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "The private key is not encrypted, https.password is not needed for it.")
+	}
+	return nil
+}
+
+// writeNewFile writes data to path, which must not exist yet. Missing parent
+// directories are created.
+func writeNewFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/httpsintercept"
+)
+
+func TestGenerateCAWritesConfiguredFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{ListenPort: 8090}
+	cfg.HTTPS.CertificatePublicKey = filepath.Join(dir, "ca", "ca.crt")
+	cfg.HTTPS.CertificatePrivateKey = filepath.Join(dir, "ca", "ca.key")
+	cfg.HTTPS.CertificateDomain = "cache.example.com"
+
+	var out bytes.Buffer
+	if err := generateCA(&out, cfg, "ecdsa-p256", 30); err != nil {
+		t.Fatalf("generateCA returned error: %v", err)
+	}
+
+	settings, err := loadInterceptSettings(cfg)
+	if err != nil {
+		t.Fatalf("loadInterceptSettings returned error: %v", err)
+	}
+	if _, err := newIntercept(settings); err != nil {
+		t.Fatalf("generated CA is not usable: %v", err)
+	}
+
+	info, err := os.Stat(cfg.HTTPS.CertificatePrivateKey)
+	if err != nil {
+		t.Fatalf("failed to stat private key: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Fatalf("private key permissions = %o, want 600", perm)
+	}
+
+	fingerprint, err := httpsintercept.Fingerprint([]byte(settings.publicKey))
+	if err != nil {
+		t.Fatalf("Fingerprint returned error: %v", err)
+	}
+	for _, want := range []string{fingerprint, "http://cache.example.com:8090/_goaptcacher/goaptcacher.crt", "update-ca-certificates"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestGenerateCAKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{}
+	cfg.HTTPS.CertificatePublicKey = filepath.Join(dir, "ca.crt")
+	cfg.HTTPS.CertificatePrivateKey = filepath.Join(dir, "ca.key")
+	if err := os.WriteFile(cfg.HTTPS.CertificatePrivateKey, []byte("existing"), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	if err := generateCA(&bytes.Buffer{}, cfg, "ecdsa-p256", 30); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("generateCA error = %v, want already exists", err)
+	}
+	if data, _ := os.ReadFile(cfg.HTTPS.CertificatePrivateKey); string(data) != "existing" {
+		t.Fatalf("existing key was overwritten")
+	}
+	if _, err := os.Stat(cfg.HTTPS.CertificatePublicKey); !os.IsNotExist(err) {
+		t.Fatalf("certificate was written although the key exists")
+	}
+}
+
+func TestGenerateCARequiresPaths(t *testing.T) {
+	if err := generateCA(&bytes.Buffer{}, &Config{}, "ecdsa-p256", 30); err == nil {
+		t.Fatalf("expected error without https.cert and https.key")
+	}
+}
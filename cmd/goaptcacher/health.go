@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// serving is set once all listeners are bound and cleared when the shutdown
+// begins, so load balancers stop sending new requests.
+var serving atomic.Bool
+
+// handleHealthRequests answers the liveness and readiness probes. They are
+// served before any access check, so probes don't need credentials. It
+// returns false if the request isn't a probe.
+func handleHealthRequests(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	switch r.URL.Path {
+	case "/_goaptcacher/healthz":
+		// The process is alive if it is able to answer.
+		writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+	case "/_goaptcacher/readyz":
+		checks, ready := readinessChecks()
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, status, map[string]any{"ready": ready, "checks": checks})
+	default:
+		return false
+	}
+	return true
+}
+
+// readinessChecks reports if the proxy is able to serve requests: the
+// listeners are up and downloads can be stored in the cache directory.
+func readinessChecks() (map[string]string, bool) {
+	checks := map[string]string{"listeners": "ok", "cache": "ok"}
+	ready := true
+
+	if !serving.Load() {
+		checks["listeners"] = "not serving"
+		ready = false
+	}
+	if cache == nil {
+		checks["cache"] = "not initialized"
+		ready = false
+	} else if err := cache.CheckWritable(); err != nil {
+		checks["cache"] = err.Error()
+		ready = false
+	}
+
+	return checks, ready
+}
+
+func writeHealth(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func withServing(t *testing.T, value bool) {
+	t.Helper()
+	old := serving.Load()
+	serving.Store(value)
+	t.Cleanup(func() {
+		serving.Store(old)
+	})
+}
+
+func probe(t *testing.T, s *Server, path string) (int, map[string]any) {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://proxy"+path, nil)
+	req.RemoteAddr = "192.0.2.10:12345"
+	s.handleRequest(rr, req)
+
+	var body map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode %s: %v, body = %q", path, err, rr.Body.String())
+	}
+	return rr.Code, body
+}
+
+func TestHealthProbesSkipAccessChecks(t *testing.T) {
+	// The probing client is not part of the allowed clients.
+	cfg := &Config{AllowedClients: []string{"10.0.0.0/8"}}
+	cfg.Management.Listen = "127.0.0.1:0"
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	// The probes are answered with the package config and cache.
+	withTestConfig(t, cfg)
+	withServing(t, true)
+	s := newTestServer(t, cfg, nil)
+
+	old := cache
+	cache = fscache.NewFSCache(t.TempDir())
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	if code, body := probe(t, s, "/_goaptcacher/healthz"); code != http.StatusOK || body["status"] != "ok" {
+		t.Fatalf("healthz = %d %v, want 200", code, body)
+	}
+	if code, body := probe(t, s, "/_goaptcacher/readyz"); code != http.StatusOK || body["ready"] != true {
+		t.Fatalf("readyz = %d %v, want 200", code, body)
+	}
+}
+
+func TestReadinessFailsWithoutListenersOrWritableCache(t *testing.T) {
+	cfg := &Config{}
+	withTestConfig(t, cfg)
+	withServing(t, false)
+	s := newTestServer(t, cfg, nil)
+
+	old := cache
+	cache = fscache.NewFSCache(t.TempDir())
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	code, body := probe(t, s, "/_goaptcacher/readyz")
+	if code != http.StatusServiceUnavailable || body["checks"].(map[string]any)["listeners"] != "not serving" {
+		t.Fatalf("readyz = %d %v, want 503 with listeners not serving", code, body)
+	}
+
+	serving.Store(true)
+	cache.CachePath = filepath.Join(cache.CachePath, "missing")
+	code, body = probe(t, s, "/_goaptcacher/readyz")
+	if code != http.StatusServiceUnavailable || body["checks"].(map[string]any)["cache"] == "ok" {
+		t.Fatalf("readyz = %d %v, want 503 with cache error", code, body)
+	}
+
+	// Liveness doesn't depend on the readiness checks.
+	if code, _ := probe(t, s, "/_goaptcacher/healthz"); code != http.StatusOK {
+		t.Fatalf("healthz = %d, want 200", code)
+	}
+}
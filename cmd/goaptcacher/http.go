@@ -1,12 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"html"
 	htmltemplate "html/template"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -14,6 +17,7 @@ import (
 
 	web "gitlab.com/bella.network/goaptcacher/lib/web"
 	"gitlab.com/bella.network/goaptcacher/pkg/buildinfo"
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
 )
 
 const statsHistoryDays = 14
@@ -41,6 +45,14 @@ func handleIndexRequests(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if handlePrefetchRequests(w, r, requestedPath) {
+		return
+	}
+
+	if handleVerifyRequests(w, r, requestedPath) {
+		return
+	}
+
 	// Based on the requested path, serve the appropriate page.
 	switch requestedPath {
 	case "/style.css", "style.css":
@@ -52,15 +64,29 @@ func handleIndexRequests(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write(web.Favicon)
 	case "/", "":
-		httpServeSubpage(w, "index")
+		httpServeSubpage(w, r, "index")
 	case "/cache":
-		httpServeSubpage(w, "cache")
+		httpServeSubpage(w, r, "cache")
+	case "/largest":
+		httpServeSubpage(w, r, "largest")
 	case "/stats":
-		httpServeSubpage(w, "stats")
+		httpServeSubpage(w, r, "stats")
 	case "/setup":
-		httpServeSubpage(w, "setup")
+		httpServeSubpage(w, r, "setup")
 	case "/api/stats":
 		httpServeAPIStats(w, r)
+	case "/api/largest":
+		httpServeAPILargest(w, r)
+	case "/api/purge":
+		httpServeAPIPurge(w, r)
+	case "/api/pin":
+		httpServeAPIPin(w, r, true)
+	case "/api/unpin":
+		httpServeAPIPin(w, r, false)
+	case "/api/config":
+		httpServeAPIConfig(w, r)
+	case "/version":
+		httpServeVersion(w, r)
 	case "/revocation.crl":
 		httpServeCRL(w, r)
 	case "/goaptcacher.crt":
@@ -68,10 +94,10 @@ func handleIndexRequests(w http.ResponseWriter, r *http.Request) {
 	default:
 		// Serve a 404 page
 		w.WriteHeader(http.StatusNotFound)
-		httpServeSubpage(w, "404")
+		httpServeSubpage(w, r, "404")
 	}
 
-	log.Printf("[INFO:WEB] Requested path: %s\n", requestedPath)
+	slog.DebugContext(r.Context(), "Web interface request", "event", "web", "client", r.RemoteAddr, "path", requestedPath)
 }
 
 // helperHTTPTemplateVars is a helper function that returns the template
@@ -80,9 +106,9 @@ func helperHTTPConstants() map[string]any {
 	return map[string]any{
 		"ListenPort":       config.ListenPort,
 		"ListenPortSecure": config.ListenPortSecure,
-		"Domains":          config.Domains,
+		"Domains":          config.currentDomains().domains,
 		"Version":          buildinfo.Version,
-		"Contact":          htmltemplate.HTML(strings.TrimSpace(config.Index.Contact)),
+		"Contact":          sanitizeContactHTML(config.Index.Contact),
 		"Year":             time.Now().Year(),
 	}
 }
@@ -91,7 +117,7 @@ func activeNavFromSubpage(subpage string) string {
 	switch subpage {
 	case "setup":
 		return "setup"
-	case "stats", "cache":
+	case "stats", "cache", "largest":
 		return "stats"
 	default:
 		return "index"
@@ -100,7 +126,7 @@ func activeNavFromSubpage(subpage string) string {
 
 // httpServeSubpage is a helper function that serves a subpage of the main page
 // template.
-func httpServeSubpage(w http.ResponseWriter, subpage string) {
+func httpServeSubpage(w http.ResponseWriter, r *http.Request, subpage string) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
 	// pageContent contains the main content of the requested page.
@@ -112,8 +138,11 @@ func httpServeSubpage(w http.ResponseWriter, subpage string) {
 		pageContent = httpPageIndex()
 		title = "GoAPTCacher - Overview"
 	case "cache":
-		pageContent = httpPageCache()
+		pageContent = httpPageCache(r)
 		title = "GoAPTCacher - Cache"
+	case "largest":
+		pageContent = httpPageLargest(r)
+		title = "GoAPTCacher - Largest files"
 	case "stats":
 		pageContent = httpPageStats()
 		title = "GoAPTCacher - Statistics"
@@ -146,6 +175,9 @@ func httpServeSubpage(w http.ResponseWriter, subpage string) {
 		"Content": htmltemplate.HTML(pageContent),
 		"Const":   helperHTTPConstants(),
 		"Active":  activeNavFromSubpage(subpage),
+		// The overview and error pages show the contact information as a
+		// panel, all other pages in the footer.
+		"ShowContact": subpage == "index" || subpage == "404",
 	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -154,7 +186,7 @@ func httpServeSubpage(w http.ResponseWriter, subpage string) {
 
 func httpPageIndex() string {
 	host := preferredIndexHost()
-	httpEndpoint := fmt.Sprintf("http://%s:%d", host, config.ListenPort)
+	httpEndpoint := "http://" + net.JoinHostPort(host, strconv.Itoa(config.ListenPort))
 
 	httpsModeClass := "badge--danger"
 	httpsModeLabel := "Disabled"
@@ -211,17 +243,23 @@ func httpPageIndex() string {
 			<p class="muted">Domain filtering controls which repositories are cached versus proxied without caching.</p>
 			<h4>Cached domains</h4>`)
 
-	if len(config.Domains) == 0 {
+	lists := config.currentDomains()
+	if len(lists.domains) == 0 {
 		builder.WriteString(`<p class="muted">No allowlist set. Requests to all domains are accepted.</p>`)
 	} else {
-		builder.WriteString(renderChipList(config.Domains, "domain"))
+		builder.WriteString(renderChipList(lists.domains, "domain"))
 	}
 
 	builder.WriteString(`<h4>Passthrough domains</h4>`)
-	if len(config.PassthroughDomains) == 0 {
+	if len(lists.passthrough) == 0 {
 		builder.WriteString(`<p class="muted">No passthrough domains configured.</p>`)
 	} else {
-		builder.WriteString(renderChipList(config.PassthroughDomains, "domain"))
+		builder.WriteString(renderChipList(lists.passthrough, "domain"))
+	}
+
+	if len(lists.denied) > 0 {
+		builder.WriteString(`<h4>Denied domains</h4>`)
+		builder.WriteString(renderChipList(lists.denied, "domain"))
 	}
 
 	builder.WriteString(`</article>
@@ -239,7 +277,11 @@ func httpPageIndex() string {
 	} else {
 		builder.WriteString(`<div class="data-table-wrap"><table class="data-table data-table-compact"><thead><tr><th>From</th><th>To</th></tr></thead><tbody>`)
 		for _, remap := range config.Remap {
-			builder.WriteString(`<tr><td><code>` + escapeHTML(remap.From) + `</code></td><td><code>` + escapeHTML(remap.To) + `</code></td></tr>`)
+			from := `<code>` + escapeHTML(remap.From) + `</code>`
+			if remap.Regex {
+				from += ` <span class="badge">regex</span>`
+			}
+			builder.WriteString(`<tr><td>` + from + `</td><td><code>` + escapeHTML(remap.To) + `</code></td></tr>`)
 		}
 		builder.WriteString(`</tbody></table></div>`)
 	}
@@ -254,7 +296,18 @@ func httpPageIndex() string {
 	if config.Overrides.DebianServer != "" {
 		builder.WriteString(`<li><strong>Debian:</strong> <code>` + escapeHTML(config.Overrides.DebianServer) + `</code></li>`)
 	}
-	if config.Overrides.UbuntuServer == "" && config.Overrides.DebianServer == "" {
+	hostPatterns := make([]string, 0, len(config.Overrides.Hosts))
+	for pattern := range config.Overrides.Hosts {
+		hostPatterns = append(hostPatterns, pattern)
+	}
+	sort.Strings(hostPatterns)
+	for _, pattern := range hostPatterns {
+		builder.WriteString(`<li><code>` + escapeHTML(pattern) + `</code> &rarr; <code>` + escapeHTML(config.Overrides.Hosts[pattern]) + `</code></li>`)
+	}
+	for _, mapping := range config.pathMappings {
+		builder.WriteString(`<li><code>` + escapeHTML(mapping.prefix) + `</code> &rarr; <code>` + escapeHTML(mapping.scheme+"://"+mapping.host+mapping.pathPrefix+"/") + `</code></li>`)
+	}
+	if config.Overrides.UbuntuServer == "" && config.Overrides.DebianServer == "" && len(hostPatterns) == 0 && len(config.pathMappings) == 0 {
 		builder.WriteString(`<li class="muted">No distribution overrides configured.</li>`)
 	}
 	builder.WriteString(`</ul>
@@ -275,7 +328,7 @@ func httpPageStats() string {
 	var filesCached, totalSize uint64
 	filesCached, totalSize, err := cache.GetCacheUsage()
 	if err != nil {
-		log.Printf("[ERROR:WEB] Error collecting cache usage: %s\n", err)
+		slog.Error("Error collecting cache usage", "event", "web", "error", err)
 	}
 
 	statsSnapshot := cache.GetStatsSnapshot(statsHistoryDays)
@@ -323,7 +376,9 @@ func httpPageStats() string {
 	builder.WriteString(renderMetricCard("Traffic to clients", prettifyBytes(totalTrafficUp), "Data delivered by the proxy"))
 	builder.WriteString(renderMetricCard("Traffic from upstream", prettifyBytes(totalTrafficDown), fmt.Sprintf("%d%% of served traffic", upstreamShare)))
 	builder.WriteString(renderMetricCard("Tunnel requests", strconv.FormatUint(totalTunnel, 10), fmt.Sprintf("%d%% request share", tunnelShare)))
-	builder.WriteString(renderMetricCard("Tunnel transfer", prettifyBytes(totalTunnelTransfer), "Traffic that bypassed cache storage"))
+	builder.WriteString(renderMetricCard("Tunnel transfer", prettifyBytes(totalTunnelTransfer), fmt.Sprintf("%s up, %s down, bypassed cache storage", prettifyBytes(statsSnapshot.Totals.TunnelUpload), prettifyBytes(statsSnapshot.Totals.TunnelDownload))))
+	totalDialFailures := statsSnapshot.Totals.TunnelDialTimeouts + statsSnapshot.Totals.TunnelDialRefused + statsSnapshot.Totals.TunnelDialErrors
+	builder.WriteString(renderMetricCard("Tunnel connect failures", strconv.FormatUint(totalDialFailures, 10), fmt.Sprintf("%d timed out, %d refused, %d other errors", statsSnapshot.Totals.TunnelDialTimeouts, statsSnapshot.Totals.TunnelDialRefused, statsSnapshot.Totals.TunnelDialErrors)))
 
 	if storageErr == nil {
 		builder.WriteString(renderMetricCard("Filesystem usage", fmt.Sprintf("%d%%", storageUsage), fmt.Sprintf("%s of %s used", prettifyBytes(storageUsed), prettifyBytes(storageTotal))))
@@ -379,10 +434,14 @@ func httpPageStats() string {
 	return builder.String()
 }
 
-func httpPageCache() string {
+// cacheBrowserPageSize is the number of files shown per page of the cache
+// browser.
+const cacheBrowserPageSize = 50
+
+func httpPageCache(r *http.Request) string {
 	filesCached, totalSize, err := cache.GetCacheUsage()
 	if err != nil {
-		log.Printf("[ERROR:WEB] Error collecting cache usage: %s\n", err)
+		slog.ErrorContext(r.Context(), "Error collecting cache usage", "event", "web", "error", err)
 	}
 
 	storageTotal, storageUsed, storageErr := getStorageInfo()
@@ -417,11 +476,176 @@ func httpPageCache() string {
 		<h3>Retention policy</h3>
 		<p class="muted">` + escapeHTML(expirationText) + `</p>
 		<div class="actions">
-			<a class="button" href="/_goaptcacher/stats">Open statistics</a>
+			<a class="button" href="/_goaptcacher/largest">Show largest files</a>
+			<a class="button button-secondary" href="/_goaptcacher/stats">Open statistics</a>
 			<a class="button button-secondary" href="/_goaptcacher/setup">Open setup guide</a>
 		</div>
 	</section>`)
 
+	// Repository verification reads all cached package files, so it's only
+	// offered to clients which may use management actions.
+	if managementAccessAllowed(r) {
+		builder.WriteString(`<section class="panel stack-sm">
+		<h3>Repository verification</h3>
+		<p class="muted">Verify the metadata and package checksums of all cached repositories. The report lists files with a mismatching checksum.</p>
+		<form class="actions" method="post" action="/_goaptcacher/api/verify-repos">
+			` + csrfFormField() + `
+			<button class="button" type="submit">Verify repositories</button>
+		</form>
+	</section>`)
+	}
+
+	builder.WriteString(renderCacheBrowser(r.URL.Query(), managementAccessAllowed(r)))
+
+	return builder.String()
+}
+
+// renderCacheBrowser renders the filterable list of cached files. The filters
+// are taken from the query parameters domain, q, sort, order and page. If
+// canPin is set, every file gets a button to pin or unpin it.
+func renderCacheBrowser(query url.Values, canPin bool) string {
+	opts := fscache.ListFilesOptions{
+		Domain:     strings.TrimSpace(query.Get("domain")),
+		Search:     strings.TrimSpace(query.Get("q")),
+		SortBy:     query.Get("sort"),
+		Descending: query.Get("order") == "desc",
+		Limit:      cacheBrowserPageSize,
+	}
+	switch opts.SortBy {
+	case fscache.ListSortSize, fscache.ListSortLastAccess:
+	default:
+		opts.SortBy = fscache.ListSortPath
+	}
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	opts.Offset = (page - 1) * cacheBrowserPageSize
+
+	var builder strings.Builder
+	builder.WriteString(`<section class="panel stack-md">
+		<h3>Cached files</h3>`)
+
+	list, err := cache.ListFiles(opts)
+	if err != nil {
+		slog.Error("Error listing cached files", "event", "web", "error", err)
+		builder.WriteString(`<p class="muted">Unable to list cached files.</p></section>`)
+		return builder.String()
+	}
+
+	// Filter form, all filters are sent as query parameters.
+	builder.WriteString(`<form class="filter-form" method="get" action="/_goaptcacher/cache">
+		<label>Domain <select name="domain"><option value="">All domains</option>`)
+	for _, domain := range list.Domains {
+		selected := ""
+		if strings.EqualFold(domain, opts.Domain) {
+			selected = " selected"
+		}
+		builder.WriteString(`<option value="` + escapeHTML(domain) + `"` + selected + `>` + escapeHTML(domain) + `</option>`)
+	}
+	builder.WriteString(`</select></label>
+		<label>Path <input type="search" name="q" value="` + escapeHTML(opts.Search) + `" placeholder="e.g. InRelease"></label>
+		<label>Sort by <select name="sort">`)
+	for _, option := range [][2]string{{fscache.ListSortPath, "Path"}, {fscache.ListSortSize, "Size"}, {fscache.ListSortLastAccess, "Last access"}} {
+		selected := ""
+		if option[0] == opts.SortBy {
+			selected = " selected"
+		}
+		builder.WriteString(`<option value="` + option[0] + `"` + selected + `>` + option[1] + `</option>`)
+	}
+	builder.WriteString(`</select></label>
+		<label>Order <select name="order">`)
+	for _, option := range [][2]string{{"asc", "Ascending"}, {"desc", "Descending"}} {
+		selected := ""
+		if (option[0] == "desc") == opts.Descending {
+			selected = " selected"
+		}
+		builder.WriteString(`<option value="` + option[0] + `"` + selected + `>` + option[1] + `</option>`)
+	}
+	builder.WriteString(`</select></label>
+		<button class="button" type="submit">Apply</button>
+	</form>`)
+
+	if len(list.Files) == 0 {
+		builder.WriteString(`<p class="muted">No cached files match the current filters.</p></section>`)
+		return builder.String()
+	}
+
+	builder.WriteString(`<div class="data-table-wrap"><table class="data-table data-table-compact">
+		<thead>
+			<tr>
+				<th>File</th>
+				<th>Size</th>
+				<th>Hits</th>
+				<th>Last access</th>
+				<th>Pinned</th>
+			</tr>
+		</thead>
+		<tbody>`)
+	returnURL := "/_goaptcacher/cache"
+	if encoded := query.Encode(); encoded != "" {
+		returnURL += "?" + encoded
+	}
+	for _, file := range list.Files {
+		lastAccess := "never"
+		if !file.LastAccessed.IsZero() {
+			lastAccess = file.LastAccessed.Format("2006-01-02 15:04")
+		}
+		pinned := "no"
+		if file.Pinned {
+			pinned = "yes"
+		}
+		size := prettifyBytes(uint64(max(file.Size, 0)))
+		if file.Missing {
+			size = "removed"
+		}
+		builder.WriteString(fmt.Sprintf(
+			"<tr><td><code>%s</code><br><span class=\"muted\">%s</span></td><td>%s</td><td>%d</td><td>%s</td><td>%s",
+			escapeHTML(file.Path),
+			escapeHTML(file.Domain),
+			escapeHTML(size),
+			file.Hits,
+			escapeHTML(lastAccess),
+			pinned,
+		))
+		if canPin {
+			action, label := "pin", "Pin"
+			if file.Pinned {
+				action, label = "unpin", "Unpin"
+			}
+			builder.WriteString(`<form method="post" action="/_goaptcacher/api/` + action + `">
+				<input type="hidden" name="url" value="` + escapeHTML(file.URL) + `">
+				<input type="hidden" name="redirect" value="` + escapeHTML(returnURL) + `">
+				` + csrfFormField() + `
+				<button class="button button-secondary" type="submit">` + label + `</button>
+			</form>`)
+		}
+		builder.WriteString(`</td></tr>`)
+	}
+	builder.WriteString(`</tbody></table></div>`)
+
+	// Pagination keeps all other filters.
+	pages := (list.Total + cacheBrowserPageSize - 1) / cacheBrowserPageSize
+	pageLink := func(target int) string {
+		linkQuery := url.Values{}
+		for _, key := range []string{"domain", "q", "sort", "order"} {
+			if value := query.Get(key); value != "" {
+				linkQuery.Set(key, value)
+			}
+		}
+		linkQuery.Set("page", strconv.Itoa(target))
+		return "/_goaptcacher/cache?" + linkQuery.Encode()
+	}
+	builder.WriteString(`<div class="actions">`)
+	if page > 1 {
+		builder.WriteString(`<a class="button button-secondary" href="` + escapeHTML(pageLink(page-1)) + `">Previous</a>`)
+	}
+	builder.WriteString(fmt.Sprintf(`<p class="muted">Page %d of %d, %d matching files</p>`, page, max(pages, 1), list.Total))
+	if page < pages {
+		builder.WriteString(`<a class="button button-secondary" href="` + escapeHTML(pageLink(page+1)) + `">Next</a>`)
+	}
+	builder.WriteString(`</div></section>`)
+
 	return builder.String()
 }
 
@@ -430,6 +654,17 @@ func httpPageCache() string {
 func httpPageSetup() string {
 	domain := preferredIndexHost()
 	httpPort := strconv.Itoa(config.ListenPort)
+	// IPv6 literals are bracketed in the proxy URL.
+	proxyURL := "http://" + net.JoinHostPort(domain, httpPort) + "/"
+	// Discovery records point to the same port as the mDNS announcement.
+	discoveryPort := httpPort
+	if config.MDNS.Enable && config.MDNS.Port > 0 {
+		discoveryPort = strconv.Itoa(config.MDNS.Port)
+	}
+	mdnsNote := ""
+	if config.MDNS.Enable {
+		mdnsNote = `<p>In the local network, this proxy is also announced via mDNS as <code>` + escapeHTML(mdnsInstanceName()+"."+mdnsServiceType+".local.") + `</code> on port ` + escapeHTML(discoveryPort) + `, which auto-apt-proxy finds without DNS records.</p>`
+	}
 	httpsPort := strconv.Itoa(effectiveHTTPSPort())
 
 	httpsNote := "HTTPS requests are tunneled without interception."
@@ -453,8 +688,8 @@ func httpPageSetup() string {
 		<h3>1) Static APT proxy directives</h3>
 		<p>Add this file on each client:</p>
 		<pre><code>/etc/apt/apt.conf.d/10proxy</code></pre>
-		<pre><code>Acquire::http::Proxy "http://` + escapeHTML(domain) + `:` + escapeHTML(httpPort) + `/";
-Acquire::https::Proxy "http://` + escapeHTML(domain) + `:` + escapeHTML(httpPort) + `/";</code></pre>
+		<pre><code>Acquire::http::Proxy "` + escapeHTML(proxyURL) + `";
+Acquire::https::Proxy "` + escapeHTML(proxyURL) + `";</code></pre>
 		<p class="muted">
 			Works for managed servers, VMs and persistent hosts. Configuration is static and not suitable for mobile clients.<br>
 			Best used with Ansible, Puppet, Chef or similar configuration management tools.
@@ -466,7 +701,8 @@ Acquire::https::Proxy "http://` + escapeHTML(domain) + `:` + escapeHTML(httpPort
 		<p>Install discovery helper on clients:</p>
 		<pre><code>apt install auto-apt-proxy</code></pre>
 		<p>Create an SRV record for your internal domain:</p>
-		<pre><code>_apt_proxy._tcp.example.com. 3600 IN SRV 0 0 ` + escapeHTML(httpPort) + ` ` + escapeHTML(domain) + `.</code></pre>
+		<pre><code>` + mdnsServiceType + `.example.com. 3600 IN SRV 0 0 ` + escapeHTML(discoveryPort) + ` ` + escapeHTML(domain) + `.</code></pre>
+		` + mdnsNote + `
 		<p class="muted">
 			Useful for ephemeral workers, CI runners and laptops switching networks.<br>
 			<strong>Note:</strong> auto-apt-proxy uses the domain name of your hosts FQDN to discover the proxy and DNS-Suffix.
@@ -485,8 +721,8 @@ _https._tcp.download.docker.com. 3600 IN SRV 0 0 ` + escapeHTML(httpsPort) + ` `
 		<h3>4) GitLab CI integration</h3>
 		<p>Add the following lines to your .gitlab-ci.yml to enable the proxy for CI jobs:</p>
 		<pre><code>  before_script:
-    - echo 'Acquire::http::Proxy "http://` + escapeHTML(domain) + `:` + escapeHTML(httpPort) + `/";' > /etc/apt/apt.conf.d/10proxy
-    - echo 'Acquire::https::Proxy "http://` + escapeHTML(domain) + `:` + escapeHTML(httpPort) + `/";' >> /etc/apt/apt.conf.d/10proxy
+    - echo 'Acquire::http::Proxy "` + escapeHTML(proxyURL) + `";' > /etc/apt/apt.conf.d/10proxy
+    - echo 'Acquire::https::Proxy "` + escapeHTML(proxyURL) + `";' >> /etc/apt/apt.conf.d/10proxy
 </code></pre>
 		<p class="muted">Works for ephemeral CI runners without static configuration. Not suitable for general client use.</p>
 	</article>`)
@@ -515,10 +751,65 @@ _https._tcp.download.docker.com. 3600 IN SRV 0 0 ` + escapeHTML(httpsPort) + ` `
 	return builder.String()
 }
 
-func httpServeAPIStats(w http.ResponseWriter, _ *http.Request) {
+// httpServeVersion returns the version information of the running binary as
+// JSON.
+func httpServeVersion(w http.ResponseWriter, _ *http.Request) {
+	jsonData, err := json.Marshal(map[string]string{
+		"version": buildinfo.Version,
+		"commit":  buildinfo.Commit,
+		"date":    buildinfo.Date,
+	})
+	if err != nil {
+		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(jsonData)
+}
 
-	statsSnapshot := cache.GetStatsSnapshot(statsHistoryDays)
+// apiStatsMaxDays is the maximum number of days returned by the stats API.
+const apiStatsMaxDays = 366
+
+// httpServeAPIStats returns the statistics as JSON. The number of daily
+// entries is set with the days query parameter, per_domain=true includes the
+// statistics per upstream domain.
+func httpServeAPIStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := statsHistoryDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > apiStatsMaxDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", apiStatsMaxDays), http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+
+	perDomain := false
+	if value := r.URL.Query().Get("per_domain"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "per_domain must be a boolean", http.StatusBadRequest)
+			return
+		}
+		perDomain = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	statsSnapshot := cache.GetStatsSnapshot(days)
+	if !perDomain {
+		statsSnapshot.Totals.Domains = nil
+		for i := range statsSnapshot.Daily {
+			statsSnapshot.Daily[i].Domains = nil
+		}
+	}
 
 	jsonData, err := statsSnapshot.ToJSON()
 	if err != nil {
@@ -568,13 +859,18 @@ func preferredIndexHost() string {
 		}
 	}
 
+	fallback := "127.0.0.1"
+	if config.tcpListenNetwork() == "tcp6" {
+		fallback = "::1"
+	}
+
 	ip, err := getLocalIP()
 	if err != nil {
-		log.Printf("[ERROR:WEB] Error getting local IP address: %s\n", err)
-		return "127.0.0.1"
+		slog.Error("Error getting local IP address", "event", "web", "error", err)
+		return fallback
 	}
 	if ip == "" {
-		return "127.0.0.1"
+		return fallback
 	}
 
 	return ip
@@ -621,14 +917,31 @@ func getLocalIP() (string, error) {
 		return "", err
 	}
 
+	return pickLocalIP(addrs, config.tcpListenNetwork())
+}
+
+// pickLocalIP returns the first global IPv4 address of addrs. If there is none
+// or the listeners are IPv6 only, the first global IPv6 address is returned.
+// Link-local addresses can't be used by clients without zone and are ignored.
+func pickLocalIP(addrs []net.Addr, network string) (string, error) {
+	var ipv6 string
 	for _, addr := range addrs {
-		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
-			if ipNet.IP.To4() != nil {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if network != "tcp6" {
 				return ipNet.IP.String(), nil
 			}
+		} else if ipv6 == "" && network != "tcp4" {
+			ipv6 = ipNet.IP.String()
 		}
 	}
 
+	if ipv6 != "" {
+		return ipv6, nil
+	}
 	return "", fmt.Errorf("no IP address found")
 }
 
@@ -651,8 +964,11 @@ func httpServeCertificate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Serve the public certificate file
-	http.ServeFile(w, r, config.HTTPS.CertificatePublicKey)
+	// Serve the public certificate file, its path may change on reload
+	reloadMux.RLock()
+	path := config.HTTPS.CertificatePublicKey
+	reloadMux.RUnlock()
+	http.ServeFile(w, r, path)
 }
 
 // getStorageInfo returns the total and used storage space of the cache directory.
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/buildinfo"
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func TestHTTPPageCacheBrowser(t *testing.T) {
+	withTestConfig(t, &Config{})
+
+	dir := t.TempDir()
+	old := cache
+	cache = fscache.NewFSCache(dir)
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	for _, rawURL := range []string{
+		"http://deb.debian.org/debian/dists/stable/InRelease",
+		"http://deb.debian.org/debian/pool/main/a/a.deb",
+		"http://archive.ubuntu.com/ubuntu/dists/noble/InRelease",
+	} {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("parse %q: %v", rawURL, err)
+		}
+		localPath := filepath.Join(dir, u.Host, filepath.FromSlash(u.Path))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := os.WriteFile(localPath, []byte("content"), 0o644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if err := cache.Set(0, u.Host, u.Path, fscache.AccessEntry{URL: u, Hits: 3}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/cache?domain=deb.debian.org&q=inrelease", nil)
+	handleIndexRequests(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "/debian/dists/stable/InRelease") {
+		t.Fatalf("expected matching file to be listed")
+	}
+	if strings.Contains(body, "/debian/pool/main/a/a.deb") || strings.Contains(body, "/ubuntu/dists/noble/InRelease") {
+		t.Fatalf("expected files not matching the filters to be hidden")
+	}
+	if !strings.Contains(body, `<option value="archive.ubuntu.com">`) {
+		t.Fatalf("expected all cached domains to be selectable")
+	}
+	if !strings.Contains(body, "Page 1 of 1, 1 matching files") {
+		t.Fatalf("expected pagination summary")
+	}
+}
+
+func TestHTTPServeAPIStats(t *testing.T) {
+	withTestConfig(t, &Config{})
+
+	dir := t.TempDir()
+	persisted := `{"version": 1, "daily": {
+		"2026-01-01": {"requests": 1, "hits": 1, "domains": {"deb.debian.org": {"requests": 1, "hits": 1}}},
+		"2026-01-02": {"requests": 2, "misses": 2, "domains": {"deb.debian.org": {"requests": 2, "misses": 2}}},
+		"2026-01-03": {"requests": 3, "hits": 3}
+	}}`
+	if err := os.WriteFile(filepath.Join(dir, ".stats.json"), []byte(persisted), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	old := cache
+	cache = fscache.NewFSCache(dir)
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	type response struct {
+		Totals struct {
+			Requests uint64                     `json:"requests"`
+			Domains  map[string]json.RawMessage `json:"domains"`
+		} `json:"totals"`
+		Daily []struct {
+			Date    string                     `json:"date"`
+			Domains map[string]json.RawMessage `json:"domains"`
+		} `json:"daily"`
+	}
+	get := func(t *testing.T, query string) (*httptest.ResponseRecorder, response) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/api/stats"+query, nil)
+		handleIndexRequests(rr, req)
+
+		var resp response
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+		}
+		return rr, resp
+	}
+
+	t.Run("days", func(t *testing.T) {
+		rr, resp := get(t, "?days=2")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+		}
+		if rr.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Fatalf("Content-Type = %q", rr.Header().Get("Content-Type"))
+		}
+		if resp.Totals.Requests != 6 {
+			t.Fatalf("totals.requests = %d, want 6", resp.Totals.Requests)
+		}
+		if len(resp.Daily) != 2 || resp.Daily[0].Date != "2026-01-03" || resp.Daily[1].Date != "2026-01-02" {
+			t.Fatalf("daily = %+v, want the last 2 days", resp.Daily)
+		}
+		if resp.Totals.Domains != nil || resp.Daily[1].Domains != nil {
+			t.Fatalf("expected no per-domain statistics without per_domain")
+		}
+	})
+
+	t.Run("per domain", func(t *testing.T) {
+		rr, resp := get(t, "?per_domain=true")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+		}
+		if _, ok := resp.Totals.Domains["deb.debian.org"]; !ok {
+			t.Fatalf("totals.domains = %v, want deb.debian.org", resp.Totals.Domains)
+		}
+		if len(resp.Daily) != 3 || resp.Daily[1].Domains == nil {
+			t.Fatalf("daily = %+v, want per-domain daily statistics", resp.Daily)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, query := range []string{"?days=0", "?days=abc", "?days=10000", "?per_domain=maybe"} {
+			if rr, _ := get(t, query); rr.Code != http.StatusBadRequest {
+				t.Fatalf("%s: status = %d, want %d", query, rr.Code, http.StatusBadRequest)
+			}
+		}
+	})
+}
+
+func TestHTTPServeVersion(t *testing.T) {
+	withTestConfig(t, &Config{})
+
+	oldVersion, oldCommit, oldDate := buildinfo.Version, buildinfo.Commit, buildinfo.Date
+	buildinfo.Version, buildinfo.Commit, buildinfo.Date = "1.2.3", "abcdef0", "2026-01-02T03:04:05Z"
+	t.Cleanup(func() {
+		buildinfo.Version, buildinfo.Commit, buildinfo.Date = oldVersion, oldCommit, oldDate
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/version", nil)
+	handleIndexRequests(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	want := map[string]string{"version": "1.2.3", "commit": "abcdef0", "date": "2026-01-02T03:04:05Z"}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func TestHelperHTTPConstantsUsesBuildVersion(t *testing.T) {
+	withTestConfig(t, &Config{})
+
+	oldVersion := buildinfo.Version
+	buildinfo.Version = "9.8.7"
+	t.Cleanup(func() {
+		buildinfo.Version = oldVersion
+	})
+
+	if got := helperHTTPConstants()["Version"]; got != "9.8.7" {
+		t.Fatalf("Version = %v, want %q", got, "9.8.7")
+	}
+}
+
+func TestHTTPPagesShowContact(t *testing.T) {
+	cfg := &Config{}
+	cfg.Index.Contact = `Ask <a href="mailto:it@example.com">IT</a><script>alert(1)</script>`
+	withTestConfig(t, cfg)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+		wantPanel  bool
+	}{
+		{path: "/_goaptcacher/", wantStatus: http.StatusOK, wantPanel: true},
+		{path: "/_goaptcacher/missing", wantStatus: http.StatusNotFound, wantPanel: true},
+		{path: "/_goaptcacher/setup", wantStatus: http.StatusOK, wantPanel: false},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example"+tt.path, nil)
+		handleIndexRequests(rr, req)
+
+		if rr.Code != tt.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tt.path, rr.Code, tt.wantStatus)
+		}
+		body := rr.Body.String()
+		if !strings.Contains(body, `<a href="mailto:it@example.com" rel="noopener noreferrer">IT</a>`) {
+			t.Fatalf("%s: contact missing from page", tt.path)
+		}
+		if strings.Contains(body, "alert(1)") {
+			t.Fatalf("%s: script of contact rendered", tt.path)
+		}
+		if got := strings.Contains(body, "contact-panel"); got != tt.wantPanel {
+			t.Fatalf("%s: contact panel shown = %v, want %v", tt.path, got, tt.wantPanel)
+		}
+	}
+}
+
+func TestPickLocalIP(t *testing.T) {
+	ipv4 := &net.IPNet{IP: net.ParseIP("192.0.2.10"), Mask: net.CIDRMask(24, 32)}
+	ipv6 := &net.IPNet{IP: net.ParseIP("2001:db8::10"), Mask: net.CIDRMask(64, 128)}
+	loopback := &net.IPNet{IP: net.ParseIP("::1"), Mask: net.CIDRMask(128, 128)}
+	linkLocal := &net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)}
+
+	tcs := []struct {
+		name    string
+		addrs   []net.Addr
+		network string
+		want    string
+	}{
+		{"prefers ipv4", []net.Addr{loopback, ipv6, ipv4}, "tcp", "192.0.2.10"},
+		{"ipv6 only host", []net.Addr{loopback, linkLocal, ipv6}, "tcp", "2001:db8::10"},
+		{"ipv6 listeners", []net.Addr{ipv4, ipv6}, "tcp6", "2001:db8::10"},
+		{"ipv4 listeners", []net.Addr{ipv6, ipv4}, "tcp4", "192.0.2.10"},
+		{"no global address", []net.Addr{loopback, linkLocal}, "tcp", ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := pickLocalIP(tc.addrs, tc.network)
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("pickLocalIP() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("pickLocalIP() = %q, %v, want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestHTTPPageSetupBracketsIPv6Host(t *testing.T) {
+	cfg := &Config{ListenPort: 8090}
+	cfg.Index.Hostnames = []string{"2001:db8::10"}
+	withTestConfig(t, cfg)
+
+	if page := httpPageSetup(); !strings.Contains(page, `Acquire::http::Proxy "http://[2001:db8::10]:8090/";`) {
+		t.Fatalf("setup page doesn't contain a bracketed proxy URL:\n%s", page)
+	}
+	if page := httpPageIndex(); !strings.Contains(page, "http://[2001:db8::10]:8090") {
+		t.Fatal("index page doesn't contain a bracketed HTTP endpoint")
+	}
+}
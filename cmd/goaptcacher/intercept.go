@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/httpsintercept"
+)
+
+// interceptSettings is the CA material and the addresses the interception
+// handler is built from. A reload only replaces the handler, and with it the
+// issued certificates, if these change.
+type interceptSettings struct {
+	publicKey  string // PEM data of the CA certificate
+	privateKey string // PEM data of the CA private key
+	password   string // Password of the private key
+	domain     string // Primary domain used for SAN
+	aiaAddress string // AIA URL of the issued certificates (empty = none)
+	crlAddress string // CRL distribution point of the issued certificates (empty = CRL disabled)
+}
+
+// loadInterceptSettings reads the CA files configured in c.
+func loadInterceptSettings(c *Config) (interceptSettings, error) {
+	privateKeyData, err := os.ReadFile(c.HTTPS.CertificatePrivateKey)
+	if err != nil {
+		return interceptSettings{}, fmt.Errorf("reading private key file: %w", err)
+	}
+	publicKeyData, err := os.ReadFile(c.HTTPS.CertificatePublicKey)
+	if err != nil {
+		return interceptSettings{}, fmt.Errorf("reading public key file: %w", err)
+	}
+
+	settings := interceptSettings{
+		publicKey:  string(publicKeyData),
+		privateKey: string(privateKeyData),
+		password:   c.HTTPS.CertificatePassword,
+	}
+
+	// Set domain for certificate if configured
+	if c.HTTPS.CertificateDomain != "" {
+		settings.domain = c.HTTPS.CertificateDomain
+	} else if len(c.Domains) > 0 {
+		settings.domain = c.Domains[0]
+	}
+
+	// If available, set AIA Address
+	if c.HTTPS.AIAAddress != "" {
+		settings.aiaAddress = c.HTTPS.AIAAddress
+	} else if c.HTTPS.CertificateDomain != "" {
+		settings.aiaAddress = fmt.Sprintf("http://%s:%d/_goaptcacher/goaptcacher.crt", c.HTTPS.CertificateDomain, c.ListenPort)
+	}
+
+	if c.HTTPS.EnableCRL && c.HTTPS.CertificateDomain != "" {
+		settings.crlAddress = fmt.Sprintf("http://%s:%d/_goaptcacher/revocation.crl", c.HTTPS.CertificateDomain, c.ListenPort)
+	}
+
+	return settings, nil
+}
+
+// newIntercept creates the HTTPS interception handler for settings.
+func newIntercept(settings interceptSettings) (*httpsintercept.Intercept, error) {
+	handler, err := httpsintercept.New(
+		[]byte(settings.publicKey),
+		[]byte(settings.privateKey),
+		settings.password,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if settings.domain != "" {
+		handler.SetDomain(settings.domain)
+	}
+	if settings.aiaAddress != "" {
+		handler.SetAIAAddress(settings.aiaAddress)
+	}
+	if settings.crlAddress != "" {
+		handler.SetCRLAddress(settings.crlAddress)
+	}
+	return handler, nil
+}
+
+// currentIntercept returns the interception handler used for new connections.
+// Connections which are already established keep their certificate.
+func (s *Server) currentIntercept() *httpsintercept.Intercept {
+	reloadMux.RLock()
+	defer reloadMux.RUnlock()
+
+	return s.intercept
+}
+
+// startInterceptMaintenance periodically removes expired certificates and, if
+// enabled, regenerates the CRL. The handler is looked up on every run, so a
+// reloaded CA is picked up.
+func (s *Server) startInterceptMaintenance() {
+	// Run periodic cleanup of expired certificates
+	go func() {
+		for {
+			time.Sleep(time.Minute * 5)
+			s.currentIntercept().GC()
+		}
+	}()
+
+	// Run periodic CRL generation if enabled
+	if s.interceptLoaded.crlAddress != "" {
+		go func() {
+			for {
+				s.generateCRL()
+				time.Sleep(time.Minute * 30)
+			}
+		}()
+		slog.Info("CRL generation enabled", "event", "crl")
+	}
+}
+
+// generateCRL writes the CRL signed by the current CA to the cache directory.
+func (s *Server) generateCRL() {
+	reloadMux.RLock()
+	handler, crlAddress := s.intercept, s.interceptLoaded.crlAddress
+	reloadMux.RUnlock()
+
+	if crlAddress == "" {
+		return
+	}
+	if err := handler.GenerateCRL(crlAddress, s.config.CacheDirectory+"/crl.pem"); err != nil {
+		slog.Warn("Error generating CRL", "event", "crl", "error", err)
+	}
+}
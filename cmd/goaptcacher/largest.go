@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+const (
+	// largestFilesDefaultLimit is the number of files listed by default.
+	largestFilesDefaultLimit = 25
+	// largestFilesMaxLimit is the maximum number of files listed.
+	largestFilesMaxLimit = 500
+)
+
+// largestFile is a cached file in the JSON response of the largest files API.
+type largestFile struct {
+	URL          string    `json:"url"`
+	Domain       string    `json:"domain"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	Hits         uint64    `json:"hits"`
+	LastAccessed time.Time `json:"last_accessed,omitzero"`
+	Pinned       bool      `json:"pinned,omitempty"`
+}
+
+// largestDomain is a domain in the JSON response of the largest files API
+// grouped by domain.
+type largestDomain struct {
+	Domain  string        `json:"domain"`
+	Files   int           `json:"files"`
+	Size    int64         `json:"size"`
+	Largest []largestFile `json:"largest"`
+}
+
+func newLargestFiles(files []fscache.CachedFile) []largestFile {
+	result := make([]largestFile, len(files))
+	for i, file := range files {
+		result[i] = largestFile{
+			URL:          file.URL,
+			Domain:       file.Domain,
+			Path:         file.Path,
+			Size:         file.Size,
+			Hits:         file.Hits,
+			LastAccessed: file.LastAccessed,
+			Pinned:       file.Pinned,
+		}
+	}
+	return result
+}
+
+// largestFilesLimit returns the number of files requested by the limit query
+// parameter.
+func largestFilesLimit(query url.Values) (int, error) {
+	raw := query.Get("limit")
+	if raw == "" {
+		return largestFilesDefaultLimit, nil
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > largestFilesMaxLimit {
+		return 0, fmt.Errorf("limit must be between 1 and %d", largestFilesMaxLimit)
+	}
+	return limit, nil
+}
+
+// httpServeAPILargest serves the largest cached files as JSON. The query
+// parameter limit sets the number of files, group=domain groups the files by
+// domain.
+func httpServeAPILargest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, err := largestFilesLimit(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response any
+	if r.URL.Query().Get("group") == "domain" {
+		usages, err := cache.LargestFilesByDomain(limit)
+		if err != nil {
+			http.Error(w, "Error listing cached files", http.StatusInternalServerError)
+			return
+		}
+
+		domains := make([]largestDomain, len(usages))
+		for i, usage := range usages {
+			domains[i] = largestDomain{
+				Domain:  usage.Domain,
+				Files:   usage.Files,
+				Size:    usage.Size,
+				Largest: newLargestFiles(usage.Largest),
+			}
+		}
+		response = map[string]any{"domains": domains}
+	} else {
+		files, total, err := cache.LargestFiles(limit)
+		if err != nil {
+			http.Error(w, "Error listing cached files", http.StatusInternalServerError)
+			return
+		}
+		response = map[string]any{"files": newLargestFiles(files), "total": total}
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+// httpServeAPIPurge removes a single file given by the url parameter from the
+// cache. Forms of the web interface pass a redirect target to return to the
+// page after purging.
+func httpServeAPIPurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeManagement(w, r, managementRemoteAllowed()) {
+		return
+	}
+
+	target, err := url.Parse(r.FormValue("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	target.Host = fscache.CanonicalHost(target.Scheme, target.Host)
+
+	// Only files known to the cache are purged.
+	if _, ok := cache.Get(fscache.DetermineProtocolFromURL(target), target.Host, target.Path); !ok {
+		http.Error(w, "File not cached", http.StatusNotFound)
+		return
+	}
+	if err := cache.DeleteFile(target); err != nil {
+		slog.ErrorContext(r.Context(), "Error purging file", "event", "purge", "client", r.RemoteAddr, "host", target.Host, "path", target.Path, "error", err)
+		http.Error(w, "Error purging file", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Purged file", "event", "purge", "client", r.RemoteAddr, "host", target.Host, "path", target.Path)
+
+	if redirect := r.FormValue("redirect"); strings.HasPrefix(redirect, "/_goaptcacher/") {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]string{"purged": target.String()})
+}
+
+// httpPageLargest returns the page content for the largest cached files,
+// optionally grouped by domain.
+func httpPageLargest(r *http.Request) string {
+	query := r.URL.Query()
+	limit, err := largestFilesLimit(query)
+	if err != nil {
+		limit = largestFilesDefaultLimit
+	}
+	grouped := query.Get("group") == "domain"
+	canPurge := managementAccessAllowed(r)
+
+	// Purging returns to this page with the same parameters.
+	returnQuery := url.Values{}
+	returnQuery.Set("limit", strconv.Itoa(limit))
+	if grouped {
+		returnQuery.Set("group", "domain")
+	}
+	returnURL := "/_goaptcacher/largest?" + returnQuery.Encode()
+
+	var builder strings.Builder
+	builder.WriteString(`<section class="hero stack-md">
+		<p class="eyebrow">Cache</p>
+		<h2>Largest cached files</h2>
+		<p class="lead">The files using the most disk space. Purged files are downloaded again on the next request.</p>
+	</section>`)
+
+	groupedSelected := ""
+	if grouped {
+		groupedSelected = " selected"
+	}
+	builder.WriteString(`<section class="panel stack-md">
+		<form class="filter-form" method="get" action="/_goaptcacher/largest">
+			<label>Files <input type="number" name="limit" min="1" max="` + strconv.Itoa(largestFilesMaxLimit) + `" value="` + strconv.Itoa(limit) + `"></label>
+			<label>Group <select name="group"><option value="">No grouping</option><option value="domain"` + groupedSelected + `>By domain</option></select></label>
+			<button class="button" type="submit">Apply</button>
+		</form>
+	</section>`)
+
+	if grouped {
+		usages, err := cache.LargestFilesByDomain(limit)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error listing cached files", "event", "web", "error", err)
+			builder.WriteString(`<section class="panel"><p class="muted">Unable to list cached files.</p></section>`)
+			return builder.String()
+		}
+		if len(usages) == 0 {
+			builder.WriteString(`<section class="panel"><p class="muted">No files are cached.</p></section>`)
+		}
+		for _, usage := range usages {
+			builder.WriteString(`<section class="panel stack-md">
+		<h3>` + escapeHTML(usage.Domain) + `</h3>
+		<p class="muted">` + escapeHTML(fmt.Sprintf("%d files, %s", usage.Files, prettifyBytes(uint64(max(usage.Size, 0))))) + `</p>`)
+			builder.WriteString(renderLargestFilesTable(usage.Largest, canPurge, returnURL))
+			builder.WriteString(`</section>`)
+		}
+		return builder.String()
+	}
+
+	files, _, err := cache.LargestFiles(limit)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error listing cached files", "event", "web", "error", err)
+		builder.WriteString(`<section class="panel"><p class="muted">Unable to list cached files.</p></section>`)
+		return builder.String()
+	}
+	builder.WriteString(`<section class="panel stack-md">`)
+	if len(files) == 0 {
+		builder.WriteString(`<p class="muted">No files are cached.</p>`)
+	} else {
+		builder.WriteString(renderLargestFilesTable(files, canPurge, returnURL))
+	}
+	builder.WriteString(`</section>`)
+
+	return builder.String()
+}
+
+// renderLargestFilesTable renders a table of cached files. If purging is
+// allowed, every file gets a button to remove it from the cache.
+func renderLargestFilesTable(files []fscache.CachedFile, canPurge bool, returnURL string) string {
+	var builder strings.Builder
+	builder.WriteString(`<div class="data-table-wrap"><table class="data-table data-table-compact">
+		<thead>
+			<tr>
+				<th>File</th>
+				<th>Size</th>
+				<th>Hits</th>`)
+	if canPurge {
+		builder.WriteString(`<th></th>`)
+	}
+	builder.WriteString(`</tr>
+		</thead>
+		<tbody>`)
+
+	for _, file := range files {
+		builder.WriteString(fmt.Sprintf(
+			"<tr><td><code>%s</code><br><span class=\"muted\">%s</span></td><td>%s</td><td>%d</td>",
+			escapeHTML(file.Path),
+			escapeHTML(file.Domain),
+			escapeHTML(prettifyBytes(uint64(max(file.Size, 0)))),
+			file.Hits,
+		))
+		if canPurge {
+			builder.WriteString(`<td><form method="post" action="/_goaptcacher/api/purge">
+				<input type="hidden" name="url" value="` + escapeHTML(file.URL) + `">
+				<input type="hidden" name="redirect" value="` + escapeHTML(returnURL) + `">
+				` + csrfFormField() + `
+				<button class="button button-secondary" type="submit">Purge</button>
+			</form></td>`)
+		}
+		builder.WriteString(`</tr>`)
+	}
+	builder.WriteString(`</tbody></table></div>`)
+
+	return builder.String()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// withTestFiles replaces the global cache with a cache containing files of the
+// given sizes.
+func withTestFiles(t *testing.T, sizes map[string]int) *fscache.FSCache {
+	t.Helper()
+
+	old := cache
+	cache = fscache.NewFSCache(t.TempDir())
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	for rawURL, size := range sizes {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatalf("url.Parse(%q) error = %v", rawURL, err)
+		}
+		localPath := filepath.Join(cache.CachePath, u.Host, filepath.FromSlash(u.Path))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(localPath, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if err := cache.Set(fscache.DetermineProtocolFromURL(u), u.Host, u.Path, fscache.AccessEntry{URL: u}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	return cache
+}
+
+func TestHTTPServeAPILargest(t *testing.T) {
+	withTestConfig(t, &Config{})
+	withTestFiles(t, map[string]int{
+		"http://deb.debian.org/debian/pool/main/a/a.deb":         100,
+		"http://deb.debian.org/debian/pool/main/b/b.deb":         10,
+		"http://archive.ubuntu.com/ubuntu/pool/main/c/c.deb":     50,
+		"http://archive.ubuntu.com/ubuntu/dists/noble/InRelease": 5,
+	})
+
+	t.Run("files", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleIndexRequests(rr, httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/api/largest?limit=2", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+		}
+
+		var got struct {
+			Files []largestFile `json:"files"`
+			Total int           `json:"total"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if got.Total != 4 || len(got.Files) != 2 || got.Files[0].Size != 100 || got.Files[1].Size != 50 {
+			t.Fatalf("response = %+v, want the two largest of 4 files", got)
+		}
+	})
+
+	t.Run("grouped", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleIndexRequests(rr, httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/api/largest?limit=1&group=domain", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+		}
+
+		var got struct {
+			Domains []largestDomain `json:"domains"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if len(got.Domains) != 2 || got.Domains[0].Domain != "deb.debian.org" || got.Domains[0].Size != 110 || len(got.Domains[0].Largest) != 1 {
+			t.Fatalf("response = %+v, want deb.debian.org with 110 bytes first", got)
+		}
+	})
+
+	t.Run("invalid limit", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handleIndexRequests(rr, httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/api/largest?limit=0", nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestHTTPPageLargest(t *testing.T) {
+	withTestConfig(t, &Config{})
+	withTestFiles(t, map[string]int{
+		"http://deb.debian.org/debian/pool/main/a/a.deb": 100,
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/largest?group=domain", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+
+	body := rr.Body.String()
+	for _, want := range []string{"/debian/pool/main/a/a.deb", "deb.debian.org", `action="/_goaptcacher/api/purge"`, `name="csrf_token" value="` + csrfToken + `"`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("page is missing %q", want)
+		}
+	}
+
+	// Remote clients can't purge files.
+	rr = httptest.NewRecorder()
+	handleIndexRequests(rr, httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/largest", nil))
+	if strings.Contains(rr.Body.String(), "/_goaptcacher/api/purge") {
+		t.Fatalf("purge button shown to remote client")
+	}
+}
+
+func TestHTTPServeAPIPurge(t *testing.T) {
+	withTestConfig(t, &Config{})
+	testCache := withTestFiles(t, map[string]int{
+		"http://deb.debian.org/debian/pool/main/a/a.deb": 100,
+	})
+	localPath := filepath.Join(testCache.CachePath, "deb.debian.org", "debian", "pool", "main", "a", "a.deb")
+
+	purge := func(remoteAddr string, form url.Values) *httptest.ResponseRecorder {
+		form.Set("csrf_token", csrfToken)
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/purge", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		handleIndexRequests(rr, req)
+		return rr
+	}
+
+	if rr := purge("192.0.2.10:12345", url.Values{"url": {"http://deb.debian.org/debian/pool/main/a/a.deb"}}); rr.Code != http.StatusForbidden {
+		t.Fatalf("remote purge status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if rr := purge("127.0.0.1:12345", url.Values{"url": {"http://deb.debian.org/debian/pool/main/x/x.deb"}}); rr.Code != http.StatusNotFound {
+		t.Fatalf("purge of uncached file status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+	if rr := purge("127.0.0.1:12345", url.Values{"url": {"/debian/pool/main/a/a.deb"}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("purge of invalid URL status = %d, want %d", rr.Code, http.StatusBadRequest)
+	}
+
+	rr := purge("127.0.0.1:12345", url.Values{
+		"url":      {"http://deb.debian.org/debian/pool/main/a/a.deb"},
+		"redirect": {"/_goaptcacher/largest?limit=25"},
+	})
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/_goaptcacher/largest?limit=25" {
+		t.Fatalf("purge status = %d, location = %q, want redirect to the largest files", rr.Code, rr.Header().Get("Location"))
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("purged file still exists: %v", err)
+	}
+}
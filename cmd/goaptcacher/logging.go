@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// parseLogLevel returns the slog level for the configured log level. An empty
+// level selects info.
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("invalid value %q, must be \"debug\", \"info\", \"warn\" or \"error\"", level)
+	}
+}
+
+// newLogHandler creates the handler for the structured log output. If the
+// program runs under systemd, timestamps are omitted as the journal records
+// them already.
+func newLogHandler(w io.Writer, c *Config, systemd bool) slog.Handler {
+	opts := &slog.HandlerOptions{Level: c.logLevel}
+	if systemd {
+		opts.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		}
+	}
+
+	if c.Log.Format == "json" {
+		return requestIDHandler{slog.NewJSONHandler(w, opts)}
+	}
+	return requestIDHandler{slog.NewTextHandler(w, opts)}
+}
+
+// requestIDHandler adds the request ID stored in the context of a log call to
+// the record, so log lines of a single request can be correlated.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := fscache.RequestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// setupLogging sets the default logger for the given configuration. Output of
+// the standard log package is passed to the same handler.
+func setupLogging(c *Config) {
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, c, os.Getenv("INVOCATION_ID") != "")))
+}
+
+// fatal logs the message with its attributes as error and exits the program.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
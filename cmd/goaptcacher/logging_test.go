@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tcs := []struct {
+		input   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"", slog.LevelInfo, false},
+		{"debug", slog.LevelDebug, false},
+		{"INFO", slog.LevelInfo, false},
+		{"warning", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"verbose", 0, true},
+	}
+
+	for _, tc := range tcs {
+		got, err := parseLogLevel(tc.input)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("parseLogLevel(%q) error = %v, wantErr %v", tc.input, err, tc.wantErr)
+		}
+		if err == nil && got != tc.want {
+			t.Fatalf("parseLogLevel(%q) = %v, want %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestNewLogHandlerFiltersLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, &Config{logLevel: slog.LevelWarn}, false))
+
+	logger.Info("hidden", "event", "test")
+	logger.Warn("shown", "event", "test")
+
+	if strings.Contains(buf.String(), "hidden") {
+		t.Fatalf("info message logged with level warn, logs = %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), `level=WARN msg=shown event=test`) {
+		t.Fatalf("warn message missing, logs = %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "time=") {
+		t.Fatalf("expected timestamp outside of systemd, logs = %q", buf.String())
+	}
+}
+
+func TestNewLogHandlerSystemdOmitsTime(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, &Config{}, true))
+
+	logger.Info("message", "event", "test")
+
+	if got, want := buf.String(), "level=INFO msg=message event=test\n"; got != want {
+		t.Fatalf("log output = %q, want %q", got, want)
+	}
+}
+
+func TestNewLogHandlerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := &Config{}
+	cfg.Log.Format = "json"
+	logger := slog.New(newLogHandler(&buf, cfg, true))
+
+	logger.Info("Cache hit", "event", "hit", "host", "deb.debian.org", "bytes", 42)
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON log output %q: %v", buf.String(), err)
+	}
+	if record["msg"] != "Cache hit" || record["event"] != "hit" || record["host"] != "deb.debian.org" || record["bytes"] != float64(42) {
+		t.Fatalf("unexpected log record %v", record)
+	}
+	if _, ok := record["time"]; ok {
+		t.Fatalf("expected timestamp to be omitted under systemd, record = %v", record)
+	}
+}
+
+func TestNewLogHandlerAddsRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, &Config{}, true))
+
+	logger.InfoContext(fscache.WithRequestID(context.Background(), "0f1e2d3c"), "Cache hit", "event", "hit")
+	logger.Info("Startup", "event", "startup")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %q", buf.String())
+	}
+	if lines[0] != "level=INFO msg=\"Cache hit\" event=hit request_id=0f1e2d3c" {
+		t.Fatalf("unexpected log line with request ID %q", lines[0])
+	}
+	if strings.Contains(lines[1], "request_id") {
+		t.Fatalf("unexpected request ID in %q", lines[1])
+	}
+}
+
+func TestHandleRequestSetsRequestID(t *testing.T) {
+	cfg := &Config{AllowedClients: []string{"192.168.1.0/24"}}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, &Config{}, true)))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/_goaptcacher/", nil)
+	req.RemoteAddr = "192.168.2.20:40000"
+	s.handleRequest(rr, req)
+
+	requestID := rr.Header().Get("X-Request-ID")
+	if requestID == "" {
+		t.Fatalf("expected X-Request-ID header")
+	}
+	if !strings.Contains(buf.String(), "request_id="+requestID) {
+		t.Fatalf("expected log lines to carry request ID %q, logs = %q", requestID, buf.String())
+	}
+}
@@ -1,21 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"time"
 
 	"gitlab.com/bella.network/goaptcacher/pkg/buildinfo"
 	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
 	"gitlab.com/bella.network/goaptcacher/pkg/httpsintercept"
 )
 
-var config *Config                      // Config struct holding the configuration values
-var loadedDomains int                   // Number of loaded domains
-var cache *fscache.FSCache              // Cache object used to store cached files
-var intercept *httpsintercept.Intercept // Intercept object used to handle HTTPS interception
+// startupMinFreeBytes is the free space the cache directory needs at startup.
+const startupMinFreeBytes = 100 << 20
+
+var config *Config         // Config struct holding the configuration values
+var cache *fscache.FSCache // Cache object used to store cached files
 
 func printHelp() {
 	fmt.Println("goaptcacher - APT caching proxy")
@@ -27,6 +28,12 @@ func printHelp() {
 	fmt.Println("  -v, --version        Print version and exit")
 	fmt.Println("  -h, --help           Show this help message and exit")
 	fmt.Println("  -c, --config <file>  Path to config file (default: ./config.yaml)")
+	fmt.Println("  --print-config       Print the effective configuration with secrets redacted and exit")
+	fmt.Println("  --generate-ca        Create an interception CA at https.cert and https.key and exit")
+	fmt.Println("  --ca-key-type <type> Key type of the generated CA: ecdsa-p256 (default), ecdsa-p384,")
+	fmt.Println("                       rsa-2048, rsa-3072 or rsa-4096")
+	fmt.Println("  --ca-validity-days <days>")
+	fmt.Println("                       Validity of the generated CA (default: 3650)")
 	fmt.Println()
 	fmt.Println("Commands:")
 	fmt.Println("  verify-repos         Verify cached repository metadata and package checksums")
@@ -41,6 +48,10 @@ func main() {
 	flag.BoolVar(showVersion, "version", false, "Print version and exit")
 	flag.BoolVar(showHelp, "help", false, "Show help and exit")
 	flag.StringVar(configPath, "config", "", "Path to config file")
+	printEffectiveConfig := flag.Bool("print-config", false, "Print the effective configuration and exit")
+	generateCAFiles := flag.Bool("generate-ca", false, "Create an interception CA at https.cert and https.key and exit")
+	caKeyType := flag.String("ca-key-type", httpsintercept.DefaultCAKeyType, "Key type of the generated CA")
+	caValidityDays := flag.Int("ca-validity-days", 3650, "Validity of the generated CA in days")
 	flag.Parse()
 
 	if *showHelp {
@@ -57,15 +68,13 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Detect if the program is launched by systemd, in that case only print
-	// reduced logs.
-	if os.Getenv("INVOCATION_ID") != "" {
-		log.SetFlags(0)
-	} else {
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
-	}
+	// Log with the default settings until the config is loaded. If the program
+	// is launched by systemd, timestamps are omitted.
+	setupLogging(&Config{})
 
-	log.Println("[INFO] Starting GoAPTCacher ", buildinfo.Version)
+	if !*printEffectiveConfig && !*generateCAFiles {
+		slog.Info("Starting GoAPTCacher", "event", "startup", "version", buildinfo.Version)
+	}
 
 	// Check if envorinment variable is set with the path to the config file
 	// Priorität: Kommandozeilenoption > ENV > Default
@@ -80,7 +89,23 @@ func main() {
 	var err error
 	config, err = ReadConfig(*configPath)
 	if err != nil {
-		log.Fatal("Error reading config file: ", err)
+		fatal("Error reading config file", "event", "config", "path", *configPath, "error", err)
+	}
+	if *printEffectiveConfig {
+		if err := printConfig(os.Stdout, config); err != nil {
+			fatal("Error printing config", "event", "config", "error", err)
+		}
+		os.Exit(0)
+	}
+	if *generateCAFiles {
+		if err := generateCA(os.Stdout, config, *caKeyType, *caValidityDays); err != nil {
+			fatal("Error generating CA", "event", "config", "error", err)
+		}
+		os.Exit(0)
+	}
+	setupLogging(config)
+	for _, includedFile := range config.IncludedFiles {
+		slog.Info("Loaded included config file", "event", "config", "path", includedFile)
 	}
 
 	// Initialize debug logging and pprof snapshotting (if enabled).
@@ -96,134 +121,188 @@ func main() {
 		// default server mode
 	case "verify-repos":
 		if err := runVerifyRepositories(config.CacheDirectory); err != nil {
-			log.Fatal("[DEBREPOCLEANER-ERROR] ", err)
+			fatal("Repository verification failed", "event", "verify_repos", "error", err)
 		}
 		return
 	default:
-		log.Fatalf("Unknown command: %s", command)
+		fatal("Unknown command", "event", "startup", "command", command)
+	}
+
+	// Export traces (if configured).
+	if err := initTracing(context.Background()); err != nil {
+		fatal("Error setting up tracing", "event", "tracing", "error", err)
+	}
+
+	// Open the access log (if enabled).
+	if err := initAccessLog(); err != nil {
+		fatal("Error opening access log", "event", "access_log", "path", config.AccessLog.File, "error", err)
 	}
 
-	// If no domains and passthrough domains are configured, log a warning that
-	// all requests will be allowed.
-	loadedDomains = len(config.Domains) + len(config.PassthroughDomains)
-	if loadedDomains == 0 {
-		log.Println("[WARN] No domains or passthrough domains are configured!")
-		log.Println("[WARN] All HTTP requests will be passed through - THIS IS A SECURITY RISK!")
-		log.Println("[WARN] Cache will be disabled!")
+	// If no domains and passthrough domains are configured, all requests would
+	// be allowed. This has to be enabled explicitly.
+	if err := config.checkOpenProxy(); err != nil {
+		fatal("Refusing to run as open proxy", "event", "config", "error", err)
+	}
+	if len(config.Domains)+len(config.PassthroughDomains) == 0 {
+		slog.Warn("No domains or passthrough domains are configured!", "event", "config")
+		slog.Warn("All HTTP requests will be passed through - THIS IS A SECURITY RISK!", "event", "config")
+		slog.Warn("Cache will be disabled!", "event", "config")
 	} else {
-		log.Printf("[INFO] Loaded %d domains and %d passthrough domains\n", len(config.Domains), len(config.PassthroughDomains))
+		slog.Info("Loaded domains", "event", "config", "domains", len(config.Domains), "passthrough_domains", len(config.PassthroughDomains))
 	}
 
 	// Show warning if index page is not enabled and show hint how to use the proxy
 	if !config.Index.Enable {
-		log.Printf("[INFO] Index page is disabled. Use this servers IP address or hostname to access the proxy server.")
+		slog.Info("Index page is disabled. Use this servers IP address or hostname to access the proxy server.", "event", "config")
 	} else {
 		if len(config.Index.Hostnames) == 0 {
-			log.Printf("[WARN] Index page is enabled but no hostnames are configured. The index page will not be shown.")
+			slog.Warn("Index page is enabled but no hostnames are configured. The index page will not be shown.", "event", "config")
 		} else {
-			log.Printf("[INFO] Index page is enabled. Access the proxy server using the following hostnames: %v", config.Index.Hostnames)
+			slog.Info("Index page is enabled. Access the proxy server using the configured hostnames.", "event", "config", "hostnames", config.Index.Hostnames)
 		}
 	}
 
+	// Initiate cache
+	cache = fscache.NewFSCache(config.CacheDirectory)
+	if config.CacheLayout == fscache.LayoutSharded {
+		cache.CustomCachePath = cache.ShardedCachePath
+	}
+	cache.SetWriteOptions(config.writeOptions())
+	cache.SetTempDirectory(config.TempDirectory)
+	cache.SetTransportOptions(config.transportOptions())
+	cache.SetDeduplication(config.CacheDeduplicate)
+	cache.SetDebugHeaders(config.Debug.Enable)
+	cache.SetRecheckOptions(config.recheckOptions())
+	cache.SetWriteLockMaxAge(config.writeLockMaxAge())
+	cache.SetLockWaitOptions(config.lockWaitOptions())
+	cache.SetDeletionGracePeriod(config.deletionGracePeriod())
+	cache.SetNeverCache(config.neverCache)
+	cache.SetCompressionFallback(config.CompressionFallback)
+	if len(config.upstreamHeaders) > 0 {
+		cache.SetUpstreamHeaders(config.upstreamHeadersFor)
+		for _, rule := range config.upstreamHeaders {
+			slog.Info("Adding headers to upstream requests", "event", "upstream", "domain", rule.domain, "headers", rule.headers)
+		}
+	}
+	cache.SetForwardedFor(config.Upstream.ForwardedFor)
+	if len(config.ProtocolAgnosticDomains) > 0 {
+		domains := config.ProtocolAgnosticDomains
+		cache.SetEquivalentProtocols(func(domain string) bool {
+			return matchDomainList(domain, domains)
+		})
+	}
+	if len(config.ImmutableDomains) > 0 {
+		domains := config.ImmutableDomains
+		cache.SetImmutable(func(domain string) bool {
+			return matchDomainList(domain, domains)
+		})
+		slog.Info("Never revalidating files of immutable domains", "event", "config", "domains", domains)
+	}
+	if len(config.AppendOnlyDomains) > 0 {
+		domains := config.AppendOnlyDomains
+		cache.SetAppendOnly(func(domain string) bool {
+			return matchDomainList(domain, domains)
+		})
+	}
+	if len(config.signedBy) > 0 {
+		if err := cache.SetSignedBy(config.signedByFor); err != nil {
+			fatal("Error enabling signature verification", "event", "signature", "error", err)
+		}
+		for _, rule := range config.signedBy {
+			slog.Info("Verifying release file signatures", "event", "signature", "domain", rule.domain, "path", rule.pathPrefix, "keyring", rule.keyring, "fingerprints", rule.fingerprints)
+		}
+	}
+	if config.parentCache != nil {
+		cache.SetParent(config.parentCache)
+		slog.Info("Using parent cache", "event", "parent", "parent", config.parentCache.Host)
+	}
+	// Move files of a cache in another layout before they are looked up
+	if moved, err := cache.MigrateLayout(config.CacheLayout); err != nil {
+		fatal("Error migrating cache layout", "event", "layout", "path", config.CacheDirectory, "moved", moved, "error", err)
+	}
+	// Start periodic verification of cached packages
+	// cache.StartSourcesVerification()
+
+	// Set expiration days for the cache
+	if config.Expiration.UnusedDays > 0 {
+		cache.SetExpirationDays(config.Expiration.UnusedDays)
+	} else {
+		slog.Info("File expiration is disabled, old packages are not automatically deleted", "event", "expire")
+	}
+
+	// The proxy handlers serve requests with the config and the cache
+	server := newServer(config, cache)
+
 	// If HTTPS interception is enabled, load the certificate and key files.
 	// Initialize the interception handler for future processing.
 	if config.HTTPS.Intercept {
-		// Load the certificate and key files
-		privateKeyData, err := os.ReadFile(config.HTTPS.CertificatePrivateKey)
-		if err != nil {
-			log.Fatal("Error reading private key file: ", err)
-		}
-		publicKeyData, err := os.ReadFile(config.HTTPS.CertificatePublicKey)
+		settings, err := loadInterceptSettings(config)
 		if err != nil {
-			log.Fatal("Error reading public key file: ", err)
+			fatal("Error loading HTTPS interception certificate", "event", "config", "cert", config.HTTPS.CertificatePublicKey, "key", config.HTTPS.CertificatePrivateKey, "error", err)
 		}
 
 		// Initialize the HTTPS interception handler
-		intercept, err = httpsintercept.New(
-			publicKeyData,
-			privateKeyData,
-			config.HTTPS.CertificatePassword,
-			nil,
-		)
+		handler, err := newIntercept(settings)
 		if err != nil {
-			log.Fatal("Error initializing HTTPS interception: ", err)
-		}
-
-		log.Println("[INFO] HTTPS interception enabled")
-
-		// Set domain for certificate if configured
-		if config.HTTPS.CertificateDomain != "" {
-			intercept.SetDomain(config.HTTPS.CertificateDomain)
-		} else if len(config.Domains) > 0 {
-			intercept.SetDomain(config.Domains[0])
+			fatal("Error initializing HTTPS interception", "event", "intercept", "error", err)
 		}
+		server.setIntercept(handler, settings)
 
-		// If available, set AIA Address
-		if config.HTTPS.AIAAddress != "" {
-			intercept.SetAIAAddress(config.HTTPS.AIAAddress)
-		} else if config.HTTPS.CertificateDomain != "" {
-			intercept.SetAIAAddress(fmt.Sprintf("http://%s:%d/_goaptcacher/goaptcacher.crt", config.HTTPS.CertificateDomain, config.ListenPort))
-		}
+		slog.Info("HTTPS interception enabled", "event", "intercept")
 
-		// Run periodic cleanup of expired certificates
-		go func() {
-			for {
-				time.Sleep(time.Minute * 5)
-				intercept.GC()
-			}
-		}()
-
-		// Run periodic CRL generation if enabled
-		if config.HTTPS.EnableCRL && config.HTTPS.CertificateDomain != "" {
-			crlAddress := fmt.Sprintf("http://%s:%d/_goaptcacher/revocation.crl", config.HTTPS.CertificateDomain, config.ListenPort)
-			intercept.SetCRLAddress(crlAddress)
-			go func() {
-				for {
-					if err := intercept.GenerateCRL(
-						crlAddress,
-						config.CacheDirectory+"/crl.pem",
-					); err != nil {
-						log.Println("[CRL-WARN] Error generating CRL: ", err)
-					}
-					time.Sleep(time.Minute * 30)
-				}
-			}()
-			log.Println("[INFO] CRL generation enabled")
-		}
+		// Run periodic cleanup of expired certificates and CRL generation
+		server.startInterceptMaintenance()
 	}
 
-	// Initiate cache
-	cache = fscache.NewFSCache(config.CacheDirectory)
-	// Start periodic verification of cached packages
-	// cache.StartSourcesVerification()
-
-	// Set expiration days for the cache
-	if config.Expiration.UnusedDays > 0 {
-		cache.SetExpirationDays(config.Expiration.UnusedDays)
-	} else {
-		log.Println("[INFO] File expiration is disabled, old packages are not automatically deleted")
+	// Write the PID file (if configured) while the process may still write to
+	// /run
+	if err := writePIDFile(); err != nil {
+		fatal("Error writing PID file", "event", "startup", "path", config.PIDFile, "error", err)
 	}
 
 	// If HTTPS interception is enabled, start the HTTPS listener
 	if config.HTTPS.Intercept {
-		go ListenHTTPS()
+		server.ListenHTTPS()
 	}
 
 	// Start the HTTP listener
-	go ListenHTTP()
+	server.ListenHTTP()
 	if len(config.AlternativePorts) > 0 {
 		for _, port := range config.AlternativePorts {
-			go ListenHTTPAlternative(port)
+			server.ListenHTTPAlternative(port)
 		}
 	} else {
-		log.Println("[INFO] No alternative ports configured")
+		slog.Info("No alternative ports configured", "event", "startup")
+	}
+
+	// Serve the web interface on its own listener (if configured)
+	if config.managementSeparated() {
+		ListenManagement()
+	}
+
+	// Privileged ports are bound, continue as unprivileged user (if configured)
+	if err := dropPrivileges(); err != nil {
+		fatal("Error dropping privileges", "event", "startup", "user", config.User, "error", err)
+	}
+
+	// Fail fast if downloads can't be stored in the cache directory
+	if err := cache.SelfTest(startupMinFreeBytes); err != nil {
+		fatal("Cache directory is not usable", "event", "startup", "path", config.CacheDirectory, "error", err)
 	}
 
 	// If mDNS is enabled, announce the service
-	if config.MDNS {
-		go mDNSAnnouncement()
+	if config.MDNS.Enable {
+		mDNSAnnouncement()
 	}
 
-	// Wait forever
-	select {}
+	// Reload the config on SIGHUP, flush the stats on SIGUSR1 and verify the
+	// cache on SIGUSR2
+	handleSignals(server, *configPath)
+
+	// All listeners are bound, report readiness to systemd and health probes
+	serving.Store(true)
+	notifyReady()
+
+	// Serve until SIGINT or SIGTERM is received
+	waitForShutdown()
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// csrfToken protects the forms of the web interface which trigger management
+// actions. It is generated on startup, so forms of a previous process are
+// rejected.
+var csrfToken = newCSRFToken()
+
+func newCSRFToken() string {
+	token := make([]byte, 32)
+	_, _ = rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+// csrfFormField returns the hidden form field carrying the CSRF token.
+func csrfFormField() string {
+	return `<input type="hidden" name="csrf_token" value="` + csrfToken + `">`
+}
+
+// managementRemoteAllowed reports if clients which aren't local may use
+// management actions without a token.
+func managementRemoteAllowed() bool {
+	return config.Debug.Enable && config.Debug.AllowRemote
+}
+
+// managementAccessAllowed reports if the client may use management actions
+// like the verification APIs or purging cached files. Only local clients are
+// allowed, unless remote debug access is enabled.
+func managementAccessAllowed(r *http.Request) bool {
+	return isLocalRequest(r) || managementRemoteAllowed()
+}
+
+// hasManagementToken reports if the request carries the configured management
+// token as bearer token.
+func hasManagementToken(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && config.Management.Token != "" &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(config.Management.Token)) == 1
+}
+
+// authorizeManagement checks if the client may call a state changing
+// management action. A request with the configured management token is always
+// accepted. Without token, only local clients (or all clients if allowRemote
+// is set) are accepted, forms of the web interface must carry the CSRF token
+// and cross-site requests of browsers are rejected. If a management token is
+// configured, API calls without token are rejected. If the request isn't
+// authorized, an error response is sent and false is returned.
+func authorizeManagement(w http.ResponseWriter, r *http.Request, allowRemote bool) bool {
+	if r.Header.Get("Authorization") != "" {
+		if hasManagementToken(r) {
+			return true
+		}
+		slog.WarnContext(r.Context(), "Invalid management token", "event", "auth", "client", r.RemoteAddr, "path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="goaptcacher"`)
+		fscache.Error(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return false
+	}
+
+	if !allowRemote && !isLocalRequest(r) {
+		fscache.Error(w, r, http.StatusForbidden, "forbidden", "Forbidden")
+		return false
+	}
+
+	if isCrossSiteRequest(r) {
+		slog.WarnContext(r.Context(), "Rejected cross-site management request", "event", "auth", "client", r.RemoteAddr, "path", r.URL.Path)
+		fscache.Error(w, r, http.StatusForbidden, "cross_site_request", "Cross-site request rejected")
+		return false
+	}
+
+	if isFormRequest(r) {
+		if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf_token")), []byte(csrfToken)) != 1 {
+			slog.WarnContext(r.Context(), "Invalid CSRF token", "event", "auth", "client", r.RemoteAddr, "path", r.URL.Path)
+			fscache.Error(w, r, http.StatusForbidden, "invalid_csrf_token", "Invalid CSRF token")
+			return false
+		}
+		return true
+	}
+
+	if config.Management.Token != "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="goaptcacher"`)
+		fscache.Error(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+		return false
+	}
+
+	return true
+}
+
+// isFormRequest reports if the request body is an HTML form submission.
+func isFormRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data")
+}
+
+// isCrossSiteRequest reports if a browser sent the request on behalf of
+// another site. Browsers send the Sec-Fetch-Site and Origin headers with
+// state changing requests, other clients usually don't send them.
+func isCrossSiteRequest(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site != "same-origin" && site != "none"
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	parsed, err := url.Parse(origin)
+	return err != nil || !strings.EqualFold(parsed.Host, r.Host)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeManagement(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		allowRemote bool
+		remoteAddr  string
+		headers     map[string]string
+		form        url.Values
+		want        int
+	}{
+		{name: "local api", remoteAddr: "127.0.0.1:1234", want: http.StatusOK},
+		{name: "remote api", remoteAddr: "192.0.2.10:1234", want: http.StatusForbidden},
+		{name: "remote api allowed", allowRemote: true, remoteAddr: "192.0.2.10:1234", want: http.StatusOK},
+		{name: "local api with configured token", token: "secret", remoteAddr: "127.0.0.1:1234", want: http.StatusUnauthorized},
+		{name: "remote api with token", token: "secret", remoteAddr: "192.0.2.10:1234", headers: map[string]string{"Authorization": "Bearer secret"}, want: http.StatusOK},
+		{name: "remote api with wrong token", token: "secret", remoteAddr: "192.0.2.10:1234", headers: map[string]string{"Authorization": "Bearer wrong"}, want: http.StatusUnauthorized},
+		{name: "token without configured token", remoteAddr: "127.0.0.1:1234", headers: map[string]string{"Authorization": "Bearer secret"}, want: http.StatusUnauthorized},
+		{name: "cross-site origin", remoteAddr: "127.0.0.1:1234", headers: map[string]string{"Origin": "https://evil.example.com"}, want: http.StatusForbidden},
+		{name: "cross-site fetch metadata", remoteAddr: "127.0.0.1:1234", headers: map[string]string{"Sec-Fetch-Site": "cross-site"}, want: http.StatusForbidden},
+		{name: "same origin", remoteAddr: "127.0.0.1:1234", headers: map[string]string{"Origin": "http://example"}, want: http.StatusOK},
+		{name: "form with csrf token", token: "secret", remoteAddr: "127.0.0.1:1234", form: url.Values{"csrf_token": {csrfToken}}, want: http.StatusOK},
+		{name: "form without csrf token", remoteAddr: "127.0.0.1:1234", form: url.Values{}, want: http.StatusForbidden},
+		{name: "form with wrong csrf token", remoteAddr: "127.0.0.1:1234", form: url.Values{"csrf_token": {"wrong"}}, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Management.Token = tt.token
+			withTestConfig(t, cfg)
+
+			req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/purge", nil)
+			if tt.form != nil {
+				req = httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/purge", strings.NewReader(tt.form.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			req.RemoteAddr = tt.remoteAddr
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+
+			rr := httptest.NewRecorder()
+			if authorizeManagement(rr, req, tt.allowRemote) {
+				rr.WriteHeader(http.StatusOK)
+			}
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
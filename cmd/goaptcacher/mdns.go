@@ -1,16 +1,91 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
 
 	"github.com/grandcat/zeroconf"
 )
 
+// mdnsServiceType is the DNS-SD service type auto-apt-proxy looks for.
+const mdnsServiceType = "_apt_proxy._tcp"
+
+// mdnsServer announces the proxy, it is nil if the announcement is disabled.
+var mdnsServer *zeroconf.Server
+
+// MDNSConfig configures the mDNS announcement. For compatibility with older
+// configs, "mdns: true" enables the announcement with the default settings.
+type MDNSConfig struct {
+	Enable     bool     `yaml:"enable"`     // Enable mDNS announcement for apt proxy auto-discovery
+	Instance   string   `yaml:"instance"`   // Announced instance name (default: hostname)
+	Port       int      `yaml:"port"`       // Announced port, e.g. one of alternative_ports (default: listen_port)
+	TXT        []string `yaml:"txt"`        // TXT records of the service as key=value pairs
+	Interfaces []string `yaml:"interfaces"` // Names of the interfaces the service is announced on (default: all multicast interfaces)
+}
+
+func (m *MDNSConfig) UnmarshalYAML(unmarshal func(any) error) error {
+	var enable bool
+	if err := unmarshal(&enable); err == nil {
+		*m = MDNSConfig{Enable: enable}
+		return nil
+	}
+
+	type plain MDNSConfig
+	return unmarshal((*plain)(m))
+}
+
+// mdnsInstanceName returns the announced instance name.
+func mdnsInstanceName() string {
+	if config.MDNS.Instance != "" {
+		return config.MDNS.Instance
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "GoAPTCacher"
+}
+
+// mdnsInterfaces resolves the configured interface names. Without configured
+// interfaces, nil is returned and all multicast interfaces are used.
+func mdnsInterfaces(names []string) ([]net.Interface, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ifaces := make([]net.Interface, 0, len(names))
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", name, err)
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	return ifaces, nil
+}
+
+// mDNSAnnouncement announces the proxy as _apt_proxy._tcp service in the
+// local network.
 func mDNSAnnouncement() {
-	// Create a service entry
-	_, err := zeroconf.Register("_apt_proxy", "_tcp", "local.", config.ListenPort, nil, nil)
+	if config.MDNS.Port == 0 {
+		slog.Warn("mDNS announcement is disabled as the proxy listens on a Unix domain socket, set mdns.port to announce a TCP port", "event", "mdns", "address", config.Listen)
+		return
+	}
+
+	ifaces, err := mdnsInterfaces(config.MDNS.Interfaces)
+	if err != nil {
+		slog.Error("Failed to register mDNS service", "event", "mdns", "error", err)
+		return
+	}
+
+	instance := mdnsInstanceName()
+	server, err := zeroconf.Register(instance, mdnsServiceType, "local.", config.MDNS.Port, config.MDNS.TXT, ifaces)
 	if err != nil {
-		log.Println("[ERR:mDNS] Failed to register service: ", err)
+		slog.Error("Failed to register mDNS service", "event", "mdns", "error", err)
 		return
 	}
+	mdnsServer = server
+
+	slog.Info("Announcing proxy via mDNS", "event", "mdns", "instance", instance, "service", mdnsServiceType, "port", config.MDNS.Port, "interfaces", config.MDNS.Interfaces)
 }
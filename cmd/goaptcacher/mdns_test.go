@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigMDNSBoolCompatibility(t *testing.T) {
+	cfg, err := ReadConfig(writeTempConfig(t, "listen_port: 9000\nmdns: true\n"))
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if !cfg.MDNS.Enable || cfg.MDNS.Port != 9000 {
+		t.Fatalf("MDNS = %+v, want enabled on listen_port", cfg.MDNS)
+	}
+}
+
+func TestReadConfigMDNSSettings(t *testing.T) {
+	cfg, err := ReadConfig(writeTempConfig(t, `
+mdns:
+  enable: true
+  instance: Office cache
+  port: 3142
+  txt:
+    - "path=/"
+  interfaces:
+    - eth1
+`))
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if !cfg.MDNS.Enable || cfg.MDNS.Instance != "Office cache" || cfg.MDNS.Port != 3142 {
+		t.Fatalf("MDNS = %+v", cfg.MDNS)
+	}
+	if !slices.Equal(cfg.MDNS.TXT, []string{"path=/"}) || !slices.Equal(cfg.MDNS.Interfaces, []string{"eth1"}) {
+		t.Fatalf("MDNS = %+v", cfg.MDNS)
+	}
+}
+
+func TestReadConfigMDNSWithUnixSocketNeedsPort(t *testing.T) {
+	cfg, err := ReadConfig(writeTempConfig(t, "listen: unix:/run/goaptcacher.sock\nmdns: true\n"))
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if cfg.MDNS.Port != 0 {
+		t.Fatalf("MDNS.Port = %d, want 0 for a Unix domain socket", cfg.MDNS.Port)
+	}
+}
+
+func TestMDNSInterfacesRejectsUnknownInterface(t *testing.T) {
+	if _, err := mdnsInterfaces([]string{"does-not-exist0"}); err == nil {
+		t.Fatal("expected error for unknown interface")
+	}
+	if ifaces, err := mdnsInterfaces(nil); err != nil || ifaces != nil {
+		t.Fatalf("mdnsInterfaces(nil) = %v, %v, want all interfaces", ifaces, err)
+	}
+}
+
+func TestHTTPPageSetupMatchesMDNSAnnouncement(t *testing.T) {
+	cfg := &Config{ListenPort: 8090}
+	cfg.Index.Hostnames = []string{"cache.example.com"}
+	cfg.MDNS = MDNSConfig{Enable: true, Instance: "Office cache", Port: 3142}
+	withTestConfig(t, cfg)
+
+	page := httpPageSetup()
+	for _, want := range []string{
+		"_apt_proxy._tcp.example.com. 3600 IN SRV 0 0 3142 cache.example.com.",
+		"<code>Office cache._apt_proxy._tcp.local.</code> on port 3142",
+	} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("setup page doesn't contain %q", want)
+		}
+	}
+}
@@ -1,81 +1,318 @@
 package main
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
 )
 
+// remapRule remaps a request. Exact rules replace the request path if it
+// equals from, regex rules rewrite the full request URL.
+type remapRule struct {
+	from    string
+	to      string
+	pattern *regexp.Regexp // Compiled pattern for regex rules, nil for exact rules
+}
+
+// compileRemaps compiles the configured remap entries. Regular expressions are
+// compiled once so invalid patterns are reported at load time.
+func compileRemaps(c *Config) ([]remapRule, error) {
+	rules := make([]remapRule, 0, len(c.Remap))
+	for _, remap := range c.Remap {
+		rule := remapRule{from: remap.From, to: remap.To}
+		if remap.Regex {
+			pattern, err := regexp.Compile(remap.From)
+			if err != nil {
+				return nil, fmt.Errorf("invalid remap pattern %q: %w", remap.From, err)
+			}
+			rule.pattern = pattern
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// applyRemaps applies all remap rules in the configured order.
+func applyRemaps(r *http.Request, rules []remapRule) {
+	for _, rule := range rules {
+		if rule.pattern == nil {
+			if r.URL.Path == rule.from {
+				slog.InfoContext(r.Context(), "Remapping request", "event", "override", "client", r.RemoteAddr, "host", r.Host, "path", r.URL.Path, "target", rule.to)
+				r.URL.Path = rule.to
+			}
+			continue
+		}
+
+		fullURL := requestFullURL(r)
+		if !rule.pattern.MatchString(fullURL) {
+			continue
+		}
+
+		remapped := rule.pattern.ReplaceAllString(fullURL, rule.to)
+		target, err := url.Parse(remapped)
+		if err != nil || target.Host == "" {
+			slog.WarnContext(r.Context(), "Remap produced invalid URL", "event", "override", "client", r.RemoteAddr, "url", fullURL, "target", remapped)
+			continue
+		}
+
+		slog.InfoContext(r.Context(), "Remapping request", "event", "override", "client", r.RemoteAddr, "url", fullURL, "target", remapped)
+		if target.Scheme != "" {
+			r.URL.Scheme = target.Scheme
+		}
+		r.URL.Host = target.Host
+		r.URL.Path = target.Path
+		r.URL.RawPath = target.RawPath
+		r.URL.RawQuery = target.RawQuery
+		r.Host = target.Host
+	}
+}
+
+// requestFullURL returns the absolute URL of a proxied request.
+func requestFullURL(r *http.Request) string {
+	u := *r.URL
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+
+	return u.String()
+}
+
+// hostOverrideRule rewrites requests for hosts matching pattern to host and
+// optionally prepends pathPrefix to the request path.
+type hostOverrideRule struct {
+	pattern    string // Exact host, leading-dot suffix (.example.com) or wildcard (ftp.*.debian.org)
+	host       string // Target host
+	pathPrefix string // Optional path prefix prepended to the request path, e.g. /ubuntu
+}
+
+// compileHostOverrides builds the ordered list of host override rules from the
+// configuration. Rules from overrides.hosts are checked first, exact hosts
+// before patterns and longer patterns before shorter ones. The Ubuntu and
+// Debian server overrides are expressed as host rules as well.
+func compileHostOverrides(c *Config) []hostOverrideRule {
+	patterns := make([]string, 0, len(c.Overrides.Hosts))
+	for pattern := range c.Overrides.Hosts {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		iExact, jExact := !isHostPattern(patterns[i]), !isHostPattern(patterns[j])
+		if iExact != jExact {
+			return iExact
+		}
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	rules := make([]hostOverrideRule, 0, len(patterns)+3)
+	for _, pattern := range patterns {
+		rules = append(rules, newHostOverrideRule(pattern, c.Overrides.Hosts[pattern]))
+	}
+
+	// *.archive.ubuntu.com and archive.ubuntu.com are mapped to the configured
+	// Ubuntu server.
+	if c.Overrides.UbuntuServer != "" {
+		rules = append(rules,
+			newHostOverrideRule("archive.ubuntu.com", c.Overrides.UbuntuServer),
+			newHostOverrideRule(".archive.ubuntu.com", c.Overrides.UbuntuServer),
+		)
+	}
+
+	// ftp.{country}.debian.org is mapped to the configured Debian server.
+	if c.Overrides.DebianServer != "" {
+		rules = append(rules, newHostOverrideRule("ftp.*.debian.org", c.Overrides.DebianServer))
+	}
+
+	return rules
+}
+
+// newHostOverrideRule creates a rule for the given pattern and target. The
+// target may contain a scheme which is ignored and a path which is used as
+// path prefix.
+func newHostOverrideRule(pattern, target string) hostOverrideRule {
+	host, pathPrefix := splitOverrideTarget(target)
+	return hostOverrideRule{
+		pattern:    strings.ToLower(strings.TrimSpace(pattern)),
+		host:       host,
+		pathPrefix: pathPrefix,
+	}
+}
+
+// splitOverrideTarget splits an override destination like
+// "mirror.example.com/ubuntu" into host and path prefix.
+func splitOverrideTarget(target string) (string, string) {
+	target = strings.TrimSpace(target)
+	target = strings.TrimPrefix(target, "http://")
+	target = strings.TrimPrefix(target, "https://")
+
+	host, pathPrefix, _ := strings.Cut(target, "/")
+	pathPrefix = strings.Trim(pathPrefix, "/")
+	if pathPrefix != "" {
+		pathPrefix = "/" + pathPrefix
+	}
+
+	return host, pathPrefix
+}
+
+// isHostPattern reports if the given host entry is a pattern instead of an
+// exact host name.
+func isHostPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, ".") || strings.Contains(pattern, "*")
+}
+
+// matchHostPattern checks if host matches the given pattern. A leading dot
+// matches all subdomains, a * matches any sequence of characters and all other
+// patterns must match exactly.
+func matchHostPattern(host, pattern string) bool {
+	switch {
+	case strings.Contains(pattern, "*"):
+		matched, err := path.Match(pattern, host)
+		return err == nil && matched
+	case strings.HasPrefix(pattern, "."):
+		return strings.HasSuffix(host, pattern)
+	default:
+		return host == pattern
+	}
+}
+
+// applyHostOverrides rewrites the request to the target of the first matching
+// host override rule.
+func applyHostOverrides(r *http.Request, rules []hostOverrideRule) {
+	host := normalizeHost(r.Host)
+
+	for _, rule := range rules {
+		if !matchHostPattern(host, rule.pattern) {
+			continue
+		}
+		// Requests already addressed to the target are left untouched.
+		if host == strings.ToLower(rule.host) {
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Overriding host", "event", "override", "client", r.RemoteAddr, "host", r.Host, "path", r.URL.Path, "target", rule.host+rule.pathPrefix)
+		r.Host = rule.host
+		r.URL.Host = rule.host
+		if rule.pathPrefix != "" {
+			r.URL.Path = rule.pathPrefix + r.URL.Path
+		}
+		return
+	}
+}
+
 // checkOverrides checks if the request URL matches any of the remap entries and
 // overrides the destination host if necessary.
-func checkOverrides(r *http.Request) {
+func (s *Server) checkOverrides(r *http.Request) {
 	// Check if the request URL matches any of the remap entries
-	for _, remap := range config.Remap {
-		if r.URL.Path == remap.From {
-			log.Printf("[INFO:OVERRIDE] Remapping %s to %s\n", r.URL.Path, remap.To)
-			r.URL.Path = remap.To
-		}
-	}
+	applyRemaps(r, s.config.remaps)
+
+	// Apply host based overrides including the Ubuntu and Debian server
+	// overrides.
+	applyHostOverrides(r, s.config.hostOverrides)
 
-	// Check if Ubuntu Server override is set
-	if config.Overrides.UbuntuServer != "" {
-		// The override destination may contain a path, so we need to split it
-		overrideParts := strings.Split(config.Overrides.UbuntuServer, "/")
-		overrideHost := overrideParts[0]
-		overridePath := strings.Join(overrideParts[1:], "/")
+	// The host deb.debian.org is a special case, as at this host all paths
+	// are available. Remap some paths to another host.
+	if s.config.Overrides.DebianServer != "" && r.Host == "deb.debian.org" {
+		overrideHost, overridePath := splitOverrideTarget(s.config.Overrides.DebianServer)
 
-		// If destination host is *.archive.ubuntu.com or archive.ubuntu.com, remap to the configured server
-		if strings.HasSuffix(r.Host, "archive.ubuntu.com") || strings.HasSuffix(r.Host, ".archive.ubuntu.com") && r.Host != overrideHost {
-			log.Printf("[INFO:OVERRIDE:UBUNTU] Overriding %s to %s\n", r.Host, config.Overrides.UbuntuServer)
+		if strings.HasPrefix(r.URL.Path, "/debian/") {
 			r.Host = overrideHost
 			r.URL.Host = overrideHost
 
-			// If the override path is set, append it to the request URL
+			slog.InfoContext(r.Context(), "Overriding Debian mirror", "event", "override", "client", r.RemoteAddr, "host", r.Host, "path", r.URL.Path, "target", s.config.Overrides.DebianServer)
 			if overridePath != "" {
 				r.URL.Path = overridePath + r.URL.Path
 			}
+		} else if strings.HasPrefix(r.URL.Path, "/debian-security/") ||
+			strings.HasPrefix(r.URL.Path, "/debian-security-debug/") ||
+			strings.HasPrefix(r.URL.Path, "/debian-debug/") ||
+			strings.HasPrefix(r.URL.Path, "/debian-ports/") {
+			r.Host = "security.debian.org"
+			r.URL.Host = "security.debian.org"
+
+			slog.InfoContext(r.Context(), "Overriding Debian mirror", "event", "override", "client", r.RemoteAddr, "host", r.Host, "path", r.URL.Path, "target", "security.debian.org")
 		}
 	}
+}
 
-	// Check if Debian Server override is set
-	if config.Overrides.DebianServer != "" {
-		// The override destination may contain a path, so we need to split it
-		overrideParts := strings.Split(config.Overrides.DebianServer, "/")
-		overrideHost := overrideParts[0]
-		overridePath := strings.Join(overrideParts[1:], "/")
+// pathMappingRule maps direct requests below prefix to an upstream host, like
+// apt-cacher-ng does for http://cache:3142/ubuntu/...
+type pathMappingRule struct {
+	prefix     string // Path prefix with leading and trailing slash, e.g. /ubuntu/
+	scheme     string // Scheme used for the upstream request
+	host       string // Target host
+	pathPrefix string // Path prefix replacing prefix, e.g. /ubuntu
+}
 
-		// If destination host is ftp.{country}.debian.org, remap to the configured server
-		if (strings.HasSuffix(r.Host, "debian.org") && strings.HasPrefix(r.Host, "ftp.")) && r.Host != overrideHost {
-			log.Printf("[INFO:OVERRIDE:DEBIAN] Overriding %s to %s\n", r.Host, config.Overrides.DebianServer)
-			r.Host = overrideHost
-			r.URL.Host = overrideHost
+// compilePathMappings builds the path mapping rules from the configuration.
+// Longer prefixes are checked first.
+func compilePathMappings(c *Config) []pathMappingRule {
+	rules := make([]pathMappingRule, 0, len(c.PathMappings))
+	for prefix, target := range c.PathMappings {
+		prefix = "/" + strings.Trim(strings.TrimSpace(prefix), "/") + "/"
+		if prefix == "//" {
+			continue
+		}
 
-			// If the override path is set, append it to the request URL
-			if overridePath != "" {
-				r.URL.Path = overridePath + r.URL.Path
-			}
+		scheme := "http"
+		if strings.HasPrefix(strings.TrimSpace(target), "https://") {
+			scheme = "https"
 		}
+		host, pathPrefix := splitOverrideTarget(target)
 
-		// The host deb.debian.org is a special case, as at this host all paths
-		// are available. Remap some paths to another host.
-		if r.Host == "deb.debian.org" {
-			if strings.HasPrefix(r.URL.Path, "/debian/") {
-				r.Host = overrideHost
-				r.URL.Host = overrideHost
-
-				log.Printf("[INFO:OVERRIDE:DEBIAN] Overriding %s to %s for path %s\n", r.Host, config.Overrides.DebianServer, r.URL.Path)
-				if overridePath != "" {
-					r.URL.Path = overridePath + r.URL.Path
-				}
-			} else if strings.HasPrefix(r.URL.Path, "/debian-security/") ||
-				strings.HasPrefix(r.URL.Path, "/debian-security-debug/") ||
-				strings.HasPrefix(r.URL.Path, "/debian-debug/") ||
-				strings.HasPrefix(r.URL.Path, "/debian-ports/") {
-				r.Host = "security.debian.org"
-				r.URL.Host = "security.debian.org"
-
-				log.Printf("[INFO:OVERRIDE:DEBIAN] Overriding %s to security.debian.org for path %s\n", r.Host, r.URL.Path)
-			}
+		rules = append(rules, pathMappingRule{
+			prefix:     prefix,
+			scheme:     scheme,
+			host:       host,
+			pathPrefix: pathPrefix,
+		})
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		if len(rules[i].prefix) != len(rules[j].prefix) {
+			return len(rules[i].prefix) > len(rules[j].prefix)
+		}
+		return rules[i].prefix < rules[j].prefix
+	})
+
+	return rules
+}
+
+// applyPathMappings rewrites a direct request to the proxy (e.g.
+// GET /ubuntu/dists/noble/InRelease) to the upstream host of the first
+// matching path mapping. Requests in proxy form, which already contain the
+// target host, are left untouched. It reports if the request was rewritten.
+func applyPathMappings(r *http.Request, rules []pathMappingRule) bool {
+	if r.URL.Host != "" {
+		return false
+	}
+
+	for _, rule := range rules {
+		rest, ok := strings.CutPrefix(r.URL.Path, rule.prefix)
+		if !ok {
+			continue
 		}
+
+		slog.InfoContext(r.Context(), "Mapping path", "event", "override", "client", r.RemoteAddr, "host", r.Host, "path", r.URL.Path, "target", rule.host+rule.pathPrefix+"/"+rest)
+		r.URL.Scheme = rule.scheme
+		r.URL.Host = rule.host
+		r.URL.Path = rule.pathPrefix + "/" + rest
+		r.URL.RawPath = ""
+		r.Host = rule.host
+		return true
 	}
+
+	return false
 }
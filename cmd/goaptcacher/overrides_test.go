@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSplitOverrideTarget(t *testing.T) {
+	tcs := []struct {
+		target     string
+		wantHost   string
+		wantPrefix string
+	}{
+		{"mirror.example.com", "mirror.example.com", ""},
+		{"mirror.example.com/ubuntu", "mirror.example.com", "/ubuntu"},
+		{"mirror.example.com/ubuntu/", "mirror.example.com", "/ubuntu"},
+		{"http://mirror.example.com/debian", "mirror.example.com", "/debian"},
+	}
+
+	for _, tc := range tcs {
+		host, prefix := splitOverrideTarget(tc.target)
+		if host != tc.wantHost || prefix != tc.wantPrefix {
+			t.Fatalf("splitOverrideTarget(%q) = (%q, %q), want (%q, %q)", tc.target, host, prefix, tc.wantHost, tc.wantPrefix)
+		}
+	}
+}
+
+func TestMatchHostPattern(t *testing.T) {
+	tcs := []struct {
+		host    string
+		pattern string
+		want    bool
+	}{
+		{"archive.ubuntu.com", "archive.ubuntu.com", true},
+		{"de.archive.ubuntu.com", "archive.ubuntu.com", false},
+		{"de.archive.ubuntu.com", ".archive.ubuntu.com", true},
+		{"archive.ubuntu.com", ".archive.ubuntu.com", false},
+		{"ftp.de.debian.org", "ftp.*.debian.org", true},
+		{"deb.debian.org", "ftp.*.debian.org", false},
+	}
+
+	for _, tc := range tcs {
+		if got := matchHostPattern(tc.host, tc.pattern); got != tc.want {
+			t.Fatalf("matchHostPattern(%q, %q) = %v, want %v", tc.host, tc.pattern, got, tc.want)
+		}
+	}
+}
+
+func TestCheckOverridesHostMap(t *testing.T) {
+	cfg := &Config{}
+	cfg.Overrides.Hosts = map[string]string{
+		"packages.vendor.com":    "mirror.example.com/vendor",
+		".cdn.vendor.com":        "cdn-mirror.example.com",
+		"special.cdn.vendor.com": "special.example.com",
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() returned error: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	tcs := []struct {
+		url      string
+		wantHost string
+		wantPath string
+	}{
+		{"http://packages.vendor.com/dists/stable/InRelease", "mirror.example.com", "/vendor/dists/stable/InRelease"},
+		{"http://eu.cdn.vendor.com/pool/a.deb", "cdn-mirror.example.com", "/pool/a.deb"},
+		{"http://special.cdn.vendor.com/pool/a.deb", "special.example.com", "/pool/a.deb"},
+		{"http://packages.vendor.com:80/pool/a.deb", "mirror.example.com", "/vendor/pool/a.deb"},
+		{"http://other.example.org/pool/a.deb", "other.example.org", "/pool/a.deb"},
+	}
+
+	for _, tc := range tcs {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		s.checkOverrides(r)
+		if r.Host != tc.wantHost || r.URL.Host != tc.wantHost || r.URL.Path != tc.wantPath {
+			t.Fatalf("checkOverrides(%q) host=%q url.host=%q path=%q, want host=%q path=%q", tc.url, r.Host, r.URL.Host, r.URL.Path, tc.wantHost, tc.wantPath)
+		}
+	}
+}
+
+func TestCheckOverridesDistributionServers(t *testing.T) {
+	cfg := &Config{}
+	cfg.Overrides.UbuntuServer = "ubuntu.mirror.example.com/ubuntu"
+	cfg.Overrides.DebianServer = "debian.mirror.example.com"
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() returned error: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	tcs := []struct {
+		url      string
+		wantHost string
+		wantPath string
+	}{
+		{"http://archive.ubuntu.com/ubuntu/dists/noble/InRelease", "ubuntu.mirror.example.com", "/ubuntu/ubuntu/dists/noble/InRelease"},
+		{"http://at.archive.ubuntu.com/ubuntu/pool/a.deb", "ubuntu.mirror.example.com", "/ubuntu/ubuntu/pool/a.deb"},
+		{"http://ftp.de.debian.org/debian/pool/a.deb", "debian.mirror.example.com", "/debian/pool/a.deb"},
+		{"http://deb.debian.org/debian/pool/a.deb", "debian.mirror.example.com", "/debian/pool/a.deb"},
+		{"http://deb.debian.org/debian-security/pool/a.deb", "security.debian.org", "/debian-security/pool/a.deb"},
+		{"http://security.ubuntu.com/ubuntu/pool/a.deb", "security.ubuntu.com", "/ubuntu/pool/a.deb"},
+	}
+
+	for _, tc := range tcs {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		s.checkOverrides(r)
+		if r.Host != tc.wantHost || r.URL.Path != tc.wantPath {
+			t.Fatalf("checkOverrides(%q) host=%q path=%q, want host=%q path=%q", tc.url, r.Host, r.URL.Path, tc.wantHost, tc.wantPath)
+		}
+	}
+}
+
+func TestCheckOverridesRegexRemap(t *testing.T) {
+	cfg := &Config{}
+	cfg.Remap = []RemapEntry{
+		{From: `^http://([a-z]+)\.archive\.example\.com/(.*)$`, To: "http://mirror.example.com/$1/$2", Regex: true},
+		{From: "/old/Release", To: "/new/Release"},
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() returned error: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "http://de.archive.example.com/ubuntu/dists/noble/InRelease", nil)
+	s.checkOverrides(r)
+	if r.Host != "mirror.example.com" || r.URL.Host != "mirror.example.com" {
+		t.Fatalf("host = %q / %q, want mirror.example.com", r.Host, r.URL.Host)
+	}
+	if r.URL.Path != "/de/ubuntu/dists/noble/InRelease" {
+		t.Fatalf("path = %q, want %q", r.URL.Path, "/de/ubuntu/dists/noble/InRelease")
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://repo.example.com/old/Release", nil)
+	s.checkOverrides(r)
+	if r.Host != "repo.example.com" || r.URL.Path != "/new/Release" {
+		t.Fatalf("exact remap produced host=%q path=%q", r.Host, r.URL.Path)
+	}
+}
+
+func TestReadConfigRejectsInvalidRemapPattern(t *testing.T) {
+	path := writeTempConfig(t, `
+remap:
+  - from: "(unclosed"
+    to: "http://example.com/"
+    regex: true
+`)
+
+	if _, err := ReadConfig(path); err == nil {
+		t.Fatalf("expected ReadConfig() to fail for invalid remap pattern")
+	}
+}
+
+func TestReadConfigKeepsRemapCaptureReferences(t *testing.T) {
+	path := writeTempConfig(t, `
+remap:
+  - from: "^http://(?P<host>[a-z.]+)/(.*)$"
+    to: "http://mirror.example.com/${host}/$2"
+    regex: true
+`)
+
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() returned error: %v", err)
+	}
+	if cfg.Remap[0].To != "http://mirror.example.com/${host}/$2" {
+		t.Fatalf("Remap[0].To = %q, want capture references to be kept", cfg.Remap[0].To)
+	}
+}
+
+func TestApplyPathMappings(t *testing.T) {
+	cfg := &Config{PathMappings: map[string]string{
+		"/ubuntu/":         "archive.ubuntu.com/ubuntu",
+		"debian":           "deb.debian.org/debian",
+		"/debian/security": "https://security.debian.org/debian-security",
+		"/docker":          "download.docker.com",
+	}}
+	rules := compilePathMappings(cfg)
+
+	tcs := []struct {
+		name       string
+		url        string
+		wantMapped bool
+		wantURL    string
+	}{
+		{"ubuntu", "/ubuntu/dists/noble/InRelease", true, "http://archive.ubuntu.com/ubuntu/dists/noble/InRelease"},
+		{"longest prefix wins", "/debian/security/dists/bookworm-security/InRelease", true, "https://security.debian.org/debian-security/dists/bookworm-security/InRelease"},
+		{"debian", "/debian/dists/bookworm/InRelease", true, "http://deb.debian.org/debian/dists/bookworm/InRelease"},
+		{"without target path", "/docker/linux/ubuntu/dists/noble/InRelease", true, "http://download.docker.com/linux/ubuntu/dists/noble/InRelease"},
+		{"prefix on label boundary only", "/ubuntu-ports/dists/noble/InRelease", false, ""},
+		{"unmapped", "/other/dists/noble/InRelease", false, ""},
+		{"proxy form is untouched", "http://archive.ubuntu.com/ubuntu/dists/noble/InRelease", false, ""},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+			if strings.HasPrefix(tc.url, "/") {
+				r.URL.Host = ""
+			}
+			before := r.URL.String()
+
+			mapped := applyPathMappings(r, rules)
+			if mapped != tc.wantMapped {
+				t.Fatalf("applyPathMappings() = %v, want %v", mapped, tc.wantMapped)
+			}
+			if !mapped {
+				if r.URL.String() != before {
+					t.Fatalf("unmapped request changed from %q to %q", before, r.URL.String())
+				}
+				return
+			}
+			if r.URL.String() != tc.wantURL {
+				t.Fatalf("URL = %q, want %q", r.URL.String(), tc.wantURL)
+			}
+			if r.Host != r.URL.Host {
+				t.Fatalf("Host = %q, want %q", r.Host, r.URL.Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile writes the process ID to the configured PID file. A PID file
+// of another process which is still running is replaced, but reported, as a
+// second instance may have been started by accident. If a user is
+// configured, the PID file and its directory are owned by this user, so the
+// file can still be removed after dropping privileges.
+func writePIDFile() error {
+	path := config.PIDFile
+	if path == "" {
+		return nil
+	}
+
+	var owner *credentials
+	if config.User != "" {
+		creds, err := resolveCredentials(config.User, config.Group)
+		if err != nil {
+			return err
+		}
+		if err := preparePIDDirectory(filepath.Dir(path), creds); err != nil {
+			return err
+		}
+		owner = &creds
+	}
+
+	if pid, ok := readPIDFile(path); ok && pid != os.Getpid() && processRunning(pid) {
+		slog.Warn("PID file belongs to a running process, another instance may be running", "event", "startup", "path", path, "pid", pid)
+	}
+
+	// Write to a temporary file first, so init scripts never read a partial
+	// PID.
+	tmpPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := os.WriteFile(tmpPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return err
+	}
+	if owner != nil {
+		if err := os.Chown(tmpPath, owner.uid, owner.gid); err != nil {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// preparePIDDirectory makes sure dir is owned by the user the process switches
+// to, as removing the PID file requires write access to its directory. A
+// missing directory is created for the user. The ownership of an existing
+// directory isn't changed, as it may be shared like /run itself.
+func preparePIDDirectory(dir string, creds credentials) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		return os.Chown(dir, creds.uid, creds.gid)
+	}
+
+	uid, err := fileOwner(dir)
+	if err != nil {
+		return err
+	}
+	if uid != creds.uid {
+		return fmt.Errorf("directory %s of the PID file isn't owned by user %s, use a dedicated directory like /run/goaptcacher", dir, config.User)
+	}
+	return nil
+}
+
+// removePIDFile removes the PID file, unless it was taken over by another
+// process in the meantime.
+func removePIDFile() {
+	if config == nil || config.PIDFile == "" {
+		return
+	}
+	path := config.PIDFile
+
+	if pid, ok := readPIDFile(path); !ok || pid != os.Getpid() {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		slog.Warn("Error removing PID file", "event", "shutdown", "path", path, "error", err)
+	}
+}
+
+// readPIDFile returns the process ID stored in the PID file at path.
+func readPIDFile(path string) (int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
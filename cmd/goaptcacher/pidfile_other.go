@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// processRunning reports if a process with pid exists.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	_ = process.Release()
+	return true
+}
+
+// fileOwner isn't supported on this platform.
+func fileOwner(string) (int, error) {
+	return 0, errors.New("file ownership is not supported on this platform")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWriteAndRemovePIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goaptcacher.pid")
+	withTestConfig(t, &Config{PIDFile: path})
+
+	if err := writePIDFile(); err != nil {
+		t.Fatalf("writePIDFile() error = %v", err)
+	}
+	if pid, ok := readPIDFile(path); !ok || pid != os.Getpid() {
+		t.Fatalf("PID file contains %d, want %d", pid, os.Getpid())
+	}
+
+	removePIDFile()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected PID file to be removed, stat error = %v", err)
+	}
+}
+
+func TestWritePIDFileReplacesStaleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goaptcacher.pid")
+	withTestConfig(t, &Config{PIDFile: path})
+
+	// The parent process is running, so a warning is logged, but the file is
+	// replaced anyway.
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())+"\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if !processRunning(os.Getppid()) {
+		t.Fatal("expected the parent process to be running")
+	}
+
+	if err := writePIDFile(); err != nil {
+		t.Fatalf("writePIDFile() error = %v", err)
+	}
+	if pid, _ := readPIDFile(path); pid != os.Getpid() {
+		t.Fatalf("PID file contains %d, want %d", pid, os.Getpid())
+	}
+}
+
+func TestRemovePIDFileKeepsFileOfOtherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goaptcacher.pid")
+	withTestConfig(t, &Config{PIDFile: path})
+
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())+"\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	removePIDFile()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected PID file of another process to be kept: %v", err)
+	}
+}
+
+// lookupUnprivilegedUser returns the credentials of the nobody user, which
+// files can only be handed over to when running as root.
+func lookupUnprivilegedUser(t *testing.T) credentials {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("changing file ownership requires root")
+	}
+	creds, err := resolveCredentials("nobody", "")
+	if err != nil {
+		t.Skipf("user nobody unknown: %v", err)
+	}
+	return creds
+}
+
+func TestWritePIDFileOwnedByUser(t *testing.T) {
+	creds := lookupUnprivilegedUser(t)
+	path := filepath.Join(t.TempDir(), "goaptcacher", "goaptcacher.pid")
+	withTestConfig(t, &Config{PIDFile: path, User: "nobody"})
+
+	if err := writePIDFile(); err != nil {
+		t.Fatalf("writePIDFile() error = %v", err)
+	}
+	for _, p := range []string{path, filepath.Dir(path)} {
+		uid, err := fileOwner(p)
+		if err != nil {
+			t.Fatalf("fileOwner(%s) error = %v", p, err)
+		}
+		if uid != creds.uid {
+			t.Fatalf("%s is owned by %d, want %d", p, uid, creds.uid)
+		}
+	}
+
+	removePIDFile()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected PID file to be removed, stat error = %v", err)
+	}
+}
+
+func TestWritePIDFileRejectsDirectoryOfOtherUser(t *testing.T) {
+	lookupUnprivilegedUser(t)
+	path := filepath.Join(t.TempDir(), "goaptcacher.pid")
+	withTestConfig(t, &Config{PIDFile: path, User: "nobody"})
+
+	if err := writePIDFile(); err == nil {
+		t.Fatal("expected error for directory which isn't owned by the user")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected no PID file to be written, stat error = %v", err)
+	}
+}
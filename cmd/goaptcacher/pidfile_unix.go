@@ -0,0 +1,30 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// processRunning reports if a process with pid exists. A process of another
+// user, which can't be signaled, counts as running.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// fileOwner returns the user ID of the owner of path.
+func fileOwner(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("owner of %s is unknown", path)
+	}
+	return int(stat.Uid), nil
+}
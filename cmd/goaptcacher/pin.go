@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// httpServeAPIPin pins or unpins the file given by the url parameter, pinned
+// files are never expired or removed after source verification. With
+// prefix=1, all cached files whose URL starts with url are changed. Forms of
+// the web interface pass a redirect target to return to the page afterwards.
+func httpServeAPIPin(w http.ResponseWriter, r *http.Request, pinned bool) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeManagement(w, r, managementRemoteAllowed()) {
+		return
+	}
+
+	target, err := url.Parse(r.FormValue("url"))
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	target.Host = fscache.CanonicalHost(target.Scheme, target.Host)
+	protocol := fscache.DetermineProtocolFromURL(target)
+
+	var count int
+	if prefix := r.FormValue("prefix"); prefix == "1" || prefix == "true" {
+		if pinned {
+			count, err = cache.PinPrefix(protocol, target.Host, target.Path)
+		} else {
+			count, err = cache.UnpinPrefix(protocol, target.Host, target.Path)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error changing pins", "event", "pin", "client", r.RemoteAddr, "host", target.Host, "prefix", target.Path, "error", err)
+			http.Error(w, "Error changing pins", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		var changed bool
+		if pinned {
+			changed = cache.Pin(protocol, target.Host, target.Path)
+		} else {
+			changed = cache.Unpin(protocol, target.Host, target.Path)
+		}
+		if !changed {
+			http.Error(w, "File not cached", http.StatusNotFound)
+			return
+		}
+		count = 1
+	}
+	slog.InfoContext(r.Context(), "Changed pins", "event", "pin", "client", r.RemoteAddr, "host", target.Host, "path", target.Path, "pinned", pinned, "files", count)
+
+	if redirect := r.FormValue("redirect"); strings.HasPrefix(redirect, "/_goaptcacher/") {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"url": target.String(), "pinned": pinned, "files": count})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHTTPServeAPIPin(t *testing.T) {
+	withTestConfig(t, &Config{})
+	testCache := withTestFiles(t, map[string]int{
+		"http://deb.debian.org/debian/pool/main/a/a.deb":     100,
+		"http://deb.debian.org/debian/pool/main/a/a-doc.deb": 50,
+		"http://deb.debian.org/debian/pool/main/b/b.deb":     10,
+	})
+
+	post := func(path, remoteAddr string, form url.Values) *httptest.ResponseRecorder {
+		form.Set("csrf_token", csrfToken)
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/"+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		handleIndexRequests(rr, req)
+		return rr
+	}
+
+	if rr := post("pin", "192.0.2.10:12345", url.Values{"url": {"http://deb.debian.org/debian/pool/main/b/b.deb"}}); rr.Code != http.StatusForbidden {
+		t.Fatalf("remote pin status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if rr := post("pin", "127.0.0.1:12345", url.Values{"url": {"http://deb.debian.org/debian/pool/main/x/x.deb"}}); rr.Code != http.StatusNotFound {
+		t.Fatalf("pin of uncached file status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	if rr := post("pin", "127.0.0.1:12345", url.Values{"url": {"http://deb.debian.org/debian/pool/main/b/b.deb"}}); rr.Code != http.StatusOK {
+		t.Fatalf("pin status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if !testCache.IsPinned(0, "deb.debian.org", "/debian/pool/main/b/b.deb") {
+		t.Fatalf("expected file to be pinned")
+	}
+
+	rr := post("pin", "127.0.0.1:12345", url.Values{"url": {"http://deb.debian.org/debian/pool/main/a/"}, "prefix": {"1"}})
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"files":2`) {
+		t.Fatalf("prefix pin status = %d, body = %q, want 2 files", rr.Code, rr.Body.String())
+	}
+
+	// The cache browser shows the pins and offers to unpin.
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/cache", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+	if !strings.Contains(rr.Body.String(), "/_goaptcacher/api/unpin") {
+		t.Fatalf("cache browser doesn't offer to unpin files")
+	}
+
+	rr = post("unpin", "127.0.0.1:12345", url.Values{
+		"url":      {"http://deb.debian.org/debian/pool/main/b/b.deb"},
+		"redirect": {"/_goaptcacher/cache?page=1"},
+	})
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/_goaptcacher/cache?page=1" {
+		t.Fatalf("unpin status = %d, location = %q, want redirect to the cache browser", rr.Code, rr.Header().Get("Location"))
+	}
+	if testCache.IsPinned(0, "deb.debian.org", "/debian/pool/main/b/b.deb") {
+		t.Fatalf("expected file to be unpinned")
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+const (
+	// prefetchMaxURLs is the maximum number of URLs of a single prefetch job.
+	prefetchMaxURLs = 10000
+	// prefetchMaxRequestSize is the maximum size of a prefetch request body.
+	prefetchMaxRequestSize = 1 << 20
+	// prefetchRetainJobs is the number of finished jobs kept for status
+	// queries.
+	prefetchRetainJobs = 100
+	// prefetchMaxManifestSize is the maximum size of an imported manifest.
+	prefetchMaxManifestSize = 256 << 20
+)
+
+// prefetchRequest is the body of a POST request to the prefetch API. Either a
+// list of URLs or a repository with its distribution is given. For a
+// repository, the release files and package indices are prefetched.
+type prefetchRequest struct {
+	URLs          []string `json:"urls"`
+	Repository    string   `json:"repository"`    // Base URL of the repository, e.g. http://deb.debian.org/debian
+	Dist          string   `json:"dist"`          // Distribution, e.g. bookworm
+	Components    []string `json:"components"`    // Components, default: main
+	Architectures []string `json:"architectures"` // Architectures, default: amd64
+}
+
+// prefetchJob tracks the progress of a prefetch job.
+type prefetchJob struct {
+	mux    sync.Mutex
+	cancel context.CancelFunc // Stops the job
+
+	ID         string            `json:"id"`
+	State      string            `json:"state"`  // "running", "done" or "cancelled"
+	Paused     bool              `json:"paused"` // Waiting for client downloads to finish
+	Total      int               `json:"total"`
+	Completed  int               `json:"completed"`
+	Failed     int               `json:"failed"`
+	Skipped    int               `json:"skipped"`          // Files which were already cached
+	Bytes      int64             `json:"bytes"`            // Bytes of the completed files
+	Errors     map[string]string `json:"errors,omitempty"` // Failed URLs and the reason
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+}
+
+// prefetchJobs holds the running and the most recently finished jobs.
+var prefetchJobs = struct {
+	sync.Mutex
+	byID     map[string]*prefetchJob
+	finished []string // IDs of finished jobs, oldest first
+}{byID: map[string]*prefetchJob{}}
+
+// handlePrefetchRequests serves the prefetch API below /api/prefetch and the
+// cache manifest at /api/manifest. It returns false if the path isn't part of
+// the API.
+func handlePrefetchRequests(w http.ResponseWriter, r *http.Request, requestedPath string) bool {
+	if requestedPath != "/api/prefetch" && requestedPath != "/api/manifest" && !strings.HasPrefix(requestedPath, "/api/prefetch/") {
+		return false
+	}
+
+	if !config.Prefetch.Enable {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return true
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		if !authorizeManagement(w, r, config.Prefetch.AllowRemote) {
+			return true
+		}
+	} else if !config.Prefetch.AllowRemote && !isLocalRequest(r) && !hasManagementToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+
+	if requestedPath == "/api/manifest" {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			if err := cache.ExportManifest(w); err != nil {
+				slog.ErrorContext(r.Context(), "Error exporting manifest", "event", "prefetch", "client", r.RemoteAddr, "error", err)
+			}
+		case http.MethodPost:
+			importManifest(w, r)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return true
+	}
+
+	if requestedPath == "/api/prefetch" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+		startPrefetchJob(w, r)
+		return true
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	prefetchJobs.Lock()
+	job, ok := prefetchJobs.byID[strings.TrimPrefix(requestedPath, "/api/prefetch/")]
+	prefetchJobs.Unlock()
+	if !ok {
+		http.Error(w, "Unknown prefetch job", http.StatusNotFound)
+		return true
+	}
+
+	// Downloads in progress are aborted when they receive the next data,
+	// the job is finished once they stopped.
+	if r.Method == http.MethodDelete {
+		job.cancel()
+		slog.InfoContext(r.Context(), "Cancelled prefetch job", "event", "prefetch", "client", r.RemoteAddr, "job", job.ID)
+	}
+
+	job.mux.Lock()
+	data, err := json.Marshal(job)
+	job.mux.Unlock()
+	if err != nil {
+		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+	return true
+}
+
+// startPrefetchJob parses the prefetch request and starts the download in the
+// background. The client receives the job ID to query the progress.
+func startPrefetchJob(w http.ResponseWriter, r *http.Request) {
+	var req prefetchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, prefetchMaxRequestSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	urls, err := req.expand()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	startPrefetch(w, r, urls, 0)
+}
+
+// importManifest starts a prefetch job for all files of a manifest exported by
+// another cache. Files which are already cached with a matching hash are
+// skipped.
+func importManifest(w http.ResponseWriter, r *http.Request) {
+	entries, err := fscache.ReadManifest(io.LimitReader(r.Body, prefetchMaxManifestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	urls := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if cache.HasManifestEntry(entry) {
+			continue
+		}
+		urls = append(urls, entry.URL)
+	}
+
+	startPrefetch(w, r, urls, len(entries)-len(urls))
+}
+
+// startPrefetch starts a prefetch job for the given URLs and responds with the
+// job ID. skipped is the number of files which didn't need to be fetched.
+func startPrefetch(w http.ResponseWriter, r *http.Request, urls []string, skipped int) {
+	job := &prefetchJob{
+		ID:        cache.GenerateUUID(),
+		State:     "running",
+		Total:     len(urls),
+		Skipped:   skipped,
+		Errors:    map[string]string{},
+		StartedAt: time.Now().UTC(),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job.cancel = cancel
+
+	prefetchJobs.Lock()
+	prefetchJobs.byID[job.ID] = job
+	prefetchJobs.Unlock()
+
+	slog.InfoContext(r.Context(), "Started prefetch job", "event", "prefetch", "client", r.RemoteAddr, "job", job.ID, "urls", len(urls))
+	go job.run(ctx, urls, config.Prefetch.Concurrency)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", "/_goaptcacher/api/prefetch/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"id":         job.ID,
+		"total":      len(urls),
+		"skipped":    skipped,
+		"status_url": "/_goaptcacher/api/prefetch/" + job.ID,
+	})
+}
+
+// expand returns the URLs to prefetch. URLs which aren't valid HTTP(S) URLs
+// are rejected.
+func (req prefetchRequest) expand() ([]string, error) {
+	urls := req.URLs
+
+	if req.Repository != "" {
+		if req.Dist == "" {
+			return nil, errors.New("dist is required together with repository")
+		}
+
+		components := req.Components
+		if len(components) == 0 {
+			components = []string{"main"}
+		}
+		architectures := req.Architectures
+		if len(architectures) == 0 {
+			architectures = []string{"amd64"}
+		}
+
+		base := strings.TrimSuffix(req.Repository, "/") + "/dists/" + req.Dist + "/"
+		urls = append(urls, base+"InRelease", base+"Release", base+"Release.gpg")
+		for _, component := range components {
+			for _, arch := range architectures {
+				indexBase := base + component + "/binary-" + arch + "/"
+				urls = append(urls, indexBase+"Packages.xz", indexBase+"Packages.gz")
+			}
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil, errors.New("no URLs to prefetch, set urls or repository and dist")
+	}
+	if len(urls) > prefetchMaxURLs {
+		return nil, fmt.Errorf("too many URLs, at most %d are allowed", prefetchMaxURLs)
+	}
+
+	for _, rawURL := range urls {
+		parsed, err := url.Parse(rawURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q", rawURL)
+		}
+	}
+
+	return urls, nil
+}
+
+// run downloads all URLs into the cache with the given number of parallel
+// downloads, as far as the scheduler allows, until ctx is cancelled.
+func (job *prefetchJob) run(ctx context.Context, urls []string, concurrency int) {
+	defer job.cancel()
+	scheduler := config.prefetchScheduler
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+
+	for range max(concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rawURL := range queue {
+				written, err := prefetchURL(ctx, scheduler, rawURL)
+				if ctx.Err() != nil {
+					// Aborted downloads are neither completed nor failed.
+					continue
+				}
+
+				job.mux.Lock()
+				job.Completed++
+				job.Bytes += written
+				if err != nil {
+					job.Failed++
+					job.Errors[rawURL] = err.Error()
+				}
+				job.mux.Unlock()
+			}
+		}()
+	}
+
+	paused := func(paused bool) {
+		job.mux.Lock()
+		job.Paused = paused
+		job.mux.Unlock()
+	}
+queueing:
+	for _, rawURL := range urls {
+		if scheduler.waitForClients(ctx, paused) != nil {
+			break
+		}
+		select {
+		case queue <- rawURL:
+		case <-ctx.Done():
+			break queueing
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	job.mux.Lock()
+	finished := time.Now().UTC()
+	job.State = "done"
+	if ctx.Err() != nil {
+		job.State = "cancelled"
+	}
+	job.FinishedAt = &finished
+	slog.Info("Prefetch job finished", "event", "prefetch", "job", job.ID, "state", job.State, "urls", job.Total, "completed", job.Completed, "failed", job.Failed)
+	job.mux.Unlock()
+
+	// Forget the oldest finished jobs.
+	prefetchJobs.Lock()
+	prefetchJobs.finished = append(prefetchJobs.finished, job.ID)
+	for len(prefetchJobs.finished) > prefetchRetainJobs {
+		delete(prefetchJobs.byID, prefetchJobs.finished[0])
+		prefetchJobs.finished = prefetchJobs.finished[1:]
+	}
+	prefetchJobs.Unlock()
+}
+
+// prefetchURL downloads a single URL into the cache and returns the size of
+// the response. The request takes the same path as a client request, so
+// overrides apply and concurrent client requests for the same file share the
+// download.
+func prefetchURL(ctx context.Context, scheduler *prefetchScheduler, rawURL string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.RemoteAddr = "prefetch"
+
+	lists := config.currentDomains()
+	if matchDomainList(req.Host, lists.denied) || !matchDomainList(req.Host, lists.domains) {
+		return 0, errors.New("domain not allowed for caching")
+	}
+
+	if err := scheduler.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer scheduler.release()
+
+	writer := &prefetchResponseWriter{header: make(http.Header), ctx: ctx, scheduler: scheduler}
+	newServer(config, cache).handleHTTP(writer, req)
+
+	if writer.aborted {
+		return writer.written, errors.New("incomplete download")
+	}
+	if writer.status != 0 && writer.status != http.StatusOK {
+		return writer.written, fmt.Errorf("unexpected status %d", writer.status)
+	}
+	return writer.written, nil
+}
+
+// prefetchResponseWriter discards the response of a prefetched file and only
+// records the status code and size. Writes are slowed down to the bandwidth
+// of the scheduler; once ctx is cancelled, they fail and abort the download.
+type prefetchResponseWriter struct {
+	header    http.Header
+	status    int
+	written   int64
+	aborted   bool // The download was incomplete
+	ctx       context.Context
+	scheduler *prefetchScheduler
+}
+
+func (w *prefetchResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *prefetchResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Abort records that the download was incomplete.
+func (w *prefetchResponseWriter) Abort() {
+	w.aborted = true
+}
+
+func (w *prefetchResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if err := w.scheduler.throttle(w.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	w.written += int64(len(p))
+	return len(p), nil
+}
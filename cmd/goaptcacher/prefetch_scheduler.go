@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPrefetchPauseActiveDownloads is the number of client downloads at
+// which prefetch jobs pause if nothing else is configured.
+const defaultPrefetchPauseActiveDownloads = 8
+
+// prefetchPauseInterval is the interval a paused prefetch job checks the
+// number of client downloads in.
+var prefetchPauseInterval = time.Second
+
+// prefetchScheduler lets prefetch jobs yield to client traffic: all jobs
+// share prefetch.max_downloads parallel downloads and prefetch.bytes_per_second
+// of bandwidth, and no new download is started while clients download
+// prefetch.pause_active_downloads or more files.
+type prefetchScheduler struct {
+	slots          chan struct{} // Downloads of all jobs, nil if unlimited
+	bytesPerSecond float64       // 0 if unlimited
+	pauseAt        int           // 0 if prefetching never pauses
+
+	active atomic.Int64 // Prefetch downloads in progress
+
+	bandwidthMux sync.Mutex
+	bandwidth    tokenBucket
+}
+
+// newPrefetchScheduler creates the scheduler for the prefetch settings.
+func newPrefetchScheduler(c *Config) (*prefetchScheduler, error) {
+	settings := c.Prefetch
+	if settings.MaxDownloads < 0 || settings.BytesPerSecond < 0 {
+		return nil, fmt.Errorf("prefetch: max_downloads and bytes_per_second must not be negative")
+	}
+
+	s := &prefetchScheduler{
+		bytesPerSecond: float64(settings.BytesPerSecond),
+		pauseAt:        settings.PauseActiveDownloads,
+	}
+	if settings.MaxDownloads > 0 {
+		s.slots = make(chan struct{}, settings.MaxDownloads)
+	}
+	// The bandwidth may be used in bursts of up to one second.
+	s.bandwidth = tokenBucket{tokens: s.bytesPerSecond, last: time.Now()}
+	return s, nil
+}
+
+// waitForClients blocks while clients download at least pause_active_downloads
+// files. paused is called with true when the wait starts and with false when
+// it ends. An error is returned if ctx is cancelled.
+func (s *prefetchScheduler) waitForClients(ctx context.Context, paused func(bool)) error {
+	if s == nil || s.pauseAt <= 0 {
+		return ctx.Err()
+	}
+
+	waiting := false
+	defer func() {
+		if waiting {
+			paused(false)
+		}
+	}()
+	for s.clientDownloads() >= s.pauseAt {
+		if !waiting {
+			waiting = true
+			paused(true)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(prefetchPauseInterval):
+		}
+	}
+	return ctx.Err()
+}
+
+// clientDownloads returns the number of downloads which aren't prefetched.
+func (s *prefetchScheduler) clientDownloads() int {
+	if cache == nil {
+		return 0
+	}
+	return max(cache.ActiveDownloads()-int(s.active.Load()), 0)
+}
+
+// acquire reserves one of the downloads shared by all jobs. It has to be
+// released with release.
+func (s *prefetchScheduler) acquire(ctx context.Context) error {
+	if s == nil {
+		return ctx.Err()
+	}
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.active.Add(1)
+	return nil
+}
+
+// release frees the download reserved by acquire.
+func (s *prefetchScheduler) release() {
+	if s == nil {
+		return
+	}
+	s.active.Add(-1)
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// throttle takes n bytes of the shared bandwidth and waits until they are
+// available.
+func (s *prefetchScheduler) throttle(ctx context.Context, n int) error {
+	if s == nil || s.bytesPerSecond <= 0 {
+		return nil
+	}
+
+	s.bandwidthMux.Lock()
+	s.bandwidth.refill(time.Now(), s.bytesPerSecond, s.bytesPerSecond)
+	s.bandwidth.tokens -= float64(n)
+	wait := time.Duration(-s.bandwidth.tokens / s.bytesPerSecond * float64(time.Second))
+	s.bandwidthMux.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// prefetchDownloads returns the number of prefetch downloads in progress.
+func prefetchDownloads() int64 {
+	if config == nil || config.prefetchScheduler == nil {
+		return 0
+	}
+	return config.prefetchScheduler.active.Load()
+}
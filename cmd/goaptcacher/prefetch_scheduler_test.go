@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPrefetchTestConfig enables prefetching with the scheduler built from
+// the adjusted settings.
+func newPrefetchTestConfig(t *testing.T, adjust func(cfg *Config)) {
+	t.Helper()
+
+	cfg := &Config{Domains: []string{"deb.debian.org"}}
+	cfg.Prefetch.Enable = true
+	cfg.Prefetch.Concurrency = 1
+	adjust(cfg)
+
+	scheduler, err := newPrefetchScheduler(cfg)
+	if err != nil {
+		t.Fatalf("newPrefetchScheduler() error = %v", err)
+	}
+	cfg.prefetchScheduler = scheduler
+	withTestConfig(t, cfg)
+
+	old := prefetchPauseInterval
+	prefetchPauseInterval = 10 * time.Millisecond
+	t.Cleanup(func() { prefetchPauseInterval = old })
+}
+
+// prefetchTestJob is the status of a prefetch job.
+type prefetchTestJob struct {
+	State     string `json:"state"`
+	Paused    bool   `json:"paused"`
+	Completed int    `json:"completed"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// startPrefetchTestJob starts a prefetch job for urls and returns its status
+// URL.
+func startPrefetchTestJob(t *testing.T, urls ...string) string {
+	t.Helper()
+
+	body, _ := json.Marshal(map[string]any{"urls": urls})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/prefetch", strings.NewReader(string(body)))
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d, body = %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+
+	var started struct {
+		StatusURL string `json:"status_url"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return started.StatusURL
+}
+
+// prefetchTestRequest sends a request to the status URL of a job.
+func prefetchTestRequest(t *testing.T, method, statusURL string) (int, prefetchTestJob) {
+	t.Helper()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(method, "http://example"+statusURL, nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+
+	var job prefetchTestJob
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+			t.Fatalf("decode status: %v", err)
+		}
+	}
+	return rr.Code, job
+}
+
+// waitForPrefetchJob polls the job until done returns true.
+func waitForPrefetchJob(t *testing.T, statusURL string, done func(prefetchTestJob) bool) prefetchTestJob {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, job := prefetchTestRequest(t, http.MethodGet, statusURL)
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetch job didn't reach the expected state, status = %+v", job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPrefetchPausesWhileClientsDownload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	newPrefetchTestConfig(t, func(cfg *Config) { cfg.Prefetch.PauseActiveDownloads = 1 })
+	testCache := withTestCache(t, upstream)
+
+	// A client download in progress holds a write lock.
+	if err := testCache.CreateWriteLock(0, "deb.debian.org", "/debian/pool/main/l/live.deb"); err != nil {
+		t.Fatalf("CreateWriteLock() error = %v", err)
+	}
+
+	statusURL := startPrefetchTestJob(t, "http://deb.debian.org/debian/pool/main/a/a.deb")
+	job := waitForPrefetchJob(t, statusURL, func(job prefetchTestJob) bool { return job.Paused })
+	if job.State != "running" || job.Completed != 0 {
+		t.Fatalf("paused job = %+v, want running without completed files", job)
+	}
+
+	testCache.DeleteWriteLock(0, "deb.debian.org", "/debian/pool/main/l/live.deb")
+	job = waitForPrefetchJob(t, statusURL, func(job prefetchTestJob) bool { return job.State == "done" })
+	if job.Paused || job.Completed != 1 || job.Bytes != int64(len("content of /debian/pool/main/a/a.deb")) {
+		t.Fatalf("finished job = %+v, want 1 completed file and its size", job)
+	}
+}
+
+func TestPrefetchCancel(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		_, _ = io.WriteString(w, "first part")
+		w.(http.Flusher).Flush()
+		<-unblock
+		_, _ = io.WriteString(w, "second part")
+	}))
+	defer upstream.Close()
+
+	newPrefetchTestConfig(t, func(*Config) {})
+	withTestCache(t, upstream)
+
+	statusURL := startPrefetchTestJob(t,
+		"http://deb.debian.org/debian/pool/main/a/a.deb",
+		"http://deb.debian.org/debian/pool/main/b/b.deb",
+	)
+	select {
+	case <-requested:
+	case <-time.After(10 * time.Second):
+		t.Fatal("prefetch job didn't request the first file")
+	}
+
+	if code, _ := prefetchTestRequest(t, http.MethodDelete, statusURL); code != http.StatusOK {
+		t.Fatalf("DELETE status = %d, want %d", code, http.StatusOK)
+	}
+	close(unblock)
+	job := waitForPrefetchJob(t, statusURL, func(job prefetchTestJob) bool { return job.State != "running" })
+	if job.State != "cancelled" || job.Completed != 0 {
+		t.Fatalf("cancelled job = %+v, want state cancelled without completed files", job)
+	}
+	if len(requested) != 0 {
+		t.Fatal("second file was requested after cancelling the job")
+	}
+}
+
+func TestPrefetchSchedulerLimits(t *testing.T) {
+	cfg := &Config{}
+	cfg.Prefetch.MaxDownloads = 1
+	cfg.Prefetch.BytesPerSecond = 1000
+	scheduler, err := newPrefetchScheduler(cfg)
+	if err != nil {
+		t.Fatalf("newPrefetchScheduler() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := scheduler.acquire(ctx); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if err := scheduler.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("second acquire() error = %v, want the download limit to block", err)
+	}
+	scheduler.release()
+
+	// One second of bandwidth is available at once, more has to wait.
+	if err := scheduler.throttle(context.Background(), 1000); err != nil {
+		t.Fatalf("throttle() error = %v", err)
+	}
+	if err := scheduler.throttle(ctx, 1000); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("throttle() error = %v, want to wait for bandwidth", err)
+	}
+
+	cfg.Prefetch.BytesPerSecond = -1
+	if _, err := newPrefetchScheduler(cfg); err == nil {
+		t.Fatal("newPrefetchScheduler() accepted negative bytes_per_second")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func TestPrefetchRequestExpand(t *testing.T) {
+	req := prefetchRequest{
+		Repository:    "http://deb.debian.org/debian/",
+		Dist:          "bookworm",
+		Components:    []string{"main", "contrib"},
+		Architectures: []string{"amd64"},
+	}
+
+	urls, err := req.expand()
+	if err != nil {
+		t.Fatalf("expand() error = %v", err)
+	}
+
+	want := []string{
+		"http://deb.debian.org/debian/dists/bookworm/InRelease",
+		"http://deb.debian.org/debian/dists/bookworm/Release",
+		"http://deb.debian.org/debian/dists/bookworm/Release.gpg",
+		"http://deb.debian.org/debian/dists/bookworm/main/binary-amd64/Packages.xz",
+		"http://deb.debian.org/debian/dists/bookworm/main/binary-amd64/Packages.gz",
+		"http://deb.debian.org/debian/dists/bookworm/contrib/binary-amd64/Packages.xz",
+		"http://deb.debian.org/debian/dists/bookworm/contrib/binary-amd64/Packages.gz",
+	}
+	if strings.Join(urls, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("expand() = %v, want %v", urls, want)
+	}
+
+	for _, invalid := range []prefetchRequest{
+		{},
+		{Repository: "http://deb.debian.org/debian"},
+		{URLs: []string{"ftp://deb.debian.org/debian/dists/bookworm/Release"}},
+		{URLs: []string{"/debian/dists/bookworm/Release"}},
+	} {
+		if _, err := invalid.expand(); err == nil {
+			t.Fatalf("expand(%+v) expected error", invalid)
+		}
+	}
+}
+
+func TestPrefetchAPI(t *testing.T) {
+	var mux sync.Mutex
+	requests := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		requests[r.URL.Path]++
+		mux.Unlock()
+		if strings.HasSuffix(r.URL.Path, "missing.deb") {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{Domains: []string{"deb.debian.org"}}
+	cfg.Prefetch.Enable = true
+	cfg.Prefetch.Concurrency = 2
+	withTestConfig(t, cfg)
+	testCache := withTestCache(t, upstream)
+
+	body := `{"urls": [
+		"http://deb.debian.org/debian/pool/main/a/a.deb",
+		"http://deb.debian.org/debian/pool/main/b/b.deb",
+		"http://deb.debian.org/debian/pool/main/m/missing.deb",
+		"http://other.example.com/debian/pool/main/c/c.deb"
+	]}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/prefetch", strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d, body = %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+	var started struct {
+		ID        string `json:"id"`
+		StatusURL string `json:"status_url"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	var status struct {
+		State     string            `json:"state"`
+		Total     int               `json:"total"`
+		Completed int               `json:"completed"`
+		Failed    int               `json:"failed"`
+		Errors    map[string]string `json:"errors"`
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example"+started.StatusURL, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handleIndexRequests(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status request = %d, want %d", rr.Code, http.StatusOK)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("decode status: %v", err)
+		}
+		if status.State == "done" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetch job didn't finish, status = %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status.Total != 4 || status.Completed != 4 || status.Failed != 2 {
+		t.Fatalf("status = %+v, want 4 total, 4 completed, 2 failed", status)
+	}
+	if _, ok := status.Errors["http://other.example.com/debian/pool/main/c/c.deb"]; !ok {
+		t.Fatalf("expected not allowed domain to fail, errors = %v", status.Errors)
+	}
+	if _, ok := status.Errors["http://deb.debian.org/debian/pool/main/m/missing.deb"]; !ok {
+		t.Fatalf("expected missing file to fail, errors = %v", status.Errors)
+	}
+
+	for _, path := range []string{"/debian/pool/main/a/a.deb", "/debian/pool/main/b/b.deb"} {
+		if _, err := os.Stat(filepath.Join(testCache.CachePath, "deb.debian.org", filepath.FromSlash(path))); err != nil {
+			t.Fatalf("expected %s to be cached: %v", path, err)
+		}
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if requests["/debian/pool/main/c/c.deb"] != 0 {
+		t.Fatalf("not allowed domain was fetched")
+	}
+}
+
+func TestPrefetchAPIAccess(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		withTestConfig(t, &Config{})
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/prefetch", strings.NewReader(`{}`))
+		req.RemoteAddr = "127.0.0.1:12345"
+		handleIndexRequests(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("remote", func(t *testing.T) {
+		cfg := &Config{}
+		cfg.Prefetch.Enable = true
+		withTestConfig(t, cfg)
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/prefetch", strings.NewReader(`{}`))
+		req.RemoteAddr = "192.0.2.10:12345"
+		handleIndexRequests(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+		}
+	})
+
+	t.Run("wrong method", func(t *testing.T) {
+		cfg := &Config{}
+		cfg.Prefetch.Enable = true
+		withTestConfig(t, cfg)
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/api/prefetch", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handleIndexRequests(rr, req)
+
+		if rr.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func TestPrefetchManifestImport(t *testing.T) {
+	var mux sync.Mutex
+	requests := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		requests[r.URL.Path]++
+		mux.Unlock()
+		_, _ = io.WriteString(w, "content of "+r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{Domains: []string{"deb.debian.org"}}
+	cfg.Prefetch.Enable = true
+	withTestConfig(t, cfg)
+	testCache := withTestCache(t, upstream)
+
+	// a.deb is already cached with the content of the manifest.
+	cachedContent := "content of /debian/pool/main/a/a.deb"
+	cachedPath := filepath.Join(testCache.CachePath, "deb.debian.org", "debian", "pool", "main", "a", "a.deb")
+	if err := os.MkdirAll(filepath.Dir(cachedPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(cachedPath, []byte(cachedContent), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	sum := sha256.Sum256([]byte(cachedContent))
+
+	manifest := `{"url":"http://deb.debian.org/debian/pool/main/a/a.deb","size":` + strconv.Itoa(len(cachedContent)) + `,"sha256":"` + hex.EncodeToString(sum[:]) + `"}
+{"url":"http://deb.debian.org/debian/pool/main/b/b.deb","size":36}
+`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/manifest", strings.NewReader(manifest))
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d, body = %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+	var started struct {
+		ID      string `json:"id"`
+		Total   int    `json:"total"`
+		Skipped int    `json:"skipped"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if started.Total != 1 || started.Skipped != 1 {
+		t.Fatalf("response = %+v, want 1 total and 1 skipped", started)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		prefetchJobs.Lock()
+		job := prefetchJobs.byID[started.ID]
+		prefetchJobs.Unlock()
+		job.mux.Lock()
+		state := job.State
+		job.mux.Unlock()
+		if state == "done" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("prefetch job didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := os.Stat(filepath.Join(testCache.CachePath, "deb.debian.org", "debian", "pool", "main", "b", "b.deb")); err != nil {
+		t.Fatalf("expected b.deb to be cached: %v", err)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if requests["/debian/pool/main/a/a.deb"] != 0 {
+		t.Fatalf("already cached file was fetched again")
+	}
+}
+
+func TestPrefetchManifestExport(t *testing.T) {
+	cfg := &Config{}
+	cfg.Prefetch.Enable = true
+	withTestConfig(t, cfg)
+
+	old := cache
+	cache = fscache.NewFSCache(t.TempDir())
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	u, _ := url.Parse("http://deb.debian.org/debian/pool/main/a/a.deb")
+	localPath := filepath.Join(cache.CachePath, "deb.debian.org", "debian", "pool", "main", "a", "a.deb")
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte("deb"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := cache.Set(fscache.DetermineProtocolFromURL(u), u.Host, u.Path, fscache.AccessEntry{URL: u}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example/_goaptcacher/api/manifest", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	entries, err := fscache.ReadManifest(rr.Body)
+	if err != nil {
+		t.Fatalf("ReadManifest() error = %v", err)
+	}
+	if len(entries) != 1 || entries[0].URL != u.String() || entries[0].Size != 3 {
+		t.Fatalf("manifest = %+v, want a.deb with 3 bytes", entries)
+	}
+}
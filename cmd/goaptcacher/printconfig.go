@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+
+	"gopkg.in/yaml.v2"
+)
+
+// redactedValue replaces secrets in the printed config.
+const redactedValue = "[redacted]"
+
+// printConfig writes the effective config with defaults and environment
+// overrides applied as YAML to w. Values of fields tagged redact:"true" are
+// replaced, fields tagged redact:"url" keep the URL without password.
+func printConfig(w io.Writer, c *Config) error {
+	printed, err := redactedConfig(c)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(printed)
+	if err != nil {
+		return err
+	}
+
+	for _, includedFile := range c.IncludedFiles {
+		if _, err := fmt.Fprintf(w, "# included: %s\n", includedFile); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// redactedConfig returns a copy of c with the secrets redacted.
+func redactedConfig(c *Config) (*Config, error) {
+	// The config is copied through YAML, so redacting doesn't change it.
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var redacted Config
+	if err := yaml.Unmarshal(data, &redacted); err != nil {
+		return nil, err
+	}
+	redactConfig(reflect.ValueOf(&redacted).Elem(), "")
+	return &redacted, nil
+}
+
+// redactConfig replaces the secrets below v according to the redact tags of
+// the struct fields. mode is the tag of the enclosing field.
+func redactConfig(v reflect.Value, mode string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := range v.NumField() {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			redactConfig(v.Field(i), field.Tag.Get("redact"))
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			redactConfig(v.Index(i), mode)
+		}
+	case reflect.Map:
+		if mode == "" {
+			return
+		}
+		// Map values are not addressable, so redact a copy and store it back.
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.New(iter.Value().Type()).Elem()
+			value.Set(iter.Value())
+			redactConfig(value, mode)
+			v.SetMapIndex(iter.Key(), value)
+		}
+	case reflect.String:
+		if v.String() == "" || !v.CanSet() {
+			return
+		}
+		switch mode {
+		case "true":
+			v.SetString(redactedValue)
+		case "url":
+			if u, err := url.Parse(v.String()); err == nil {
+				v.SetString(u.Redacted())
+			} else {
+				v.SetString(redactedValue)
+			}
+		}
+	default:
+		// Other kinds don't hold secrets.
+	}
+}
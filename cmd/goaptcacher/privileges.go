@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// credentials are the user and group IDs the process runs as after dropping
+// privileges.
+type credentials struct {
+	uid int
+	gid int
+}
+
+// resolveCredentials looks up the configured user and group. Without group,
+// the primary group of the user is used.
+func resolveCredentials(userName, groupName string) (credentials, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return credentials{}, err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return credentials{}, fmt.Errorf("user %s has no numeric ID: %w", userName, err)
+	}
+
+	gidString := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return credentials{}, err
+		}
+		gidString = g.Gid
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return credentials{}, fmt.Errorf("group of user %s has no numeric ID: %w", userName, err)
+	}
+
+	return credentials{uid: uid, gid: gid}, nil
+}
+
+// chownOwnedFiles hands the files the proxy keeps writing to over to creds:
+// the cache tree with the shard directories, metadata and CRL created on
+// startup, the temporary directory and the access log.
+func chownOwnedFiles(creds credentials) error {
+	roots := []string{config.CacheDirectory}
+	if config.TempDirectory != "" {
+		roots = append(roots, config.TempDirectory)
+	}
+	for _, root := range roots {
+		if err := chownTree(root, creds); err != nil {
+			return err
+		}
+	}
+
+	if config.AccessLog.Enable {
+		if err := os.Lchown(config.AccessLog.File, creds.uid, creds.gid); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWritable verifies that files can be created in dir.
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".goaptcacher-write-test-*")
+	if err != nil {
+		return err
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
+
+// dropPrivileges switches to the configured user and group once the
+// listeners are bound, so privileged ports can be used without running as
+// root. The cache was opened as root, so the files written so far are handed
+// to the user first. Afterwards the cache directory (and the directories of
+// the access log and the PID file) must still be writable.
+func dropPrivileges() error {
+	if config.User == "" {
+		if config.Group != "" {
+			return fmt.Errorf("group is set without user")
+		}
+		return nil
+	}
+
+	creds, err := resolveCredentials(config.User, config.Group)
+	if err != nil {
+		return err
+	}
+	if err := chownOwnedFiles(creds); err != nil {
+		return fmt.Errorf("handing files to user %s: %w", config.User, err)
+	}
+	if err := setCredentials(creds); err != nil {
+		return fmt.Errorf("switching to user %s: %w", config.User, err)
+	}
+
+	dirs := []string{config.CacheDirectory}
+	if config.AccessLog.Enable {
+		dirs = append(dirs, filepath.Dir(config.AccessLog.File))
+	}
+	if config.PIDFile != "" {
+		dirs = append(dirs, filepath.Dir(config.PIDFile))
+	}
+	for _, dir := range dirs {
+		if err := checkWritable(dir); err != nil {
+			return fmt.Errorf("user %s can't write to %s: %w", config.User, dir, err)
+		}
+	}
+
+	slog.Info("Dropped privileges", "event", "startup", "user", config.User, "uid", creds.uid, "gid", creds.gid)
+	return nil
+}
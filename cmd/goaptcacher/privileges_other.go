@@ -0,0 +1,15 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// setCredentials isn't supported on this platform.
+func setCredentials(credentials) error {
+	return errors.New("dropping privileges is not supported on this platform")
+}
+
+// chownTree isn't needed on this platform, as privileges can't be dropped.
+func chownTree(string, credentials) error {
+	return nil
+}
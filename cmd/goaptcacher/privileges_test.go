@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestResolveCredentialsUsesPrimaryGroup(t *testing.T) {
+	current, err := user.Current()
+	if err != nil {
+		t.Skipf("current user unknown: %v", err)
+	}
+
+	creds, err := resolveCredentials(current.Username, "")
+	if err != nil {
+		t.Fatalf("resolveCredentials() error = %v", err)
+	}
+	if strconv.Itoa(creds.uid) != current.Uid || strconv.Itoa(creds.gid) != current.Gid {
+		t.Fatalf("credentials = %+v, want uid %s gid %s", creds, current.Uid, current.Gid)
+	}
+}
+
+func TestResolveCredentialsRejectsUnknownUser(t *testing.T) {
+	if _, err := resolveCredentials("goaptcacher-no-such-user", ""); err == nil {
+		t.Fatal("expected error for unknown user")
+	}
+}
+
+func TestDropPrivilegesRequiresUserForGroup(t *testing.T) {
+	cfg := &Config{Group: "nogroup"}
+	withTestConfig(t, cfg)
+
+	if err := dropPrivileges(); err == nil {
+		t.Fatal("expected error for group without user")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkWritable(dir); err != nil {
+		t.Fatalf("checkWritable() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected test file to be removed, found %v", entries)
+	}
+
+	if err := checkWritable(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expected error for missing directory")
+	}
+}
+
+func TestChownOwnedFilesHandsCacheTreeToUser(t *testing.T) {
+	creds := lookupUnprivilegedUser(t)
+	dir := t.TempDir()
+	// A shard directory and metadata written as root before the drop
+	shard := filepath.Join(dir, "ab")
+	if err := os.Mkdir(shard, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(shard, "package.deb")
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logFile := filepath.Join(t.TempDir(), "access.log")
+	if err := os.WriteFile(logFile, nil, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{CacheDirectory: dir}
+	cfg.AccessLog.Enable = true
+	cfg.AccessLog.File = logFile
+	withTestConfig(t, cfg)
+
+	if err := chownOwnedFiles(creds); err != nil {
+		t.Fatalf("chownOwnedFiles() error = %v", err)
+	}
+	for _, p := range []string{dir, shard, file, logFile} {
+		uid, err := fileOwner(p)
+		if err != nil {
+			t.Fatalf("fileOwner(%s) error = %v", p, err)
+		}
+		if uid != creds.uid {
+			t.Fatalf("%s is owned by %d, want %d", p, uid, creds.uid)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// setCredentials sets the group and user ID of the process. The group has to
+// be changed first, as an unprivileged user can't change it anymore.
+func setCredentials(creds credentials) error {
+	if err := syscall.Setgroups([]int{creds.gid}); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(creds.gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(creds.uid)
+}
+
+// chownTree changes the owner of root and everything below it to creds.
+// Entries already owned by creds are skipped, so a large cache is only walked
+// on every start. Entries removed during the walk are ignored.
+func chownTree(root string, creds credentials) error {
+	root, err := filepath.EvalSymlinks(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		var info fs.FileInfo
+		if err == nil {
+			info, err = d.Info()
+		}
+		if err == nil {
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if ok && int(stat.Uid) == creds.uid && int(stat.Gid) == creds.gid {
+				return nil
+			}
+			err = os.Lchown(path, creds.uid, creds.gid)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+}
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 
 	"gitlab.com/bella.network/goaptcacher/lib/web"
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
 )
 
 // handleRequest is the main handler function for incoming HTTP requests. It
@@ -16,11 +17,44 @@ import (
 // status code is returned to the client. If a client directly requests the
 // proxy server e.g. by entering the IP or hostname of the proxy server in the
 // browser, a overview page is shown.
-func handleRequest(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	// Assign a request ID which is included in all log lines of the request
+	// and the background tasks spawned for it.
+	requestID := s.cache.GenerateUUID()
+	r = r.WithContext(fscache.WithRequestID(r.Context(), requestID))
+	w.Header().Set("X-Request-ID", requestID)
+
+	// Health probes of load balancers are answered without access checks.
+	if handleHealthRequests(w, r) {
+		return
+	}
+	countRequest(r)
+
+	// Reject clients which are not part of the configured client ranges before
+	// doing anything else.
+	if !s.config.isClientAllowed(r) {
+		fscache.Error(w, r, http.StatusForbidden, "client_not_allowed", "Forbidden")
+		slog.InfoContext(r.Context(), "Client not allowed", "event", "access_denied", "client", r.RemoteAddr, "host", r.Host, "status", http.StatusForbidden)
+		return
+	}
+
+	// Apply the per-client rate limits. Requests read from an intercepted
+	// CONNECT tunnel are counted individually.
+	w, ok := s.checkRateLimit(w, r)
+	if !ok {
+		return
+	}
+
 	// If path starts with /_goaptcacher, handle the request as an internal
 	// request. This is used for the index page, overview/configuration page,
 	// and cache management.
+	// With a dedicated management listener, only the files referenced by
+	// issued certificates are served here.
 	if r.Method != http.MethodConnect && strings.HasPrefix(r.URL.Path, "/_goaptcacher/") {
+		if s.config.managementSeparated() && !isCertificatePath(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
 		handleIndexRequests(w, r)
 		return
 	}
@@ -33,6 +67,9 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		// response on / and a HTML redirect to the index page.
 		// See: https://github.com/terceiro/auto-apt-proxy/blob/f3b86d8727cbf4968130f4fae2651be3480269ad/auto-apt-proxy#L148
 		w.WriteHeader(http.StatusNotAcceptable)
+		if s.config.managementSeparated() {
+			return
+		}
 		// Add a redirect to the index page for browsers.
 		w.Header().Set("Location", "/_goaptcacher/")
 		// Last fallback, write a small HTML meta refresh redirect.
@@ -56,6 +93,10 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 			_, _ = w.Write([]byte("User-agent: *\nDisallow: /\n"))
 			return
 		case "/_goaptcacher":
+			if s.config.managementSeparated() {
+				http.NotFound(w, r)
+				return
+			}
 			// Redirect to the index page.
 			http.Redirect(w, r, "/_goaptcacher/", http.StatusTemporaryRedirect)
 			return
@@ -69,30 +110,50 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Clients which use the proxy as mirror base URL (apt-cacher-ng style)
+	// select the upstream with the first path segment.
+	if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == fscache.MethodPurge || r.Method == http.MethodDelete {
+		applyPathMappings(r, s.config.pathMappings)
+	}
+
+	// Require proxy credentials if configured. This is done after handling
+	// the internal pages, so the overview page stays reachable without them.
+	if !s.checkProxyAuth(w, r) {
+		return
+	}
+
+	// The domain lists may be replaced by a reload, the request is handled
+	// with the lists which are active now.
+	lists := s.config.currentDomains()
+
+	// Denied domains are rejected before evaluating the allow lists, so hosts
+	// can be carved out of broad wildcards.
+	if matchDomainList(r.Host, lists.denied) {
+		fscache.Error(w, r, http.StatusForbidden, "domain_denied", "Forbidden")
+		slog.InfoContext(r.Context(), "Domain denied", "event", "access_denied", "client", r.RemoteAddr, "host", r.Host, "status", http.StatusForbidden)
+		return
+	}
+
 	// Check if target host is in whitelist of configured domains to cache and
 	// proxy.
-	var found bool
-	for _, host := range config.Domains {
-		if strings.HasSuffix(r.Host, host) || strings.HasSuffix(r.Host, host+":443") {
-			found = true
-			break
-		}
-	}
+	found := matchDomainList(r.Host, lists.domains)
 
 	// Check if target host is in whitelist of configured passthrough domains.
 	// Domains in this list are allowed the same was as domains in the domains
 	// list, but they are not cached.
-	var passthrough bool
-	for _, host := range config.PassthroughDomains {
-		if strings.HasSuffix(r.Host, host) || strings.HasSuffix(r.Host, host+":443") {
-			passthrough = true
-			found = true
-			break
-		}
+	passthrough := matchDomainList(r.Host, lists.passthrough)
+	if passthrough {
+		found = true
 	}
 
-	// If no domains are configured, allow all requests.
-	if loadedDomains == 0 {
+	// If no domains are configured, allow all requests, but only if the
+	// open proxy was enabled explicitly.
+	if lists.loaded == 0 {
+		if !lists.openProxy {
+			fscache.Error(w, r, http.StatusForbidden, "open_proxy_disabled", "Forbidden")
+			slog.WarnContext(r.Context(), "No domains configured and allow_open_proxy is not set", "event", "access_denied", "client", r.RemoteAddr, "host", r.Host, "status", http.StatusForbidden)
+			return
+		}
 		found = true
 	}
 
@@ -109,8 +170,8 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	// If the target host is not allowed to be proxied, return a 403 Forbidden
 	// status code to the client.
 	if !found {
-		http.Error(w, "Forbidden", http.StatusForbidden)
-		log.Printf("[INFO:403] Domain not allowed: %s\n", r.Host)
+		fscache.Error(w, r, http.StatusForbidden, "domain_not_allowed", "Forbidden")
+		slog.InfoContext(r.Context(), "Domain not allowed", "event", "access_denied", "client", r.RemoteAddr, "host", r.Host, "status", http.StatusForbidden)
 
 		return
 	}
@@ -120,29 +181,48 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	case http.MethodConnect:
 		// If HTTPS requests are not allowed, return a 403 Forbidden status
 		// code to the client.
-		if config.HTTPS.Prevent {
-			http.Error(w, "Forbidden", http.StatusForbidden)
-			log.Printf("[INFO:403:%s] HTTPS requests are not allowed: %s\n", r.RemoteAddr, r.Host)
+		if s.config.HTTPS.Prevent {
+			fscache.Error(w, r, http.StatusForbidden, "https_not_allowed", "Forbidden")
+			slog.InfoContext(r.Context(), "HTTPS requests are not allowed", "event", "access_denied", "client", r.RemoteAddr, "host", r.Host, "status", http.StatusForbidden)
+			return
+		}
+
+		// Only tunnel to explicitly allowed ports, otherwise the proxy could
+		// be abused to connect to arbitrary services.
+		if !s.isConnectPortAllowed(r.Host) {
+			fscache.Error(w, r, http.StatusForbidden, "connect_port_not_allowed", "Forbidden")
+			slog.InfoContext(r.Context(), "CONNECT port not allowed", "event", "access_denied", "client", r.RemoteAddr, "host", r.Host, "status", http.StatusForbidden)
 			return
 		}
 
 		// If passthrough is enabled or HTTPS interception is disabled, tunnel
 		// the request to the target host without any caching or interception.
-		if passthrough || !config.HTTPS.Intercept {
-			handleTUNNEL(w, r)
+		if passthrough || !s.config.HTTPS.Intercept {
+			s.handleTUNNEL(w, r)
 		} else {
-			handleCONNECT(w, r)
+			s.handleCONNECT(w, r)
 		}
 	case http.MethodGet, http.MethodHead:
 		// If passthrough is enabled or no domains are configured, forward the
 		// request to the target host without any caching or interception.
-		if passthrough || loadedDomains == 0 {
-			handleTUNNEL(w, r)
+		if passthrough || lists.loaded == 0 {
+			s.handleTUNNEL(w, r)
 		} else {
-			handleHTTP(w, r)
+			s.handleHTTP(w, r)
+		}
+	case fscache.MethodPurge, http.MethodDelete:
+		// Purging evicts content of all clients, so it is a management
+		// action.
+		if !authorizeManagement(w, r, managementRemoteAllowed()) {
+			return
+		}
+		if passthrough || lists.loaded == 0 {
+			fscache.Error(w, r, http.StatusNotFound, "not_cached", "File not cached")
+			return
 		}
+		s.handleHTTP(w, r)
 	default:
-		log.Printf("Unsupported method: %s\n", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		slog.InfoContext(r.Context(), "Unsupported method", "event", "request", "client", r.RemoteAddr, "method", r.Method, "status", http.StatusMethodNotAllowed)
+		fscache.Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 	}
 }
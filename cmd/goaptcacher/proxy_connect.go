@@ -3,33 +3,42 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
 )
 
 // handleCONNECT handles HTTPS CONNECT requests of clients which want to fetch a
 // repository over HTTPS. This function intercepts the HTTPS request, applies
 // the same caching as handleHTTP and serves a self-signed certificate to the
 // client. This allows the proxy to cache HTTPS requests.
-func handleCONNECT(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleCONNECT(w http.ResponseWriter, r *http.Request) {
+	if !s.acquireHijackedConnection(w, r) {
+		return
+	}
+	defer releaseHijackedConnection()
 
 	// "Hijack" the client connection to get a TCP (or TLS) socket we can read
 	// and write arbitrary data to/from.
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
-		log.Println("webserver doesn't support hijacking")
+		fscache.Error(w, r, http.StatusInternalServerError, "hijacking_unsupported", "webserver doesn't support hijacking")
+		slog.ErrorContext(r.Context(), "Webserver doesn't support hijacking", "event", "connect", "client", r.RemoteAddr)
 		return
 	}
 
 	clientConn, _, err := hj.Hijack()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println("http hijacking failed")
+		slog.ErrorContext(r.Context(), "HTTP hijacking failed", "event", "connect", "client", r.RemoteAddr, "error", err)
 		return
 	}
 
@@ -37,22 +46,25 @@ func handleCONNECT(w http.ResponseWriter, r *http.Request) {
 	// a port - e.g. example.org:443
 	// To generate a fake certificate for example.org, we have to first split off
 	// the host from the port.
-	host, _, err := net.SplitHostPort(r.Host)
+	host, port, err := net.SplitHostPort(r.Host)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println("error splitting host/port:", err)
+		slog.ErrorContext(r.Context(), "Error splitting host and port", "event", "connect", "client", r.RemoteAddr, "host", r.Host, "error", err)
 		return
 	}
+	// Host as used in URLs of the tunneled requests, IPv6 literals have to be
+	// bracketed.
+	urlHost := connectURLHost(host, port)
 
 	// Get intercept certificate
-	certBundle := intercept.GetCertificate(host)
+	certBundle := s.currentIntercept().GetCertificate(host)
 
 	// Send an HTTP OK response back to the client; this initiates the CONNECT
 	// tunnel. From this point on the client will assume it's connected directly
 	// to the target.
 	if _, err := clientConn.Write(proxyCONNECTStatus(200, "OK")); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println("error writing status to client:", err)
+		slog.ErrorContext(r.Context(), "Error writing status to client", "event", "connect", "client", r.RemoteAddr, "host", r.Host, "error", err)
 		return
 	}
 
@@ -60,10 +72,10 @@ func handleCONNECT(w http.ResponseWriter, r *http.Request) {
 	// our certificate. This server will now pretend being the target.
 	tlsConfig := &tls.Config{
 		PreferServerCipherSuites: true,
-		CurvePreferences:         []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256},
-		MinVersion:               tls.VersionTLS12,
+		CurvePreferences:         defaultInterceptCurves,
 		Certificates:             []tls.Certificate{*certBundle},
 	}
+	s.config.applyInterceptTLSSettings(tlsConfig)
 
 	tlsConn := tls.Server(clientConn, tlsConfig)
 	defer tlsConn.Close()
@@ -71,9 +83,9 @@ func handleCONNECT(w http.ResponseWriter, r *http.Request) {
 	// Versuche TLS-Handshake und erkenne Zertifikatsfehler
 	if err := tlsConn.Handshake(); err != nil {
 		if strings.Contains(err.Error(), "unknown certificate") || strings.Contains(err.Error(), "certificate") || strings.Contains(err.Error(), "alert") {
-			log.Printf("[TLS-ALERT] Client %s has aborted the TLS-connection due to a certificate error: %v", r.RemoteAddr, err)
+			slog.WarnContext(r.Context(), "Client has aborted the TLS-connection due to a certificate error", "event", "tls_alert", "client", r.RemoteAddr, "host", r.Host, "error", err)
 		} else {
-			log.Printf("[TLS-ERROR] TLS-Handshake with client %s failed: %v", r.RemoteAddr, err)
+			slog.WarnContext(r.Context(), "TLS-Handshake with client failed", "event", "tls_error", "client", r.RemoteAddr, "host", r.Host, "error", err)
 		}
 		return
 	}
@@ -98,35 +110,91 @@ func handleCONNECT(w http.ResponseWriter, r *http.Request) {
 			if strings.Contains(err.Error(), "connection reset by") {
 				break
 			}
-			log.Println("error reading request from client:", err)
+			slog.WarnContext(r.Context(), "Error reading request from client", "event", "connect", "client", r.RemoteAddr, "host", r.Host, "error", err)
 			break
 		}
 
-		// Set missing fields in the request
+		// Set missing fields in the request, the method is kept so HEAD
+		// requests are answered without body.
 		incomingRequest.URL.Scheme = "https"
-		incomingRequest.URL.Host = host
-		incomingRequest.Method = http.MethodGet
+		incomingRequest.URL.Host = urlHost
 		incomingRequest.RemoteAddr = r.RemoteAddr
-		incomingRequest.RequestURI = fmt.Sprintf("https://%s%s", host, incomingRequest.URL.Path)
+		incomingRequest.RequestURI = fmt.Sprintf("https://%s%s", urlHost, incomingRequest.URL.RequestURI())
+		// The CONNECT request was already authenticated, requests read from
+		// the tunnel don't carry proxy credentials themselves. Their bytes
+		// are accounted on the hijacked connection of the CONNECT request.
+		incomingRequest = withBandwidthAccounted(withProxyAuthenticated(incomingRequest))
 
 		// Log the incoming request
-		log.Printf("[CONNECT] %s %s from %s\n", incomingRequest.Method, incomingRequest.URL.String(), incomingRequest.RemoteAddr)
+		slog.InfoContext(r.Context(), "Intercepted request", "event", "connect", "client", incomingRequest.RemoteAddr, "method", incomingRequest.Method, "host", urlHost, "path", incomingRequest.URL.Path)
 
-		writer := newConnectResponseWriter(tlsConn)
-		// Handle the request
-		handleRequest(writer, incomingRequest)
+		writer := newConnectResponseWriter(tlsConn, incomingRequest)
+		// Handle the request, this applies the same overrides and caching as
+		// for plain HTTP requests.
+		withAccessLog(s.config, withTracing(s.handleRequest))(writer, incomingRequest)
 
 		if err := writer.Close(); err != nil {
-			log.Println("error writing response back:", err)
+			slog.WarnContext(r.Context(), "Error writing response back", "event", "connect", "client", r.RemoteAddr, "host", r.Host, "error", err)
+			break
 		}
 
-		// Close the connection if the client closed the connection
+		// The next request starts after the body of this one. If the body
+		// can't be skipped, the connection can't be reused.
+		if !drainRequestBody(incomingRequest.Body) {
+			break
+		}
+
+		// Close the connection if the client or the handler asked for it
 		if incomingRequest.Close || writer.closeAfter {
 			break
 		}
 	}
 }
 
+// connectMaxDrainBytes is the maximum size of an unread request body which is
+// discarded to keep a CONNECT tunnel open for further requests.
+const connectMaxDrainBytes = 256 << 10
+
+// drainRequestBody discards the unread rest of a request body. It returns
+// false if the body was too large or couldn't be read completely.
+func drainRequestBody(body io.ReadCloser) bool {
+	if body == nil || body == http.NoBody {
+		return true
+	}
+	defer body.Close()
+
+	_, err := io.CopyN(io.Discard, body, connectMaxDrainBytes+1)
+	return err == io.EOF
+}
+
+// connectURLHost returns the URL host of a CONNECT target. IPv6 literals are
+// bracketed and the port is only kept if it differs from the HTTPS default.
+func connectURLHost(host, port string) string {
+	if port != "" && port != "443" {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+
+	return host
+}
+
+// isConnectPortAllowed checks if the port of a CONNECT target is part of the
+// configured CONNECT ports. A target without port uses the default HTTPS port.
+func (s *Server) isConnectPortAllowed(target string) bool {
+	port := 443
+	if _, portString, err := net.SplitHostPort(target); err == nil {
+		parsed, err := strconv.Atoi(portString)
+		if err != nil {
+			return false
+		}
+		port = parsed
+	}
+
+	return slices.Contains(s.config.HTTPS.ConnectPorts, port)
+}
+
 // proxyCONNECTStatus returns a HTTP response for a CONNECT request, with the
 // given status code and message.
 func proxyCONNECTStatus(code int, message string) []byte {
@@ -142,13 +210,20 @@ type connectResponseWriter struct {
 	status      int
 	chunked     bool
 	closeAfter  bool
+	head        bool // Response to a HEAD request, the body is discarded
+	aborted     bool // The body is incomplete, the connection has to be closed
 }
 
-func newConnectResponseWriter(conn net.Conn) *connectResponseWriter {
+// newConnectResponseWriter creates a response writer for req which was read
+// from a CONNECT tunnel. If the client asked to close the connection, the
+// response announces it.
+func newConnectResponseWriter(conn net.Conn, req *http.Request) *connectResponseWriter {
 	return &connectResponseWriter{
-		conn:   conn,
-		bw:     bufio.NewWriterSize(conn, 32*1024),
-		header: make(http.Header),
+		conn:       conn,
+		bw:         bufio.NewWriterSize(conn, 32*1024),
+		header:     make(http.Header),
+		closeAfter: req.Close,
+		head:       req.Method == http.MethodHead,
 	}
 }
 
@@ -171,6 +246,10 @@ func (w *connectResponseWriter) Write(p []byte) (int, error) {
 		}
 	}
 
+	if w.head {
+		return len(p), nil
+	}
+
 	if w.chunked {
 		if len(p) == 0 {
 			return 0, nil
@@ -197,7 +276,17 @@ func (w *connectResponseWriter) Flush() {
 	_ = w.bw.Flush()
 }
 
+// Abort marks the response as incomplete. It isn't finished by Close, so the
+// client notices the missing data once the connection is closed.
+func (w *connectResponseWriter) Abort() {
+	w.aborted = true
+}
+
 func (w *connectResponseWriter) Close() error {
+	if w.aborted {
+		_ = w.bw.Flush()
+		return errors.New("response aborted, body incomplete")
+	}
 	if !w.wroteHeader {
 		if err := w.writeHeader(); err != nil {
 			return err
@@ -224,8 +313,13 @@ func (w *connectResponseWriter) writeHeader() error {
 	if v := w.header.Get("Connection"); v != "" && strings.EqualFold(strings.TrimSpace(v), "close") {
 		w.closeAfter = true
 	}
+	if w.closeAfter {
+		w.header.Set("Connection", "close")
+	}
 
-	if w.header.Get("Content-Length") == "" {
+	// Responses to HEAD requests never have a body, so they are never
+	// chunked.
+	if w.header.Get("Content-Length") == "" && !w.head {
 		te := w.header.Get("Transfer-Encoding")
 		if te == "" {
 			if !statusNoBody(status) {
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/httpsintercept"
+)
+
+func TestIsConnectPortAllowed(t *testing.T) {
+	cfg := &Config{}
+	cfg.HTTPS.ConnectPorts = []int{443, 8443}
+	s := newTestServer(t, cfg, nil)
+
+	tcs := []struct {
+		target string
+		want   bool
+	}{
+		{"example.com:443", true},
+		{"example.com:8443", true},
+		{"example.com:22", false},
+		{"example.com", true},
+		{"[2001:db8::1]:443", true},
+		{"[2001:db8::1]:25", false},
+		{"example.com:https", false},
+	}
+
+	for _, tc := range tcs {
+		if got := s.isConnectPortAllowed(tc.target); got != tc.want {
+			t.Fatalf("isConnectPortAllowed(%q) = %v, want %v", tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestHandleRequestRejectsDisallowedConnectPort(t *testing.T) {
+	cfg := &Config{}
+	cfg.HTTPS.ConnectPorts = []int{443}
+	s := newTestServer(t, cfg, nil)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodConnect, "http://example.com:22", nil)
+	req.Host = "example.com:22"
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+// newTestCA generates a CA and returns its certificate and private key as PEM.
+func newTestCA(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "GoAPTCacher Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("create CA: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// withTestIntercept installs an HTTPS interception handler backed by a freshly
+// generated CA in s.
+func withTestIntercept(t *testing.T, s *Server) *x509.CertPool {
+	t.Helper()
+
+	certPEM, keyPEM := newTestCA(t)
+	testIntercept, err := httpsintercept.New(certPEM, keyPEM, "", nil)
+	if err != nil {
+		t.Fatalf("httpsintercept.New: %v", err)
+	}
+
+	s.setIntercept(testIntercept, interceptSettings{})
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		t.Fatal("parse CA")
+	}
+	return pool
+}
+
+// openInterceptedTunnel sends a CONNECT request for target through a proxy
+// running s and performs the TLS handshake with the intercepting proxy.
+func openInterceptedTunnel(t *testing.T, s *Server, target string, serverName string, roots *x509.CertPool) (*tls.Conn, *bufio.Reader) {
+	t.Helper()
+
+	proxy := httptest.NewServer(http.HandlerFunc(s.handleRequest))
+	t.Cleanup(proxy.Close)
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, RootCAs: roots, MinVersion: tls.VersionTLS12})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+
+	return tlsConn, bufio.NewReader(tlsConn)
+}
+
+func TestConnectURLHost(t *testing.T) {
+	tcs := []struct {
+		host, port, want string
+	}{
+		{"example.com", "443", "example.com"},
+		{"example.com", "8443", "example.com:8443"},
+		{"::1", "443", "[::1]"},
+		{"2001:db8::1", "8443", "[2001:db8::1]:8443"},
+		{"192.0.2.1", "443", "192.0.2.1"},
+	}
+
+	for _, tc := range tcs {
+		if got := connectURLHost(tc.host, tc.port); got != tc.want {
+			t.Fatalf("connectURLHost(%q, %q) = %q, want %q", tc.host, tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestHandleCONNECTIPv6Target(t *testing.T) {
+	const payload = "ipv6-release"
+
+	var gotPath string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{Domains: []string{"::1"}}
+	cfg.HTTPS.Intercept = true
+	cfg.HTTPS.ConnectPorts = []int{443}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, upstream)
+	roots := withTestIntercept(t, s)
+
+	// The certificate must be valid for the IPv6 literal, tls.Client verifies
+	// an IP SAN if the server name is an IP address.
+	tlsConn, reader := openInterceptedTunnel(t, s, "[::1]:443", "::1", roots)
+
+	if _, err := io.WriteString(tlsConn, "GET /debian/dists/stable/InRelease HTTP/1.1\r\nHost: [::1]\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != payload {
+		t.Fatalf("response = %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, payload)
+	}
+	if gotPath != "/debian/dists/stable/InRelease" {
+		t.Fatalf("upstream path = %q", gotPath)
+	}
+
+	// The file is moved into place after the response was sent.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(filepath.Join(s.cache.CachePath, "::1", "debian", "dists", "stable", "InRelease"))
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected file to be cached under the IPv6 host: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setupInterceptedTunnelTest configures an intercepting proxy for example.com
+// whose upstream requests are answered by handler.
+func setupInterceptedTunnelTest(t *testing.T, handler http.HandlerFunc) (*Server, *x509.CertPool) {
+	t.Helper()
+
+	upstream := httptest.NewTLSServer(handler)
+	t.Cleanup(upstream.Close)
+
+	cfg := &Config{Domains: []string{"example.com"}}
+	cfg.HTTPS.Intercept = true
+	cfg.HTTPS.ConnectPorts = []int{443}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, upstream)
+
+	return s, withTestIntercept(t, s)
+}
+
+func TestHandleCONNECTPreservesHEAD(t *testing.T) {
+	const payload = "release file content"
+
+	s, roots := setupInterceptedTunnelTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, payload)
+	})
+
+	tlsConn, reader := openInterceptedTunnel(t, s, "example.com:443", "example.com", roots)
+
+	// Pipeline GET, HEAD and GET requests. The HEAD response must not contain
+	// a body or the following response is read from the wrong position.
+	const path = "/debian/dists/stable/Release"
+	if _, err := io.WriteString(tlsConn,
+		"GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+			"HEAD "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+			"GET "+path+" HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatalf("write requests: %v", err)
+	}
+
+	for i, method := range []string{http.MethodGet, http.MethodHead, http.MethodGet} {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+		if err != nil {
+			t.Fatalf("read response %d (%s): %v", i, method, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("response %d (%s) status = %d, want %d", i, method, resp.StatusCode, http.StatusOK)
+		}
+		if method == http.MethodHead {
+			if resp.TransferEncoding != nil {
+				t.Fatalf("HEAD response is chunked: %v", resp.TransferEncoding)
+			}
+			if resp.ContentLength != int64(len(payload)) {
+				t.Fatalf("HEAD Content-Length = %d, want %d", resp.ContentLength, len(payload))
+			}
+			continue
+		}
+		if string(body) != payload {
+			t.Fatalf("response %d (%s) body = %q, want %q", i, method, body, payload)
+		}
+	}
+}
+
+func TestHandleCONNECTHonorsConnectionClose(t *testing.T) {
+	s, roots := setupInterceptedTunnelTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "content")
+	})
+
+	tlsConn, reader := openInterceptedTunnel(t, s, "example.com:443", "example.com", roots)
+
+	if _, err := io.WriteString(tlsConn, "GET /debian/pool/main/a.deb HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if !resp.Close {
+		t.Fatalf("response doesn't announce Connection: close, header = %v", resp.Header)
+	}
+
+	_ = tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the proxy to close the tunnel, got %v", err)
+	}
+}
+
+func TestHandleCONNECTAbortsIncompleteResponse(t *testing.T) {
+	// The chunked upstream response ends without its last chunk.
+	s, roots := setupInterceptedTunnelTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "only part of it")
+		w.(http.Flusher).Flush()
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			_ = conn.Close()
+		}
+	})
+
+	tlsConn, reader := openInterceptedTunnel(t, s, "example.com:443", "example.com", roots)
+
+	if _, err := io.WriteString(tlsConn, "GET /debian/pool/main/a.deb HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	_ = tlsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err == nil {
+		t.Fatalf("client received a complete response %q, want the tunnel to be closed", body)
+	}
+}
+
+func TestHandleCONNECTDrainsRequestBody(t *testing.T) {
+	s, roots := setupInterceptedTunnelTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "content")
+	})
+
+	tlsConn, reader := openInterceptedTunnel(t, s, "example.com:443", "example.com", roots)
+
+	// The POST is rejected without reading its body, the body must be skipped
+	// before the following GET is read.
+	const body = "GET /smuggled HTTP/1.1\r\n\r\n"
+	if _, err := io.WriteString(tlsConn,
+		"POST /debian/upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body+
+			"GET /debian/pool/main/b.deb HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatalf("write requests: %v", err)
+	}
+
+	postResp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read POST response: %v", err)
+	}
+	_, _ = io.ReadAll(postResp.Body)
+	_ = postResp.Body.Close()
+	if postResp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status = %d, want %d", postResp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	getResp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read GET response: %v", err)
+	}
+	content, _ := io.ReadAll(getResp.Body)
+	_ = getResp.Body.Close()
+	if getResp.StatusCode != http.StatusOK || string(content) != "content" {
+		t.Fatalf("GET response = %d %q, want %d %q", getResp.StatusCode, content, http.StatusOK, "content")
+	}
+}
+
+// startIPv6Proxy serves handleRequest of s on an IPv6 only listener on the
+// loopback interface. The test is skipped if the host has no IPv6 support.
+func startIPv6Proxy(t *testing.T, s *Server) string {
+	t.Helper()
+
+	ln, err := s.config.listen("[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(s.handleRequest)}
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	return ln.Addr().String()
+}
+
+func TestIPv6ListenerTunnelsToBracketedTarget(t *testing.T) {
+	upstream, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(conn, "hello over ipv6")
+	}()
+	_, upstreamPort, _ := net.SplitHostPort(upstream.Addr().String())
+	port, _ := strconv.Atoi(upstreamPort)
+
+	cfg := &Config{ListenNetwork: "ipv6", Domains: []string{"::1"}, AllowOpenProxy: true}
+	cfg.HTTPS.ConnectPorts = []int{port}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	proxyAddr := startIPv6Proxy(t, s)
+	conn, err := net.Dial("tcp6", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	target := upstream.Addr().String()
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s status = %d, want %d", target, resp.StatusCode, http.StatusOK)
+	}
+
+	greeting, _ := io.ReadAll(reader)
+	if string(greeting) != "hello over ipv6" {
+		t.Fatalf("tunnel data = %q", greeting)
+	}
+
+	// Wait until the closed tunnel was tracked.
+	_ = conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.cache.GetStatsSnapshot(1).Totals.Tunnel == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIPv6ListenerCachesBracketedHost(t *testing.T) {
+	const payload = "ipv6-host-release"
+
+	var gotHost string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{ListenNetwork: "ipv6", Domains: []string{"2001:db8::1"}}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, upstream)
+
+	proxyURL, _ := url.Parse("http://" + startIPv6Proxy(t, s))
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://[2001:db8::1]:8080/debian/dists/stable/InRelease")
+	if err != nil {
+		t.Fatalf("GET through proxy: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != payload {
+		t.Fatalf("response = %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, payload)
+	}
+	if gotHost != "[2001:db8::1]:8080" {
+		t.Fatalf("upstream Host = %q, want [2001:db8::1]:8080", gotHost)
+	}
+	if _, err := os.Stat(filepath.Join(s.cache.CachePath, "2001:db8::1", "debian", "dists", "stable", "InRelease")); err != nil {
+		t.Fatalf("expected file to be cached under the IPv6 host: %v", err)
+	}
+}
@@ -4,10 +4,10 @@ import "net/http"
 
 // handleHTTP handles basic HTTP requests. Probably the most important function
 // as most repositories are accessed over HTTP.
-func handleHTTP(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	// Check if a override is set for the requested URL
-	checkOverrides(r)
+	s.checkOverrides(r)
 
 	// Perform the request and serve the response
-	cache.ServeFromRequest(r, w)
+	s.cache.ServeFromRequest(r, w)
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// newTestCache returns a cache which sends all upstream requests to the given
+// test server, regardless of the requested host and scheme. Without upstream,
+// the default transport is kept.
+func newTestCache(t *testing.T, upstream *httptest.Server) *fscache.FSCache {
+	t.Helper()
+
+	testCache := fscache.NewFSCache(t.TempDir())
+	if upstream == nil {
+		return testCache
+	}
+	testCache.SetTransport(&http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, upstream.Listener.Addr().String())
+		},
+		// The test server certificate doesn't match the requested hosts.
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, //nolint:gosec
+	})
+	return testCache
+}
+
+// withTestCache installs a test cache of newTestCache as package cache.
+func withTestCache(t *testing.T, upstream *httptest.Server) *fscache.FSCache {
+	t.Helper()
+
+	testCache := newTestCache(t, upstream)
+	old := cache
+	cache = testCache
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	return testCache
+}
+
+func TestHandleRequestAppliesUbuntuOverride(t *testing.T) {
+	const payload = "mirror-release"
+
+	var gotHost, gotPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		gotPath = r.URL.Path
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{Domains: []string{"ubuntu.com", "mirror.example.com"}}
+	cfg.Overrides.UbuntuServer = "mirror.example.com"
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, upstream)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://archive.ubuntu.com/ubuntu/dists/noble/InRelease", nil)
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if rr.Body.String() != payload {
+		t.Fatalf("body = %q, want %q", rr.Body.String(), payload)
+	}
+	if gotHost != "mirror.example.com" || gotPath != "/ubuntu/dists/noble/InRelease" {
+		t.Fatalf("upstream request = %s%s, want mirror.example.com/ubuntu/dists/noble/InRelease", gotHost, gotPath)
+	}
+
+	cached, err := os.ReadFile(filepath.Join(s.cache.CachePath, "mirror.example.com", "ubuntu", "dists", "noble", "InRelease"))
+	if err != nil {
+		t.Fatalf("expected file to be cached under the mirror host: %v", err)
+	}
+	if string(cached) != payload {
+		t.Fatalf("cached body = %q, want %q", cached, payload)
+	}
+	if _, err := os.Stat(filepath.Join(s.cache.CachePath, "archive.ubuntu.com")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be cached under the original host, stat error = %v", err)
+	}
+}
+
+func TestHandleRequestAppliesPathMapping(t *testing.T) {
+	const payload = "ubuntu-release"
+
+	var gotHost, gotPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+		gotPath = r.URL.Path
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	cfg := &Config{
+		Domains:      []string{"archive.ubuntu.com"},
+		PathMappings: map[string]string{"/ubuntu/": "archive.ubuntu.com/ubuntu"},
+	}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, upstream)
+
+	// A direct request like apt-cacher-ng clients send it.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ubuntu/dists/noble/InRelease", nil)
+	req.Host = "cache.example.com:3142"
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if gotHost != "archive.ubuntu.com" || gotPath != "/ubuntu/dists/noble/InRelease" {
+		t.Fatalf("upstream request = %s%s, want archive.ubuntu.com/ubuntu/dists/noble/InRelease", gotHost, gotPath)
+	}
+	if _, err := os.Stat(filepath.Join(s.cache.CachePath, "archive.ubuntu.com", "ubuntu", "dists", "noble", "InRelease")); err != nil {
+		t.Fatalf("expected file to be cached under the upstream host: %v", err)
+	}
+}
+
+func TestHandleRequestPurge(t *testing.T) {
+	cfg := &Config{Domains: []string{"deb.debian.org"}}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	// Purging is a management action, which is authorized with the package
+	// config.
+	withTestConfig(t, cfg)
+	s := newServer(cfg, withTestFiles(t, map[string]int{
+		"http://deb.debian.org/debian/pool/main/a/a.deb": 100,
+		"http://deb.debian.org/debian/pool/main/b/b.deb": 10,
+	}))
+
+	purge := func(method, remoteAddr, target, token string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.handleRequest(rr, req)
+		return rr
+	}
+
+	if rr := purge("PURGE", "192.0.2.10:12345", "http://deb.debian.org/debian/pool/main/a/a.deb", ""); rr.Code != http.StatusForbidden {
+		t.Fatalf("remote PURGE status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if rr := purge("PURGE", "127.0.0.1:12345", "http://deb.debian.org/debian/pool/main/a/a.deb", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"bytes":100`) {
+		t.Fatalf("local PURGE = %d %q, want 200 with 100 bytes", rr.Code, rr.Body.String())
+	}
+	if rr := purge(http.MethodDelete, "127.0.0.1:12345", "http://deb.debian.org/debian/pool/main/a/a.deb", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("DELETE of purged file status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	// With a management token, the token is required.
+	config.Management.Token = "secret"
+	if rr := purge(http.MethodDelete, "127.0.0.1:12345", "http://deb.debian.org/debian/pool/main/b/b.deb", ""); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("DELETE without token status = %d, want %d", rr.Code, http.StatusUnauthorized)
+	}
+	if rr := purge(http.MethodDelete, "192.0.2.10:12345", "http://deb.debian.org/debian/pool/main/b/b.deb", "secret"); rr.Code != http.StatusOK {
+		t.Fatalf("DELETE with token status = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
@@ -1,24 +1,53 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
 )
 
 // handleTUNNEL tunnels the request to the target host without any caching or
 // interception. This is used for CONNECT requests and passthrough domains.
-func handleTUNNEL(w http.ResponseWriter, r *http.Request) {
-	log.Printf("[INFO:TUNNEL:%s] Tunneling request to %s\n", r.RemoteAddr, r.Host)
+func (s *Server) handleTUNNEL(w http.ResponseWriter, r *http.Request) {
+	if !s.acquireHijackedConnection(w, r) {
+		return
+	}
+	defer releaseHijackedConnection()
+
+	slog.InfoContext(r.Context(), "Tunneling request", "event", "tunnel", "client", r.RemoteAddr, "host", r.Host)
 
 	// Connect to the target host
-	destConn, err := net.DialTimeout("tcp", r.Host, 5*time.Second)
+	destConn, err := s.dialTunnelTarget(r.Context(), r.Host)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		failure := classifyDialError(err)
+		switch failure {
+		case fscache.TunnelDialTimeout:
+			slog.WarnContext(r.Context(), "Timeout connecting to tunnel target", "event", "tunnel", "client", r.RemoteAddr, "host", r.Host, "error", err)
+		case fscache.TunnelDialRefused:
+			slog.WarnContext(r.Context(), "Connection to tunnel target refused", "event", "tunnel", "client", r.RemoteAddr, "host", r.Host, "error", err)
+		default:
+			slog.WarnContext(r.Context(), "Failed to connect to tunnel target", "event", "tunnel", "client", r.RemoteAddr, "host", r.Host, "error", err)
+		}
+
+		go func() {
+			if err := s.cache.TrackTunnelDialFailure(failure); err != nil {
+				slog.WarnContext(r.Context(), "Failed to track tunnel dial failure", "event", "tunnel", "error", err)
+			}
+		}()
+
+		fscache.Error(w, r, http.StatusServiceUnavailable, "upstream_unreachable", err.Error())
 		return
 	}
 	defer destConn.Close()
@@ -45,52 +74,260 @@ func handleTUNNEL(w http.ResponseWriter, r *http.Request) {
 	srcConnStr := fmt.Sprintf("%s->%s", srcConn.LocalAddr().String(), srcConn.RemoteAddr().String())
 	dstConnStr := fmt.Sprintf("%s->%s", destConn.LocalAddr().String(), destConn.RemoteAddr().String())
 
+	deadline := newTunnelDeadline(
+		time.Duration(s.config.Tunnel.IdleTimeoutSeconds)*time.Second,
+		time.Duration(s.config.Tunnel.MaxDurationSeconds)*time.Second,
+	)
+
 	var wg sync.WaitGroup
 
 	wg.Add(2)
-	var sizeIn, sizeOut int64
-	go func(size *int64) {
-		*size = transfer(&wg, destConn, srcConn, dstConnStr, srcConnStr)
-	}(&sizeOut)
-	go func(size *int64) {
-		*size = transfer(&wg, srcConn, destConn, srcConnStr, dstConnStr)
-	}(&sizeIn)
+	var upload, download int64
+	go func() {
+		defer wg.Done()
+		upload = transfer(r.Context(), destConn, srcConn, dstConnStr, srcConnStr, deadline)
+	}()
+	go func() {
+		defer wg.Done()
+		download = transfer(r.Context(), srcConn, destConn, srcConnStr, dstConnStr, deadline)
+	}()
 
 	wg.Wait()
 
-	// Log transfer statistics
-	go func(download int64) {
-		if err := cache.TrackTunnelRequest(download); err != nil {
-			log.Printf("[WARN:TUNNEL] failed to track tunnel request: %v\n", err)
+	if reason := deadline.reason(); reason != "" {
+		slog.InfoContext(r.Context(), "Tunnel closed", "event", "tunnel", "client", r.RemoteAddr, "host", r.Host, "reason", reason)
+	}
+
+	// Record the transferred bytes of both directions once the tunnel is
+	// closed.
+	go func(upload, download int64) {
+		if err := s.cache.TrackTunnelRequest(upload, download); err != nil {
+			slog.WarnContext(r.Context(), "Failed to track tunnel request", "event", "tunnel", "error", err)
+		}
+	}(upload, download)
+}
+
+// defaultTunnelDialTimeout is the time to connect to the target host of a
+// tunnel if no timeout is configured.
+const defaultTunnelDialTimeout = 5 * time.Second
+
+// dialTunnelTarget connects to the target host of a tunnel. If an address
+// family is preferred, the addresses of that family are tried first and the
+// others are used as fallback. The dial timeout applies to all attempts
+// together.
+func (s *Server) dialTunnelTarget(ctx context.Context, address string) (net.Conn, error) {
+	timeout := time.Duration(s.config.Tunnel.DialTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTunnelDialTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	if s.config.Tunnel.IPPreference == "" {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	preferIPv4 := s.config.Tunnel.IPPreference == "ipv4"
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].Unmap().Is4() == preferIPv4 && addrs[j].Unmap().Is4() != preferIPv4
+	})
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
 		}
-	}(sizeIn + sizeOut)
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// classifyDialError tells apart why a tunnel target couldn't be reached, so
+// timeouts and refused connections can be reported separately.
+func classifyDialError(err error) fscache.TunnelDialFailure {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fscache.TunnelDialRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return fscache.TunnelDialTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return fscache.TunnelDialTimeout
+	default:
+		return fscache.TunnelDialError
+	}
+}
+
+// tunnelDeadline tracks the activity of both directions of a tunnel. The
+// tunnel is closed if no data was transferred in any direction for the idle
+// timeout or if the maximum duration is reached.
+type tunnelDeadline struct {
+	idle         time.Duration // Idle timeout, 0 = disabled
+	end          time.Time     // Absolute end of the tunnel, zero = unlimited
+	lastActivity atomic.Int64  // Unix nanoseconds of the last transferred data
+
+	closeReason atomic.Pointer[string]
+}
+
+// newTunnelDeadline creates the deadline tracking for a new tunnel.
+func newTunnelDeadline(idle, maxDuration time.Duration) *tunnelDeadline {
+	d := &tunnelDeadline{idle: idle}
+	now := time.Now()
+	if maxDuration > 0 {
+		d.end = now.Add(maxDuration)
+	}
+	d.lastActivity.Store(now.UnixNano())
+	return d
+}
+
+// touch records transferred data.
+func (d *tunnelDeadline) touch() {
+	d.lastActivity.Store(time.Now().UnixNano())
+}
+
+// next returns the deadline for the next read or write. A zero time means no
+// deadline.
+func (d *tunnelDeadline) next() time.Time {
+	var next time.Time
+	if d.idle > 0 {
+		next = time.Now().Add(d.idle)
+	}
+	if !d.end.IsZero() && (next.IsZero() || d.end.Before(next)) {
+		next = d.end
+	}
+	return next
+}
+
+// expired checks if the tunnel has to be closed after a timeout of a single
+// read or write and records the reason. A timeout of one direction doesn't
+// close the tunnel if the other direction was active in the meantime.
+func (d *tunnelDeadline) expired() bool {
+	now := time.Now()
+	reason := ""
+	switch {
+	case !d.end.IsZero() && !now.Before(d.end):
+		reason = "maximum tunnel duration reached"
+	case d.idle > 0 && now.Sub(time.Unix(0, d.lastActivity.Load())) >= d.idle:
+		reason = "idle timeout reached"
+	default:
+		return false
+	}
+
+	d.closeReason.CompareAndSwap(nil, &reason)
+	return true
+}
+
+// reason returns why the tunnel was closed by a timeout, an empty string if it
+// was closed regularly.
+func (d *tunnelDeadline) reason() string {
+	if reason := d.closeReason.Load(); reason != nil {
+		return *reason
+	}
+	return ""
 }
 
 // transfer copies data from source to destination and logs any errors that
 // occur. It is used to tunnel data between the client and the target host.
-func transfer(wg *sync.WaitGroup, destination io.Writer, source io.Reader, destName, srcName string) int64 {
-	defer wg.Done()
-	transferSize, err := io.Copy(destination, source)
+// Reads and writes are bound to the deadline of the tunnel.
+//
+// If source reached EOF, only the write side of destination is closed so the
+// other direction can still deliver its remaining data. On errors both
+// connections are closed which also stops the copy of the other direction.
+func transfer(ctx context.Context, destination, source net.Conn, destName, srcName string, deadline *tunnelDeadline) int64 {
+	transferSize, err := copyWithDeadline(destination, source, deadline)
 	if err != nil {
-		// Ignore broken pipe errors
-		if netErr, ok := err.(*net.OpError); ok && netErr.Err.Error() == "write: broken pipe" {
-			log.Printf("[INFO:TUNNEL] Connection closed: %s -> %s\n", srcName, destName)
-		} else {
-			fmt.Printf("[ERR:TUNNEL] Error during copy from %s to %s: %v\n", srcName, destName, err)
+		// Disconnects of either side are part of normal operation
+		if isConnectionClosedError(err) {
+			slog.InfoContext(ctx, "Connection closed", "event", "tunnel", "source", srcName, "destination", destName)
+		} else if !errors.Is(err, os.ErrDeadlineExceeded) {
+			slog.ErrorContext(ctx, "Error during copy", "event", "tunnel", "source", srcName, "destination", destName, "error", err)
 		}
 	}
 
-	log.Printf("[INFO:TUNNEL] Transferred %d bytes from %s to %s\n", transferSize, srcName, destName)
+	slog.InfoContext(ctx, "Transferred bytes", "event", "tunnel", "source", srcName, "destination", destName, "bytes", transferSize)
 
-	// Close the destination connection to signal that we're done
-	if closer, ok := destination.(io.Closer); ok {
-		closer.Close()
+	if err != nil {
+		destination.Close()
+		source.Close()
+	} else {
+		closeWrite(destination)
 	}
 
-	// Close the source connection to signal that we're done
-	if closer, ok := source.(io.Closer); ok {
-		closer.Close()
+	return transferSize
+}
+
+// isConnectionClosedError reports if err was caused by the peer or the other
+// direction of the tunnel closing the connection.
+func isConnectionClosedError(err error) bool {
+	return errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// closeWrite signals EOF to the peer of conn while still allowing to read from
+// it. Connections which don't support half-closing (like *net.TCPConn and
+// *tls.Conn do) are closed completely.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err == nil {
+			return
+		}
 	}
+	conn.Close()
+}
 
-	return transferSize
+// copyWithDeadline copies from source to destination until EOF, an error or
+// the expiry of the tunnel deadline.
+func copyWithDeadline(destination, source net.Conn, deadline *tunnelDeadline) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+
+	for {
+		_ = source.SetReadDeadline(deadline.next())
+		n, readErr := source.Read(buf)
+		if n > 0 {
+			deadline.touch()
+
+			for chunk := buf[:n]; len(chunk) > 0; {
+				_ = destination.SetWriteDeadline(deadline.next())
+				wn, err := destination.Write(chunk)
+				written += int64(wn)
+				chunk = chunk[wn:]
+				if wn > 0 {
+					deadline.touch()
+				}
+				if err != nil {
+					if errors.Is(err, os.ErrDeadlineExceeded) && !deadline.expired() {
+						continue
+					}
+					return written, err
+				}
+			}
+		}
+
+		if readErr != nil {
+			if errors.Is(readErr, os.ErrDeadlineExceeded) && !deadline.expired() {
+				continue
+			}
+			if errors.Is(readErr, io.EOF) {
+				return written, nil
+			}
+			return written, readErr
+		}
+	}
 }
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// startEchoUpstream starts a TCP server which answers every connection with
+// the given greeting and then discards everything it receives.
+func startEchoUpstream(t *testing.T, greeting string) net.Listener {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.WriteString(conn, greeting)
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func TestHandleTUNNELTracksTransferredBytes(t *testing.T) {
+	const greeting = "hello from upstream"
+	const request = "client payload of 29 bytes..."
+
+	upstream := startEchoUpstream(t, greeting)
+	s := newTestServer(t, &Config{}, nil)
+	before := s.cache.GetStatsSnapshot(1).Totals
+
+	proxy := httptest.NewServer(http.HandlerFunc(s.handleTUNNEL))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	target := upstream.Addr().String()
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	received := make([]byte, len(greeting))
+	if _, err := io.ReadFull(reader, received); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	if string(received) != greeting {
+		t.Fatalf("greeting = %q, want %q", received, greeting)
+	}
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("write payload: %v", err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	_, _ = io.Copy(io.Discard, reader)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		after := s.cache.GetStatsSnapshot(1).Totals
+		if after.Tunnel == before.Tunnel+1 {
+			if after.TunnelUpload-before.TunnelUpload != uint64(len(request)) {
+				t.Fatalf("TunnelUpload delta = %d, want %d", after.TunnelUpload-before.TunnelUpload, len(request))
+			}
+			if after.TunnelDownload-before.TunnelDownload != uint64(len(greeting)) {
+				t.Fatalf("TunnelDownload delta = %d, want %d", after.TunnelDownload-before.TunnelDownload, len(greeting))
+			}
+			if after.TunnelTransfer-before.TunnelTransfer != uint64(len(request)+len(greeting)) {
+				t.Fatalf("TunnelTransfer delta = %d, want %d", after.TunnelTransfer-before.TunnelTransfer, len(request)+len(greeting))
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel request was not tracked, stats = %+v", after)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCopyWithDeadlineIdleTimeout(t *testing.T) {
+	source, sourcePeer := net.Pipe()
+	destination, destinationPeer := net.Pipe()
+	defer source.Close()
+	defer sourcePeer.Close()
+	defer destination.Close()
+	defer destinationPeer.Close()
+
+	deadline := newTunnelDeadline(50*time.Millisecond, 0)
+	start := time.Now()
+	_, err := copyWithDeadline(destination, source, deadline)
+	if err == nil {
+		t.Fatalf("expected copy to be aborted by the idle timeout")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("copy returned after %s, before the idle timeout", elapsed)
+	}
+	if got := deadline.reason(); got != "idle timeout reached" {
+		t.Fatalf("reason = %q, want idle timeout", got)
+	}
+}
+
+func TestCopyWithDeadlineOtherDirectionKeepsTunnelAlive(t *testing.T) {
+	source, sourcePeer := net.Pipe()
+	destination, destinationPeer := net.Pipe()
+	defer source.Close()
+	defer sourcePeer.Close()
+	defer destination.Close()
+	defer destinationPeer.Close()
+
+	deadline := newTunnelDeadline(50*time.Millisecond, 0)
+
+	// Simulate traffic of the other direction for a while.
+	activeUntil := time.Now().Add(200 * time.Millisecond)
+	go func() {
+		for time.Now().Before(activeUntil) {
+			deadline.touch()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	_, _ = copyWithDeadline(destination, source, deadline)
+	if time.Now().Before(activeUntil) {
+		t.Fatalf("tunnel was closed although the other direction was active")
+	}
+	if got := deadline.reason(); got != "idle timeout reached" {
+		t.Fatalf("reason = %q, want idle timeout", got)
+	}
+}
+
+func TestCopyWithDeadlineMaxDuration(t *testing.T) {
+	source, sourcePeer := net.Pipe()
+	destination, destinationPeer := net.Pipe()
+	defer source.Close()
+	defer sourcePeer.Close()
+	defer destination.Close()
+	defer destinationPeer.Close()
+
+	// Keep data flowing so the idle timeout never triggers.
+	go func() {
+		for {
+			if _, err := sourcePeer.Write([]byte("data")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	go func() { _, _ = io.Copy(io.Discard, destinationPeer) }()
+
+	deadline := newTunnelDeadline(time.Second, 100*time.Millisecond)
+	written, err := copyWithDeadline(destination, source, deadline)
+	if err == nil {
+		t.Fatalf("expected copy to be aborted by the maximum duration")
+	}
+	if written == 0 {
+		t.Fatalf("expected data to be copied before the maximum duration")
+	}
+	if got := deadline.reason(); got != "maximum tunnel duration reached" {
+		t.Fatalf("reason = %q, want maximum duration", got)
+	}
+}
+
+func TestCopyWithDeadlineEOF(t *testing.T) {
+	source, sourcePeer := net.Pipe()
+	destination, destinationPeer := net.Pipe()
+	defer source.Close()
+	defer destination.Close()
+	defer destinationPeer.Close()
+
+	go func() {
+		_, _ = sourcePeer.Write([]byte("payload"))
+		_ = sourcePeer.Close()
+	}()
+	received := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(destinationPeer)
+		received <- string(data)
+	}()
+
+	deadline := newTunnelDeadline(time.Second, 0)
+	written, err := copyWithDeadline(destination, source, deadline)
+	if err != nil {
+		t.Fatalf("copyWithDeadline() error = %v", err)
+	}
+	if written != int64(len("payload")) {
+		t.Fatalf("written = %d, want %d", written, len("payload"))
+	}
+	if got := deadline.reason(); got != "" {
+		t.Fatalf("reason = %q, want regular close", got)
+	}
+	_ = destination.Close()
+	if got := <-received; got != "payload" {
+		t.Fatalf("received = %q, want payload", got)
+	}
+}
+
+func TestHandleTUNNELHalfClose(t *testing.T) {
+	upload := bytes.Repeat([]byte("u"), 2<<20)
+	download := bytes.Repeat([]byte("d"), 4<<20)
+
+	// The upstream only answers after the client finished its upload, like
+	// a server which processes a request body before responding.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	received := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- int(n)
+		_, _ = conn.Write(download)
+	}()
+
+	s := newTestServer(t, &Config{}, nil)
+
+	proxy := httptest.NewServer(http.HandlerFunc(s.handleTUNNEL))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	target := ln.Addr().String()
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if _, err := conn.Write(upload); err != nil {
+		t.Fatalf("write upload: %v", err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read download: %v", err)
+	}
+	if got := <-received; got != len(upload) {
+		t.Fatalf("upstream received %d bytes, want %d", got, len(upload))
+	}
+	if !bytes.Equal(data, download) {
+		t.Fatalf("received %d bytes, want %d", len(data), len(download))
+	}
+
+	// Wait for the tunnel to be tracked before the cache is restored.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.cache.GetStatsSnapshot(1).Totals.Tunnel == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel request was not tracked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleTUNNELHalfCloseThroughProxyProtocol(t *testing.T) {
+	upload := bytes.Repeat([]byte("u"), 2<<20)
+	download := bytes.Repeat([]byte("d"), 1<<20)
+
+	// The upstream finishes its response first and keeps receiving the
+	// upload of the client afterwards.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	received := make(chan int, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write(download)
+		_ = conn.(*net.TCPConn).CloseWrite()
+		n, _ := io.Copy(io.Discard, conn)
+		received <- int(n)
+	}()
+
+	cfg := &Config{}
+	cfg.ProxyProtocol.Enable = true
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(s.handleTUNNEL))
+	proxy.Listener = cfg.newProxyProtocolListener(proxy.Listener)
+	proxy.Start()
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	target := ln.Addr().String()
+	if _, err := io.WriteString(conn, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nCONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	// The end of the download must only half-close the client connection.
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read download: %v", err)
+	}
+	if !bytes.Equal(data, download) {
+		t.Fatalf("received %d bytes, want %d", len(data), len(download))
+	}
+
+	if _, err := conn.Write(upload); err != nil {
+		t.Fatalf("write upload: %v", err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	select {
+	case got := <-received:
+		if got != len(upload) {
+			t.Fatalf("upstream received %d bytes, want %d", got, len(upload))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("upload was not forwarded")
+	}
+}
+
+func TestTransferHalfClosesDestination(t *testing.T) {
+	source, sourcePeer := net.Pipe()
+	defer source.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	destination, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer destination.Close()
+	destinationPeer, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer destinationPeer.Close()
+
+	go func() {
+		_, _ = sourcePeer.Write([]byte("payload"))
+		_ = sourcePeer.Close()
+	}()
+
+	deadline := newTunnelDeadline(time.Second, 0)
+	if n := transfer(context.Background(), destination, source, "destination", "source", deadline); n != int64(len("payload")) {
+		t.Fatalf("transfer() = %d, want %d", n, len("payload"))
+	}
+
+	data, err := io.ReadAll(destinationPeer)
+	if err != nil || string(data) != "payload" {
+		t.Fatalf("destination peer read = %q, %v", data, err)
+	}
+
+	// The read side of the destination must still be usable.
+	if _, err := io.WriteString(destinationPeer, "reply"); err != nil {
+		t.Fatalf("write reply: %v", err)
+	}
+	reply := make([]byte, len("reply"))
+	if _, err := io.ReadFull(destination, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("destination read = %q, %v", reply, err)
+	}
+}
+
+func TestHandleTUNNELTracksRefusedDial(t *testing.T) {
+	// Reserve a port and close it again, so connections are refused.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	target := ln.Addr().String()
+	_ = ln.Close()
+
+	s := newTestServer(t, &Config{}, nil)
+
+	req := httptest.NewRequest(http.MethodConnect, "http://"+target, nil)
+	req.Host = target
+	rec := httptest.NewRecorder()
+	s.handleTUNNEL(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		totals := s.cache.GetStatsSnapshot(1).Totals
+		if totals.TunnelDialRefused == 1 {
+			if totals.TunnelDialTimeouts != 0 || totals.TunnelDialErrors != 0 || totals.Tunnel != 0 {
+				t.Fatalf("unexpected stats = %+v", totals)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("refused dial was not tracked, stats = %+v", totals)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClassifyDialError(t *testing.T) {
+	tcs := []struct {
+		name string
+		err  error
+		want fscache.TunnelDialFailure
+	}{
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, fscache.TunnelDialRefused},
+		{"context deadline", &net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}, fscache.TunnelDialTimeout},
+		{"i/o timeout", &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, fscache.TunnelDialTimeout},
+		{"dns timeout", &net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true}, fscache.TunnelDialTimeout},
+		{"dns not found", &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, fscache.TunnelDialError},
+		{"unreachable", &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, fscache.TunnelDialError},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := classifyDialError(tc.err); got != tc.want {
+				t.Fatalf("classifyDialError() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDialTunnelTargetFallsBackToOtherFamily(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	cfg := &Config{}
+	cfg.Tunnel.DialTimeoutSeconds = 5
+	cfg.Tunnel.IPPreference = "ipv6"
+	s := newTestServer(t, cfg, nil)
+
+	// localhost may resolve to ::1 first, which isn't listening. The dial
+	// has to fall back to 127.0.0.1.
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	conn, err := s.dialTunnelTarget(context.Background(), net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("dialTunnelTarget() error = %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != ln.Addr().String() {
+		t.Fatalf("RemoteAddr = %q, want %q", got, ln.Addr().String())
+	}
+}
+
+// failingWriteConn is a connection whose writes fail with the given error.
+type failingWriteConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingWriteConn) Write([]byte) (int, error) {
+	return 0, c.err
+}
+
+func TestIsConnectionClosedError(t *testing.T) {
+	tcs := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"broken pipe", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"connection reset", &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{"closed connection", &net.OpError{Op: "read", Net: "tcp", Err: net.ErrClosed}, true},
+		{"wrapped", fmt.Errorf("copy: %w", syscall.EPIPE), true},
+		{"other", &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.ENETUNREACH)}, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isConnectionClosedError(tc.err); got != tc.want {
+				t.Fatalf("isConnectionClosedError() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTransferLogsBrokenPipeAsInfo(t *testing.T) {
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+	})
+
+	source, sourcePeer := net.Pipe()
+	defer source.Close()
+	destConn, destinationPeer := net.Pipe()
+	defer destinationPeer.Close()
+	destination := &failingWriteConn{
+		Conn: destConn,
+		err:  &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)},
+	}
+
+	go func() {
+		_, _ = sourcePeer.Write([]byte("payload"))
+		_ = sourcePeer.Close()
+	}()
+
+	transfer(context.Background(), destination, source, "destination", "source", newTunnelDeadline(time.Second, 0))
+
+	if !strings.Contains(logs.String(), `level=INFO msg="Connection closed" event=tunnel source=source destination=destination`) {
+		t.Fatalf("expected broken pipe to be logged as info, logs = %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "level=ERROR") {
+		t.Fatalf("broken pipe logged as error, logs = %q", logs.String())
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// proxyAuthenticatedKey marks requests in their context which were read from
+// an already authenticated CONNECT tunnel.
+type proxyAuthenticatedKey struct{}
+
+// withProxyAuthenticated returns a copy of r which is marked as authenticated.
+// Requests read from an intercepted CONNECT tunnel don't carry their own
+// Proxy-Authorization header, the CONNECT request itself was checked instead.
+func withProxyAuthenticated(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), proxyAuthenticatedKey{}, true))
+}
+
+// checkProxyAuth enforces the configured proxy credentials. If the request is
+// not authorized, a 407 Proxy Authentication Required response is sent and
+// false is returned.
+func (s *Server) checkProxyAuth(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.config.ProxyAuth.Users) == 0 {
+		return true
+	}
+	if authenticated, _ := r.Context().Value(proxyAuthenticatedKey{}).(bool); authenticated {
+		return true
+	}
+
+	username, ok := validProxyAuthorization(r.Header.Get("Proxy-Authorization"), s.config.ProxyAuth.Users)
+	if !ok {
+		realm := s.config.ProxyAuth.Realm
+		if realm == "" {
+			realm = "GoAPTCacher"
+		}
+
+		w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+		fscache.Error(w, r, http.StatusProxyAuthRequired, "proxy_auth_required", "Proxy Authentication Required")
+		if username != "" {
+			slog.InfoContext(r.Context(), "Invalid proxy credentials", "event", "proxy_auth", "client", r.RemoteAddr, "user", username, "status", http.StatusProxyAuthRequired)
+		} else {
+			slog.InfoContext(r.Context(), "Proxy authentication required", "event", "proxy_auth", "client", r.RemoteAddr, "status", http.StatusProxyAuthRequired)
+		}
+		return false
+	}
+
+	// Credentials are meant for the proxy only and must never be forwarded to
+	// the upstream server.
+	r.Header.Del("Proxy-Authorization")
+	return true
+}
+
+// validProxyAuthorization parses a Basic Proxy-Authorization header value and
+// checks the credentials against users. The username is returned whenever it
+// could be parsed, also if the credentials are invalid.
+func validProxyAuthorization(header string, users map[string]string) (string, bool) {
+	scheme, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", false
+	}
+
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", false
+	}
+
+	expected, found := users[username]
+	if !found {
+		// Compare anyway to not reveal valid usernames through timing.
+		subtle.ConstantTimeCompare([]byte(password), []byte(password))
+		return username, false
+	}
+
+	return username, subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func basicProxyAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestValidProxyAuthorization(t *testing.T) {
+	users := map[string]string{"apt": "secret"}
+
+	tcs := []struct {
+		name     string
+		header   string
+		wantUser string
+		want     bool
+	}{
+		{"valid", basicProxyAuth("apt", "secret"), "apt", true},
+		{"lowercase scheme", "basic " + base64.StdEncoding.EncodeToString([]byte("apt:secret")), "apt", true},
+		{"wrong password", basicProxyAuth("apt", "wrong"), "apt", false},
+		{"unknown user", basicProxyAuth("other", "secret"), "other", false},
+		{"missing", "", "", false},
+		{"other scheme", "Bearer token", "", false},
+		{"invalid base64", "Basic !!!", "", false},
+		{"missing colon", "Basic " + base64.StdEncoding.EncodeToString([]byte("apt")), "", false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			user, ok := validProxyAuthorization(tc.header, users)
+			if user != tc.wantUser || ok != tc.want {
+				t.Fatalf("validProxyAuthorization(%q) = %q, %v, want %q, %v", tc.header, user, ok, tc.wantUser, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleRequestRequiresProxyAuth(t *testing.T) {
+	cfg := &Config{}
+	cfg.ProxyAuth.Users = map[string]string{"apt": "secret"}
+	s := newTestServer(t, cfg, nil)
+
+	for _, method := range []string{http.MethodGet, http.MethodConnect} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "http://example.com/file", nil)
+		req.Host = "example.com:443"
+		s.handleRequest(rr, req)
+
+		if rr.Code != http.StatusProxyAuthRequired {
+			t.Fatalf("%s status = %d, want %d", method, rr.Code, http.StatusProxyAuthRequired)
+		}
+		if got := rr.Header().Get("Proxy-Authenticate"); got != `Basic realm="GoAPTCacher"` {
+			t.Fatalf("%s Proxy-Authenticate = %q", method, got)
+		}
+	}
+}
+
+func TestCheckProxyAuthStripsCredentials(t *testing.T) {
+	cfg := &Config{}
+	cfg.ProxyAuth.Users = map[string]string{"apt": "secret"}
+	s := newTestServer(t, cfg, nil)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+	req.Header.Set("Proxy-Authorization", basicProxyAuth("apt", "secret"))
+
+	if !s.checkProxyAuth(rr, req) {
+		t.Fatalf("expected valid credentials to be accepted")
+	}
+	if req.Header.Get("Proxy-Authorization") != "" {
+		t.Fatalf("expected Proxy-Authorization header to be removed")
+	}
+}
+
+func TestCheckProxyAuthAcceptsTunneledRequests(t *testing.T) {
+	cfg := &Config{}
+	cfg.ProxyAuth.Users = map[string]string{"apt": "secret"}
+	s := newTestServer(t, cfg, nil)
+
+	rr := httptest.NewRecorder()
+	req := withProxyAuthenticated(httptest.NewRequest(http.MethodGet, "https://example.com/file", nil))
+
+	if !s.checkProxyAuth(rr, req) {
+		t.Fatalf("expected request from authenticated tunnel to be accepted")
+	}
+}
+
+func TestHandleRequestInternalPagesWithoutProxyAuth(t *testing.T) {
+	cfg := &Config{}
+	cfg.ProxyAuth.Users = map[string]string{"apt": "secret"}
+	s := newTestServer(t, cfg, nil)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/robots.txt", nil)
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+}
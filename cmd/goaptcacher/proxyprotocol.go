@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocolHeaderTimeout is the time a client has to send the PROXY
+// protocol header after the connection was established.
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+// proxyProtocolV2Signature is the fixed signature of a PROXY protocol v2
+// header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener wraps a listener and parses the HAProxy PROXY protocol
+// header (v1 and v2) sent by load balancers in front of GoAPTCacher. The
+// address from the header is returned as RemoteAddr of the connection.
+type proxyProtocolListener struct {
+	net.Listener
+	trusted []netip.Prefix // Peers which are allowed to send a header, empty = all peers
+}
+
+// newProxyProtocolListener wraps ln if PROXY protocol support is enabled,
+// otherwise ln is returned unchanged.
+func (c *Config) newProxyProtocolListener(ln net.Listener) net.Listener {
+	if !c.ProxyProtocol.Enable {
+		return ln
+	}
+
+	return &proxyProtocolListener{Listener: ln, trusted: c.proxyProtocolSources}
+}
+
+// Accept returns the next connection. The header is parsed lazily on first use
+// of the connection, so a slow client doesn't block accepting other clients.
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// Connections of peers which aren't trusted are used as they are.
+	if len(l.trusted) > 0 {
+		addr, ok := remoteAddrIP(conn.RemoteAddr().String())
+		if !ok || !prefixesContain(l.trusted, addr) {
+			return conn, nil
+		}
+	}
+
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn is a connection which starts with a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+// readHeader parses the PROXY protocol header once. If the header is invalid,
+// the connection is closed.
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		c.remoteAddr, c.err = parseProxyProtocolHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+
+		if c.err != nil {
+			slog.Warn("Invalid PROXY protocol header", "event", "proxy_protocol", "client", c.Conn.RemoteAddr().String(), "error", c.err)
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address sent by the load balancer. If the
+// header doesn't contain an address (e.g. health checks), the address of the
+// peer is returned.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the connection, so CONNECT tunnels can signal EOF.
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// parseProxyProtocolHeader reads a PROXY protocol v1 or v2 header from r. The
+// returned address is nil if the header doesn't carry a client address.
+func parseProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(5)
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	switch {
+	case string(start) == "PROXY":
+		return parseProxyProtocolV1(r)
+	case bytes.HasPrefix(proxyProtocolV2Signature, start):
+		return parseProxyProtocolV2(r)
+	default:
+		return nil, errors.New("missing PROXY protocol header")
+	}
+}
+
+// parseProxyProtocolV1 parses a human readable v1 header like
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func parseProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	// A v1 header is at most 107 bytes long including the CRLF.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+// parseProxyProtocolV2 parses a binary v2 header. TLVs are skipped.
+func parseProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) {
+		return nil, errors.New("invalid v2 signature")
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading v2 addresses: %w", err)
+	}
+
+	// LOCAL commands are sent by the load balancer itself, e.g. health checks.
+	switch header[12] & 0x0f {
+	case 0x0:
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", header[12]&0x0f)
+	}
+
+	switch header[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.New("v2 IPv4 address block too short")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10]))), nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("v2 IPv6 address block too short")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16])).Unmap()
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34]))), nil
+	default:
+		// AF_UNSPEC and AF_UNIX don't carry a usable client address.
+		return nil, nil
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func proxyProtocolV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestParseProxyProtocolHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 192, 0, 2, 2, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1").To16())
+	copy(ipv6[16:], net.ParseIP("2001:db8::2").To16())
+	binary.BigEndian.PutUint16(ipv6[32:], 40000)
+	binary.BigEndian.PutUint16(ipv6[34:], 443)
+
+	tcs := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 40000 443\r\nGET", "[2001:db8::1]:40000", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\nGET", "", false},
+		{"v1 family mismatch", "PROXY TCP4 2001:db8::1 192.0.2.2 56324 443\r\n", "", true},
+		{"v1 malformed", "PROXY TCP4 192.0.2.1\r\n", "", true},
+		{"v1 missing crlf", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("A", 200), "", true},
+		{"v2 ipv4", string(proxyProtocolV2Header(0x1, 0x11, ipv4)) + "GET", "192.0.2.1:56324", false},
+		{"v2 ipv6", string(proxyProtocolV2Header(0x1, 0x21, ipv6)) + "GET", "[2001:db8::1]:40000", false},
+		{"v2 ipv4 with tlv", string(proxyProtocolV2Header(0x1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00))) + "GET", "192.0.2.1:56324", false},
+		{"v2 local", string(proxyProtocolV2Header(0x0, 0x00, nil)) + "GET", "", false},
+		{"v2 truncated", string(proxyProtocolV2Header(0x1, 0x11, ipv4[:6])), "", true},
+		{"missing header", "GET / HTTP/1.1\r\n", "", true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tc.input))
+			addr, err := parseProxyProtocolHeader(reader)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.want {
+				t.Fatalf("address = %q, want %q", got, tc.want)
+			}
+
+			// The payload following the header must be preserved.
+			rest, _ := io.ReadAll(reader)
+			if string(rest) != "GET" {
+				t.Fatalf("remaining payload = %q, want %q", rest, "GET")
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	cfg := &Config{}
+	cfg.ProxyProtocol.Enable = true
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln := cfg.newProxyProtocolListener(tcpListener)
+	defer ln.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		_, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nhello"))
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Fatalf("RemoteAddr = %q, want %q", got, "192.0.2.1:56324")
+	}
+	payload, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(payload) != "hello" {
+		t.Fatalf("payload = %q, want %q", payload, "hello")
+	}
+}
+
+func TestProxyProtocolListenerUntrustedPeer(t *testing.T) {
+	cfg := &Config{}
+	cfg.ProxyProtocol.Enable = true
+	cfg.ProxyProtocol.TrustedSources = []string{"192.0.2.0/24"}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln := cfg.newProxyProtocolListener(tcpListener)
+	defer ln.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", tcpListener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer client.Close()
+		_, _ = client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"))
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	defer conn.Close()
+
+	// The header of an untrusted peer must not be evaluated.
+	if _, ok := conn.(*proxyProtocolConn); ok {
+		t.Fatalf("expected plain connection for untrusted peer")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// defaultRateLimitMaxClients is the number of clients tracked by the rate
+// limiter if no limit is configured.
+const defaultRateLimitMaxClients = 10000
+
+// tokenBucket is a simple token bucket which is refilled continuously with rate
+// tokens per second up to burst tokens. The token count may become negative if
+// more than available is taken, e.g. for transferred bytes which are only known
+// after the response was sent.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+}
+
+// rateLimitClient holds the buckets of a single client.
+type rateLimitClient struct {
+	addr      netip.Addr
+	requests  tokenBucket
+	bandwidth tokenBucket
+}
+
+// clientRateLimiter limits requests and transferred bytes per client IP. The
+// number of tracked clients is bounded, if the limit is reached the least
+// recently seen client is forgotten.
+type clientRateLimiter struct {
+	requestRate    float64
+	requestBurst   float64
+	bandwidthRate  float64
+	bandwidthBurst float64
+	maxClients     int
+	exempt         []netip.Prefix
+
+	mux     sync.Mutex
+	clients map[netip.Addr]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+// newClientRateLimiter creates the rate limiter for the given configuration.
+// If no limits are configured, nil is returned.
+func newClientRateLimiter(c *Config) (*clientRateLimiter, error) {
+	limits := c.RateLimit
+	if limits.RequestsPerSecond < 0 || limits.BytesPerSecond < 0 || limits.Burst < 0 || limits.BytesBurst < 0 || limits.MaxClients < 0 {
+		return nil, fmt.Errorf("rate_limit: values must not be negative")
+	}
+	if limits.RequestsPerSecond == 0 && limits.BytesPerSecond == 0 {
+		return nil, nil
+	}
+
+	exempt, err := parsePrefixes(limits.Exempt)
+	if err != nil {
+		return nil, fmt.Errorf("rate_limit.exempt: %w", err)
+	}
+
+	limiter := &clientRateLimiter{
+		requestRate:    limits.RequestsPerSecond,
+		requestBurst:   float64(limits.Burst),
+		bandwidthRate:  float64(limits.BytesPerSecond),
+		bandwidthBurst: float64(limits.BytesBurst),
+		maxClients:     limits.MaxClients,
+		exempt:         exempt,
+		clients:        make(map[netip.Addr]*list.Element),
+		lru:            list.New(),
+		now:            time.Now,
+	}
+
+	// A burst smaller than the rate would never allow the full rate.
+	if limiter.requestBurst < limiter.requestRate {
+		limiter.requestBurst = max(limiter.requestRate, 1)
+	}
+	if limiter.bandwidthBurst < limiter.bandwidthRate {
+		limiter.bandwidthBurst = limiter.bandwidthRate
+	}
+	if limiter.maxClients == 0 {
+		limiter.maxClients = defaultRateLimitMaxClients
+	}
+
+	return limiter, nil
+}
+
+// isExempt reports if the client is not subject to rate limiting.
+func (l *clientRateLimiter) isExempt(addr netip.Addr) bool {
+	return addr.IsLoopback() || prefixesContain(l.exempt, addr)
+}
+
+// client returns the refilled buckets of addr, creating them if necessary.
+// The caller must hold l.mux.
+func (l *clientRateLimiter) client(addr netip.Addr, now time.Time) *rateLimitClient {
+	if element, ok := l.clients[addr]; ok {
+		l.lru.MoveToFront(element)
+		client := element.Value.(*rateLimitClient)
+		client.requests.refill(now, l.requestRate, l.requestBurst)
+		client.bandwidth.refill(now, l.bandwidthRate, l.bandwidthBurst)
+		return client
+	}
+
+	for l.lru.Len() >= l.maxClients {
+		oldest := l.lru.Back()
+		l.lru.Remove(oldest)
+		delete(l.clients, oldest.Value.(*rateLimitClient).addr)
+	}
+
+	client := &rateLimitClient{
+		addr:      addr,
+		requests:  tokenBucket{tokens: l.requestBurst, last: now},
+		bandwidth: tokenBucket{tokens: l.bandwidthBurst, last: now},
+	}
+	l.clients[addr] = l.lru.PushFront(client)
+	return client
+}
+
+// allow takes a request token of the client and checks if the client has
+// bandwidth left. If the client has to wait, false is returned together with
+// the duration after which the next request will be accepted.
+func (l *clientRateLimiter) allow(addr netip.Addr) (bool, time.Duration) {
+	if l.isExempt(addr) {
+		return true, 0
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	client := l.client(addr, l.now())
+
+	if l.bandwidthRate > 0 && client.bandwidth.tokens < 0 {
+		return false, time.Duration(-client.bandwidth.tokens / l.bandwidthRate * float64(time.Second))
+	}
+
+	if l.requestRate > 0 {
+		if client.requests.tokens < 1 {
+			return false, time.Duration((1 - client.requests.tokens) / l.requestRate * float64(time.Second))
+		}
+		client.requests.tokens--
+	}
+
+	return true, 0
+}
+
+// consume takes the given number of transferred bytes from the bandwidth
+// bucket of the client.
+func (l *clientRateLimiter) consume(addr netip.Addr, bytes int64) {
+	if l.bandwidthRate == 0 || bytes <= 0 || l.isExempt(addr) {
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	client := l.client(addr, l.now())
+	client.bandwidth.tokens -= float64(bytes)
+}
+
+// checkRateLimit enforces the configured per-client limits. If the client has
+// exceeded its limits, a 429 Too Many Requests response is sent and false is
+// returned. Otherwise the returned response writer must be used to serve the
+// request, it accounts the transferred bytes to the client.
+func (s *Server) checkRateLimit(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, bool) {
+	limiter := s.config.rateLimiter
+	if limiter == nil {
+		return w, true
+	}
+
+	addr, ok := s.config.clientIP(r)
+	if !ok {
+		return w, true
+	}
+
+	allowed, retryAfter := limiter.allow(addr)
+	if !allowed {
+		seconds := int(retryAfter.Round(time.Second) / time.Second)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", max(seconds, 1)))
+		fscache.Error(w, r, http.StatusTooManyRequests, "rate_limited", "Too Many Requests")
+		slog.InfoContext(r.Context(), "Rate limit exceeded", "event", "rate_limit", "client", r.RemoteAddr, "status", http.StatusTooManyRequests)
+		return w, false
+	}
+
+	if limiter.bandwidthRate == 0 || limiter.isExempt(addr) {
+		return w, true
+	}
+	if accounted, _ := r.Context().Value(bandwidthAccountedKey{}).(bool); accounted {
+		return w, true
+	}
+
+	return &rateLimitResponseWriter{ResponseWriter: w, limiter: limiter, addr: addr}, true
+}
+
+// bandwidthAccountedKey marks requests in their context whose transferred
+// bytes are already accounted by the connection they were read from.
+type bandwidthAccountedKey struct{}
+
+// withBandwidthAccounted returns a copy of r which is marked as accounted.
+// Requests read from an intercepted CONNECT tunnel are sent over the hijacked
+// connection of the CONNECT request, which already accounts all bytes.
+func withBandwidthAccounted(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), bandwidthAccountedKey{}, true))
+}
+
+// rateLimitResponseWriter accounts all written bytes to the bandwidth bucket
+// of the client.
+type rateLimitResponseWriter struct {
+	http.ResponseWriter
+	limiter *clientRateLimiter
+	addr    netip.Addr
+}
+
+func (w *rateLimitResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.limiter.consume(w.addr, int64(n))
+	return n, err
+}
+
+// ReadFrom copies src using the ReadFrom of the wrapped response writer if
+// available, which allows the server to send cached files with sendfile.
+func (w *rateLimitResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, src)
+	w.limiter.consume(w.addr, n)
+	return n, err
+}
+
+func (w *rateLimitResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *rateLimitResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *rateLimitResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("webserver doesn't support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &rateLimitConn{Conn: conn, limiter: w.limiter, addr: w.addr}, rw, nil
+}
+
+// rateLimitConn accounts all bytes written to a hijacked connection, e.g. a
+// CONNECT tunnel, to the bandwidth bucket of the client.
+type rateLimitConn struct {
+	net.Conn
+	limiter *clientRateLimiter
+	addr    netip.Addr
+}
+
+func (c *rateLimitConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.limiter.consume(c.addr, int64(n))
+	return n, err
+}
+
+// ReadFrom copies src using the ReadFrom of the wrapped connection if
+// available, which allows splicing tunneled data between TCP connections.
+func (c *rateLimitConn) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(c.Conn, src)
+	}
+	c.limiter.consume(c.addr, n)
+	return n, err
+}
+
+// CloseWrite closes the write side of the wrapped connection if supported, so
+// half-closed tunnels keep working.
+func (c *rateLimitConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
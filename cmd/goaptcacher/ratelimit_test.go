@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(t *testing.T, cfg *Config) (*clientRateLimiter, *time.Time) {
+	t.Helper()
+	limiter, err := newClientRateLimiter(cfg)
+	if err != nil {
+		t.Fatalf("newClientRateLimiter: %v", err)
+	}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestClientRateLimiterRequests(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.RequestsPerSecond = 1
+	cfg.RateLimit.Burst = 2
+	limiter, now := newTestRateLimiter(t, cfg)
+	addr := netip.MustParseAddr("192.168.1.20")
+
+	for i := range 2 {
+		if ok, _ := limiter.allow(addr); !ok {
+			t.Fatalf("request %d within burst was rejected", i)
+		}
+	}
+	ok, retryAfter := limiter.allow(addr)
+	if ok {
+		t.Fatalf("expected request exceeding burst to be rejected")
+	}
+	if retryAfter != time.Second {
+		t.Fatalf("retryAfter = %s, want 1s", retryAfter)
+	}
+
+	// Other clients have their own bucket.
+	if ok, _ := limiter.allow(netip.MustParseAddr("192.168.1.21")); !ok {
+		t.Fatalf("expected other client to be allowed")
+	}
+
+	*now = now.Add(time.Second)
+	if ok, _ := limiter.allow(addr); !ok {
+		t.Fatalf("expected request after refill to be allowed")
+	}
+}
+
+func TestClientRateLimiterBandwidth(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.BytesPerSecond = 1000
+	limiter, now := newTestRateLimiter(t, cfg)
+	addr := netip.MustParseAddr("192.168.1.20")
+
+	if ok, _ := limiter.allow(addr); !ok {
+		t.Fatalf("expected first request to be allowed")
+	}
+	limiter.consume(addr, 3000)
+
+	ok, retryAfter := limiter.allow(addr)
+	if ok {
+		t.Fatalf("expected request after exhausted bandwidth to be rejected")
+	}
+	if retryAfter != 2*time.Second {
+		t.Fatalf("retryAfter = %s, want 2s", retryAfter)
+	}
+
+	*now = now.Add(2 * time.Second)
+	if ok, _ := limiter.allow(addr); !ok {
+		t.Fatalf("expected request after refill to be allowed")
+	}
+}
+
+// readerFromRecorder records whether the response body was sent using
+// ReadFrom, like the sendfile path of the HTTP server.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestRateLimitResponseWriterReadFrom(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.BytesPerSecond = 1000
+	limiter, _ := newTestRateLimiter(t, cfg)
+	addr := netip.MustParseAddr("192.168.1.20")
+
+	rec := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	w := &rateLimitResponseWriter{ResponseWriter: rec, limiter: limiter, addr: addr}
+	// http.ServeFile copies cached files through a limited reader.
+	n, err := io.Copy(w, io.LimitReader(strings.NewReader(strings.Repeat("x", 4000)), 3000))
+	if err != nil || n != 3000 {
+		t.Fatalf("copy = %d, %v", n, err)
+	}
+	if !rec.readFrom {
+		t.Fatalf("expected ReadFrom of the wrapped writer to be used")
+	}
+	if ok, _ := limiter.allow(addr); ok {
+		t.Fatalf("expected bytes sent with ReadFrom to be accounted")
+	}
+}
+
+func TestRateLimitResponseWriterHijackAccountsTunnel(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.BytesPerSecond = 1000
+	limiter, _ := newTestRateLimiter(t, cfg)
+	addr := netip.MustParseAddr("192.168.1.20")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &rateLimitResponseWriter{ResponseWriter: w, limiter: limiter, addr: addr}
+		conn, _, err := rw.Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, strings.NewReader(strings.Repeat("x", 3000)))
+		closeWrite(conn)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	body, err := io.ReadAll(conn)
+	if err != nil || len(body) != 3000 {
+		t.Fatalf("read %d bytes, %v", len(body), err)
+	}
+
+	if ok, _ := limiter.allow(addr); ok {
+		t.Fatalf("expected tunneled bytes to be accounted")
+	}
+}
+
+func TestClientRateLimiterExempt(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.RequestsPerSecond = 1
+	cfg.RateLimit.Exempt = []string{"10.0.0.0/8"}
+	limiter, _ := newTestRateLimiter(t, cfg)
+
+	for _, addr := range []string{"127.0.0.1", "::1", "10.1.2.3"} {
+		for range 5 {
+			if ok, _ := limiter.allow(netip.MustParseAddr(addr)); !ok {
+				t.Fatalf("expected exempt client %s to be allowed", addr)
+			}
+		}
+	}
+	if len(limiter.clients) != 0 {
+		t.Fatalf("expected exempt clients not to be tracked, got %d", len(limiter.clients))
+	}
+}
+
+func TestClientRateLimiterBoundsTrackedClients(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.RequestsPerSecond = 1
+	cfg.RateLimit.MaxClients = 2
+	limiter, _ := newTestRateLimiter(t, cfg)
+
+	first := netip.MustParseAddr("192.168.1.1")
+	limiter.allow(first)
+	limiter.allow(netip.MustParseAddr("192.168.1.2"))
+	limiter.allow(netip.MustParseAddr("192.168.1.3"))
+
+	if len(limiter.clients) != 2 || limiter.lru.Len() != 2 {
+		t.Fatalf("tracked clients = %d/%d, want 2", len(limiter.clients), limiter.lru.Len())
+	}
+	if _, ok := limiter.clients[first]; ok {
+		t.Fatalf("expected least recently seen client to be evicted")
+	}
+}
+
+func TestNewClientRateLimiterDisabledAndInvalid(t *testing.T) {
+	limiter, err := newClientRateLimiter(&Config{})
+	if err != nil || limiter != nil {
+		t.Fatalf("expected disabled limiter, got %v, %v", limiter, err)
+	}
+
+	cfg := &Config{}
+	cfg.RateLimit.RequestsPerSecond = -1
+	if _, err := newClientRateLimiter(cfg); err == nil {
+		t.Fatalf("expected error for negative rate")
+	}
+
+	cfg = &Config{}
+	cfg.RateLimit.RequestsPerSecond = 1
+	cfg.RateLimit.Exempt = []string{"invalid"}
+	if _, err := newClientRateLimiter(cfg); err == nil {
+		t.Fatalf("expected error for invalid exempt range")
+	}
+}
+
+func TestHandleRequestRateLimited(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.RequestsPerSecond = 1
+	cfg.RateLimit.Burst = 1
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	serve := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/robots.txt", nil)
+		req.RemoteAddr = "192.168.1.20:40000"
+		s.handleRequest(rr, req)
+		return rr
+	}
+
+	if rr := serve(); rr.Code != http.StatusOK {
+		t.Fatalf("first status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	rr := serve()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("second status = %d, want %d", rr.Code, http.StatusTooManyRequests)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected Retry-After header")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// reloadMux guards the settings which are replaced on SIGHUP: the domain
+// lists of the config, AllowOpenProxy, HTTPS.CertificatePublicKey and the
+// interception handler of the server.
+var reloadMux sync.RWMutex
+
+// domainLists are the domain lists of the running configuration.
+type domainLists struct {
+	domains     []string // Domains which are cached and proxied
+	passthrough []string // Domains which are proxied without caching
+	denied      []string // Domains which are never proxied
+	loaded      int      // Number of cached and passthrough domains, 0 allows all domains if openProxy is set
+	openProxy   bool     // allow_open_proxy is set
+}
+
+// currentDomains returns the domain lists used for new requests.
+func (c *Config) currentDomains() domainLists {
+	reloadMux.RLock()
+	defer reloadMux.RUnlock()
+
+	return domainLists{
+		domains:     c.Domains,
+		passthrough: c.PassthroughDomains,
+		denied:      c.DeniedDomains,
+		loaded:      len(c.Domains) + len(c.PassthroughDomains),
+		openProxy:   c.AllowOpenProxy,
+	}
+}
+
+// reloadConfig reads the config file at path again and applies the domain
+// lists and the CA material of HTTPS interception to new requests. Existing
+// connections and tunnels keep their settings. If the new config is invalid,
+// the running config is kept and the error is returned.
+func (s *Server) reloadConfig(path string) error {
+	updated, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := updated.checkOpenProxy(); err != nil {
+		return err
+	}
+	if updated.HTTPS.Intercept != s.config.HTTPS.Intercept {
+		return errors.New("https.intercept can't be changed without restart")
+	}
+
+	// The CA is only replaced if it changed, otherwise the issued
+	// certificates are kept.
+	var (
+		settings   interceptSettings
+		newHandler = s.intercept
+	)
+	if updated.HTTPS.Intercept {
+		settings, err = loadInterceptSettings(updated)
+		if err != nil {
+			return err
+		}
+
+		reloadMux.RLock()
+		changed := settings != s.interceptLoaded
+		reloadMux.RUnlock()
+
+		if changed {
+			newHandler, err = newIntercept(settings)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	reloadMux.Lock()
+	s.config.Domains = updated.Domains
+	s.config.PassthroughDomains = updated.PassthroughDomains
+	s.config.DeniedDomains = updated.DeniedDomains
+	s.config.AllowOpenProxy = updated.AllowOpenProxy
+	caReplaced := newHandler != s.intercept
+	if caReplaced {
+		s.config.HTTPS.CertificatePublicKey = updated.HTTPS.CertificatePublicKey
+		s.intercept = newHandler
+		s.interceptLoaded = settings
+	}
+	reloadMux.Unlock()
+
+	slog.Info("Reloaded config", "event", "reload", "path", path, "domains", len(updated.Domains), "passthrough_domains", len(updated.PassthroughDomains), "denied_domains", len(updated.DeniedDomains), "ca_replaced", caReplaced)
+	if caReplaced {
+		// The CRL has to be signed by the new CA.
+		s.generateCRL()
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestReloadConfigReplacesDomainLists(t *testing.T) {
+	cfg := &Config{Domains: []string{"deb.debian.org"}}
+	s := newServer(cfg, nil)
+
+	path := writeTempConfig(t, `
+domains:
+  - deb.debian.org
+  - archive.ubuntu.com
+passthrough_domains:
+  - download.docker.com
+denied_domains:
+  - security.debian.org
+`)
+	if err := s.reloadConfig(path); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+
+	lists := cfg.currentDomains()
+	if !slices.Equal(lists.domains, []string{"deb.debian.org", "archive.ubuntu.com"}) {
+		t.Fatalf("domains = %v", lists.domains)
+	}
+	if !slices.Equal(lists.passthrough, []string{"download.docker.com"}) || !slices.Equal(lists.denied, []string{"security.debian.org"}) {
+		t.Fatalf("passthrough = %v, denied = %v", lists.passthrough, lists.denied)
+	}
+	if lists.loaded != 3 {
+		t.Fatalf("loaded = %d, want 3", lists.loaded)
+	}
+}
+
+func TestReloadConfigKeepsConfigOnError(t *testing.T) {
+	cfg := &Config{Domains: []string{"deb.debian.org"}}
+	s := newServer(cfg, nil)
+
+	tcs := map[string]string{
+		"invalid":   "domains:\n  - archive.ubuntu.com\nlog:\n  level: loud\n",
+		"intercept": "domains:\n  - archive.ubuntu.com\nhttps:\n  intercept: true\n",
+		"open":      "denied_domains:\n  - archive.ubuntu.com\n",
+	}
+	for name, content := range tcs {
+		if err := s.reloadConfig(writeTempConfig(t, content)); err == nil {
+			t.Fatalf("%s: expected reload to fail", name)
+		}
+		if domains := cfg.currentDomains().domains; !slices.Equal(domains, []string{"deb.debian.org"}) {
+			t.Fatalf("%s: domains = %v, want the running config", name, domains)
+		}
+	}
+	if err := s.reloadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected reload of a missing file to fail")
+	}
+}
+
+func TestReloadConfigReplacesChangedCA(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{CacheDirectory: dir}
+	cfg.HTTPS.Intercept = true
+	cfg.HTTPS.CertificatePublicKey = filepath.Join(dir, "ca.crt")
+	cfg.HTTPS.CertificatePrivateKey = filepath.Join(dir, "ca.key")
+	s := newServer(cfg, nil)
+
+	writeCA := func() {
+		t.Helper()
+		certPEM, keyPEM := newTestCA(t)
+		if err := os.WriteFile(cfg.HTTPS.CertificatePublicKey, certPEM, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if err := os.WriteFile(cfg.HTTPS.CertificatePrivateKey, keyPEM, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	writeCA()
+
+	settings, err := loadInterceptSettings(cfg)
+	if err != nil {
+		t.Fatalf("loadInterceptSettings() error = %v", err)
+	}
+	initial, err := newIntercept(settings)
+	if err != nil {
+		t.Fatalf("newIntercept() error = %v", err)
+	}
+	s.setIntercept(initial, settings)
+
+	path := writeTempConfig(t, "cache_directory: "+dir+"\nallow_open_proxy: true\nhttps:\n  intercept: true\n  cert: "+cfg.HTTPS.CertificatePublicKey+"\n  key: "+cfg.HTTPS.CertificatePrivateKey+"\n")
+
+	// Unchanged CA material keeps the handler and the issued certificates.
+	if err := s.reloadConfig(path); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+	if s.currentIntercept() != initial {
+		t.Fatal("expected the interception handler to be kept")
+	}
+
+	writeCA()
+	if err := s.reloadConfig(path); err != nil {
+		t.Fatalf("reloadConfig() error = %v", err)
+	}
+	if s.currentIntercept() == initial {
+		t.Fatal("expected the interception handler to be replaced")
+	}
+
+	// A broken CA is rejected, the running handler stays in place.
+	replaced := s.currentIntercept()
+	if err := os.WriteFile(cfg.HTTPS.CertificatePrivateKey, []byte("broken"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := s.reloadConfig(path); err == nil {
+		t.Fatal("expected reload with a broken key to fail")
+	}
+	if s.currentIntercept() != replaced {
+		t.Fatal("expected the running interception handler to be kept")
+	}
+}
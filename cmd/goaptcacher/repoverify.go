@@ -3,11 +3,13 @@ package main
 import (
 	"fmt"
 	"io/fs"
-	"log"
+	"log/slog"
 	"path/filepath"
 	"slices"
+	"strings"
 
 	"gitlab.com/bella.network/goaptcacher/pkg/debrepocleaner"
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
 )
 
 type cachedRepository struct {
@@ -15,6 +17,23 @@ type cachedRepository struct {
 	distrib  string
 }
 
+// repositoryVerification is the result of verifying a single cached
+// repository.
+type repositoryVerification struct {
+	Repository string   `json:"repository"` // Path of the repository relative to the cache directory
+	Dist       string   `json:"dist"`
+	Mismatches []string `json:"mismatches"`      // Files with a mismatching checksum, relative to the cache directory
+	Error      string   `json:"error,omitempty"` // Reason why the repository couldn't be verified
+}
+
+// repositoryVerificationReport summarizes the verification of cached
+// repositories.
+type repositoryVerificationReport struct {
+	Repositories []repositoryVerification `json:"repositories"`
+	Mismatches   int                      `json:"mismatches"` // Total number of mismatching files
+	Failures     int                      `json:"failures"`   // Number of repositories which couldn't be verified
+}
+
 func runVerifyRepositories(cacheDirectory string) error {
 	repositories, err := discoverCachedRepositories(cacheDirectory)
 	if err != nil {
@@ -22,73 +41,87 @@ func runVerifyRepositories(cacheDirectory string) error {
 	}
 
 	if len(repositories) == 0 {
-		log.Printf("[DEBREPOCLEANER-INFO] No repositories with InRelease metadata found under %s", cacheDirectory)
+		slog.Info("No repositories with InRelease metadata found", "event", "repo_verify", "path", cacheDirectory)
 		return nil
 	}
 
-	var failedRepositories int
-	var mismatchingFiles int
+	report := verifyCachedRepositories(cacheDirectory, repositories)
+	if report.Failures > 0 {
+		return fmt.Errorf("%d repositories could not be verified", report.Failures)
+	}
+
+	return nil
+}
+
+// verifyCachedRepositories verifies the metadata and package checksums of the
+// given repositories and logs the progress.
+func verifyCachedRepositories(cacheDirectory string, repositories []cachedRepository) repositoryVerificationReport {
+	report := repositoryVerificationReport{Repositories: make([]repositoryVerification, 0, len(repositories))}
 
-	log.Printf("[DEBREPOCLEANER-INFO] Verifying %d cached repositories", len(repositories))
+	slog.Info("Verifying cached repositories", "event", "repo_verify", "repositories", len(repositories))
 
 	for _, repository := range repositories {
-		cleanup, err := debrepocleaner.New(repository.rootPath, repository.distrib)
-		if err != nil {
-			failedRepositories++
-			log.Printf(
-				"[DEBREPOCLEANER-WARN] Failed to initialize repository %s (%s): %v",
-				repository.rootPath,
-				repository.distrib,
-				err,
-			)
-			continue
+		result := repositoryVerification{
+			Repository: relativeCachePath(cacheDirectory, repository.rootPath),
+			Dist:       repository.distrib,
+			Mismatches: []string{},
 		}
 
-		mismatches, err := cleanup.VerifyChecksums()
+		mismatches, err := verifyCachedRepository(repository)
 		if err != nil {
-			failedRepositories++
-			log.Printf(
-				"[DEBREPOCLEANER-WARN] Failed to verify repository %s (%s): %v",
-				repository.rootPath,
-				repository.distrib,
-				err,
-			)
+			report.Failures++
+			result.Error = err.Error()
+			slog.Warn("Failed to verify repository", "event", "repo_verify", "path", repository.rootPath, "dist", repository.distrib, "error", err)
+			report.Repositories = append(report.Repositories, result)
 			continue
 		}
 
+		for _, mismatch := range mismatches {
+			result.Mismatches = append(result.Mismatches, relativeCachePath(cacheDirectory, mismatch))
+		}
+		report.Repositories = append(report.Repositories, result)
+
 		if len(mismatches) == 0 {
-			log.Printf(
-				"[DEBREPOCLEANER-INFO] Repository verified successfully: %s (%s)",
-				repository.rootPath,
-				repository.distrib,
-			)
+			slog.Info("Repository verified successfully", "event", "repo_verify", "path", repository.rootPath, "dist", repository.distrib)
 			continue
 		}
 
-		mismatchingFiles += len(mismatches)
-		log.Printf(
-			"[DEBREPOCLEANER-WARN] Repository has %d mismatching files: %s (%s)",
-			len(mismatches),
-			repository.rootPath,
-			repository.distrib,
-		)
+		report.Mismatches += len(mismatches)
+		slog.Warn("Repository has mismatching files", "event", "repo_verify", "path", repository.rootPath, "dist", repository.distrib, "mismatches", len(mismatches))
 		for _, mismatch := range mismatches {
-			log.Printf("[DEBREPOCLEANER-WARN] mismatch: %s", mismatch)
+			slog.Warn("Mismatching file", "event", "repo_verify", "path", mismatch)
 		}
 	}
 
-	log.Printf(
-		"[DEBREPOCLEANER-INFO] Repository verification finished: repositories=%d mismatches=%d failures=%d",
-		len(repositories),
-		mismatchingFiles,
-		failedRepositories,
-	)
+	slog.Info("Repository verification finished", "event", "repo_verify", "repositories", len(repositories), "mismatches", report.Mismatches, "failures", report.Failures)
+
+	return report
+}
 
-	if failedRepositories > 0 {
-		return fmt.Errorf("%d repositories could not be verified", failedRepositories)
+// verifyCachedRepository returns the files of the repository with a
+// mismatching checksum.
+func verifyCachedRepository(repository cachedRepository) ([]string, error) {
+	cleanup, err := debrepocleaner.New(repository.rootPath, repository.distrib)
+	if err != nil {
+		return nil, fmt.Errorf("initializing repository: %w", err)
+	}
+	if config != nil && config.CacheLayout == fscache.LayoutSharded {
+		cleanup.PackagePath = fscache.ShardPath
 	}
 
-	return nil
+	return cleanup.VerifyChecksums()
+}
+
+// relativeCachePath returns path relative to the cache directory with forward
+// slashes. If path is outside of the cache directory, it is returned
+// unchanged.
+func relativeCachePath(cacheDirectory, path string) string {
+	relative, err := filepath.Rel(cacheDirectory, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return path
+	}
+
+	return filepath.ToSlash(relative)
 }
 
 func discoverCachedRepositories(cacheDirectory string) ([]cachedRepository, error) {
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -55,3 +61,102 @@ func TestDiscoverCachedRepositories(t *testing.T) {
 		t.Fatalf("discoverCachedRepositories() = %#v, want %#v", repositories, want)
 	}
 }
+
+// writeTestRepository creates a repository below cacheDir whose only package
+// has the given content, while the index expects other content.
+func writeTestRepository(t *testing.T, cacheDir, root, dist, debContent, expectedContent string) {
+	t.Helper()
+
+	packages := "Package: a\n" +
+		"Filename: pool/main/a/a.deb\n" +
+		"SHA256: " + checksumHex(expectedContent) + "\n\n"
+	inRelease := "SHA256:\n" +
+		" " + checksumHex(packages) + " " + strconv.Itoa(len(packages)) + " main/binary-amd64/Packages\n"
+
+	files := map[string]string{
+		filepath.Join(root, "dists", dist, "InRelease"):                        inRelease,
+		filepath.Join(root, "dists", dist, "main", "binary-amd64", "Packages"): packages,
+		filepath.Join(root, "pool", "main", "a", "a.deb"):                      debContent,
+	}
+	for path, content := range files {
+		path = filepath.Join(cacheDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll(%q) returned error: %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile(%q) returned error: %v", path, err)
+		}
+	}
+}
+
+func checksumHex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyCachedRepositoriesReport(t *testing.T) {
+	cacheDir := t.TempDir()
+	writeTestRepository(t, cacheDir, filepath.Join("mirror.example.org", "debian"), "stable", "corrupted", "expected")
+	writeTestRepository(t, cacheDir, filepath.Join("mirror.example.org", "ubuntu"), "noble", "expected", "expected")
+
+	repositories, err := discoverCachedRepositories(cacheDir)
+	if err != nil {
+		t.Fatalf("discoverCachedRepositories() returned error: %v", err)
+	}
+
+	report := verifyCachedRepositories(cacheDir, repositories)
+	want := repositoryVerificationReport{
+		Repositories: []repositoryVerification{
+			{Repository: "mirror.example.org/debian", Dist: "stable", Mismatches: []string{"mirror.example.org/debian/pool/main/a/a.deb"}},
+			{Repository: "mirror.example.org/ubuntu", Dist: "noble", Mismatches: []string{}},
+		},
+		Mismatches: 1,
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("verifyCachedRepositories() = %#v, want %#v", report, want)
+	}
+}
+
+func TestVerifyRepositoriesAPI(t *testing.T) {
+	cacheDir := t.TempDir()
+	writeTestRepository(t, cacheDir, filepath.Join("mirror.example.org", "debian"), "stable", "corrupted", "expected")
+	writeTestRepository(t, cacheDir, filepath.Join("mirror.example.org", "ubuntu"), "noble", "expected", "expected")
+	withTestConfig(t, &Config{CacheDirectory: cacheDir})
+
+	tests := []struct {
+		name       string
+		query      string
+		remoteAddr string
+		want       int
+		wantRepos  int
+	}{
+		{name: "all", remoteAddr: "127.0.0.1:12345", want: http.StatusOK, wantRepos: 2},
+		{name: "single", query: "?repository=mirror.example.org/debian&dist=stable", remoteAddr: "127.0.0.1:12345", want: http.StatusOK, wantRepos: 1},
+		{name: "unknown", query: "?repository=mirror.example.org/missing", remoteAddr: "127.0.0.1:12345", want: http.StatusNotFound},
+		{name: "remote", remoteAddr: "192.0.2.10:12345", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/verify-repos"+tt.query, nil)
+			req.RemoteAddr = tt.remoteAddr
+			handleIndexRequests(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body = %s", rr.Code, tt.want, rr.Body.String())
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var report repositoryVerificationReport
+			if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if len(report.Repositories) != tt.wantRepos || report.Mismatches != 1 {
+				t.Fatalf("report = %+v, want %d repositories and 1 mismatch", report, tt.wantRepos)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+	"gitlab.com/bella.network/goaptcacher/pkg/httpsintercept"
+)
+
+// Server handles the proxy requests of clients: plain HTTP requests,
+// intercepted CONNECT requests and tunnels. The management pages and the
+// background tasks use the package config and cache, which are the ones of the
+// server started by main.
+type Server struct {
+	config *Config          // Configuration the requests are handled with
+	cache  *fscache.FSCache // Cache object used to store cached files
+
+	// The interception handler and the settings it was built from are
+	// replaced on SIGHUP and guarded by reloadMux.
+	intercept       *httpsintercept.Intercept // nil if HTTPS interception is disabled
+	interceptLoaded interceptSettings
+}
+
+// newServer creates a server which handles requests with c and stores files in
+// cache. HTTPS interception is disabled until an interception handler is set
+// with setIntercept.
+func newServer(c *Config, cache *fscache.FSCache) *Server {
+	return &Server{config: c, cache: cache}
+}
+
+// setIntercept sets the interception handler and the settings it was built
+// from.
+func (s *Server) setIntercept(handler *httpsintercept.Intercept, settings interceptSettings) {
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	s.intercept = handler
+	s.interceptLoaded = settings
+}
@@ -1,43 +1,92 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
-func ListenHTTP() {
-	// Create a new HTTP server with the handleRequest function as the handler
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", config.ListenPort),
-		Handler: http.HandlerFunc(handleRequest),
+// ListenHTTP binds the proxy on listen_port of all listen addresses, or on the
+// Unix domain socket set by listen, and serves requests in the background.
+func (s *Server) ListenHTTP() {
+	addresses := s.config.listenEndpoints(s.config.ListenPort)
+	if s.config.Listen != "" {
+		addresses = []string{s.config.Listen}
+	}
 
-		ReadHeaderTimeout: 90 * time.Second,
-		IdleTimeout:       120 * time.Second,
+	for _, address := range addresses {
+		s.serveHTTP(address)
 	}
+}
 
-	// Start the server and log any errors
-	log.Printf("[INFO] Starting proxy server on port %d\n", config.ListenPort)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal("[ERR] Error starting proxy server: ", err)
+// ListenHTTPAlternative binds the proxy on an alternative port of all listen
+// addresses and serves requests in the background.
+func (s *Server) ListenHTTPAlternative(port int) {
+	for _, address := range s.config.listenEndpoints(port) {
+		s.serveHTTP(address)
 	}
 }
 
-// ListenHTTPAlternative starts an HTTP server on an alternative port
-func ListenHTTPAlternative(port int) {
+// listenEndpoints returns the addresses to bind for port. Without configured
+// listen addresses, port is bound on all interfaces.
+func (c *Config) listenEndpoints(port int) []string {
+	if len(c.listenAddresses) == 0 {
+		return []string{fmt.Sprintf(":%d", port)}
+	}
+
+	endpoints := make([]string, len(c.listenAddresses))
+	for i, addr := range c.listenAddresses {
+		endpoints[i] = net.JoinHostPort(addr.String(), strconv.Itoa(port))
+	}
+	return endpoints
+}
+
+// serveHTTP binds address and serves requests on it in the background. As this
+// happens at startup, an address which can't be bound is fatal.
+func (s *Server) serveHTTP(address string) {
 	// Create a new HTTP server with the handleRequest function as the handler
-	server := http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(handleRequest),
+	server := &http.Server{
+		Addr:    address,
+		Handler: withAccessLog(s.config, withTracing(s.handleRequest)),
 
 		ReadHeaderTimeout: 90 * time.Second,
 		IdleTimeout:       120 * time.Second,
 	}
 
-	// Start the server and log any errors
-	log.Printf("[INFO] Starting alternative proxy server on port %d\n", port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal("[ERR] Error starting alternative proxy server: ", err)
+	ln, err := s.config.listen(address)
+	if err != nil {
+		fatal("Error starting proxy server", "event", "startup", "address", address, "error", err)
+	}
+	slog.Info("Listening for proxy requests", "event", "startup", "address", ln.Addr().String())
+
+	registerServer(server)
+	go func() {
+		// If enabled, the PROXY protocol header is parsed on all accepted
+		// connections.
+		if err := server.Serve(s.config.newProxyProtocolListener(ln)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Proxy server failed", "event", "startup", "address", address, "error", err)
+		}
+	}()
+}
+
+// listen binds address. Addresses starting with unix: are bound as Unix
+// domain socket, all others as TCP address of the configured listen network.
+func (c *Config) listen(address string) (net.Listener, error) {
+	if path, ok := unixSocketPath(address); ok {
+		return listenUnix(path, c.listenSocketMode)
+	}
+	return net.Listen(c.tcpListenNetwork(), address)
+}
+
+// tcpListenNetwork returns the network of the TCP listeners. "tcp" binds
+// addresses without host dual-stack, so IPv4 and IPv6 clients are accepted.
+func (c *Config) tcpListenNetwork() string {
+	if c.listenNetwork == "" {
+		return "tcp"
 	}
+	return c.listenNetwork
 }
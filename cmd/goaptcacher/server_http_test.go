@@ -0,0 +1,88 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestListenEndpoints(t *testing.T) {
+	cfg := &Config{ListenAddresses: []string{"10.0.0.1", "[fd00::1]"}}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	withTestConfig(t, cfg)
+
+	if got, want := config.listenEndpoints(8090), []string{"10.0.0.1:8090", "[fd00::1]:8090"}; !slices.Equal(got, want) {
+		t.Fatalf("listenEndpoints() = %v, want %v", got, want)
+	}
+
+	withTestConfig(t, &Config{})
+	if got, want := config.listenEndpoints(3142), []string{":3142"}; !slices.Equal(got, want) {
+		t.Fatalf("listenEndpoints() = %v, want %v", got, want)
+	}
+}
+
+func TestListenBindsTCPAddress(t *testing.T) {
+	ln, err := (&Config{}).listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen() error = %v", err)
+	}
+	defer ln.Close()
+
+	if ln.Addr().Network() != "tcp" {
+		t.Fatalf("network = %q, want tcp", ln.Addr().Network())
+	}
+}
+
+func TestReadConfigRejectsInvalidListenAddress(t *testing.T) {
+	path := writeTempConfig(t, "listen_addresses:\n  - eth0\n")
+
+	if _, err := ReadConfig(path); err == nil {
+		t.Fatal("expected error for listen address which is not an IP address")
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	tcs := []struct {
+		network string
+		want    string
+	}{
+		{"", "tcp"},
+		{"dual", "tcp"},
+		{"ipv4", "tcp4"},
+		{"ipv6", "tcp6"},
+	}
+
+	for _, tc := range tcs {
+		cfg := &Config{ListenNetwork: tc.network}
+		if err := cfg.compile(); err != nil {
+			t.Fatalf("compile(%q) error = %v", tc.network, err)
+		}
+		if got := cfg.tcpListenNetwork(); got != tc.want {
+			t.Fatalf("tcpListenNetwork() for %q = %q, want %q", tc.network, got, tc.want)
+		}
+	}
+}
+
+func TestListenIPv4OnlyRejectsIPv6(t *testing.T) {
+	cfg := &Config{ListenNetwork: "ipv4"}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	if ln, err := cfg.listen("[::1]:0"); err == nil {
+		_ = ln.Close()
+		t.Fatal("expected an IPv4 only listener to refuse an IPv6 address")
+	}
+}
+
+func TestReadConfigRejectsInvalidListenNetwork(t *testing.T) {
+	for _, content := range []string{
+		"listen_network: ipx\n",
+		"listen_network: ipv4\nlisten_addresses:\n  - \"fd00::1\"\n",
+		"listen_network: ipv6\nlisten_addresses:\n  - 10.0.0.1\n",
+	} {
+		if _, err := ReadConfig(writeTempConfig(t, content)); err == nil {
+			t.Fatalf("ReadConfig(%q) expected error", content)
+		}
+	}
+}
@@ -2,50 +2,70 @@ package main
 
 import (
 	"crypto/tls"
-	"fmt"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 )
 
-func ListenHTTPS() {
+// ListenHTTPS binds the HTTPS interception listener on listen_port_secure of
+// all listen addresses and serves requests in the background.
+func (s *Server) ListenHTTPS() {
+	// If s.config.ListenPortSecure is 0, start the server on port 8091
+	if s.config.ListenPortSecure == 0 {
+		s.config.ListenPortSecure = 8091
+	}
+
+	for _, address := range s.config.listenEndpoints(s.config.ListenPortSecure) {
+		s.serveHTTPS(address)
+	}
+}
+
+// serveHTTPS binds address and serves TLS connections on it in the
+// background. As this happens at startup, an address which can't be bound is
+// fatal.
+func (s *Server) serveHTTPS(address string) {
 	tlsconfig := &tls.Config{
-		GetCertificate:           intercept.ReturnCert,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.currentIntercept().ReturnCert(hello)
+		},
 		PreferServerCipherSuites: true,
-		MinVersion:               tls.VersionTLS12,
 		MaxVersion:               tls.VersionTLS13,
 	}
+	s.config.applyInterceptTLSSettings(tlsconfig)
 
-	// If config.ListenPortSecure is 0, start the server on port 8091
-	if config.ListenPortSecure == 0 {
-		config.ListenPortSecure = 8091
-	}
-
-	ln, err := tls.Listen("tcp", fmt.Sprintf(":%d", config.ListenPortSecure), tlsconfig)
+	tcpListener, err := net.Listen(s.config.tcpListenNetwork(), address)
 	if err != nil {
-		log.Println(err)
-		return
+		fatal("Error starting HTTPS proxy server", "event", "startup", "address", address, "error", err)
 	}
-	defer ln.Close()
+	slog.Info("Listening for HTTPS proxy requests", "event", "startup", "address", tcpListener.Addr().String())
+
+	// The PROXY protocol header is sent before the TLS handshake.
+	ln := tls.NewListener(s.config.newProxyProtocolListener(tcpListener), tlsconfig)
 
 	// HTTP handler
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", config.ListenPortSecure),
-		Handler: http.HandlerFunc(handleRequest),
+		Addr:    address,
+		Handler: withAccessLog(s.config, withTracing(s.handleRequest)),
 
 		ReadHeaderTimeout: 90 * time.Second,
 		IdleTimeout:       120 * time.Second,
 	}
 
 	// start TLS server
-	log.Printf("[INFO] Starting proxy server on port %d\n", config.ListenPortSecure)
-	err = server.Serve(ln)
-	if err != nil {
-		if strings.Contains(err.Error(), "tls: ") || strings.Contains(err.Error(), "alert") {
-			log.Printf("[TLS-ALERT] A client has aborted the TLS-connection due to a certificate error: %v", err)
-		} else {
-			log.Fatal("Web server (HTTPS): ", err)
+	registerServer(server)
+	go func() {
+		defer ln.Close()
+
+		err := server.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if strings.Contains(err.Error(), "tls: ") || strings.Contains(err.Error(), "alert") {
+				slog.Warn("A client has aborted the TLS-connection due to a certificate error", "event", "tls_alert", "error", err)
+			} else {
+				fatal("Web server (HTTPS) failed", "event", "startup", "error", err)
+			}
 		}
-	}
+	}()
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/lib/web"
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// managementSeparated reports if the web interface, the APIs and the debug
+// endpoints are served on a dedicated listener instead of the proxy ports.
+func (c *Config) managementSeparated() bool {
+	return c.Management.Listen != ""
+}
+
+// isCertificatePath reports if path is the CA certificate or the CRL. Both are
+// referenced by the certificates issued for HTTPS interception and must stay
+// reachable on the proxy ports.
+func isCertificatePath(path string) bool {
+	return path == "/_goaptcacher/goaptcacher.crt" || path == "/_goaptcacher/revocation.crl"
+}
+
+// ListenManagement binds the management listener and serves the web
+// interface on it in the background. As this happens at startup, an address
+// which can't be bound is fatal.
+func ListenManagement() {
+	address := config.Management.Listen
+	server := &http.Server{
+		Addr:    address,
+		Handler: withAccessLog(config, withTracing(handleManagementRequest)),
+
+		ReadHeaderTimeout: 90 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	ln, err := config.listen(address)
+	if err != nil {
+		fatal("Error starting management server", "event", "startup", "address", address, "error", err)
+	}
+	slog.Info("Listening for management requests", "event", "startup", "address", ln.Addr().String())
+
+	registerServer(server)
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Management server failed", "event", "startup", "address", address, "error", err)
+		}
+	}()
+}
+
+// handleManagementRequest serves the web interface, the APIs and the debug
+// endpoints on the management listener. Requests are never proxied.
+func handleManagementRequest(w http.ResponseWriter, r *http.Request) {
+	requestID := cache.GenerateUUID()
+	r = r.WithContext(fscache.WithRequestID(r.Context(), requestID))
+	w.Header().Set("X-Request-ID", requestID)
+
+	if handleHealthRequests(w, r) {
+		return
+	}
+
+	if !config.isClientAllowed(r) {
+		fscache.Error(w, r, http.StatusForbidden, "client_not_allowed", "Forbidden")
+		slog.InfoContext(r.Context(), "Client not allowed", "event", "access_denied", "client", r.RemoteAddr, "host", r.Host, "status", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodConnect || r.URL.IsAbs() {
+		http.Error(w, "This is the management interface, use the proxy port for proxy requests", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/_goaptcacher/"):
+		handleIndexRequests(w, r)
+	case r.URL.Path == "/" || r.URL.Path == "/_goaptcacher":
+		http.Redirect(w, r, "/_goaptcacher/", http.StatusTemporaryRedirect)
+	case r.URL.Path == "/favicon.ico":
+		w.Header().Set("Content-Type", "image/x-icon")
+		_, _ = w.Write(web.Favicon)
+	case r.URL.Path == "/robots.txt":
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("User-agent: *\nDisallow: /\n"))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func withManagementListener(t *testing.T) *Config {
+	t.Helper()
+
+	cfg := &Config{}
+	cfg.Management.Listen = "127.0.0.1:0"
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	withTestConfig(t, cfg)
+
+	old := cache
+	cache = fscache.NewFSCache(t.TempDir())
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	return cfg
+}
+
+func TestProxyPortHidesManagementWithDedicatedListener(t *testing.T) {
+	s := newTestServer(t, withManagementListener(t), nil)
+
+	for _, path := range []string{"/_goaptcacher/", "/_goaptcacher/stats", "/_goaptcacher/api/stats", "/_goaptcacher/debug/pprof/", "/_goaptcacher"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://proxy"+path, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		s.handleRequest(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("%s: status = %d, want %d", path, rr.Code, http.StatusNotFound)
+		}
+	}
+
+	// auto-apt-proxy still detects the proxy on /.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://proxy/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	s.handleRequest(rr, req)
+	if rr.Code != http.StatusNotAcceptable || rr.Body.Len() != 0 {
+		t.Fatalf("status = %d, body = %q, want %d without link to the index page", rr.Code, rr.Body.String(), http.StatusNotAcceptable)
+	}
+}
+
+func TestProxyPortServesCertificateWithDedicatedListener(t *testing.T) {
+	cfg := withManagementListener(t)
+	s := newTestServer(t, cfg, nil)
+	cfg.HTTPS.Intercept = true
+	cfg.HTTPS.CertificatePublicKey = filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(cfg.HTTPS.CertificatePublicKey, []byte("certificate"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://proxy/_goaptcacher/goaptcacher.crt", nil)
+	req.RemoteAddr = "192.0.2.10:12345"
+	s.handleRequest(rr, req)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != "certificate" {
+		t.Fatalf("status = %d, body = %q, want the certificate", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandleManagementRequest(t *testing.T) {
+	withManagementListener(t)
+
+	tcs := []struct {
+		target string
+		want   int
+	}{
+		{"/_goaptcacher/version", http.StatusOK},
+		{"/", http.StatusTemporaryRedirect},
+		{"/robots.txt", http.StatusOK},
+		{"/pool/main/p/pkg.deb", http.StatusNotFound},
+		{"http://deb.debian.org/debian/dists/bookworm/InRelease", http.StatusBadRequest},
+	}
+
+	for _, tc := range tcs {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handleManagementRequest(rr, req)
+
+		if rr.Code != tc.want {
+			t.Fatalf("%s: status = %d, want %d", tc.target, rr.Code, tc.want)
+		}
+	}
+}
+
+func TestReadConfigRejectsInvalidManagementListen(t *testing.T) {
+	path := writeTempConfig(t, "management:\n  listen: \"8091\"\n")
+
+	if _, err := ReadConfig(path); err == nil {
+		t.Fatal("expected error for management listen address without port separator")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// withoutPackageState clears the package config and cache for the test, so
+// any use of them by a server panics.
+func withoutPackageState(t *testing.T) {
+	t.Helper()
+	withTestConfig(t, nil)
+	old := cache
+	cache = nil
+	t.Cleanup(func() {
+		cache = old
+	})
+}
+
+// newTestServer returns a server which handles requests with cfg and stores
+// files in its own cache of newTestCache. The package config and cache are
+// left alone.
+func newTestServer(t *testing.T, cfg *Config, upstream *httptest.Server) *Server {
+	t.Helper()
+	return newServer(cfg, newTestCache(t, upstream))
+}
+
+func TestServersUseTheirOwnConfigAndCache(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "release")
+	}))
+	defer upstream.Close()
+
+	// Without package config and cache, the servers can't fall back to them.
+	withoutPackageState(t)
+
+	newTestCacheServer := func(domain string) (*Server, *fscache.FSCache) {
+		cfg := &Config{Domains: []string{domain}}
+		if err := cfg.compile(); err != nil {
+			t.Fatalf("compile() error = %v", err)
+		}
+		s := newTestServer(t, cfg, upstream)
+		return s, s.cache
+	}
+	debian, debianCache := newTestCacheServer("deb.debian.org")
+	ubuntu, ubuntuCache := newTestCacheServer("archive.ubuntu.com")
+
+	get := func(s *Server, rawURL string) int {
+		req := httptest.NewRequest(http.MethodGet, rawURL, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		rr := httptest.NewRecorder()
+		s.handleRequest(rr, req)
+		return rr.Code
+	}
+
+	if code := get(debian, "http://deb.debian.org/debian/dists/stable/InRelease"); code != http.StatusOK {
+		t.Fatalf("debian server status = %d, want %d", code, http.StatusOK)
+	}
+	if code := get(ubuntu, "http://deb.debian.org/debian/dists/stable/InRelease"); code != http.StatusForbidden {
+		t.Fatalf("ubuntu server status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := get(ubuntu, "http://archive.ubuntu.com/ubuntu/dists/noble/InRelease"); code != http.StatusOK {
+		t.Fatalf("ubuntu server status = %d, want %d", code, http.StatusOK)
+	}
+
+	// Each server stores the files in its own cache.
+	if _, err := os.Stat(filepath.Join(debianCache.CachePath, "deb.debian.org", "debian", "dists", "stable", "InRelease")); err != nil {
+		t.Fatalf("expected file in the debian cache: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ubuntuCache.CachePath, "deb.debian.org")); !os.IsNotExist(err) {
+		t.Fatalf("expected no debian files in the ubuntu cache, got %v", err)
+	}
+}
+
+func TestServerUsesItsTrustedProxies(t *testing.T) {
+	withoutPackageState(t)
+
+	cfg := &Config{
+		AllowedClients: []string{"192.0.2.0/24"},
+		TrustedProxies: []string{"198.51.100.1/32"},
+	}
+	cfg.RateLimit.RequestsPerSecond = 1
+	cfg.RateLimit.Burst = 1
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+
+	get := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/robots.txt", nil)
+		req.RemoteAddr = "198.51.100.1:40000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rr := httptest.NewRecorder()
+		s.handleRequest(rr, req)
+		return rr.Code
+	}
+
+	// The clients behind the load balancer are checked and limited
+	// individually.
+	if code := get("192.0.2.10"); code != http.StatusOK {
+		t.Fatalf("allowed client status = %d, want %d", code, http.StatusOK)
+	}
+	if code := get("192.0.2.11"); code != http.StatusOK {
+		t.Fatalf("other allowed client status = %d, want %d", code, http.StatusOK)
+	}
+	if code := get("192.0.2.10"); code != http.StatusTooManyRequests {
+		t.Fatalf("rate limited client status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := get("203.0.113.5"); code != http.StatusForbidden {
+		t.Fatalf("disallowed client status = %d, want %d", code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	serversMux sync.Mutex
+	servers    []*http.Server // Proxy servers which are shut down on exit
+)
+
+// registerServer adds server to the servers which stop accepting connections
+// on shutdown.
+func registerServer(server *http.Server) {
+	serversMux.Lock()
+	defer serversMux.Unlock()
+
+	servers = append(servers, server)
+}
+
+// waitForShutdown blocks until SIGINT or SIGTERM is received and shuts the
+// proxy down gracefully. A second signal terminates the program immediately.
+func waitForShutdown() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		slog.Warn("Error notifying systemd", "event", "systemd", "error", err)
+	}
+
+	timeout := time.Duration(config.ShutdownTimeoutSeconds) * time.Second
+	slog.Info("Shutting down", "event", "shutdown", "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdown(ctx)
+
+	slog.Info("Shutdown complete", "event", "shutdown")
+}
+
+// shutdown stops accepting new connections, waits until in-flight requests
+// and downloads are finished or ctx is done, writes the stats, the access
+// cache and the access log to disk and removes the PID file.
+func shutdown(ctx context.Context) {
+	serversMux.Lock()
+	list := servers
+	servers = nil
+	serversMux.Unlock()
+
+	// Clients are told that the proxy is gone before the listeners stop.
+	serving.Store(false)
+	if mdnsServer != nil {
+		mdnsServer.Shutdown()
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range list {
+		wg.Go(func() {
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Warn("Requests were still running at shutdown", "event", "shutdown", "address", server.Addr, "error", err)
+				_ = server.Close()
+			}
+		})
+	}
+	wg.Wait()
+
+	// Downloads started by intercepted CONNECT tunnels and background refreshes
+	// are not tracked by the servers.
+	if cache != nil {
+		if err := cache.Close(ctx); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				slog.Warn("Downloads were still running at shutdown", "event", "shutdown", "active_downloads", cache.ActiveDownloads())
+			} else {
+				slog.Error("Error closing cache", "event", "shutdown", "error", err)
+			}
+		}
+	}
+
+	// Requests of CONNECT tunnels may still be logged, these lines are
+	// discarded.
+	if accessLog != nil {
+		if err := accessLog.Close(); err != nil {
+			slog.Error("Error closing access log", "event", "shutdown", "error", err)
+		}
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Warn("Error exporting remaining spans", "event", "shutdown", "error", err)
+	}
+
+	removePIDFile()
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func TestShutdownStopsServersAndFlushesCache(t *testing.T) {
+	testCache := fscache.NewFSCache(t.TempDir())
+	old := cache
+	cache = testCache
+	t.Cleanup(func() {
+		cache = old
+	})
+	if err := testCache.TrackRequest(true, 42); err != nil {
+		t.Fatalf("TrackRequest() error = %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	registerServer(server)
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown(ctx)
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Fatalf("Serve() error = %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server was not shut down")
+	}
+
+	if _, err := os.Stat(filepath.Join(testCache.CachePath, ".stats.json")); err != nil {
+		t.Fatalf("expected stats to be written on shutdown: %v", err)
+	}
+}
+
+func TestAccessLoggerDiscardsLinesAfterClose(t *testing.T) {
+	var out bufferCloser
+	logger := newAccessLogger(&out)
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	logger.log([]byte("late\n"))
+	if err := logger.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("access log = %q, want no output", out.String())
+	}
+}
+
+func TestReadConfigShutdownTimeoutDefault(t *testing.T) {
+	path := writeTempConfig(t, "cache_directory: /var/cache/goaptcacher\n")
+
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if cfg.ShutdownTimeoutSeconds != 30 {
+		t.Fatalf("ShutdownTimeoutSeconds = %d, want 30", cfg.ShutdownTimeoutSeconds)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "log/slog"
+
+// flushStatsAndLogStatus writes the stats to disk and logs a summary of the
+// proxy state. It is triggered by SIGUSR1.
+func flushStatsAndLogStatus() {
+	if err := cache.FlushStats(); err != nil {
+		slog.Error("Error writing stats", "event", "signal", "error", err)
+	} else {
+		slog.Info("Stats written to disk", "event", "signal")
+	}
+
+	stats := cache.GetStatsSnapshot(1)
+	args := []any{
+		"event", "status",
+		"requests", stats.Totals.Requests,
+		"hits", stats.Totals.Hits,
+		"misses", stats.Totals.Misses,
+		"tunnel", stats.Totals.Tunnel,
+		"traffic_down", stats.Totals.TrafficDown,
+		"traffic_up", stats.Totals.TrafficUp,
+		"active_downloads", cache.ActiveDownloads(),
+	}
+	if files, size, err := cache.GetCacheUsage(); err == nil {
+		args = append(args, "files_cached", files, "cache_size", size)
+	}
+	slog.Info("Status", args...)
+}
+
+// startVerification starts a verification pass of the cached packages unless
+// one is already running. It is triggered by SIGUSR2.
+func startVerification() {
+	job, started := runVerifyJob()
+	if !started {
+		slog.Info("Source verification job is already running", "event", "signal", "job", job.ID)
+		return
+	}
+	slog.Info("Started source verification job", "event", "signal", "job", job.ID)
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// handleSignals does nothing, SIGHUP, SIGUSR1 and SIGUSR2 don't exist on this
+// platform.
+func handleSignals(*Server, string) {}
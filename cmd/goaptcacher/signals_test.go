@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func TestFlushStatsAndLogStatusWritesStats(t *testing.T) {
+	withTestConfig(t, &Config{})
+
+	old := cache
+	cache = fscache.NewFSCache(t.TempDir())
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	if err := cache.TrackRequest(true, 42); err != nil {
+		t.Fatalf("TrackRequest() error = %v", err)
+	}
+
+	// Repeated signals must not interfere with each other.
+	for range 3 {
+		flushStatsAndLogStatus()
+	}
+
+	if _, err := os.Stat(filepath.Join(cache.CachePath, ".stats.json")); err != nil {
+		t.Fatalf("expected stats file to be written: %v", err)
+	}
+}
+
+func TestStartVerificationKeepsRunningJob(t *testing.T) {
+	running := &verifyJob{ID: "running", State: "running"}
+	verifyJobs.Lock()
+	verifyJobs.running = running
+	jobs := len(verifyJobs.byID)
+	verifyJobs.Unlock()
+	t.Cleanup(func() {
+		verifyJobs.Lock()
+		verifyJobs.running = nil
+		verifyJobs.Unlock()
+	})
+
+	startVerification()
+
+	verifyJobs.Lock()
+	defer verifyJobs.Unlock()
+	if verifyJobs.running != running {
+		t.Fatalf("running job = %+v, want the job which was already running", verifyJobs.running)
+	}
+	if len(verifyJobs.byID) != jobs {
+		t.Fatalf("jobs = %d, want %d", len(verifyJobs.byID), jobs)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals runs the actions of SIGHUP, SIGUSR1 and SIGUSR2. Signals are
+// handled one after another, a signal received while an action runs is queued.
+// SIGHUP reloads the config file at configPath into s.
+func handleSignals(s *Server, configPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGHUP:
+				if err := s.reloadConfig(configPath); err != nil {
+					slog.Error("Error reloading config, keeping the running config", "event", "reload", "path", configPath, "error", err)
+				}
+			case syscall.SIGUSR1:
+				flushStatsAndLogStatus()
+			case syscall.SIGUSR2:
+				startVerification()
+			}
+		}
+	}()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends state to the notification socket of systemd. Without
+// NOTIFY_SOCKET (not started by systemd or not Type=notify), it does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Sockets starting with @ are in the abstract namespace.
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if socket[0] == '@' {
+		addr.Name = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval in which systemd expects watchdog
+// pings, or 0 if the watchdog is disabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady reports readiness to systemd and starts sending watchdog pings
+// if WatchdogSec= is set. It is called once all listeners are bound.
+func notifyReady() {
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Error notifying systemd", "event", "systemd", "error", err)
+		return
+	}
+
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	// Ping twice per interval, so a delayed ping doesn't trigger a restart.
+	slog.Info("systemd watchdog enabled", "event", "systemd", "interval", interval)
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Error sending systemd watchdog ping", "event", "systemd", "error", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSDNotifyWithoutSocketDoesNothing(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify() error = %v", err)
+	}
+}
+
+func TestSDNotifySendsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram() error = %v", err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("sdNotify() error = %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if got := string(buf[:n]); got != "READY=1" {
+		t.Fatalf("notification = %q, want %q", got, "READY=1")
+	}
+}
+
+func TestSDWatchdogInterval(t *testing.T) {
+	tcs := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{"disabled", "", "", 0},
+		{"invalid", "abc", "", 0},
+		{"enabled", "30000000", "", 30 * time.Second},
+		{"own pid", "30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		{"other pid", "30000000", "1", 0},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tc.usec)
+			t.Setenv("WATCHDOG_PID", tc.pid)
+
+			if got := sdWatchdogInterval(); got != tc.want {
+				t.Fatalf("sdWatchdogInterval() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// tlsCurves maps the names accepted by https.curves to the key exchange
+// groups of crypto/tls.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+}
+
+// defaultInterceptCurves are offered to clients of intercepted CONNECT
+// tunnels if https.curves isn't set.
+var defaultInterceptCurves = []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256}
+
+// parseTLSVersion parses the minimum TLS version. An empty version selects
+// TLS 1.2.
+func parseTLSVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid value %q, must be \"1.2\" or \"1.3\"", version)
+	}
+}
+
+// parseCipherSuites returns the IDs of the named TLS 1.2 cipher suites. Only
+// suites considered secure by crypto/tls are accepted. TLS 1.3 suites can't
+// be configured in crypto/tls.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		index := slices.IndexFunc(tls.CipherSuites(), func(suite *tls.CipherSuite) bool {
+			return suite.Name == name
+		})
+		if index < 0 {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+
+		suite := tls.CipherSuites()[index]
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("%s is a TLS 1.3 cipher suite, these can't be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// parseCurves returns the key exchange groups for names in order of
+// preference.
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		curve, ok := tlsCurves[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q, must be one of X25519MLKEM768, X25519, P256, P384 or P521", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+// applyInterceptTLSSettings sets the configured minimum TLS version, cipher
+// suites and curves on the TLS config of an intercepting listener or tunnel.
+// Settings which aren't configured keep the values of tlsConfig.
+func (c *Config) applyInterceptTLSSettings(tlsConfig *tls.Config) {
+	tlsConfig.MinVersion = c.tlsMinVersion
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	if len(c.tlsCipherSuites) > 0 {
+		tlsConfig.CipherSuites = c.tlsCipherSuites
+	}
+	if len(c.tlsCurves) > 0 {
+		tlsConfig.CurvePreferences = c.tlsCurves
+	}
+}
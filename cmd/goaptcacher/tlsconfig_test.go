@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestCompileTLSSettings(t *testing.T) {
+	cfg := &Config{}
+	cfg.HTTPS.MinTLSVersion = "1.2"
+	cfg.HTTPS.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+	cfg.HTTPS.Curves = []string{"P384", "X25519"}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+
+	if cfg.tlsMinVersion != tls.VersionTLS12 {
+		t.Fatalf("tlsMinVersion = %x, want TLS 1.2", cfg.tlsMinVersion)
+	}
+	if !slices.Equal(cfg.tlsCipherSuites, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}) {
+		t.Fatalf("tlsCipherSuites = %v", cfg.tlsCipherSuites)
+	}
+	if !slices.Equal(cfg.tlsCurves, []tls.CurveID{tls.CurveP384, tls.X25519}) {
+		t.Fatalf("tlsCurves = %v", cfg.tlsCurves)
+	}
+}
+
+func TestCompileRejectsInvalidTLSSettings(t *testing.T) {
+	tcs := map[string]func(c *Config){
+		"version":        func(c *Config) { c.HTTPS.MinTLSVersion = "1.1" },
+		"unknown suite":  func(c *Config) { c.HTTPS.CipherSuites = []string{"TLS_FOO"} },
+		"insecure suite": func(c *Config) { c.HTTPS.CipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"} },
+		"tls13 suite":    func(c *Config) { c.HTTPS.CipherSuites = []string{"TLS_AES_128_GCM_SHA256"} },
+		"suites with tls13": func(c *Config) {
+			c.HTTPS.MinTLSVersion = "1.3"
+			c.HTTPS.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}
+		},
+		"curve": func(c *Config) { c.HTTPS.Curves = []string{"P192"} },
+	}
+
+	for name, setup := range tcs {
+		cfg := &Config{}
+		setup(cfg)
+		if err := cfg.compile(); err == nil {
+			t.Fatalf("%s: expected compile() to fail", name)
+		}
+	}
+}
+
+func TestApplyInterceptTLSSettingsKeepsDefaults(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	tlsConfig := &tls.Config{CurvePreferences: defaultInterceptCurves}
+	cfg.applyInterceptTLSSettings(tlsConfig)
+
+	if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.CipherSuites != nil {
+		t.Fatalf("MinVersion = %x, CipherSuites = %v, want TLS 1.2 and Go defaults", tlsConfig.MinVersion, tlsConfig.CipherSuites)
+	}
+	if !slices.Equal(tlsConfig.CurvePreferences, defaultInterceptCurves) {
+		t.Fatalf("CurvePreferences = %v, want defaults", tlsConfig.CurvePreferences)
+	}
+}
+
+func TestMinTLSVersionRejectsTLS12Clients(t *testing.T) {
+	cfg := &Config{}
+	cfg.HTTPS.MinTLSVersion = "1.3"
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	s := newTestServer(t, cfg, nil)
+	roots := withTestIntercept(t, s)
+
+	handshake := func(maxVersion uint16) error {
+		serverConn, clientConn := net.Pipe()
+		defer serverConn.Close()
+		defer clientConn.Close()
+
+		serverConfig := &tls.Config{Certificates: []tls.Certificate{*s.intercept.GetCertificate("example.com")}}
+		s.config.applyInterceptTLSSettings(serverConfig)
+		go func() {
+			_ = tls.Server(serverConn, serverConfig).Handshake()
+			_ = serverConn.Close()
+		}()
+
+		return tls.Client(clientConn, &tls.Config{
+			ServerName: "example.com",
+			RootCAs:    roots,
+			MinVersion: tls.VersionTLS12,
+			MaxVersion: maxVersion,
+		}).Handshake()
+	}
+
+	if err := handshake(tls.VersionTLS12); err == nil {
+		t.Fatal("expected TLS 1.2 handshake to fail")
+	}
+	if err := handshake(tls.VersionTLS13); err != nil {
+		t.Fatalf("TLS 1.3 handshake error = %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/buildinfo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans created by the proxy.
+const tracerName = "gitlab.com/bella.network/goaptcacher"
+
+// tracingEnabled is set if spans are exported. Without tracing, requests are
+// passed to the handler without any instrumentation.
+var tracingEnabled bool
+
+// tracerProvider exports the spans, it is nil if tracing is disabled.
+var tracerProvider *sdktrace.TracerProvider
+
+// initTracing sets up the OTLP exporter if tracing.endpoint is configured.
+// Without endpoint, the global no-op tracer provider of OpenTelemetry stays in
+// place.
+func initTracing(ctx context.Context) error {
+	if config.Tracing.Endpoint == "" {
+		return nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(config.Tracing.Endpoint))
+	if err != nil {
+		return err
+	}
+
+	resource, err := sdkresource.Merge(sdkresource.Default(), sdkresource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(config.Tracing.ServiceName),
+		semconv.ServiceVersion(buildinfo.Version),
+	))
+	if err != nil {
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	tracerProvider = provider
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracingEnabled = true
+
+	slog.Info("Tracing enabled", "event", "tracing", "url", config.Tracing.Endpoint, "sample_ratio", config.Tracing.SampleRatio)
+	return nil
+}
+
+// shutdownTracing exports the remaining spans and stops the exporter.
+func shutdownTracing(ctx context.Context) error {
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+// withTracing wraps next in a server span. The trace context sent by the
+// client is continued, so the spans of the proxy are part of the client's
+// trace.
+func withTracing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !tracingEnabled {
+			next(w, r)
+			return
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.ServerAddress(r.Host),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(r.RemoteAddr),
+			),
+		)
+		defer span.End()
+
+		recorder := &accessLogResponseWriter{ResponseWriter: w}
+		next(recorder, r.WithContext(ctx))
+
+		status := recorder.statusCode()
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(status),
+			semconv.HTTPResponseBodySize(int(recorder.bytes)),
+		)
+		if cacheResult := recorder.Header().Get("X-Cache"); cacheResult != "" {
+			span.SetAttributes(attribute.String("goaptcacher.cache", cacheResult))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
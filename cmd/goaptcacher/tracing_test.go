@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// withTestTracing enables tracing with an in-memory span recorder.
+func withTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	oldProvider := otel.GetTracerProvider()
+	oldPropagator := otel.GetTextMapPropagator()
+	oldEnabled := tracingEnabled
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracingEnabled = true
+	t.Cleanup(func() {
+		_ = provider.Shutdown(t.Context())
+		otel.SetTracerProvider(oldProvider)
+		otel.SetTextMapPropagator(oldPropagator)
+		tracingEnabled = oldEnabled
+	})
+
+	return recorder
+}
+
+func TestWithTracingDisabledPassesRequest(t *testing.T) {
+	oldEnabled := tracingEnabled
+	tracingEnabled = false
+	t.Cleanup(func() {
+		tracingEnabled = oldEnabled
+	})
+
+	var recorded bool
+	handler := withTracing(func(w http.ResponseWriter, r *http.Request) {
+		_, recorded = w.(*accessLogResponseWriter)
+		if trace.SpanContextFromContext(r.Context()).IsValid() {
+			t.Fatal("expected no span without tracing")
+		}
+	})
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/", nil))
+
+	if recorded {
+		t.Fatal("expected the response writer to be passed unchanged")
+	}
+}
+
+func TestWithTracingContinuesIncomingTrace(t *testing.T) {
+	recorder := withTestTracing(t)
+
+	handler := withTracing(func(w http.ResponseWriter, r *http.Request) {
+		if !trace.SpanContextFromContext(r.Context()).IsValid() {
+			t.Fatal("expected a span in the request context")
+		}
+		w.Header().Set("X-Cache", "MISS")
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/stable/InRelease", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("ended spans = %d, want 1", len(spans))
+	}
+	span := spans[0]
+	if got := span.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace ID = %s, want the incoming trace", got)
+	}
+	if got := span.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Fatalf("parent span ID = %s, want the incoming span", got)
+	}
+
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, attr := range span.Attributes() {
+		attrs[attr.Key] = attr.Value
+	}
+	if got := attrs["http.response.status_code"].AsInt64(); got != http.StatusBadGateway {
+		t.Fatalf("status attribute = %d, want %d", got, http.StatusBadGateway)
+	}
+	if got := attrs["goaptcacher.cache"].AsString(); got != "MISS" {
+		t.Fatalf("cache attribute = %q, want MISS", got)
+	}
+	if span.Status().Code != codes.Error {
+		t.Fatalf("span status = %v, want Error", span.Status())
+	}
+}
+
+func TestReadConfigTracingDefaults(t *testing.T) {
+	path := writeTempConfig(t, `
+cache_directory: /var/cache/goaptcacher
+tracing:
+  endpoint: http://collector:4318
+`)
+
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if cfg.Tracing.ServiceName != "goaptcacher" || cfg.Tracing.SampleRatio != 1 {
+		t.Fatalf("unexpected tracing defaults %+v", cfg.Tracing)
+	}
+}
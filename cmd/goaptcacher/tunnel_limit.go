@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// defaultTunnelMaxConnections is the number of hijacked client connections
+// (tunnels and intercepted CONNECT requests) open at the same time if no limit
+// is configured. Each tunnel uses two file descriptors.
+const defaultTunnelMaxConnections = 512
+
+// hijackedConnections counts the client connections taken over from the HTTP
+// server by handleCONNECT and handleTUNNEL.
+var hijackedConnections atomic.Int64
+
+// acquireHijackedConnection reserves a slot for a hijacked connection. If
+// tunnel.max_connections is reached, the request is answered with 503 and
+// false is returned. Otherwise the slot has to be released with
+// releaseHijackedConnection once the connection is closed.
+func (s *Server) acquireHijackedConnection(w http.ResponseWriter, r *http.Request) bool {
+	limit := int64(s.config.Tunnel.MaxConnections)
+	if n := hijackedConnections.Add(1); limit > 0 && n > limit {
+		hijackedConnections.Add(-1)
+		w.Header().Set("Retry-After", "1")
+		fscache.Error(w, r, http.StatusServiceUnavailable, "too_many_connections", "Too many open connections")
+		slog.WarnContext(r.Context(), "Maximum number of tunnels reached", "event", "tunnel", "client", r.RemoteAddr, "host", r.Host, "limit", limit, "status", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// releaseHijackedConnection frees the slot reserved by
+// acquireHijackedConnection.
+func releaseHijackedConnection() {
+	hijackedConnections.Add(-1)
+}
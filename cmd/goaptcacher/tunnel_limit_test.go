@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleTUNNELRejectsWhenLimitReached(t *testing.T) {
+	cfg := &Config{}
+	cfg.Tunnel.MaxConnections = 1
+	s := newTestServer(t, cfg, nil)
+
+	// An open tunnel takes the only slot.
+	hijackedConnections.Add(1)
+	t.Cleanup(releaseHijackedConnection)
+
+	req := httptest.NewRequest(http.MethodConnect, "http://deb.debian.org:443", nil)
+	req.Host = "deb.debian.org:443"
+	rec := httptest.NewRecorder()
+	s.handleTUNNEL(rec, req)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if got := rec.Header().Get("Retry-After"); got == "" {
+		t.Fatalf("Retry-After missing")
+	}
+	if got := hijackedConnections.Load(); got != 1 {
+		t.Fatalf("hijackedConnections = %d, want %d", got, 1)
+	}
+}
+
+func TestAcquireHijackedConnection(t *testing.T) {
+	s := newTestServer(t, &Config{}, nil)
+	before := hijackedConnections.Load()
+
+	// Without limit, every connection gets a slot.
+	for range 3 {
+		if !s.acquireHijackedConnection(httptest.NewRecorder(), httptest.NewRequest(http.MethodConnect, "http://deb.debian.org:443", nil)) {
+			t.Fatalf("acquireHijackedConnection() = false without limit")
+		}
+	}
+	if got := hijackedConnections.Load() - before; got != 3 {
+		t.Fatalf("hijackedConnections delta = %d, want %d", got, 3)
+	}
+	if got := gaugeValues()["hijacked_connections"]; got != before+3 {
+		t.Fatalf("gauge hijacked_connections = %v, want %d", got, before+3)
+	}
+
+	for range 3 {
+		releaseHijackedConnection()
+	}
+	if got := hijackedConnections.Load(); got != before {
+		t.Fatalf("hijackedConnections = %d, want %d", got, before)
+	}
+}
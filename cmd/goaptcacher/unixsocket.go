@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// unixSocketPrefix marks a listen address as path of a Unix domain socket.
+const unixSocketPrefix = "unix:"
+
+// unixSocketPath returns the socket path of a listen address like
+// unix:/run/goaptcacher.sock.
+func unixSocketPath(address string) (string, bool) {
+	path, ok := strings.CutPrefix(address, unixSocketPrefix)
+	return path, ok && path != ""
+}
+
+// parseSocketMode parses the octal file mode of a Unix domain socket.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0o777 {
+		return 0, fmt.Errorf("invalid value %q, must be an octal file mode like \"0660\"", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// listenUnix creates the Unix domain socket at path with the given file mode.
+// A socket left over from a previous run is replaced, other files are not
+// touched. The socket file is removed once the listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+
+	return unixSocketListener{ln}, nil
+}
+
+// unixSocketListener accepts connections of a Unix domain socket. Peers of the
+// socket are local, so they are treated like loopback clients.
+type unixSocketListener struct {
+	net.Listener
+}
+
+func (l unixSocketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return unixSocketConn{conn}, nil
+}
+
+// unixSocketConn reports the loopback address as remote address, as the
+// address of a socket peer is empty.
+type unixSocketConn struct {
+	net.Conn
+}
+
+func (c unixSocketConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(netip.IPv6Loopback(), 0))
+}
+
+// CloseWrite half-closes the connection, so CONNECT tunnels can signal EOF.
+func (c unixSocketConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
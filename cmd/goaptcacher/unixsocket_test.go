@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenUnixServesLoopbackClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	ln, err := listenUnix(path, 0o660)
+	if err != nil {
+		t.Fatalf("listenUnix() error = %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if got := info.Mode().Perm(); got != 0o660 {
+		t.Fatalf("socket mode = %o, want 660", got)
+	}
+
+	remoteAddr := make(chan string, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr <- r.RemoteAddr
+	})}
+	go func() { _ = server.Serve(ln) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	resp, err := client.Get("http://goaptcacher/")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+
+	addr, ok := remoteAddrIP(<-remoteAddr)
+	if !ok || !addr.IsLoopback() {
+		t.Fatalf("remote address %v is not loopback", addr)
+	}
+
+	if err := server.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected socket to be removed on close, Stat() error = %v", err)
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	// Keep the socket file like a crashed process would.
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	ln, err := listenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("listenUnix() error = %v", err)
+	}
+	_ = ln.Close()
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if _, err := listenUnix(path, 0o660); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Fatalf("listenUnix() error = %v, want not a socket", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected regular file to be kept: %v", err)
+	}
+}
+
+func TestUnixSocketClientIsAllowed(t *testing.T) {
+	cfg := &Config{AllowedClients: []string{"192.0.2.0/24"}}
+	if err := cfg.compile(); err != nil {
+		t.Fatalf("compile() error = %v", err)
+	}
+	withTestConfig(t, cfg)
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/", nil)
+	req.RemoteAddr = unixSocketConn{}.RemoteAddr().String()
+	if !config.isClientAllowed(req) {
+		t.Fatal("expected clients of the Unix domain socket to be allowed")
+	}
+}
+
+func TestReadConfigRejectsInvalidListen(t *testing.T) {
+	for _, content := range []string{
+		"listen: 127.0.0.1:8090\n",
+		"listen: \"unix:\"\n",
+		"listen: unix:/run/goaptcacher.sock\nlisten_socket_mode: \"0999\"\n",
+	} {
+		if _, err := ReadConfig(writeTempConfig(t, content)); err == nil {
+			t.Fatalf("ReadConfig(%q) expected error", content)
+		}
+	}
+
+	cfg, err := ReadConfig(writeTempConfig(t, "listen: unix:/run/goaptcacher.sock\n"))
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if cfg.listenSocketMode != 0o660 {
+		t.Fatalf("listenSocketMode = %o, want 660", cfg.listenSocketMode)
+	}
+}
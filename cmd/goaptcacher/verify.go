@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+// verifyRetainJobs is the number of finished verification jobs kept for
+// status queries.
+const verifyRetainJobs = 10
+
+// verifyJob tracks an on-demand source verification run.
+type verifyJob struct {
+	mux sync.Mutex
+
+	ID         string                `json:"id"`
+	State      string                `json:"state"` // "running" or "done"
+	Result     *fscache.VerifyResult `json:"result,omitempty"`
+	Error      string                `json:"error,omitempty"`
+	StartedAt  time.Time             `json:"started_at"`
+	FinishedAt *time.Time            `json:"finished_at,omitempty"`
+}
+
+// verifyJobs holds the running and the most recently finished verification
+// jobs. Only a single job runs at a time.
+var verifyJobs = struct {
+	sync.Mutex
+	byID     map[string]*verifyJob
+	running  *verifyJob
+	finished []string // IDs of finished jobs, oldest first
+}{byID: map[string]*verifyJob{}}
+
+// verifyRepositoriesMux prevents concurrent repository verifications, as each
+// one reads all cached package files.
+var verifyRepositoriesMux sync.Mutex
+
+// handleVerifyRequests serves the verification APIs below /api/verify-sources
+// and /api/verify-repos. It returns false if the path isn't part of the APIs.
+// The APIs are only reachable from local clients or with the management
+// token, unless remote debug access is enabled.
+func handleVerifyRequests(w http.ResponseWriter, r *http.Request, requestedPath string) bool {
+	if requestedPath != "/api/verify-repos" && requestedPath != "/api/verify-sources" && !strings.HasPrefix(requestedPath, "/api/verify-sources/") {
+		return false
+	}
+
+	if r.Method == http.MethodPost {
+		if !authorizeManagement(w, r, managementRemoteAllowed()) {
+			return true
+		}
+	} else if !managementAccessAllowed(r) && !hasManagementToken(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
+	}
+
+	if requestedPath == "/api/verify-repos" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+		serveVerifyRepositories(w, r)
+		return true
+	}
+
+	if requestedPath == "/api/verify-sources" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return true
+		}
+		startVerifyJob(w, r)
+		return true
+	}
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	verifyJobs.Lock()
+	job, ok := verifyJobs.byID[strings.TrimPrefix(requestedPath, "/api/verify-sources/")]
+	verifyJobs.Unlock()
+	if !ok {
+		http.Error(w, "Unknown verification job", http.StatusNotFound)
+		return true
+	}
+
+	job.mux.Lock()
+	data, err := json.Marshal(job)
+	job.mux.Unlock()
+	if err != nil {
+		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+	return true
+}
+
+// serveVerifyRepositories verifies the cached repositories and responds with
+// the mismatch report. The query parameters repository (path relative to the
+// cache directory, e.g. deb.debian.org/debian) and dist limit the verification
+// to matching repositories.
+func serveVerifyRepositories(w http.ResponseWriter, r *http.Request) {
+	if !verifyRepositoriesMux.TryLock() {
+		http.Error(w, "Repository verification already running", http.StatusConflict)
+		return
+	}
+	defer verifyRepositoriesMux.Unlock()
+
+	repositories, err := discoverCachedRepositories(config.CacheDirectory)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error discovering cached repositories", "event", "repo_verify", "client", r.RemoteAddr, "error", err)
+		http.Error(w, "Error discovering cached repositories", http.StatusInternalServerError)
+		return
+	}
+
+	repository := strings.Trim(r.URL.Query().Get("repository"), "/")
+	dist := r.URL.Query().Get("dist")
+	if repository != "" || dist != "" {
+		repositories = slices.DeleteFunc(repositories, func(candidate cachedRepository) bool {
+			return (repository != "" && relativeCachePath(config.CacheDirectory, candidate.rootPath) != repository) ||
+				(dist != "" && candidate.distrib != dist)
+		})
+		if len(repositories) == 0 {
+			http.Error(w, "No matching cached repository", http.StatusNotFound)
+			return
+		}
+	}
+
+	slog.InfoContext(r.Context(), "Verifying cached repositories on request", "event", "repo_verify", "client", r.RemoteAddr, "repositories", len(repositories))
+	report := verifyCachedRepositories(config.CacheDirectory, repositories)
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, "Error generating JSON", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+// startVerifyJob starts a verification run in the background. If a run is
+// already in progress, its ID is returned instead of starting another one.
+func startVerifyJob(w http.ResponseWriter, r *http.Request) {
+	job, started := runVerifyJob()
+	if started {
+		slog.InfoContext(r.Context(), "Started source verification job", "event", "verify", "client", r.RemoteAddr, "job", job.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", "/_goaptcacher/api/verify-sources/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"id":         job.ID,
+		"status_url": "/_goaptcacher/api/verify-sources/" + job.ID,
+	})
+}
+
+// runVerifyJob starts a verification run in the background and reports true.
+// If a run is already in progress, it is returned instead.
+func runVerifyJob() (*verifyJob, bool) {
+	verifyJobs.Lock()
+	defer verifyJobs.Unlock()
+
+	if verifyJobs.running != nil {
+		return verifyJobs.running, false
+	}
+
+	job := &verifyJob{
+		ID:        cache.GenerateUUID(),
+		State:     "running",
+		StartedAt: time.Now().UTC(),
+	}
+	verifyJobs.byID[job.ID] = job
+	verifyJobs.running = job
+
+	go job.run(cache)
+	return job, true
+}
+
+// run performs the verification and records the result.
+func (job *verifyJob) run(c *fscache.FSCache) {
+	result, err := c.VerifySources()
+
+	job.mux.Lock()
+	finished := time.Now().UTC()
+	job.State = "done"
+	job.FinishedAt = &finished
+	if err != nil {
+		job.Error = err.Error()
+		slog.Error("Source verification job failed", "event", "verify", "job", job.ID, "error", err)
+	} else {
+		job.Result = &result
+		slog.Info("Source verification job finished", "event", "verify", "job", job.ID, "files_checked", result.FilesChecked, "marked_for_deletion", result.MarkedForDeletion)
+	}
+	job.mux.Unlock()
+
+	// Forget the oldest finished jobs.
+	verifyJobs.Lock()
+	verifyJobs.running = nil
+	verifyJobs.finished = append(verifyJobs.finished, job.ID)
+	for len(verifyJobs.finished) > verifyRetainJobs {
+		delete(verifyJobs.byID, verifyJobs.finished[0])
+		verifyJobs.finished = verifyJobs.finished[1:]
+	}
+	verifyJobs.Unlock()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/fscache"
+)
+
+func TestVerifySourcesAPI(t *testing.T) {
+	withTestConfig(t, &Config{})
+
+	old := cache
+	cache = fscache.NewFSCache(t.TempDir())
+	t.Cleanup(func() {
+		cache = old
+	})
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://example/_goaptcacher/api/verify-sources", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	handleIndexRequests(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d, body = %s", rr.Code, http.StatusAccepted, rr.Body.String())
+	}
+	var started struct {
+		ID        string `json:"id"`
+		StatusURL string `json:"status_url"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &started); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+
+	var status struct {
+		State  string                `json:"state"`
+		Result *fscache.VerifyResult `json:"result"`
+		Error  string                `json:"error"`
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example"+started.StatusURL, nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		handleIndexRequests(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status request = %d, want %d", rr.Code, http.StatusOK)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatalf("decode status: %v", err)
+		}
+		if status.State == "done" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("verification job didn't finish, status = %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status.Error != "" || status.Result == nil {
+		t.Fatalf("status = %+v, want a result without error", status)
+	}
+	if *status.Result != (fscache.VerifyResult{}) {
+		t.Fatalf("result = %+v, want empty result for empty cache", *status.Result)
+	}
+}
+
+func TestVerifySourcesAPIAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		debug      bool
+		method     string
+		path       string
+		remoteAddr string
+		want       int
+	}{
+		{name: "remote", method: http.MethodPost, path: "/api/verify-sources", remoteAddr: "192.0.2.10:12345", want: http.StatusForbidden},
+		{name: "remote debug", debug: true, method: http.MethodGet, path: "/api/verify-sources/unknown", remoteAddr: "192.0.2.10:12345", want: http.StatusNotFound},
+		{name: "wrong method", method: http.MethodGet, path: "/api/verify-sources", remoteAddr: "127.0.0.1:12345", want: http.StatusMethodNotAllowed},
+		{name: "unknown job", method: http.MethodGet, path: "/api/verify-sources/unknown", remoteAddr: "127.0.0.1:12345", want: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Debug.Enable = tt.debug
+			cfg.Debug.AllowRemote = tt.debug
+			withTestConfig(t, cfg)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "http://example/_goaptcacher"+tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			handleIndexRequests(rr, req)
+
+			if rr.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
@@ -30,6 +30,11 @@ type RepositoryCleanup struct {
 	ValidUntil    time.Time
 
 	Checksums []ChecksumSum
+
+	// PackagePath maps the path of a package file below Path to its location
+	// on disk, e.g. for caches storing packages in another layout. If nil,
+	// packages are expected at their repository path.
+	PackagePath func(path string) string
 }
 
 type ChecksumAlgorithm string
@@ -67,6 +72,16 @@ func New(path, distrib string) (*RepositoryCleanup, error) {
 	return cl, nil
 }
 
+// ParseRelease parses the contents of an InRelease or Release file, e.g. to
+// read its Valid-Until date. Path and Distrib of the result are empty.
+func ParseRelease(contents []byte) (*RepositoryCleanup, error) {
+	cl := &RepositoryCleanup{Checksums: []ChecksumSum{}}
+	if err := cl.parseRelease(string(contents)); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
 // readInRelease reads the InRelease file and parses it
 func (cl *RepositoryCleanup) readInRelease() error {
 	// Read the InRelease file and parse it
@@ -75,13 +90,19 @@ func (cl *RepositoryCleanup) readInRelease() error {
 		return err
 	}
 
+	return cl.parseRelease(string(contents))
+}
+
+// parseRelease parses the fields and checksums of an InRelease or Release
+// file.
+func (cl *RepositoryCleanup) parseRelease(contents string) error {
 	// Parse the InRelease file by looping over the lines. As the file is
 	// structured as key-value pairs and may contain multiple lines, we can't
 	// use some sort of standard parsing or splitting.
 	var checksumAlgorithm ChecksumAlgorithm
 	checksums := []ChecksumSum{}
 
-	for line := range strings.SplitSeq(string(contents), "\n") {
+	for line := range strings.SplitSeq(contents, "\n") {
 		if algorithm, ok := checksumAlgorithmFromBlockHeader(line); ok {
 			checksumAlgorithm = algorithm
 			continue
@@ -196,7 +217,7 @@ func (cl *RepositoryCleanup) VerifyChecksums() ([]string, error) {
 
 			if currentHash, ok := packageChecksums[packageFile]; ok {
 				if currentHash.Algorithm == packageHash.Algorithm && currentHash.Hash != packageHash.Hash {
-					mismatches[filepath.Join(cl.Path, filepath.FromSlash(packageFile))] = struct{}{}
+					mismatches[cl.packagePath(packageFile)] = struct{}{}
 					continue
 				}
 
@@ -210,7 +231,7 @@ func (cl *RepositoryCleanup) VerifyChecksums() ([]string, error) {
 	}
 
 	for packageFile, expectedHash := range packageChecksums {
-		path := filepath.Join(cl.Path, filepath.FromSlash(packageFile))
+		path := cl.packagePath(packageFile)
 		exists, err := fileExists(path)
 		if err != nil {
 			return nil, err
@@ -238,6 +259,15 @@ func (cl *RepositoryCleanup) VerifyChecksums() ([]string, error) {
 	return result, nil
 }
 
+// packagePath returns the location of the package file on disk.
+func (cl *RepositoryCleanup) packagePath(packageFile string) string {
+	path := filepath.Join(cl.Path, filepath.FromSlash(packageFile))
+	if cl.PackagePath != nil {
+		return cl.PackagePath(path)
+	}
+	return path
+}
+
 func fileExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
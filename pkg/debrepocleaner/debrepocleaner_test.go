@@ -11,6 +11,7 @@ import (
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestVerifySHA256sumsIncludesDebFilesFromMultiplePackageIndexes(t *testing.T) {
@@ -92,6 +93,45 @@ func TestVerifyChecksumsReportsIndexMismatchInsideDistPath(t *testing.T) {
 	}
 }
 
+func TestVerifyChecksumsUsesPackagePath(t *testing.T) {
+	repo := t.TempDir()
+
+	debRelativePath := "pool/main/h/hello/hello_1.0_all.deb"
+	debPath := filepath.Join(repo, "shard", filepath.FromSlash(debRelativePath))
+	writeFile(t, debPath, []byte("actual deb"))
+
+	packagesRelativePath := "main/binary-all/Packages"
+	packagesBody := []byte(
+		"Package: hello\n" +
+			"Filename: " + debRelativePath + "\n" +
+			"SHA256: " + checksumHexSHA256([]byte("expected deb")) + "\n\n",
+	)
+	writeFile(t, filepath.Join(repo, "dists", "stable", filepath.FromSlash(packagesRelativePath)), packagesBody)
+
+	inRelease := "SHA256:\n" +
+		" " + checksumHexSHA256(packagesBody) + " " + fileSize(packagesBody) + " " + packagesRelativePath + "\n"
+	writeFile(t, filepath.Join(repo, "dists", "stable", "InRelease"), []byte(inRelease))
+
+	cleanup, err := New(repo, "stable")
+	if err != nil {
+		t.Fatalf("New() returned error: %v", err)
+	}
+	cleanup.PackagePath = func(path string) string {
+		relative, _ := filepath.Rel(repo, path)
+		return filepath.Join(repo, "shard", relative)
+	}
+
+	mismatches, err := cleanup.VerifyChecksums()
+	if err != nil {
+		t.Fatalf("VerifyChecksums() returned error: %v", err)
+	}
+
+	want := []string{debPath}
+	if !reflect.DeepEqual(mismatches, want) {
+		t.Fatalf("VerifyChecksums() = %v, want %v", mismatches, want)
+	}
+}
+
 func TestVerifyChecksumsSupportsSHA512(t *testing.T) {
 	repo := t.TempDir()
 
@@ -171,3 +211,24 @@ func checksumHexSHA512(content []byte) string {
 	sum := sha512.Sum512(content)
 	return hex.EncodeToString(sum[:])
 }
+
+func TestParseRelease(t *testing.T) {
+	release, err := ParseRelease([]byte(`Origin: Debian
+Suite: stable-security
+Date: Sun, 13 Oct 2024 13:53:11 UTC
+Valid-Until: Sun, 20 Oct 2024 13:53:11 UTC
+Components: main contrib
+SHA256:
+ 0142c5460ea3908d1272a84b3fdb9d8fb8f3710e0142c5460ea3908d1272a84b 4195 main/binary-amd64/Packages
+`))
+	if err != nil {
+		t.Fatalf("ParseRelease() error = %v", err)
+	}
+
+	if want := time.Date(2024, 10, 20, 13, 53, 11, 0, time.UTC); !release.ValidUntil.Equal(want) {
+		t.Fatalf("ValidUntil = %s, want %s", release.ValidUntil, want)
+	}
+	if len(release.Components) != 2 || len(release.Checksums) != 1 {
+		t.Fatalf("Components = %v, Checksums = %v, want 2 components and 1 checksum", release.Components, release.Checksums)
+	}
+}
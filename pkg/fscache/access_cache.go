@@ -3,7 +3,7 @@ package fscache
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -23,6 +23,11 @@ type AccessEntry struct {
 	URL                *url.URL  `json:"url,omitempty"`
 	Size               int64     `json:"size,omitempty"`
 	SHA256             string    `json:"sha256,omitempty"`
+	Hits               uint64    `json:"hits,omitempty"`
+	Origin             string    `json:"origin,omitempty"`          // Host of the parent cache the file was fetched from, empty for the upstream server
+	UpstreamRanges     bool      `json:"upstream_ranges,omitempty"` // Upstream announced "Accept-Ranges: bytes" for the file
+
+	Checksums map[string]string `json:"checksums,omitempty"` // Checksums besides SHA256 by algorithm (md5, sha1, sha512), recorded once requested
 }
 
 const (
@@ -31,18 +36,24 @@ const (
 )
 
 type accessEntryJSON struct {
-	Protocol           int       `json:"protocol"`
-	Domain             string    `json:"domain"`
-	Path               string    `json:"path"`
-	URL                string    `json:"url,omitempty"`
-	LastAccessed       time.Time `json:"last_accessed,omitempty"`
-	LastChecked        time.Time `json:"last_checked,omitempty"`
-	RemoteLastModified time.Time `json:"remote_last_modified,omitempty"`
-	ETag               string    `json:"etag,omitempty"`
-	Size               int64     `json:"size,omitempty"`
-	SHA256             string    `json:"sha256,omitempty"`
-	MarkedForDeletion  bool      `json:"marked_for_deletion,omitempty"`
-	MarkedAt           time.Time `json:"marked_at,omitempty"`
+	Protocol           int               `json:"protocol"`
+	Domain             string            `json:"domain"`
+	Path               string            `json:"path"`
+	URL                string            `json:"url,omitempty"`
+	LastAccessed       time.Time         `json:"last_accessed,omitempty"`
+	LastChecked        time.Time         `json:"last_checked,omitempty"`
+	RemoteLastModified time.Time         `json:"remote_last_modified,omitempty"`
+	ETag               string            `json:"etag,omitempty"`
+	Size               int64             `json:"size,omitempty"`
+	SHA256             string            `json:"sha256,omitempty"`
+	Hits               uint64            `json:"hits,omitempty"`
+	Origin             string            `json:"origin,omitempty"`
+	UpstreamRanges     bool              `json:"upstream_ranges,omitempty"`
+	Checksums          map[string]string `json:"checksums,omitempty"`
+	MarkedForDeletion  bool              `json:"marked_for_deletion,omitempty"`
+	MarkedAt           time.Time         `json:"marked_at,omitempty"`
+	MarkCount          int               `json:"mark_count,omitempty"`
+	Pinned             bool              `json:"pinned,omitempty"`
 }
 
 type accessCacheRecord struct {
@@ -52,11 +63,13 @@ type accessCacheRecord struct {
 	path              string
 	markedForDeletion bool
 	markedAt          time.Time
+	markCount         int  // Times the file was marked for deletion since the first mark
+	pinned            bool // Protected from expiration and removal after source verification
 	dirty             bool
 }
 
 func (fs *FSCache) accessCacheKey(protocol int, domain, path string) string {
-	return strconv.Itoa(protocol) + "|" + domain + "|" + path
+	return strconv.Itoa(fs.canonicalProtocol(protocol, domain)) + "|" + domain + "|" + path
 }
 
 func protocolScheme(protocol int) string {
@@ -127,7 +140,7 @@ func (fs *FSCache) flushAccessCache() {
 		fs.accessCacheMux.Unlock()
 
 		if err := fs.writeAccessCacheRecord(&recordCopy); err != nil {
-			log.Printf("[WARN:ACCESS] failed to write access cache record: %v", err)
+			slog.Warn("Failed to write access cache record", "event", "access", "error", err)
 			fs.accessCacheMux.Lock()
 			if current, ok := fs.accessCache[key]; ok && !current.dirty {
 				current.dirty = true
@@ -162,8 +175,14 @@ func (fs *FSCache) writeAccessCacheRecord(record *accessCacheRecord) error {
 		ETag:               record.entry.ETag,
 		Size:               record.entry.Size,
 		SHA256:             record.entry.SHA256,
+		Hits:               record.entry.Hits,
+		Origin:             record.entry.Origin,
+		UpstreamRanges:     record.entry.UpstreamRanges,
+		Checksums:          record.entry.Checksums,
 		MarkedForDeletion:  record.markedForDeletion,
 		MarkedAt:           record.markedAt,
+		MarkCount:          record.markCount,
+		Pinned:             record.pinned,
 	}
 
 	data, err := json.Marshal(payload)
@@ -187,7 +206,7 @@ func (fs *FSCache) loadAccessCacheRecord(protocol int, domain, path string) (*ac
 
 	var payload accessEntryJSON
 	if err := json.Unmarshal(data, &payload); err != nil {
-		log.Printf("[WARN:ACCESS] invalid metadata %s: %v", metaPath, err)
+		slog.Warn("Invalid metadata", "event", "access", "path", metaPath, "error", err)
 		return nil, false
 	}
 
@@ -198,6 +217,10 @@ func (fs *FSCache) loadAccessCacheRecord(protocol int, domain, path string) (*ac
 		ETag:               payload.ETag,
 		Size:               payload.Size,
 		SHA256:             payload.SHA256,
+		Hits:               payload.Hits,
+		Origin:             payload.Origin,
+		UpstreamRanges:     payload.UpstreamRanges,
+		Checksums:          payload.Checksums,
 	}
 
 	if payload.URL != "" {
@@ -217,6 +240,8 @@ func (fs *FSCache) loadAccessCacheRecord(protocol int, domain, path string) (*ac
 		path:              path,
 		markedForDeletion: payload.MarkedForDeletion,
 		markedAt:          payload.MarkedAt,
+		markCount:         payload.MarkCount,
+		pinned:            payload.Pinned,
 	}, true
 }
 
@@ -228,7 +253,7 @@ func (fs *FSCache) loadAccessCacheRecordFromFile(metaPath string) (*accessCacheR
 
 	var payload accessEntryJSON
 	if err := json.Unmarshal(data, &payload); err != nil {
-		log.Printf("[WARN:ACCESS] invalid metadata %s: %v", metaPath, err)
+		slog.Warn("Invalid metadata", "event", "access", "path", metaPath, "error", err)
 		return nil, false
 	}
 
@@ -239,6 +264,10 @@ func (fs *FSCache) loadAccessCacheRecordFromFile(metaPath string) (*accessCacheR
 		ETag:               payload.ETag,
 		Size:               payload.Size,
 		SHA256:             payload.SHA256,
+		Hits:               payload.Hits,
+		Origin:             payload.Origin,
+		UpstreamRanges:     payload.UpstreamRanges,
+		Checksums:          payload.Checksums,
 	}
 
 	protocol := payload.Protocol
@@ -289,6 +318,8 @@ func (fs *FSCache) loadAccessCacheRecordFromFile(metaPath string) (*accessCacheR
 		path:              path,
 		markedForDeletion: payload.MarkedForDeletion,
 		markedAt:          payload.MarkedAt,
+		markCount:         payload.MarkCount,
+		pinned:            payload.Pinned,
 	}, true
 }
 
@@ -305,6 +336,8 @@ func (fs *FSCache) snapshotAccessCache() map[string]accessCacheRecord {
 			path:              record.path,
 			markedForDeletion: record.markedForDeletion,
 			markedAt:          record.markedAt,
+			markCount:         record.markCount,
+			pinned:            record.pinned,
 		}
 	}
 
@@ -367,6 +400,7 @@ func (fs *FSCache) collectAccessCacheRecords() ([]accessCacheRecord, error) {
 }
 
 func (fs *FSCache) getAccessCacheRecord(protocol int, domain, path string) (*accessCacheRecord, bool) {
+	protocol = fs.canonicalProtocol(protocol, domain)
 	key := fs.accessCacheKey(protocol, domain, path)
 	fs.accessCacheMux.RLock()
 	record, ok := fs.accessCache[key]
@@ -392,6 +426,7 @@ func (fs *FSCache) getAccessCacheRecord(protocol int, domain, path string) (*acc
 }
 
 func (fs *FSCache) setAccessCacheRecord(protocol int, domain, path string, update func(record *accessCacheRecord) bool) {
+	protocol = fs.canonicalProtocol(protocol, domain)
 	key := fs.accessCacheKey(protocol, domain, path)
 	fs.accessCacheMux.Lock()
 	record, ok := fs.accessCache[key]
@@ -402,6 +437,12 @@ func (fs *FSCache) setAccessCacheRecord(protocol int, domain, path string, updat
 	if update(record) {
 		record.dirty = true
 	}
+	// Files of domains with equivalent protocols are refreshed over HTTPS,
+	// the validators are kept as the content is the same.
+	if upgraded := fs.preferHTTPS(record.entry.URL); upgraded != record.entry.URL {
+		record.entry.URL = upgraded
+		record.dirty = true
+	}
 	fs.accessCacheMux.Unlock()
 }
 
@@ -412,8 +453,12 @@ func (fs *FSCache) Get(protocol int, domain, path string) (AccessEntry, bool) {
 		return AccessEntry{}, false
 	}
 
-	entry := fs.normalizeAccessEntry(protocol, domain, path, record.entry)
-	return entry, true
+	// Hits and refreshes update the entry concurrently.
+	fs.accessCacheMux.RLock()
+	entry := record.entry
+	fs.accessCacheMux.RUnlock()
+
+	return fs.normalizeAccessEntry(protocol, domain, path, entry), true
 }
 
 // GetSHA256 returns the SHA256 hash for a given protocol, domain, and path of a
@@ -424,6 +469,8 @@ func (fs *FSCache) GetSHA256(protocol int, domain, path string) (string, bool) {
 		return "", false
 	}
 
+	fs.accessCacheMux.RLock()
+	defer fs.accessCacheMux.RUnlock()
 	return record.entry.SHA256, true
 }
 
@@ -442,6 +489,16 @@ func (fs *FSCache) SetSHA256(protocol int, domain, path, sha256 string) error {
 	return nil
 }
 
+// setUpstreamRanges records if upstream announced byte range support for the
+// file.
+func (fs *FSCache) setUpstreamRanges(protocol int, domain, path string, supported bool) {
+	fs.setAccessCacheRecord(protocol, domain, path, func(record *accessCacheRecord) bool {
+		changed := record.entry.UpstreamRanges != supported
+		record.entry.UpstreamRanges = supported
+		return changed
+	})
+}
+
 // Set sets the access information for a given key.
 func (fs *FSCache) Set(protocol int, domain, path string, entry AccessEntry) error {
 	if entry.URL == nil {
@@ -449,8 +506,7 @@ func (fs *FSCache) Set(protocol int, domain, path string, entry AccessEntry) err
 	}
 	fs.setAccessCacheRecord(protocol, domain, path, func(record *accessCacheRecord) bool {
 		record.entry = entry
-		record.markedForDeletion = false
-		record.markedAt = time.Time{}
+		fs.clearDeletionMark(record)
 		return true
 	})
 	return nil
@@ -477,13 +533,15 @@ func (fs *FSCache) Hit(protocol int, domain, key string) error {
 
 	fs.accessCacheMux.Lock()
 	record.entry.LastAccessed = time.Now()
+	record.entry.Hits++
 	record.dirty = true
 	fs.accessCacheMux.Unlock()
 
 	return nil
 }
 
-// UpdateLastChecked updates the last checked time for the given key.
+// UpdateLastChecked updates the last checked time for the given key. The file
+// was found upstream, so a deletion mark is removed.
 func (fs *FSCache) UpdateLastChecked(protocol int, domain, path string) error {
 	record, ok := fs.getAccessCacheRecord(protocol, domain, path)
 	if !ok {
@@ -492,6 +550,7 @@ func (fs *FSCache) UpdateLastChecked(protocol int, domain, path string) error {
 
 	fs.accessCacheMux.Lock()
 	record.entry.LastChecked = time.Now()
+	fs.clearDeletionMark(record)
 	record.dirty = true
 	fs.accessCacheMux.Unlock()
 
@@ -532,8 +591,9 @@ func (fs *FSCache) UpdateFile(protocol int, domain, path, urlString string, last
 		record.entry.LastChecked = time.Now()
 		record.entry.ETag = etag
 		record.entry.Size = size
-		record.markedForDeletion = false
-		record.markedAt = time.Time{}
+		record.entry.Origin = ""
+		record.entry.Checksums = nil
+		fs.clearDeletionMark(record)
 		return true
 	})
 }
@@ -545,6 +605,7 @@ func (fs *FSCache) AddURLIfNotExists(protocol int, domain, path, urlString strin
 	if err != nil {
 		parsedURL = fs.buildAccessURL(protocol, domain, path)
 	}
+	parsedURL = fs.preferHTTPS(parsedURL)
 
 	fs.setAccessCacheRecord(protocol, domain, path, func(record *accessCacheRecord) bool {
 		if record.entry.URL == nil || record.entry.URL.String() != parsedURL.String() {
@@ -570,6 +631,7 @@ func (fs *FSCache) CreateFileLock(protocol int, domain, path string) {
 // RemoveFileLock deletes the lock for the given UUID.
 func (fs *FSCache) RemoveFileLock(protocol int, domain, path string) {
 	fs.memoryFileReadLockDelete(protocol, domain, path)
+	fs.notifyLockReleased(protocol, domain, path)
 }
 
 // HasFileLock checks if the given domain and path has a lock.
@@ -589,7 +651,7 @@ func (fs *FSCache) CreateWriteLock(protocol int, domain, path string) error {
 	fs.memoryFileWriteLockMux.Lock()
 	defer fs.memoryFileWriteLockMux.Unlock()
 
-	fs.memoryFileWriteLock[strconv.Itoa(protocol)+domain+path] = time.Now()
+	fs.memoryFileWriteLock[fs.lockKey(protocol, domain, path)] = time.Now()
 	return nil
 }
 
@@ -599,9 +661,10 @@ func (fs *FSCache) CreateWriteLock(protocol int, domain, path string) error {
 func (fs *FSCache) DeleteWriteLock(protocol int, domain, path string) {
 	// Remove the write lock from the in-memory map
 	fs.memoryFileWriteLockMux.Lock()
-	defer fs.memoryFileWriteLockMux.Unlock()
+	delete(fs.memoryFileWriteLock, fs.lockKey(protocol, domain, path))
+	fs.memoryFileWriteLockMux.Unlock()
 
-	delete(fs.memoryFileWriteLock, strconv.Itoa(protocol)+domain+path)
+	fs.notifyLockReleased(protocol, domain, path)
 }
 
 // HasWriteLock checks if the given protocol, domain and path has a write lock.
@@ -609,7 +672,7 @@ func (fs *FSCache) HasWriteLock(protocol int, domain, path string) (bool, time.T
 	fs.memoryFileWriteLockMux.RLock()
 	defer fs.memoryFileWriteLockMux.RUnlock()
 
-	lockTime, ok := fs.memoryFileWriteLock[strconv.Itoa(protocol)+domain+path]
+	lockTime, ok := fs.memoryFileWriteLock[fs.lockKey(protocol, domain, path)]
 	if !ok {
 		return false, time.Time{}
 	}
@@ -617,15 +680,26 @@ func (fs *FSCache) HasWriteLock(protocol int, domain, path string) (bool, time.T
 	return true, lockTime
 }
 
+// ActiveDownloads returns the number of files which are currently downloaded
+// or refreshed, each of them holds a write lock.
+func (fs *FSCache) ActiveDownloads() int {
+	fs.memoryFileWriteLockMux.RLock()
+	defer fs.memoryFileWriteLockMux.RUnlock()
+
+	return len(fs.memoryFileWriteLock)
+}
+
 // CreateExclusiveWriteLock locks the write lock for the given domain if it is
-// not already locked for writing and there are currently no read locks.
+// not already locked for writing and there are currently no read locks. A write
+// lock older than the maximum age was left behind by a crashed download and is
+// taken over.
 func (fs *FSCache) CreateExclusiveWriteLock(protocol int, domain, path string) bool {
-	if ok, _ := fs.HasWriteLock(protocol, domain, path); ok {
+	if ok, _ := fs.HasFileLock(protocol, domain, path); ok {
 		return false
 	}
 
-	if ok, _ := fs.HasFileLock(protocol, domain, path); ok {
-		return false
+	if ok, _ := fs.HasWriteLock(protocol, domain, path); ok {
+		return fs.takeOverStaleWriteLock(protocol, domain, path)
 	}
 
 	err := fs.CreateWriteLock(protocol, domain, path)
@@ -633,7 +707,9 @@ func (fs *FSCache) CreateExclusiveWriteLock(protocol int, domain, path string) b
 	return err == nil
 }
 
-// MarkForDeletion marks the given domain and path for deletion.
+// MarkForDeletion marks the given domain and path for deletion. Marking an
+// already marked file again confirms the mark, the time of the first mark is
+// kept.
 func (fs *FSCache) MarkForDeletion(protocol int, domain, path string) {
 	record, ok := fs.getAccessCacheRecord(protocol, domain, path)
 	if !ok {
@@ -641,12 +717,32 @@ func (fs *FSCache) MarkForDeletion(protocol int, domain, path string) {
 	}
 
 	fs.accessCacheMux.Lock()
-	record.markedForDeletion = true
-	record.markedAt = time.Now()
+	if !record.markedForDeletion {
+		record.markedForDeletion = true
+		record.markedAt = time.Now()
+		fs.pendingDeletions.Add(1)
+	}
+	record.markCount++
 	record.dirty = true
 	fs.accessCacheMux.Unlock()
 }
 
+// UnmarkForDeletion removes the deletion mark of the given domain and path,
+// e.g. once source verification found the file to be valid again.
+func (fs *FSCache) UnmarkForDeletion(protocol int, domain, path string) {
+	record, ok := fs.getAccessCacheRecord(protocol, domain, path)
+	if !ok {
+		return
+	}
+
+	fs.accessCacheMux.Lock()
+	if record.markedForDeletion {
+		fs.clearDeletionMark(record)
+		record.dirty = true
+	}
+	fs.accessCacheMux.Unlock()
+}
+
 // GetFileByPath returns the file by the given path. OriginURL is the URL of the
 // file that was previously accessed as path might be a relative path.
 func (fs *FSCache) GetFileByPath(originURL, path string) (*url.URL, bool) {
@@ -678,7 +774,7 @@ func (fs *FSCache) memoryFileReadLockRead(protocol int, domain, path string) (bo
 	fs.memoryFileReadLockMux.RLock()
 	defer fs.memoryFileReadLockMux.RUnlock()
 
-	lockTime, ok := fs.memoryFileReadLock[strconv.Itoa(protocol)+domain+path]
+	lockTime, ok := fs.memoryFileReadLock[fs.lockKey(protocol, domain, path)]
 	return ok, lockTime
 }
 
@@ -687,7 +783,7 @@ func (fs *FSCache) memoryFileReadLockWrite(protocol int, domain, path string) {
 	fs.memoryFileReadLockMux.Lock()
 	defer fs.memoryFileReadLockMux.Unlock()
 
-	fs.memoryFileReadLock[strconv.Itoa(protocol)+domain+path] = time.Now()
+	fs.memoryFileReadLock[fs.lockKey(protocol, domain, path)] = time.Now()
 }
 
 // memoryFileReadLockDelete deletes the memoryFileReadLock if a given file is locked.
@@ -695,5 +791,5 @@ func (fs *FSCache) memoryFileReadLockDelete(protocol int, domain, path string) {
 	fs.memoryFileReadLockMux.Lock()
 	defer fs.memoryFileReadLockMux.Unlock()
 
-	delete(fs.memoryFileReadLock, strconv.Itoa(protocol)+domain+path)
+	delete(fs.memoryFileReadLock, fs.lockKey(protocol, domain, path))
 }
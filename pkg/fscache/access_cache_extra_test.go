@@ -2,6 +2,7 @@ package fscache
 
 import (
 	"os"
+	"sync"
 	"testing"
 	"time"
 )
@@ -75,6 +76,9 @@ func TestHitAndUpdateLastChecked(t *testing.T) {
 	if !after.LastChecked.After(before.LastChecked) {
 		t.Fatalf("LastChecked was not updated: before=%v after=%v", before.LastChecked, after.LastChecked)
 	}
+	if after.Hits != before.Hits+1 {
+		t.Fatalf("Hits = %d, want %d", after.Hits, before.Hits+1)
+	}
 }
 
 func TestHitAndUpdateLastCheckedMissingEntry(t *testing.T) {
@@ -163,3 +167,37 @@ func TestAddURLIfNotExistsUsesFallbackForInvalidURL(t *testing.T) {
 		t.Fatalf("entry.URL after update = %#v, want %q", entry.URL, "https://mirror.example.org/alt/pkg.deb")
 	}
 }
+
+func TestGetConcurrentWithHit(t *testing.T) {
+	cache := newTestFSCache(t)
+	u := mustParseURL(t, "https://example.com/pool/main/p/pkg/pkg_1.0_amd64.deb")
+	protocol := DetermineProtocolFromURL(u)
+
+	if err := cache.Set(protocol, u.Host, u.Path, AccessEntry{URL: u}); err != nil {
+		t.Fatalf("Set() returned error: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				_ = cache.Hit(protocol, u.Host, u.Path)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				_, _ = cache.Get(protocol, u.Host, u.Path)
+				_, _ = cache.GetSHA256(protocol, u.Host, u.Path)
+			}
+		}()
+	}
+	wg.Wait()
+
+	entry, ok := cache.Get(protocol, u.Host, u.Path)
+	if !ok || entry.Hits != 400 {
+		t.Fatalf("Get() = %d hits, %v, want 400 hits", entry.Hits, ok)
+	}
+}
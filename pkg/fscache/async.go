@@ -1,27 +1,30 @@
 package fscache
 
-import "log"
+import (
+	"context"
+	"log/slog"
+)
 
-func (c *FSCache) trackRequestAsync(cacheHit bool, transferred int64) {
+func (c *FSCache) trackRequestAsync(ctx context.Context, domain string, cacheHit bool, transferred int64) {
 	go func() {
-		if err := c.TrackRequest(cacheHit, transferred); err != nil {
-			log.Printf("[WARN:STATS] failed to track request: %v", err)
+		if err := c.TrackDomainRequest(domain, cacheHit, transferred); err != nil {
+			slog.WarnContext(ctx, "Failed to track request", "event", "stats", "host", domain, "error", err)
 		}
 	}()
 }
 
-func (c *FSCache) hitAsync(protocol int, domain, path string) {
+func (c *FSCache) hitAsync(ctx context.Context, protocol int, domain, path string) {
 	go func() {
 		if err := c.Hit(protocol, domain, path); err != nil {
-			log.Printf("[WARN:ACCESS] failed to update hit count for %s%s: %v", domain, path, err)
+			slog.WarnContext(ctx, "Failed to update hit count", "event", "access", "host", domain, "path", path, "error", err)
 		}
 	}()
 }
 
-func (c *FSCache) addURLIfNotExistsAsync(protocol int, domain, path, urlString string) {
+func (c *FSCache) addURLIfNotExistsAsync(ctx context.Context, protocol int, domain, path, urlString string) {
 	go func() {
 		if err := c.AddURLIfNotExists(protocol, domain, path, urlString); err != nil {
-			log.Printf("[WARN:ACCESS] failed to update URL for %s%s: %v", domain, path, err)
+			slog.WarnContext(ctx, "Failed to update URL", "event", "access", "host", domain, "path", path, "error", err)
 		}
 	}()
 }
@@ -2,22 +2,25 @@ package fscache
 
 import (
 	"io"
-	"os"
+	"sync/atomic"
 )
 
 // asyncFileWriter writes data to a file asynchronously using a buffered channel
 // to avoid blocking the calling goroutine. The Write method copies the provided
-// bytes and sends them to the writer goroutine. Close waits until all pending
+// bytes and sends them to the writer goroutine. Once the channel is full, Write
+// blocks until the writer goroutine caught up, so a slow disk slows down the
+// caller instead of buffering without limit. Close waits until all pending
 // data has been written to disk.
 type asyncFileWriter struct {
-	ch   chan []byte
-	done chan error
+	ch     chan []byte
+	done   chan error
+	failed atomic.Bool // Set once a write failed, later data is discarded
 }
 
-// newAsyncFileWriter creates a new asynchronous writer for the provided file.
-// buf controls the number of buffered chunks kept in memory. Each chunk has the
-// same size as the byte slices passed to Write.
-func newAsyncFileWriter(file *os.File, buf int) *asyncFileWriter {
+// newAsyncFileWriter creates a new asynchronous writer for dst. buf controls
+// the number of buffered chunks kept in memory. Each chunk has the same size
+// as the byte slices passed to Write. dst is not closed by the writer.
+func newAsyncFileWriter(dst io.Writer, buf int) *asyncFileWriter {
 	w := &asyncFileWriter{
 		ch:   make(chan []byte, buf),
 		done: make(chan error, 1),
@@ -29,9 +32,10 @@ func newAsyncFileWriter(file *os.File, buf int) *asyncFileWriter {
 			if err != nil {
 				continue
 			}
-			_, err = file.Write(b)
+			if _, err = dst.Write(b); err != nil {
+				w.failed.Store(true)
+			}
 		}
-		file.Close()
 		w.done <- err
 	}()
 
@@ -39,8 +43,13 @@ func newAsyncFileWriter(file *os.File, buf int) *asyncFileWriter {
 }
 
 // Write implements io.Writer. The slice is copied to avoid data races with the
-// caller reusing the buffer.
+// caller reusing the buffer. Errors of the writer goroutine are not returned
+// here, so the caller can keep streaming, they are reported by Close.
 func (w *asyncFileWriter) Write(p []byte) (int, error) {
+	if w.failed.Load() {
+		return len(p), nil
+	}
+
 	buf := make([]byte, len(p))
 	copy(buf, p)
 	w.ch <- buf
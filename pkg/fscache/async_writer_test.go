@@ -3,7 +3,9 @@ package fscache
 import (
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestAsyncFileWriterWritesBufferedData(t *testing.T) {
@@ -25,6 +27,9 @@ func TestAsyncFileWriterWritesBufferedData(t *testing.T) {
 	if err := w.Close(); err != nil {
 		t.Fatalf("Close() error = %v", err)
 	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("file.Close() error = %v", err)
+	}
 
 	data, err := os.ReadFile(path)
 	if err != nil {
@@ -55,3 +60,89 @@ func TestAsyncFileWriterReturnsWriteErrorOnClose(t *testing.T) {
 		t.Fatalf("Close() error = nil, want non-nil")
 	}
 }
+
+// blockingWriter blocks every write until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func TestAsyncFileWriterBlocksWhenBufferIsFull(t *testing.T) {
+	dst := blockingWriter{release: make(chan struct{})}
+	w := newAsyncFileWriter(dst, 2)
+
+	// One chunk is taken by the writer goroutine, two wait in the buffer.
+	for range 3 {
+		if _, err := w.Write([]byte("x")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	written := make(chan struct{})
+	go func() {
+		_, _ = w.Write([]byte("x"))
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Write() returned while the buffer was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(dst.release)
+	<-written
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+}
+
+// slowDiskWriter simulates a slow disk by sleeping before every write.
+type slowDiskWriter struct {
+	delay   time.Duration
+	written atomic.Int64
+}
+
+func (w *slowDiskWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.written.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// BenchmarkAsyncFileWriterSlowDisk streams data faster than the simulated disk
+// accepts it. The reported peak of buffered bytes stays at the configured
+// buffer size plus the chunk being written.
+func BenchmarkAsyncFileWriterSlowDisk(b *testing.B) {
+	const (
+		chunks      = 32
+		chunkCount  = 256
+		totalLength = chunkCount * copyBufferSize
+	)
+	chunk := make([]byte, copyBufferSize)
+
+	var peak int64
+	b.SetBytes(totalLength)
+	for b.Loop() {
+		dst := &slowDiskWriter{delay: 20 * time.Microsecond}
+		w := newAsyncFileWriter(dst, chunks)
+
+		var produced int64
+		for range chunkCount {
+			_, _ = w.Write(chunk)
+			produced += copyBufferSize
+			peak = max(peak, produced-dst.written.Load())
+		}
+		if err := w.Close(); err != nil {
+			b.Fatalf("Close() error = %v", err)
+		}
+	}
+
+	if limit := int64(chunks+2) * copyBufferSize; peak > limit {
+		b.Fatalf("peak buffered bytes = %d, want <= %d", peak, limit)
+	}
+	b.ReportMetric(float64(peak), "peak-buffered-B")
+}
@@ -0,0 +1,52 @@
+package fscache
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// cacheDebugHeader is the response header describing the caching decision.
+const cacheDebugHeader = "X-Cache-Debug"
+
+// SetDebugHeaders enables the X-Cache-Debug response header, which describes
+// the path a request took through the cache. It has to be called before
+// requests are served.
+func (c *FSCache) SetDebugHeaders(enabled bool) {
+	c.debugHeaders = enabled
+}
+
+// addCacheDebug appends a step of the caching decision to the X-Cache-Debug
+// header of w. Steps are separated by semicolons in the order they were taken.
+func (c *FSCache) addCacheDebug(w http.ResponseWriter, format string, args ...any) {
+	if !c.debugHeaders {
+		return
+	}
+
+	step := fmt.Sprintf(format, args...)
+	if current := w.Header().Get(cacheDebugHeader); current != "" {
+		step = current + "; " + step
+	}
+	w.Header().Set(cacheDebugHeader, step)
+}
+
+// describeRecheck describes if the metadata of localFile is due for a check
+// upstream, with the recheck timeout used and the rule it was chosen by.
+func (c *FSCache) describeRecheck(localFile *url.URL, lastAccess AccessEntry) string {
+	if c.isImmutable(localFile.Host) {
+		return "recheck=never (immutable domain)"
+	}
+
+	timeout, rule := c.recheckTimeout(localFile)
+	if lastAccess.LastChecked.IsZero() {
+		return fmt.Sprintf("recheck=due (timeout %s by %s rule, never checked)", timeout, rule)
+	}
+
+	age := time.Since(lastAccess.LastChecked).Truncate(time.Second)
+	state := "not due"
+	if age > timeout {
+		state = "due"
+	}
+	return fmt.Sprintf("recheck=%s (timeout %s by %s rule, last checked %s ago)", state, timeout, rule, age)
+}
@@ -0,0 +1,103 @@
+package fscache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecheckTimeout(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	tests := []struct {
+		url         string
+		wantTimeout time.Duration
+		wantRule    string
+	}{
+		{url: "http://deb.example/debian/dists/stable/Contents-amd64.gz", wantTimeout: 24 * time.Hour, wantRule: "default"},
+		{url: "http://deb.example/debian/pool/main/h/hello/hello_1.0_amd64.deb", wantTimeout: 168 * time.Hour, wantRule: "pool"},
+		{url: "http://deb.example/debian/dists/stable/main/binary-amd64/by-hash/SHA256/abc", wantTimeout: 168 * time.Hour, wantRule: "by-hash"},
+		{url: "http://deb.example/debian/dists/stable/InRelease", wantTimeout: 5 * time.Minute, wantRule: "repository index"},
+	}
+
+	for _, tt := range tests {
+		timeout, rule := cache.recheckTimeout(mustParseURL(t, tt.url))
+		if timeout != tt.wantTimeout || rule != tt.wantRule {
+			t.Errorf("recheckTimeout(%q) = %s, %q, want %s, %q", tt.url, timeout, rule, tt.wantTimeout, tt.wantRule)
+		}
+	}
+}
+
+func TestServeGETRequestCacheDebugHeader(t *testing.T) {
+	const payload = "packages"
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == "\"etag\"" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", "\"etag\"")
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	cache := newTestFSCache(t)
+	target := upstream.URL + "/debian/dists/stable/main/binary-amd64/Packages.gz"
+	serve := func() string {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(httptest.NewRequest(http.MethodGet, target, nil), rr)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+		}
+		return rr.Header().Get(cacheDebugHeader)
+	}
+
+	if got := serve(); got != "" {
+		t.Fatalf("%s = %q without debug headers, want none", cacheDebugHeader, got)
+	}
+	cache.SetDebugHeaders(true)
+
+	got := serve()
+	want := "result=hit; size=matched (8 bytes); recheck=not due (timeout 5m0s by repository index rule, last checked "
+	if !strings.HasPrefix(got, want) {
+		t.Fatalf("%s of hit = %q, want prefix %q", cacheDebugHeader, got, want)
+	}
+
+	// Stale metadata is revalidated before serving.
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	protocol := DetermineProtocolFromURL(req.URL)
+	entry, _ := cache.Get(protocol, req.URL.Host, req.URL.Path)
+	entry.LastChecked = time.Now().Add(-10 * time.Minute)
+	if err := cache.Set(protocol, req.URL.Host, req.URL.Path, entry); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	got = serve()
+	for _, step := range []string{"recheck=due (timeout 5m0s by repository index rule, last checked 10m0s ago)", "refresh=before serving, file unchanged upstream"} {
+		if !strings.Contains(got, step) {
+			t.Fatalf("%s of stale hit = %q, want step %q", cacheDebugHeader, got, step)
+		}
+	}
+
+	// A file which doesn't match its metadata is downloaded again.
+	localPath := cache.buildLocalPath(req.URL)
+	if err := os.WriteFile(localPath, []byte("truncated"+payload), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	got = serve()
+	want = "result=stale (size mismatch, expected 8 bytes, file has 17 bytes); origin=upstream"
+	if got != want {
+		t.Fatalf("%s of stale file = %q, want %q", cacheDebugHeader, got, want)
+	}
+
+	// Files without metadata are recorded and served.
+	cache.Delete(protocol, req.URL.Host, req.URL.Path)
+	got = serve()
+	if !strings.HasPrefix(got, "result=miss (no metadata); recovered=file without metadata, sha256 ") {
+		t.Fatalf("%s of file without metadata = %q", cacheDebugHeader, got)
+	}
+}
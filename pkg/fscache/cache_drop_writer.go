@@ -8,7 +8,8 @@ const (
 )
 
 // cacheDropWriter writes to a file and hints the kernel to drop written pages
-// from the page cache once a threshold is exceeded.
+// from the page cache once a threshold is exceeded. A threshold of 0 or less
+// never drops anything.
 type cacheDropWriter struct {
 	f         *os.File
 	offset    int64
@@ -43,7 +44,7 @@ func (w *cacheDropWriter) Write(p []byte) (int, error) {
 
 	w.offset += int64(n)
 	if !w.enabled {
-		if w.offset < w.threshold {
+		if w.threshold <= 0 || w.offset < w.threshold {
 			return n, err
 		}
 		w.enabled = true
@@ -35,6 +35,29 @@ func TestCacheDropWriterSkipsDropsBelowThreshold(t *testing.T) {
 	}
 }
 
+func TestCacheDropWriterDisabledThreshold(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "payload.bin"))
+	if err != nil {
+		t.Fatalf("os.Create() error = %v", err)
+	}
+	defer file.Close()
+
+	calls := []dropCall{}
+	w := newCacheDropWriterWithDropRange(file, 0, 1, func(_ *os.File, offset, length int64) error {
+		calls = append(calls, dropCall{offset: offset, length: length})
+		return nil
+	})
+
+	if _, err := w.Write([]byte("12345")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	w.DropCache()
+
+	if len(calls) != 0 {
+		t.Fatalf("drop calls = %v, want none", calls)
+	}
+}
+
 func TestNewCacheDropWriterDefaultConstructor(t *testing.T) {
 	file, err := os.Create(filepath.Join(t.TempDir(), "payload.bin"))
 	if err != nil {
@@ -0,0 +1,129 @@
+package fscache
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// verifyChecksumHeader is the request header asking to verify the checksum of
+// a cached file before it is served, e.g. "sha1" to check the file against the
+// stored SHA1 or "sha1=<hex>" to check it against the given value. A mismatch
+// fetches the file again.
+const verifyChecksumHeader = "X-Verify-Checksum"
+
+// checksumAlgorithm is a checksum which can be sent for cached files.
+type checksumAlgorithm struct {
+	header  string
+	newHash func() hash.Hash
+}
+
+// checksumAlgorithms are the supported checksums by lowercase name. SHA256 is
+// recorded for every download, the others once they are requested.
+var checksumAlgorithms = map[string]checksumAlgorithm{
+	"md5":    {header: "X-MD5", newHash: md5.New},
+	"sha1":   {header: "X-SHA1", newHash: sha1.New},
+	"sha256": {header: "X-SHA256", newHash: sha256.New},
+	"sha512": {header: "X-SHA512", newHash: sha512.New},
+}
+
+// parseVerifyChecksum parses the value of the X-Verify-Checksum header into
+// the algorithm and the optional expected checksum.
+func parseVerifyChecksum(value string) (string, string, bool) {
+	name, expected, _ := strings.Cut(strings.TrimSpace(value), "=")
+	name = strings.ToLower(strings.TrimSpace(name))
+	if _, ok := checksumAlgorithms[name]; !ok {
+		return "", "", false
+	}
+	return name, strings.ToLower(strings.TrimSpace(expected)), true
+}
+
+// fileChecksum returns the hex encoded checksum of the file at path.
+func fileChecksum(path, algorithm string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := checksumAlgorithms[algorithm].newHash()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// entryChecksum returns the stored checksum of entry for algorithm.
+func entryChecksum(entry AccessEntry, algorithm string) string {
+	if algorithm == "sha256" {
+		return entry.SHA256
+	}
+	return entry.Checksums[algorithm]
+}
+
+// setChecksumHeaders adds a header for every checksum stored for entry.
+func setChecksumHeaders(header http.Header, entry AccessEntry) {
+	for _, name := range slices.Sorted(maps.Keys(checksumAlgorithms)) {
+		if checksum := entryChecksum(entry, name); checksum != "" {
+			header.Set(checksumAlgorithms[name].header, checksum)
+		}
+	}
+}
+
+// setChecksum stores the checksum of a cached file for algorithm.
+func (c *FSCache) setChecksum(protocol int, domain, path, algorithm, checksum string) {
+	if algorithm == "sha256" {
+		_ = c.SetSHA256(protocol, domain, path, checksum)
+		return
+	}
+
+	c.setAccessCacheRecord(protocol, domain, path, func(record *accessCacheRecord) bool {
+		if record.entry.Checksums[algorithm] == checksum {
+			return false
+		}
+		// The map is cloned as copies of the entry handed out by Get share it.
+		checksums := maps.Clone(record.entry.Checksums)
+		if checksums == nil {
+			checksums = make(map[string]string, 1)
+		}
+		checksums[algorithm] = checksum
+		record.entry.Checksums = checksums
+		return true
+	})
+}
+
+// verifyChecksumBeforeServe checks the cached file at localPath if the client
+// asked for it with the X-Verify-Checksum header. The computed checksum is
+// stored, so it is sent with later responses. It returns false if the file
+// doesn't match and has to be fetched again.
+func (c *FSCache) verifyChecksumBeforeServe(ctx context.Context, protocol int, requestURL *url.URL, localPath string, entry AccessEntry, algorithm, expected string) bool {
+	checksum, err := fileChecksum(localPath, algorithm)
+	if err != nil {
+		slog.WarnContext(ctx, "Error computing checksum", "event", "get_verify", "host", requestURL.Host, "path", requestURL.Path, "algorithm", algorithm, "error", err)
+		return false
+	}
+
+	if stored := entryChecksum(entry, algorithm); stored != "" && stored != checksum {
+		slog.WarnContext(ctx, "Cached file doesn't match stored checksum", "event", "get_verify", "host", requestURL.Host, "path", requestURL.Path, "algorithm", algorithm, "expected", stored, "checksum", checksum)
+		return false
+	}
+	if expected != "" && expected != checksum {
+		slog.WarnContext(ctx, "Cached file doesn't match checksum of client", "event", "get_verify", "host", requestURL.Host, "path", requestURL.Path, "algorithm", algorithm, "expected", expected, "checksum", checksum)
+		return false
+	}
+
+	c.setChecksum(protocol, requestURL.Host, requestURL.Path, algorithm, checksum)
+	return true
+}
@@ -0,0 +1,135 @@
+package fscache
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func hexSum(sum []byte) string {
+	return hex.EncodeToString(sum)
+}
+
+func serveVerified(cache *FSCache, rawURL, verify string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, rawURL, nil)
+	if verify != "" {
+		req.Header.Set(verifyChecksumHeader, verify)
+	}
+	rr := httptest.NewRecorder()
+	cache.serveGETRequest(req, rr)
+	return rr
+}
+
+func TestParseVerifyChecksum(t *testing.T) {
+	tcs := []struct {
+		value    string
+		alg      string
+		expected string
+		ok       bool
+	}{
+		{"sha1", "sha1", "", true},
+		{" SHA256 = ABCDEF ", "sha256", "abcdef", true},
+		{"md5=0123", "md5", "0123", true},
+		{"crc32", "", "", false},
+		{"", "", "", false},
+	}
+
+	for _, tc := range tcs {
+		alg, expected, ok := parseVerifyChecksum(tc.value)
+		if alg != tc.alg || expected != tc.expected || ok != tc.ok {
+			t.Errorf("parseVerifyChecksum(%q) = %q, %q, %v, want %q, %q, %v", tc.value, alg, expected, ok, tc.alg, tc.expected, tc.ok)
+		}
+	}
+}
+
+func TestServeGETRequestHitSendsChecksums(t *testing.T) {
+	const payload = "package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	rawURL := mirror.URL + "/debian/dists/stable/main/binary-amd64/Packages.gz"
+
+	if rr := serveVerified(cache, rawURL, ""); rr.Code != http.StatusOK {
+		t.Fatalf("cache miss status = %d, want 200", rr.Code)
+	}
+
+	rr := serveVerified(cache, rawURL, "")
+	sha256Sum := sha256.Sum256([]byte(payload))
+	if got := rr.Header().Get("X-SHA256"); got != hexSum(sha256Sum[:]) {
+		t.Fatalf("X-SHA256 = %q, want %q", got, hexSum(sha256Sum[:]))
+	}
+	if got := rr.Header().Get("X-SHA1"); got != "" {
+		t.Fatalf("X-SHA1 = %q before it was requested", got)
+	}
+
+	// Once verified, the SHA1 is recorded and sent with later hits.
+	sha1Sum := sha1.Sum([]byte(payload))
+	if rr := serveVerified(cache, rawURL, "sha1"); rr.Code != http.StatusOK || rr.Header().Get("X-SHA1") != hexSum(sha1Sum[:]) {
+		t.Fatalf("verified hit = %d, X-SHA1 %q, want 200, %q", rr.Code, rr.Header().Get("X-SHA1"), hexSum(sha1Sum[:]))
+	}
+	if got := serveVerified(cache, rawURL, "").Header().Get("X-SHA1"); got != hexSum(sha1Sum[:]) {
+		t.Fatalf("X-SHA1 = %q, want %q", got, hexSum(sha1Sum[:]))
+	}
+}
+
+func TestServeGETRequestVerifyMismatchFetchesAgain(t *testing.T) {
+	const payload = "package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	rawURL := mirror.URL + "/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	if rr := serveVerified(cache, rawURL, ""); rr.Code != http.StatusOK {
+		t.Fatalf("cache miss status = %d, want 200", rr.Code)
+	}
+
+	// Corrupt the cached file without changing its size.
+	localPath := cache.buildLocalPath(mustParseURL(t, rawURL))
+	if err := os.WriteFile(localPath, []byte("corrupt content"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	// Without verification, the pool file is served from disk.
+	if rr := serveVerified(cache, rawURL, ""); rr.Body.String() == payload || mirror.requests.Load() != 1 {
+		t.Fatalf("unverified hit = %q after %d requests, want corrupt file without request", rr.Body.String(), mirror.requests.Load())
+	}
+
+	rr := serveVerified(cache, rawURL, "sha256")
+	if rr.Code != http.StatusOK || rr.Body.String() != payload {
+		t.Fatalf("verified response = %d %q, want 200 %q", rr.Code, rr.Body.String(), payload)
+	}
+	if mirror.requests.Load() != 2 {
+		t.Fatalf("upstream requests = %d, want 2", mirror.requests.Load())
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil || string(data) != payload {
+		t.Fatalf("cached file = %q, %v, want %q", data, err, payload)
+	}
+}
+
+func TestServeGETRequestVerifyExpectedChecksum(t *testing.T) {
+	const payload = "package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	rawURL := mirror.URL + "/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+	serveVerified(cache, rawURL, "")
+
+	sha1Sum := sha1.Sum([]byte(payload))
+	if rr := serveVerified(cache, rawURL, "sha1="+hexSum(sha1Sum[:])); rr.Code != http.StatusOK || mirror.requests.Load() != 1 {
+		t.Fatalf("matching checksum = %d after %d requests, want 200 without request", rr.Code, mirror.requests.Load())
+	}
+
+	// A checksum of the client which doesn't match the file fetches it again.
+	if rr := serveVerified(cache, rawURL, "sha1=0000"); rr.Code != http.StatusOK || mirror.requests.Load() != 2 {
+		t.Fatalf("mismatching checksum = %d after %d requests, want 200 after 2 requests", rr.Code, mirror.requests.Load())
+	}
+
+	if rr := serveVerified(cache, rawURL, "crc32"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("unsupported algorithm status = %d, want 400", rr.Code)
+	}
+}
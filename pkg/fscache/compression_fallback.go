@@ -0,0 +1,319 @@
+package fscache
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ulikunitz/xz"
+)
+
+// compressionExtensions are the extensions of compressed repository index
+// files in the order they are tried as source, smallest download first.
+var compressionExtensions = []string{".xz", ".gz", ".bz2"}
+
+// compressionFallbackNames are the name prefixes of the index files which are
+// converted from another compression variant.
+var compressionFallbackNames = []string{"Packages", "Sources", "Contents-", "Translation-", "Commands-"}
+
+// SetCompressionFallback enables serving repository index files which are not
+// found upstream from another compression variant, e.g. Packages from
+// Packages.xz. It has to be called before requests are served.
+func (c *FSCache) SetCompressionFallback(enabled bool) {
+	c.compressionFallback = enabled
+}
+
+// splitCompression returns urlPath without compression extension and the
+// extension, which is empty for uncompressed files.
+func splitCompression(urlPath string) (string, string) {
+	for _, ext := range compressionExtensions {
+		if base, ok := strings.CutSuffix(urlPath, ext); ok {
+			return base, ext
+		}
+	}
+	return urlPath, ""
+}
+
+// compressionSiblings returns the paths of the other compression variants of
+// the index file at urlPath, which can be converted into it. bzip2 can only be
+// read, so .bz2 files have none.
+func compressionSiblings(urlPath string) []string {
+	if !isRepositoryIndexPath(urlPath) {
+		return nil
+	}
+
+	base, ext := splitCompression(urlPath)
+	if ext == ".bz2" {
+		return nil
+	}
+	name := path.Base(base)
+	if !slices.ContainsFunc(compressionFallbackNames, func(prefix string) bool { return strings.HasPrefix(name, prefix) }) {
+		return nil
+	}
+
+	var siblings []string
+	if ext != "" {
+		siblings = append(siblings, base)
+	}
+	for _, siblingExt := range compressionExtensions {
+		if siblingExt != ext {
+			siblings = append(siblings, base+siblingExt)
+		}
+	}
+	return siblings
+}
+
+// decompressReader returns a reader of the uncompressed content of r, which
+// is compressed according to the extension ext.
+func decompressReader(ext string, r io.Reader) (io.Reader, error) {
+	switch ext {
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".bz2":
+		return bzip2.NewReader(r), nil
+	case ".xz":
+		return xz.NewReader(r)
+	default:
+		return r, nil
+	}
+}
+
+// nopWriteCloser passes writes to an io.Writer which is closed elsewhere.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressWriter returns a writer compressing to w according to the extension
+// ext. Close flushes the compressed data, w is not closed.
+func compressWriter(ext string, w io.Writer) (io.WriteCloser, error) {
+	switch ext {
+	case ".gz":
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case ".xz":
+		return xz.NewWriter(w)
+	case "":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("can't compress to %s", ext)
+	}
+}
+
+// serveCompressionFallback serves the index file of r, which wasn't found
+// upstream, converted from another compression variant. Both files are
+// cached. The write lock of r has to be held. It returns false if no variant
+// is available, nothing is written to w in this case.
+func (c *FSCache) serveCompressionFallback(protocol int, r *http.Request, w http.ResponseWriter) bool {
+	if !c.compressionFallback {
+		return false
+	}
+
+	for _, siblingPath := range compressionSiblings(r.URL.Path) {
+		sibling := *r.URL
+		sibling.Path, sibling.RawPath = siblingPath, ""
+
+		entry, ok := c.convertCompressionSibling(r, protocol, &sibling)
+		if !ok {
+			continue
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		c.addCacheDebug(w, "fallback=converted from %s", path.Base(siblingPath))
+		http.ServeFile(w, r, c.buildLocalPath(r.URL))
+
+		slog.InfoContext(r.Context(), "Cache miss, converted other compression variant", "event", "miss", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "source", siblingPath, "bytes", entry.Size)
+		c.trackRequestAsync(r.Context(), r.URL.Host, false, entry.Size)
+		return true
+	}
+
+	return false
+}
+
+// convertCompressionSibling caches the variant sibling of the index file of r
+// if necessary and writes the converted file to the cache location of r.
+func (c *FSCache) convertCompressionSibling(r *http.Request, protocol int, sibling *url.URL) (AccessEntry, bool) {
+	// A variant which is downloaded or served right now is skipped.
+	if !c.CreateExclusiveWriteLock(protocol, sibling.Host, sibling.Path) {
+		return AccessEntry{}, false
+	}
+	defer c.DeleteWriteLock(protocol, sibling.Host, sibling.Path)
+
+	siblingPath := c.buildLocalPath(sibling)
+	source, ok := c.Get(protocol, sibling.Host, sibling.Path)
+	if info, err := os.Stat(siblingPath); !ok || err != nil || !fileMatchesEntry(info, source) {
+		if source, ok = c.downloadCompressionSibling(r, protocol, sibling); !ok {
+			return AccessEntry{}, false
+		}
+	}
+
+	_, sourceExt := splitCompression(sibling.Path)
+	_, targetExt := splitCompression(r.URL.Path)
+	targetPath := c.buildLocalPath(r.URL)
+	size, hash, err := convertCompressedFile(siblingPath, sourceExt, targetPath, targetExt, source.RemoteLastModified)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error converting compression variant", "event", "miss", "host", r.URL.Host, "path", r.URL.Path, "source", sibling.Path, "error", err)
+		return AccessEntry{}, false
+	}
+
+	entry := AccessEntry{
+		RemoteLastModified: source.RemoteLastModified,
+		LastAccessed:       time.Now(),
+		LastChecked:        time.Now(),
+		URL:                r.URL,
+		Size:               size,
+		SHA256:             hash,
+		Origin:             source.Origin,
+	}
+	if err := c.Set(protocol, r.URL.Host, r.URL.Path, entry); err != nil {
+		slog.ErrorContext(r.Context(), "Error updating access cache", "event", "miss", "host", r.URL.Host, "path", r.URL.Path, "error", err)
+	}
+	return entry, true
+}
+
+// downloadCompressionSibling downloads the variant sibling from upstream into
+// the cache.
+func (c *FSCache) downloadCompressionSibling(r *http.Request, protocol int, sibling *url.URL) (AccessEntry, bool) {
+	siblingRequest := r.Clone(r.Context())
+	siblingRequest.URL = sibling
+	siblingRequest.Header.Del("Range")
+	req, err := c.newCacheMissUpstreamRequest(siblingRequest)
+	if err != nil {
+		return AccessEntry{}, false
+	}
+
+	resp, err := c.client.Do(req.WithContext(r.Context()))
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error fetching compression variant", "event", "miss", "host", sibling.Host, "path", sibling.Path, "error", err)
+		return AccessEntry{}, false
+	}
+	defer resp.Body.Close()
+	c.noteUpstreamResponse(r.Context(), sibling.Host, resp)
+	if resp.StatusCode != http.StatusOK {
+		return AccessEntry{}, false
+	}
+
+	targetPath := c.buildLocalPath(sibling)
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+		slog.ErrorContext(r.Context(), "Error creating cache directory", "event", "miss", "path", filepath.Dir(targetPath), "error", err)
+		return AccessEntry{}, false
+	}
+	if resp.ContentLength > 0 {
+		if err := ensureDiskSpace(targetPath, resp.ContentLength); err != nil {
+			slog.ErrorContext(r.Context(), "Error reserving disk space", "event", "miss", "host", sibling.Host, "path", sibling.Path, "bytes", resp.ContentLength, "error", err)
+			return AccessEntry{}, false
+		}
+	}
+
+	lastModified := parseLastModifiedForMetadata(r.Context(), resp.Header.Get("Last-Modified"))
+	size, hash, err := writeCacheFile(targetPath, resp.Body, resp.ContentLength, lastModified)
+	if errors.Is(err, errIncompleteDownload) {
+		slog.ErrorContext(r.Context(), "Incomplete download", "event", "miss", "host", sibling.Host, "path", sibling.Path, "expected_bytes", resp.ContentLength, "bytes", size)
+		return AccessEntry{}, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error writing file", "event", "miss", "path", targetPath, "error", err)
+		return AccessEntry{}, false
+	}
+	c.deduplicateFile(r.Context(), targetPath, hash, size)
+
+	entry := AccessEntry{
+		RemoteLastModified: lastModified,
+		LastAccessed:       time.Now(),
+		LastChecked:        time.Now(),
+		ETag:               resp.Header.Get("ETag"),
+		URL:                sibling,
+		Size:               size,
+		SHA256:             hash,
+		UpstreamRanges:     upstreamSupportsRanges(resp.Header),
+	}
+	if err := c.Set(protocol, sibling.Host, sibling.Path, entry); err != nil {
+		slog.ErrorContext(r.Context(), "Error updating access cache", "event", "miss", "host", sibling.Host, "path", sibling.Path, "error", err)
+	}
+	return entry, true
+}
+
+// convertCompressedFile writes the content of the file at sourcePath,
+// compressed according to sourceExt, compressed according to targetExt to
+// targetPath. It returns the size and SHA256 checksum of the written file.
+func convertCompressedFile(sourcePath, sourceExt, targetPath, targetExt string, modTime time.Time) (int64, string, error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer source.Close()
+
+	content, err := decompressReader(sourceExt, source)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// The content is compressed by a goroutine while it is written to disk.
+	pr, pw := io.Pipe()
+	go func() {
+		cw, err := compressWriter(targetExt, pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(cw, content); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(cw.Close())
+	}()
+	defer pr.Close()
+
+	return writeCacheFile(targetPath, pr, -1, modTime)
+}
+
+// errIncompleteDownload is returned by writeCacheFile if r had less or more
+// data than expected.
+var errIncompleteDownload = errors.New("incomplete download")
+
+// writeCacheFile writes r to a temporary file which is renamed to targetPath
+// once complete. If expectedSize isn't negative, the file is only renamed if
+// it has exactly that size. The modification time is set to modTime. It
+// returns the size and SHA256 checksum of the file.
+func writeCacheFile(targetPath string, r io.Reader, expectedSize int64, modTime time.Time) (int64, string, error) {
+	tempPath := buildTempCachePath(targetPath)
+	file, err := createCacheFile(tempPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(tempPath)
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if expectedSize >= 0 && size != expectedSize {
+		return size, "", fmt.Errorf("%w: expected %d bytes, got %d", errIncompleteDownload, expectedSize, size)
+	}
+
+	if err := os.Rename(tempPath, targetPath); err != nil {
+		return 0, "", err
+	}
+	if !modTime.IsZero() && modTime.Year() > 2000 {
+		_ = os.Chtimes(targetPath, time.Now(), modTime)
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
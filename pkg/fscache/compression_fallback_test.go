@@ -0,0 +1,187 @@
+package fscache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPackagesIndex = "Package: hello\nVersion: 1.0\nFilename: pool/main/h/hello/hello_1.0_amd64.deb\n\n"
+
+func compressTestData(t *testing.T, ext string, data string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := compressWriter(ext, &buf)
+	if err != nil {
+		t.Fatalf("compressWriter(%q) error = %v", ext, err)
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressionSiblings(t *testing.T) {
+	tcs := []struct {
+		path string
+		want []string
+	}{
+		{"/debian/dists/stable/main/binary-amd64/Packages", []string{
+			"/debian/dists/stable/main/binary-amd64/Packages.xz",
+			"/debian/dists/stable/main/binary-amd64/Packages.gz",
+			"/debian/dists/stable/main/binary-amd64/Packages.bz2",
+		}},
+		{"/debian/dists/stable/main/i18n/Translation-en.gz", []string{
+			"/debian/dists/stable/main/i18n/Translation-en",
+			"/debian/dists/stable/main/i18n/Translation-en.xz",
+			"/debian/dists/stable/main/i18n/Translation-en.bz2",
+		}},
+		{"/debian/dists/stable/main/binary-amd64/Packages.bz2", nil},
+		{"/debian/dists/stable/InRelease", nil},
+		{"/debian/pool/main/p/packages/Packages.gz", nil},
+	}
+
+	for _, tc := range tcs {
+		if got := compressionSiblings(tc.path); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("compressionSiblings(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestServeGETRequestCompressionFallback(t *testing.T) {
+	const indexPath = "/debian/dists/stable/main/binary-amd64/Packages"
+
+	t.Run("decompress", func(t *testing.T) {
+		mirror := newTestMirrorFiles(t, map[string][]byte{indexPath + ".xz": compressTestData(t, ".xz", testPackagesIndex)}).URL
+		cache := newTestFSCache(t)
+		cache.SetCompressionFallback(true)
+
+		req := httptest.NewRequest(http.MethodGet, mirror+indexPath, nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusOK || rr.Body.String() != testPackagesIndex || rr.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("response = %d %q, X-Cache %q, want 200 %q, MISS", rr.Code, rr.Body.String(), rr.Header().Get("X-Cache"), testPackagesIndex)
+		}
+
+		for _, urlPath := range []string{indexPath, indexPath + ".xz"} {
+			u := mustParseURL(t, mirror+urlPath)
+			entry, ok := cache.Get(0, u.Host, u.Path)
+			if !ok {
+				t.Fatalf("%s has no metadata", urlPath)
+			}
+			if info, err := os.Stat(cache.buildLocalPath(u)); err != nil || info.Size() != entry.Size {
+				t.Fatalf("cached %s: %v, metadata size %d", urlPath, err, entry.Size)
+			}
+		}
+
+		rr = httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Header().Get("X-Cache") != "HIT" || rr.Body.String() != testPackagesIndex {
+			t.Fatalf("second response X-Cache %q, body %q, want HIT", rr.Header().Get("X-Cache"), rr.Body.String())
+		}
+	})
+
+	t.Run("recompress", func(t *testing.T) {
+		mirror := newTestMirrorFiles(t, map[string][]byte{indexPath: []byte(testPackagesIndex)}).URL
+		cache := newTestFSCache(t)
+		cache.SetCompressionFallback(true)
+
+		req := httptest.NewRequest(http.MethodGet, mirror+indexPath+".gz", nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("response = %d, want 200", rr.Code)
+		}
+		gz, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("gzip.NewReader() error = %v", err)
+		}
+		if data, err := io.ReadAll(gz); err != nil || string(data) != testPackagesIndex {
+			t.Fatalf("decompressed body = %q, %v, want %q", data, err, testPackagesIndex)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		mirror := newTestMirrorFiles(t, map[string][]byte{indexPath + ".gz": compressTestData(t, ".gz", testPackagesIndex)}).URL
+		cache := newTestFSCache(t)
+
+		req := httptest.NewRequest(http.MethodGet, mirror+indexPath, nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("response = %d, want 404", rr.Code)
+		}
+	})
+
+	t.Run("incomplete variant", func(t *testing.T) {
+		compressed := compressTestData(t, ".xz", testPackagesIndex)
+		cache := newTestFSCache(t)
+		cache.SetCompressionFallback(true)
+		cache.client = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if r.URL.Path != indexPath+".xz" {
+				return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: http.NoBody, Request: r}, nil
+			}
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{},
+				Body:          io.NopCloser(bytes.NewReader(compressed)),
+				ContentLength: int64(len(compressed)) + 100,
+				Request:       r,
+			}, nil
+		})}
+
+		req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org"+indexPath, nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("response = %d, want 404", rr.Code)
+		}
+
+		variant := mustParseURL(t, "http://deb.debian.org"+indexPath+".xz")
+		if _, ok := cache.Get(0, variant.Host, variant.Path); ok {
+			t.Fatal("incomplete variant has a metadata entry")
+		}
+		if _, err := os.Stat(cache.buildLocalPath(variant)); !os.IsNotExist(err) {
+			t.Fatalf("incomplete variant was cached, Stat() error = %v", err)
+		}
+	})
+
+	t.Run("no variant", func(t *testing.T) {
+		mirror := newTestMirrorFiles(t, nil).URL
+		cache := newTestFSCache(t)
+		cache.SetCompressionFallback(true)
+
+		req := httptest.NewRequest(http.MethodGet, mirror+indexPath, nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusNotFound || strings.Contains(rr.Header().Get(cacheDebugHeader), "fallback") {
+			t.Fatalf("response = %d, want 404 without fallback", rr.Code)
+		}
+	})
+}
+
+func TestDecompressReader(t *testing.T) {
+	for _, ext := range []string{"", ".gz", ".xz"} {
+		r, err := decompressReader(ext, bytes.NewReader(compressTestData(t, ext, testPackagesIndex)))
+		if err != nil {
+			t.Fatalf("decompressReader(%q) error = %v", ext, err)
+		}
+		if data, err := io.ReadAll(r); err != nil || string(data) != testPackagesIndex {
+			t.Fatalf("decompressReader(%q) = %q, %v", ext, data, err)
+		}
+	}
+
+	if _, err := compressWriter(".bz2", io.Discard); err == nil {
+		t.Fatalf("compressWriter(.bz2) error = nil, want error")
+	}
+}
@@ -0,0 +1,108 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUpstreamCooldown limits the cooldown requested by a Retry-After header,
+// so a misconfigured mirror can't block a host for days.
+const maxUpstreamCooldown = time.Hour
+
+// errUpstreamCoolingDown is returned instead of contacting an upstream host
+// which asked to retry later.
+var errUpstreamCoolingDown = errors.New("upstream host asked to retry later")
+
+// hostCooldowns holds the hosts which answered with 429 or 503 and a
+// Retry-After header, until the time they may be contacted again. The zero
+// value is ready to use.
+type hostCooldowns struct {
+	mux   sync.Mutex
+	until map[string]time.Time
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return min(time.Duration(seconds)*time.Second, maxUpstreamCooldown), true
+	}
+	if date, err := parseHTTPTime(value); err == nil && date.After(now) {
+		return min(date.Sub(now), maxUpstreamCooldown), true
+	}
+	return 0, false
+}
+
+// noteUpstreamResponse counts the status code of resp in the stats and
+// starts a cooldown for host if the upstream server throttles requests with
+// 429 or 503 and a Retry-After header.
+func (c *FSCache) noteUpstreamResponse(ctx context.Context, host string, resp *http.Response) {
+	c.trackUpstreamStatus(host, resp.StatusCode)
+
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	now := time.Now()
+	delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		return
+	}
+
+	c.cooldowns.mux.Lock()
+	defer c.cooldowns.mux.Unlock()
+
+	if c.cooldowns.until == nil {
+		c.cooldowns.until = make(map[string]time.Time)
+	}
+	if until := now.Add(delay); until.After(c.cooldowns.until[host]) {
+		c.cooldowns.until[host] = until
+	}
+	slog.WarnContext(ctx, "Upstream asked to retry later, pausing requests", "event", "cooldown", "host", host, "status", resp.StatusCode, "retry_after", delay)
+}
+
+// upstreamCooldown returns the time left until host may be contacted again,
+// or 0 if it isn't cooling down.
+func (c *FSCache) upstreamCooldown(host string) time.Duration {
+	c.cooldowns.mux.Lock()
+	defer c.cooldowns.mux.Unlock()
+
+	until, ok := c.cooldowns.until[host]
+	if !ok {
+		return 0
+	}
+	remaining := time.Until(until)
+	if remaining <= 0 {
+		delete(c.cooldowns.until, host)
+		return 0
+	}
+	return remaining
+}
+
+// rejectDuringCooldown answers the request with 503 and the remaining time as
+// Retry-After if its host is cooling down.
+func (c *FSCache) rejectDuringCooldown(w http.ResponseWriter, r *http.Request) bool {
+	remaining := c.upstreamCooldown(r.URL.Host)
+	if remaining == 0 {
+		return false
+	}
+
+	seconds := int64((remaining + time.Second - 1) / time.Second)
+	c.addCacheDebug(w, "cooldown=upstream asked to retry in %ds", seconds)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	Error(w, r, http.StatusServiceUnavailable, "upstream_cooldown", "Upstream server asked to retry later")
+	slog.InfoContext(r.Context(), "Upstream is cooling down, request rejected", "event", "miss", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "status", http.StatusServiceUnavailable, "retry_after", remaining)
+	return true
+}
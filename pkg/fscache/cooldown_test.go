@@ -0,0 +1,117 @@
+package fscache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 2, 11, 14, 0, 0, 0, time.UTC)
+
+	tcs := []struct {
+		name  string
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"seconds", "120", 2 * time.Minute, true},
+		{"date", now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{"capped", "86400", maxUpstreamCooldown, true},
+		{"zero", "0", 0, false},
+		{"past date", now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{"empty", "", 0, false},
+		{"invalid", "soon", 0, false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tc.value, now)
+			if got != tc.want || ok != tc.ok {
+				t.Fatalf("parseRetryAfter(%q) = %v, %v, want %v, %v", tc.value, got, ok, tc.want, tc.ok)
+			}
+		})
+	}
+}
+
+// newThrottlingMirror starts an upstream server answering every request with
+// 429 and Retry-After.
+func newThrottlingMirror(t *testing.T) (string, *atomic.Int64) {
+	t.Helper()
+
+	var requests atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "120")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.URL, &requests
+}
+
+func TestServeGETRequestCacheMissRespectsRetryAfter(t *testing.T) {
+	mirror, requests := newThrottlingMirror(t)
+	cache := newTestFSCache(t)
+
+	for i := range 3 {
+		req := httptest.NewRequest(http.MethodGet, mirror+"/debian/pool/main/h/hello/hello_1.0_amd64.deb", nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("request %d: status = %d, want %d", i, rr.Code, http.StatusServiceUnavailable)
+		}
+		if got, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || got < 1 || got > 120 {
+			t.Fatalf("request %d: Retry-After = %q, want 1 to 120", i, rr.Header().Get("Retry-After"))
+		}
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("upstream requests = %d, want 1", requests.Load())
+	}
+}
+
+func TestServeGETRequestServesStaleDuringCooldown(t *testing.T) {
+	const content = "cached inrelease"
+
+	mirror, requests := newThrottlingMirror(t)
+	cache := newTestFSCache(t)
+	localFile := mustParseURL(t, mirror+"/debian/dists/bookworm/InRelease")
+	localPath := cache.buildLocalPath(localFile)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := cache.Set(0, localFile.Host, localFile.Path, AccessEntry{
+		URL:         localFile,
+		LastChecked: time.Now().Add(-time.Hour),
+		Size:        int64(len(content)),
+	}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	// The first revalidation is throttled, the cached file is served and the
+	// next revalidation waits for the cooldown.
+	for i := range 2 {
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(httptest.NewRequest(http.MethodGet, localFile.String(), nil), rr)
+		body, _ := io.ReadAll(rr.Body)
+		if rr.Code != http.StatusOK || !strings.Contains(string(body), content) {
+			t.Fatalf("request %d = %d %q, want cached file", i, rr.Code, body)
+		}
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("upstream requests = %d, want 1", requests.Load())
+	}
+	if cache.upstreamCooldown(localFile.Host) == 0 {
+		t.Fatalf("expected %s to cool down", localFile.Host)
+	}
+}
@@ -0,0 +1,91 @@
+package fscache
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// blobIndex maps the SHA256 of cached files to the local path of one file
+// with this content. It is built from the metadata on first use.
+type blobIndex struct {
+	mux   sync.Mutex
+	paths map[string]string
+}
+
+// SetDeduplication enables storing files with identical content only once.
+// A downloaded file whose SHA256 matches an already cached file is replaced by
+// a hard link to it, e.g. for repositories reachable under several mirror
+// hostnames. It has to be called before requests are served.
+func (c *FSCache) SetDeduplication(enabled bool) {
+	c.deduplicate = enabled
+}
+
+// loadLocked fills the index from the metadata of all cached files.
+func (b *blobIndex) loadLocked(c *FSCache) {
+	if b.paths != nil {
+		return
+	}
+
+	b.paths = make(map[string]string)
+	records, err := c.collectAccessCacheRecords()
+	if err != nil {
+		slog.Warn("Error loading metadata for deduplication", "event", "dedupe", "error", err)
+		return
+	}
+	for _, record := range records {
+		entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
+		if entry.SHA256 == "" || entry.URL == nil {
+			continue
+		}
+		b.paths[entry.SHA256] = c.buildLocalPath(entry.URL)
+	}
+}
+
+// deduplicateFile replaces the file at localPath by a hard link to a cached
+// file with the same SHA256 and size. Otherwise localPath is remembered as
+// location of the content. It returns true if a link was created.
+func (c *FSCache) deduplicateFile(ctx context.Context, localPath, hash string, size int64) bool {
+	if !c.deduplicate || hash == "" {
+		return false
+	}
+
+	c.blobs.mux.Lock()
+	defer c.blobs.mux.Unlock()
+	c.blobs.loadLocked(c)
+
+	existing, ok := c.blobs.paths[hash]
+	if !ok || existing == localPath {
+		c.blobs.paths[hash] = localPath
+		return false
+	}
+
+	existingInfo, err := os.Stat(existing)
+	if err != nil || existingInfo.Size() != size {
+		// The file was removed or replaced since it was indexed.
+		c.blobs.paths[hash] = localPath
+		return false
+	}
+	if info, err := os.Stat(localPath); err != nil || os.SameFile(existingInfo, info) {
+		return false
+	}
+
+	// The link is created next to the file and renamed over it, so the file
+	// is never missing.
+	tempPath := localPath + ".link-" + uuid.NewString()
+	if err := os.Link(existing, tempPath); err != nil {
+		slog.WarnContext(ctx, "Error linking duplicate file", "event", "dedupe", "path", localPath, "target", existing, "error", err)
+		return false
+	}
+	if err := os.Rename(tempPath, localPath); err != nil {
+		slog.WarnContext(ctx, "Error replacing duplicate file", "event", "dedupe", "path", localPath, "error", err)
+		_ = os.Remove(tempPath)
+		return false
+	}
+
+	slog.InfoContext(ctx, "Linked duplicate file", "event", "dedupe", "path", localPath, "target", existing, "bytes", size)
+	return true
+}
@@ -0,0 +1,102 @@
+package fscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// downloadPackage fetches a package from mirror into cache and returns the
+// local path of the file.
+func downloadPackage(t *testing.T, cache *FSCache, mirror, payload string) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, mirror+"/debian/pool/main/h/hello/hello_1.0_amd64.deb", nil)
+	rr := httptest.NewRecorder()
+	cache.serveGETRequestCacheMiss(req, rr, 0)
+	if rr.Code != http.StatusOK || rr.Body.String() != payload {
+		t.Fatalf("response = %d %q, want 200 %q", rr.Code, rr.Body.String(), payload)
+	}
+	return cache.buildLocalPath(req.URL)
+}
+
+func sameFile(t *testing.T, a, b string) bool {
+	t.Helper()
+
+	infoA, err := os.Stat(a)
+	if err != nil {
+		t.Fatalf("Stat(%s) error = %v", a, err)
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		t.Fatalf("Stat(%s) error = %v", b, err)
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+func TestDeduplicationLinksIdenticalFiles(t *testing.T) {
+	const payload = "identical package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	cache.SetDeduplication(true)
+	first := downloadPackage(t, cache, mirror.URL, payload)
+	second := downloadPackage(t, cache, mirror.AltURL, payload)
+
+	if !sameFile(t, first, second) {
+		t.Fatalf("expected %s to be linked to %s", second, first)
+	}
+	data, err := os.ReadFile(second)
+	if err != nil || string(data) != payload {
+		t.Fatalf("linked content = %q, %v, want %q", data, err, payload)
+	}
+
+	files, size, err := cache.GetCacheUsage()
+	if err != nil {
+		t.Fatalf("GetCacheUsage() error = %v", err)
+	}
+	if files != 2 || size != uint64(len(payload)) {
+		t.Fatalf("GetCacheUsage() = %d files, %d bytes, want 2 files, %d bytes", files, size, len(payload))
+	}
+
+	// Removing one of the files keeps the content of the other.
+	if err := os.Remove(first); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if data, err := os.ReadFile(second); err != nil || string(data) != payload {
+		t.Fatalf("content after removal = %q, %v, want %q", data, err, payload)
+	}
+}
+
+func TestDeduplicationDisabledKeepsCopies(t *testing.T) {
+	const payload = "identical package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	first := downloadPackage(t, cache, mirror.URL, payload)
+	second := downloadPackage(t, cache, mirror.AltURL, payload)
+
+	if sameFile(t, first, second) {
+		t.Fatalf("expected separate copies without deduplication")
+	}
+}
+
+func TestDeduplicationIndexLoadedFromMetadata(t *testing.T) {
+	const payload = "identical package content"
+
+	mirror := newTestMirror(t, payload)
+	dir := t.TempDir()
+	cache := NewFSCache(dir)
+	first := downloadPackage(t, cache, mirror.URL, payload)
+	cache.flushAccessCache()
+
+	// A new instance knows the files cached before deduplication was enabled.
+	restarted := NewFSCache(dir)
+	restarted.SetDeduplication(true)
+	second := downloadPackage(t, restarted, mirror.AltURL, payload)
+
+	if !sameFile(t, first, second) {
+		t.Fatalf("expected %s to be linked to %s", second, first)
+	}
+}
@@ -0,0 +1,135 @@
+package fscache
+
+import (
+	"log/slog"
+	"time"
+)
+
+const (
+	// DefaultDeletionGracePeriod is the time a file stays marked for deletion
+	// before it is removed.
+	DefaultDeletionGracePeriod = 24 * time.Hour
+
+	deletionSweepDelay    = 10 * time.Minute // Time after startup until the first sweep
+	deletionSweepInterval = 6 * time.Hour    // Interval of the sweeps
+)
+
+// SetDeletionGracePeriod sets the time files stay marked for deletion before
+// they are removed and starts removing them in the background on the first
+// call. A file is only removed once it was marked again by a later source
+// verification or refresh, so an index or upstream server which is broken
+// for a short time doesn't wipe the cache.
+func (c *FSCache) SetDeletionGracePeriod(gracePeriod time.Duration) {
+	firstSet := !c.deletionSweepStarted
+	c.deletionGracePeriod = gracePeriod
+	c.deletionSweepStarted = true
+
+	if firstSet {
+		slog.Info("Activated removal of files marked for deletion", "event", "delete", "grace_period", gracePeriod)
+		go c.deleteMarkedFilesLoop()
+	}
+}
+
+// PendingDeletions returns the number of files marked for deletion which
+// aren't removed yet, because their grace period is running or the mark isn't
+// confirmed. Files marked in earlier runs of the process are counted from the
+// first sweep on.
+func (c *FSCache) PendingDeletions() int64 {
+	// Marks of earlier runs which are cleared before the first sweep would
+	// make the count negative.
+	return max(c.pendingDeletions.Load(), 0)
+}
+
+func (c *FSCache) deleteMarkedFilesLoop() {
+	timer := time.NewTimer(deletionSweepDelay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-c.statsStop:
+			return
+		}
+
+		deleted, pending, err := c.DeleteMarkedFiles()
+		if err != nil {
+			slog.Error("Removing files marked for deletion failed", "event", "delete", "error", err)
+		} else {
+			slog.Info("Removed files marked for deletion", "event", "delete", "files", deleted, "pending", pending)
+		}
+		timer.Reset(deletionSweepInterval)
+	}
+}
+
+// DeleteMarkedFiles removes the files which were marked for deletion at least
+// twice and whose first mark is older than the grace period. It returns the
+// number of removed files and of files which stay marked.
+func (c *FSCache) DeleteMarkedFiles() (int, int, error) {
+	records, err := c.collectAccessCacheRecords()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	deleted, pending := 0, 0
+	for _, record := range records {
+		if !record.markedForDeletion {
+			continue
+		}
+		if !c.deletionDue(record) || !c.deleteMarkedFile(record) {
+			pending++
+			continue
+		}
+		deleted++
+	}
+
+	c.pendingDeletions.Store(int64(pending))
+	return deleted, pending, nil
+}
+
+// deletionDue reports whether the mark of record is confirmed and older than
+// the grace period. Pinned files stay marked but are never removed.
+func (c *FSCache) deletionDue(record accessCacheRecord) bool {
+	return record.markedForDeletion && !record.pinned && record.markCount >= 2 && time.Since(record.markedAt) >= c.deletionGracePeriod
+}
+
+// deleteMarkedFile removes the file of record if it is still due for deletion
+// and not in use.
+func (c *FSCache) deleteMarkedFile(record accessCacheRecord) bool {
+	if !c.CreateExclusiveWriteLock(record.protocol, record.domain, record.path) {
+		return false
+	}
+	defer c.DeleteWriteLock(record.protocol, record.domain, record.path)
+
+	// A refresh or download may have cleared the mark since the records were
+	// collected.
+	current, ok := c.getAccessCacheRecord(record.protocol, record.domain, record.path)
+	if !ok {
+		return false
+	}
+	c.accessCacheMux.RLock()
+	latest := *current
+	c.accessCacheMux.RUnlock()
+	if !c.deletionDue(latest) {
+		return false
+	}
+
+	entry := c.normalizeAccessEntry(latest.protocol, latest.domain, latest.path, latest.entry)
+	if err := c.DeleteFile(entry.URL); err != nil {
+		slog.Warn("Error removing file marked for deletion", "event", "delete", "host", latest.domain, "path", latest.path, "error", err)
+		return false
+	}
+
+	slog.Info("Removed file marked for deletion", "event", "delete", "host", latest.domain, "path", latest.path, "marked_at", latest.markedAt, "marks", latest.markCount)
+	return true
+}
+
+// clearDeletionMark removes the deletion mark of record, the caller has to
+// hold accessCacheMux.
+func (c *FSCache) clearDeletionMark(record *accessCacheRecord) {
+	if record.markedForDeletion {
+		c.pendingDeletions.Add(-1)
+	}
+	record.markedForDeletion = false
+	record.markedAt = time.Time{}
+	record.markCount = 0
+}
@@ -0,0 +1,121 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeMarkedTestFile caches a file with metadata for rawURL and returns its
+// local path.
+func writeMarkedTestFile(t *testing.T, cache *FSCache, rawURL string) string {
+	t.Helper()
+
+	u := mustParseURL(t, rawURL)
+	localPath := cache.buildLocalPath(u)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte("payload"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := cache.Set(0, u.Host, u.Path, AccessEntry{URL: u, Size: 7}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	return localPath
+}
+
+func ageDeletionMark(t *testing.T, cache *FSCache, rawURL string, age time.Duration) {
+	t.Helper()
+
+	u := mustParseURL(t, rawURL)
+	record, ok := cache.getAccessCacheRecord(0, u.Host, u.Path)
+	if !ok {
+		t.Fatalf("no metadata for %s", rawURL)
+	}
+	cache.accessCacheMux.Lock()
+	record.markedAt = time.Now().Add(-age)
+	cache.accessCacheMux.Unlock()
+}
+
+func TestDeleteMarkedFilesAfterGracePeriod(t *testing.T) {
+	const rawURL = "http://deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	cache := newTestFSCache(t)
+	cache.deletionGracePeriod = time.Hour
+	localPath := writeMarkedTestFile(t, cache, rawURL)
+	u := mustParseURL(t, rawURL)
+
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	ageDeletionMark(t, cache, rawURL, 2*time.Hour)
+	if deleted, pending, err := cache.DeleteMarkedFiles(); err != nil || deleted != 0 || pending != 1 {
+		t.Fatalf("DeleteMarkedFiles() = %d, %d, %v, want unconfirmed mark kept", deleted, pending, err)
+	}
+
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	ageDeletionMark(t, cache, rawURL, 30*time.Minute)
+	if deleted, pending, err := cache.DeleteMarkedFiles(); err != nil || deleted != 0 || pending != 1 {
+		t.Fatalf("DeleteMarkedFiles() = %d, %d, %v, want file kept within grace period", deleted, pending, err)
+	}
+	if got := cache.PendingDeletions(); got != 1 {
+		t.Fatalf("PendingDeletions() = %d, want 1", got)
+	}
+
+	ageDeletionMark(t, cache, rawURL, 2*time.Hour)
+	if deleted, pending, err := cache.DeleteMarkedFiles(); err != nil || deleted != 1 || pending != 0 {
+		t.Fatalf("DeleteMarkedFiles() = %d, %d, %v, want file removed", deleted, pending, err)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("marked file still exists, stat err=%v", err)
+	}
+	if _, ok := cache.Get(0, u.Host, u.Path); ok {
+		t.Fatalf("metadata of removed file still exists")
+	}
+}
+
+func TestDeleteMarkedFilesKeepsRevalidatedFile(t *testing.T) {
+	const rawURL = "http://deb.debian.org/debian/dists/stable/InRelease"
+
+	cache := newTestFSCache(t)
+	cache.deletionGracePeriod = 0
+	localPath := writeMarkedTestFile(t, cache, rawURL)
+	u := mustParseURL(t, rawURL)
+
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	if got := cache.PendingDeletions(); got != 1 {
+		t.Fatalf("PendingDeletions() = %d, want 1", got)
+	}
+
+	// The upstream server answered again, e.g. with 304 Not Modified.
+	if err := cache.UpdateLastChecked(0, u.Host, u.Path); err != nil {
+		t.Fatalf("UpdateLastChecked() error = %v", err)
+	}
+	if got := cache.PendingDeletions(); got != 0 {
+		t.Fatalf("PendingDeletions() = %d, want 0", got)
+	}
+
+	if deleted, pending, err := cache.DeleteMarkedFiles(); err != nil || deleted != 0 || pending != 0 {
+		t.Fatalf("DeleteMarkedFiles() = %d, %d, %v, want nothing to do", deleted, pending, err)
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		t.Fatalf("revalidated file was removed: %v", err)
+	}
+}
+
+func TestMarkForDeletionIsPersisted(t *testing.T) {
+	const rawURL = "http://deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	cache := newTestFSCache(t)
+	writeMarkedTestFile(t, cache, rawURL)
+	u := mustParseURL(t, rawURL)
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	cache.flushAccessCache()
+
+	record, ok := cache.loadAccessCacheRecord(0, u.Host, u.Path)
+	if !ok || !record.markedForDeletion || record.markCount != 2 || record.markedAt.IsZero() {
+		t.Fatalf("loaded record = %+v, want confirmed deletion mark", record)
+	}
+}
@@ -17,6 +17,9 @@ func (c *FSCache) downloadFileSimple(url string, localPath string) error {
 	if err != nil {
 		return err
 	}
+	if c.upstreamCooldown(req.URL.Host) > 0 {
+		return errUpstreamCoolingDown
+	}
 
 	// Add the user agent to the request
 	req.Header.Add("User-Agent", fmt.Sprintf("GoAptCacher/%s (+https://gitlab.com/bella.network/goaptcacher)", buildinfo.Version))
@@ -27,9 +30,10 @@ func (c *FSCache) downloadFileSimple(url string, localPath string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	c.noteUpstreamResponse(req.Context(), req.URL.Host, resp)
 
 	// Create the file
-	file, err := os.Create(localPath)
+	file, err := createCacheFile(localPath)
 	if err != nil {
 		return err
 	}
@@ -49,7 +53,7 @@ func (c *FSCache) downloadFileSimple(url string, localPath string) error {
 
 	// Set file modification time
 	if lm := resp.Header.Get("Last-Modified"); lm != "" {
-		if t, err := http.ParseTime(lm); err == nil {
+		if t, err := parseHTTPTime(lm); err == nil {
 			err := os.Chtimes(localPath, t, t)
 			if err != nil {
 				return err
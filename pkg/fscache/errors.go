@@ -0,0 +1,71 @@
+package fscache
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorResponse is the body of error responses for clients preferring JSON.
+type ErrorResponse struct {
+	Error          string `json:"error"`                     // Machine-readable code, e.g. "not_cached"
+	Message        string `json:"message"`                   // Text sent to other clients
+	Status         int    `json:"status"`                    // HTTP status of the response
+	UpstreamStatus int    `json:"upstream_status,omitempty"` // Status of the upstream server if it caused the error
+	RequestID      string `json:"request_id,omitempty"`      // ID of the request in the log
+}
+
+// Error replies to r with status and message like http.Error. Clients which
+// prefer JSON (Accept: application/json) get an ErrorResponse with the
+// machine-readable code instead, apt and other clients plain text.
+func Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeError(w, r, ErrorResponse{Error: code, Message: message, Status: status})
+}
+
+// upstreamError is Error for a failed request to the upstream server which
+// answered with upstreamStatus.
+func upstreamError(w http.ResponseWriter, r *http.Request, status, upstreamStatus int, code, message string) {
+	writeError(w, r, ErrorResponse{Error: code, Message: message, Status: status, UpstreamStatus: upstreamStatus})
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, response ErrorResponse) {
+	if !prefersJSON(r.Header) {
+		http.Error(w, response.Message, response.Status)
+		return
+	}
+
+	response.RequestID = RequestIDFromContext(r.Context())
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, response.Message, response.Status)
+		return
+	}
+
+	// Like http.Error, headers meant for the file are dropped.
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(response.Status)
+	_, _ = w.Write(append(data, '\n'))
+}
+
+// prefersJSON reports whether the Accept header asks for application/json.
+// Wildcards don't count, apt sends none at all.
+func prefersJSON(header http.Header) bool {
+	for _, value := range header.Values("Accept") {
+		for mediaRange := range strings.SplitSeq(value, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err != nil || mediaType != "application/json" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package fscache
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrefersJSON(t *testing.T) {
+	tests := []struct {
+		accept []string
+		want   bool
+	}{
+		{accept: nil, want: false},
+		{accept: []string{"*/*"}, want: false},
+		{accept: []string{"text/html, application/*;q=0.9"}, want: false},
+		{accept: []string{"application/json"}, want: true},
+		{accept: []string{"text/plain;q=0.5, application/json;q=0.8"}, want: true},
+		{accept: []string{"text/plain", "application/json"}, want: true},
+		{accept: []string{"application/json;q=0"}, want: false},
+		{accept: []string{"application/json;;"}, want: false},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		for _, value := range tt.accept {
+			header.Add("Accept", value)
+		}
+		if got := prefersJSON(header); got != tt.want {
+			t.Errorf("prefersJSON(%q) = %v, want %v", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestErrorPlainText(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/pool/main/a/apt/apt.deb", nil)
+	rr := httptest.NewRecorder()
+	Error(rr, r, http.StatusForbidden, "domain_denied", "Forbidden")
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Fatalf("Content-Type = %q, want text/plain", got)
+	}
+	if got := strings.TrimSpace(rr.Body.String()); got != "Forbidden" {
+		t.Fatalf("body = %q, want %q", got, "Forbidden")
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/pool/main/a/apt/apt.deb", nil)
+	r.Header.Set("Accept", "application/json")
+	r = r.WithContext(WithRequestID(r.Context(), "req-1"))
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Content-Length", "1234")
+	Error(rr, r, http.StatusForbidden, "domain_denied", "Forbidden")
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusForbidden)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+		t.Fatalf("Content-Type = %q", got)
+	}
+	if got := rr.Header().Get("Content-Length"); got != "" {
+		t.Fatalf("Content-Length = %q, want it removed", got)
+	}
+
+	var got ErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	want := ErrorResponse{Error: "domain_denied", Message: "Forbidden", Status: http.StatusForbidden, RequestID: "req-1"}
+	if got != want {
+		t.Fatalf("body = %+v, want %+v", got, want)
+	}
+}
+
+func TestServeGETRequestUpstreamErrorJSON(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.client = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusBadGateway, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+	})}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/dists/stable/InRelease", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	cache.serveGETRequest(req, rr)
+
+	var got ErrorResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+	}
+	if got.Error != "upstream_error" || got.Status != http.StatusNotFound || got.UpstreamStatus != http.StatusBadGateway {
+		t.Fatalf("body = %+v, want upstream_error with status 404 and upstream status 502", got)
+	}
+}
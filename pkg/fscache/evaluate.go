@@ -1,9 +1,11 @@
 package fscache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,6 +16,9 @@ import (
 
 	"github.com/google/uuid"
 	"gitlab.com/bella.network/goaptcacher/pkg/buildinfo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // RefreshFiles is a list of files that should be refreshed more often as these
@@ -73,37 +78,54 @@ func isRepositoryMetadataPath(path string) bool {
 
 // evaluateRefresh checks if the file should be refreshed.
 func (c *FSCache) evaluateRefresh(localFile *url.URL, lastAccess AccessEntry) bool {
+	if c.isImmutable(localFile.Host) {
+		return false
+	}
+
+	recheckTimeout, _ := c.recheckTimeout(localFile)
+
+	// Check if the file is older than the recheck timeout
+	return time.Since(lastAccess.LastChecked) > recheckTimeout
+}
+
+// recheckTimeout returns the time after which localFile is checked upstream
+// for changes again, together with the name of the rule which selected it.
+func (c *FSCache) recheckTimeout(localFile *url.URL) (time.Duration, string) {
 	// From localFile, get the filename only without the path
-	filename := filepath.Base(c.buildLocalPath(localFile))
+	localPath := c.buildLocalPath(localFile)
+	filename := filepath.Base(localPath)
 
 	// By default a 24 hour recheck timeout is used
-	recheckTimeout := time.Hour * 24
+	recheckTimeout, rule := time.Hour*24, "default"
 
 	// If the file is within pool/**, these files are usually static and do not
 	// need to be refreshed often.
 	if strings.Contains(localFile.Path, "/pool/") {
-		recheckTimeout = time.Hour * 168 // 7 days
+		recheckTimeout, rule = time.Hour*168, "pool" // 7 days
 	}
 
 	// Files served using the "by-hash" URL usually do not change and can be
 	// cached for longer periods, same as pool files.
 	if strings.Contains(localFile.Path, "/by-hash/") {
-		recheckTimeout = time.Hour * 168 // 7 days
+		recheckTimeout, rule = time.Hour*168, "by-hash" // 7 days
 	}
 
 	// Check if the file is in the RefreshFiles list which should be kept as fresh
-	// as possible.
+	// as possible. Release files declaring Valid-Until are checked more often
+	// as the deadline approaches, so clients don't get expired metadata.
 	if slices.Contains(RefreshFiles, filename) {
-		recheckTimeout = time.Minute * 5
+		recheckTimeout, rule = c.recheck.Metadata, "repository index"
+		if interval, ok := c.validUntilRecheck(localPath, filename); ok {
+			recheckTimeout, rule = interval, "valid-until"
+		}
 	}
 
-	// Check if the file is older than the recheck timeout
-	return time.Since(lastAccess.LastChecked) > recheckTimeout
+	return recheckTimeout, rule
 }
 
 // cacheRefresh refreshes the file if it has changed. If the file has changed, it
 // will be downloaded again.
-func (c *FSCache) cacheRefresh(localFile *url.URL, lastAccess AccessEntry) {
+func (c *FSCache) cacheRefresh(ctx context.Context, localFile *url.URL, lastAccess AccessEntry) {
 	generatedName := c.buildLocalPath(localFile)
 	// From localFile, get the filename only without the path
 	filename := filepath.Base(generatedName)
@@ -115,14 +137,22 @@ func (c *FSCache) cacheRefresh(localFile *url.URL, lastAccess AccessEntry) {
 	}
 
 	// Refresh the current file
-	refreshed, err := c.refreshFile(generatedName, localFile, lastAccess)
+	refreshed, err := c.refreshFile(ctx, generatedName, localFile, lastAccess)
+	if errors.Is(err, errUpstreamCoolingDown) {
+		slog.InfoContext(ctx, "Refresh skipped, upstream asked to retry later", "event", "refresh", "host", localFile.Host, "path", localFile.Path)
+		return
+	}
 	if err != nil {
-		log.Printf("[ERROR:REFRESH] %s\n", err)
+		slog.ErrorContext(ctx, "Refresh failed", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "error", err)
 		return
 	}
 
-	// If the file was refreshed, we need to refresh the connected files
+	// If the file was refreshed, we need to refresh the connected files. The
+	// files listed in a refreshed release have to match its checksums,
+	// otherwise they were fetched from a mirror with another state of the
+	// repository.
 	if refreshed {
+		checksums := releaseChecksums(generatedName, filename)
 		// Parse protocol and domain from
 		for _, file := range connectedFiles {
 			// Get the URL of the connected file
@@ -148,9 +178,15 @@ func (c *FSCache) cacheRefresh(localFile *url.URL, lastAccess AccessEntry) {
 			}
 
 			// Refresh the connected file
-			_, err := c.refreshFile(c.buildLocalPath(connectedFile), connectedFile, connectedLastAccess)
-			if err != nil {
-				log.Printf("[ERROR:REFRESH] %s\n", err)
+			expected := checksums[file]
+			connectedRefreshed, err := c.refreshFileExpecting(ctx, c.buildLocalPath(connectedFile), connectedFile, connectedLastAccess, expected)
+			switch {
+			case errors.Is(err, errReleaseMismatch):
+				slog.WarnContext(ctx, "Refreshed file doesn't match refreshed release, mirrors may be inconsistent, keeping cached file", "event", "refresh", "host", connectedFile.Host, "path", connectedFile.Path, "release", localFile.String(), "error", err)
+			case err != nil && !errors.Is(err, errUpstreamCoolingDown):
+				slog.ErrorContext(ctx, "Refresh failed", "event", "refresh", "host", connectedFile.Host, "path", connectedFile.Path, "error", err)
+			case err == nil && !connectedRefreshed:
+				c.checkConnectedFile(ctx, localFile, connectedFile, protocol, expected)
 			}
 		}
 	}
@@ -160,7 +196,32 @@ func (c *FSCache) cacheRefresh(localFile *url.URL, lastAccess AccessEntry) {
 // necessary. The function returns true if the file has changed and false if the
 // file has not changed. An error is returned if an error occurred during the
 // download.
-func (c *FSCache) refreshFile(generatedName string, localFile *url.URL, lastAccess AccessEntry) (bool, error) {
+func (c *FSCache) refreshFile(ctx context.Context, generatedName string, localFile *url.URL, lastAccess AccessEntry) (bool, error) {
+	return c.refreshFileExpecting(ctx, generatedName, localFile, lastAccess, "")
+}
+
+// refreshFileExpecting is refreshFile for a file whose new content has to
+// match expectedSHA256 if it isn't empty. A download with another checksum is
+// discarded and errReleaseMismatch is returned.
+func (c *FSCache) refreshFileExpecting(ctx context.Context, generatedName string, localFile *url.URL, lastAccess AccessEntry, expectedSHA256 string) (refreshed bool, err error) {
+	ctx, span := tracer.Start(ctx, "refresh", trace.WithAttributes(attribute.String("url.full", localFile.String())))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if c.upstreamCooldown(localFile.Host) > 0 {
+		return false, errUpstreamCoolingDown
+	}
+
+	if c.isAppendOnly(localFile.Host) && !c.checksSignature(localFile) {
+		if refreshed, done, err := c.refreshAppended(ctx, generatedName, localFile, lastAccess, expectedSHA256); done || err != nil {
+			return refreshed, err
+		}
+	}
+
 	// Build a conditional GET so unchanged files can be detected cheaply by the origin.
 	req, err := buildRefreshRequest(lastAccess)
 	if err != nil {
@@ -172,37 +233,44 @@ func (c *FSCache) refreshFile(generatedName string, localFile *url.URL, lastAcce
 		return false, err
 	}
 	defer resp.Body.Close()
+	c.noteUpstreamResponse(ctx, localFile.Host, resp)
 
 	// Use cached URL protocol to address the same entry that triggered this refresh.
 	protocol := DetermineProtocolFromURL(lastAccess.URL)
 
-	if c.handleRefreshStatus(resp.StatusCode, protocol, localFile) {
+	if c.handleRefreshStatus(ctx, resp.StatusCode, protocol, localFile) {
 		return false, nil
 	}
 
-	lastModified, etag, unchanged := c.evaluateNotModified(resp, localFile, protocol, lastAccess)
+	lastModified, etag, unchanged := c.evaluateNotModified(ctx, resp, localFile, protocol, lastAccess)
 	if unchanged {
 		return false, nil
 	}
 
 	// Download into a temporary file and replace atomically once complete.
-	wrb, newHash, err := downloadResponseToFile(resp, generatedName)
+	wrb, newHash, err := c.downloadResponseToFile(ctx, resp, localFile, generatedName, expectedSHA256)
 	if err != nil {
 		return false, err
 	}
 
-	// Update the access cache with the new file
-	c.UpdateFile(protocol, localFile.Host, localFile.Path, lastAccess.URL.String(), lastModified, etag, wrb)
-	if err := c.SetSHA256(protocol, localFile.Host, localFile.Path, newHash); err != nil {
-		log.Printf("[ERROR:REFRESH:SHA256] %s\n", err)
-	}
-	c.trackRequestAsync(false, wrb)
+	c.storeRefreshedFile(ctx, protocol, localFile, lastAccess, lastModified, etag, wrb, newHash, upstreamSupportsRanges(resp.Header))
+	c.trackRequestAsync(ctx, localFile.Host, false, wrb)
 
-	log.Printf("[INFO:REFRESH:200] %s%s has changed, downloaded %d bytes\n", localFile.Host, localFile.Path, wrb)
+	slog.InfoContext(ctx, "File has changed", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "status", http.StatusOK, "bytes", wrb)
 
 	return true, nil
 }
 
+// storeRefreshedFile updates the access cache with the metadata of the
+// refreshed file.
+func (c *FSCache) storeRefreshedFile(ctx context.Context, protocol int, localFile *url.URL, lastAccess AccessEntry, lastModified time.Time, etag string, size int64, hash string, upstreamRanges bool) {
+	c.UpdateFile(protocol, localFile.Host, localFile.Path, lastAccess.URL.String(), lastModified, etag, size)
+	c.setUpstreamRanges(protocol, localFile.Host, localFile.Path, upstreamRanges)
+	if err := c.SetSHA256(protocol, localFile.Host, localFile.Path, hash); err != nil {
+		slog.ErrorContext(ctx, "Failed to store SHA256 hash", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "error", err)
+	}
+}
+
 // buildRefreshRequest creates the conditional GET request used for cache refreshes.
 func buildRefreshRequest(lastAccess AccessEntry) (*http.Request, error) {
 	req, err := http.NewRequest(http.MethodGet, lastAccess.URL.String(), nil)
@@ -228,34 +296,34 @@ func buildRefreshRequest(lastAccess AccessEntry) (*http.Request, error) {
 }
 
 // handleRefreshStatus handles status codes that do not require a download.
-func (c *FSCache) handleRefreshStatus(statusCode, protocol int, localFile *url.URL) bool {
+func (c *FSCache) handleRefreshStatus(ctx context.Context, statusCode, protocol int, localFile *url.URL) bool {
 	switch statusCode {
 	case http.StatusOK:
 		return false
 	case http.StatusNotModified:
 		if err := c.UpdateLastChecked(protocol, localFile.Host, localFile.Path); err != nil {
-			log.Printf("[ERROR:REFRESH:304] %s%s failed to update last checked: %v\n", localFile.Host, localFile.Path, err)
+			slog.ErrorContext(ctx, "Failed to update last checked", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "status", http.StatusNotModified, "error", err)
 		}
-		log.Printf("[INFO:REFRESH:304] %s%s has not changed\n", localFile.Host, localFile.Path)
+		slog.InfoContext(ctx, "File has not changed", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "status", http.StatusNotModified)
 	case http.StatusNotFound:
 		c.MarkForDeletion(protocol, localFile.Host, localFile.Path)
-		log.Printf("[INFO:REFRESH:404] %s%s not found, marked for deletion\n", localFile.Host, localFile.Path)
+		slog.InfoContext(ctx, "File not found, marked for deletion", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "status", http.StatusNotFound)
 	default:
-		log.Printf("[WARN:REFRESH:CODE] %s%s returned status code %d\n", localFile.Host, localFile.Path, statusCode)
+		slog.WarnContext(ctx, "Unexpected status code", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "status", statusCode)
 	}
 
 	return true
 }
 
 // evaluateNotModified evaluates validators and returns true if content is unchanged.
-func (c *FSCache) evaluateNotModified(resp *http.Response, localFile *url.URL, protocol int, lastAccess AccessEntry) (time.Time, string, bool) {
-	lastModified, unchangedByDate := c.resolveRemoteLastModified(resp.Header.Get("Last-Modified"), localFile, protocol, lastAccess)
+func (c *FSCache) evaluateNotModified(ctx context.Context, resp *http.Response, localFile *url.URL, protocol int, lastAccess AccessEntry) (time.Time, string, bool) {
+	lastModified, unchangedByDate := c.resolveRemoteLastModified(ctx, resp.Header.Get("Last-Modified"), localFile, protocol, lastAccess)
 	if unchangedByDate {
 		return lastModified, "", true
 	}
 
 	etag := resp.Header.Get("ETag")
-	if c.isUnchangedByETag(etag, protocol, localFile, lastAccess.ETag) {
+	if c.isUnchangedByETag(ctx, etag, protocol, localFile, lastAccess.ETag) {
 		return lastModified, etag, true
 	}
 
@@ -263,24 +331,24 @@ func (c *FSCache) evaluateNotModified(resp *http.Response, localFile *url.URL, p
 }
 
 // resolveRemoteLastModified parses Last-Modified and compares it with known metadata.
-func (c *FSCache) resolveRemoteLastModified(lastmod string, localFile *url.URL, protocol int, lastAccess AccessEntry) (time.Time, bool) {
+func (c *FSCache) resolveRemoteLastModified(ctx context.Context, lastmod string, localFile *url.URL, protocol int, lastAccess AccessEntry) (time.Time, bool) {
 	lastModified := lastAccess.RemoteLastModified
 	if lastmod == "" {
 		return lastModified, false
 	}
 
-	parsedLastModified, parseErr := time.Parse(http.TimeFormat, lastmod)
+	parsedLastModified, parseErr := parseHTTPTime(lastmod)
 	if parseErr != nil {
-		log.Printf("[WARN:REFRESH:LAST-MODIFIED] %s%s invalid Last-Modified header %q: %v\n", localFile.Host, localFile.Path, lastmod, parseErr)
+		slog.WarnContext(ctx, "Invalid Last-Modified header", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "value", lastmod, "error", parseErr)
 		return lastModified, false
 	}
 
 	lastModified = parsedLastModified
 	if !lastAccess.RemoteLastModified.IsZero() && lastModified.Before(lastAccess.RemoteLastModified) {
 		if err := c.UpdateLastChecked(protocol, localFile.Host, localFile.Path); err != nil {
-			log.Printf("[ERROR:REFRESH:NOTMODIFIED:LAST-MODIFIED] %s%s failed to update last checked: %v\n", localFile.Host, localFile.Path, err)
+			slog.ErrorContext(ctx, "Failed to update last checked", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "error", err)
 		}
-		log.Printf("[INFO:REFRESH:NOTMODIFIED:LAST-MODIFIED] %s%s has not changed\n", localFile.Host, localFile.Path)
+		slog.InfoContext(ctx, "File has not changed according to Last-Modified", "event", "refresh", "host", localFile.Host, "path", localFile.Path)
 		return lastModified, true
 	}
 
@@ -288,35 +356,37 @@ func (c *FSCache) resolveRemoteLastModified(lastmod string, localFile *url.URL,
 }
 
 // isUnchangedByETag returns true if the origin reports the same entity tag.
-func (c *FSCache) isUnchangedByETag(etag string, protocol int, localFile *url.URL, previousETag string) bool {
+func (c *FSCache) isUnchangedByETag(ctx context.Context, etag string, protocol int, localFile *url.URL, previousETag string) bool {
 	if etag == "" || etag != previousETag {
 		return false
 	}
 
 	if err := c.UpdateLastChecked(protocol, localFile.Host, localFile.Path); err != nil {
-		log.Printf("[ERROR:REFRESH:NOTMODIFIED:ETAG] %s%s failed to update last checked: %v\n", localFile.Host, localFile.Path, err)
+		slog.ErrorContext(ctx, "Failed to update last checked", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "error", err)
 	}
-	log.Printf("[INFO:REFRESH:NOTMODIFIED:ETAG] %s%s has not changed\n", localFile.Host, localFile.Path)
+	slog.InfoContext(ctx, "File has not changed according to ETag", "event", "refresh", "host", localFile.Host, "path", localFile.Path)
 	return true
 }
 
 // downloadResponseToFile stores the response body in a temp file and atomically swaps it in.
-func downloadResponseToFile(resp *http.Response, generatedName string) (int64, string, error) {
+// If expectedSHA256 is set, a file with another checksum is discarded, as is
+// a release file of localFile without a valid signature.
+func (c *FSCache) downloadResponseToFile(ctx context.Context, resp *http.Response, localFile *url.URL, generatedName, expectedSHA256 string) (int64, string, error) {
 	requiredSize := resp.ContentLength
 	if requiredSize > 0 {
-		if err := ensureDiskSpace(generatedName, requiredSize); err != nil {
-			log.Printf("[ERROR:REFRESH:DISK] %s %s\n", generatedName, err)
+		if err := c.ensureDownloadSpace(generatedName, requiredSize); err != nil {
+			slog.ErrorContext(ctx, "Error reserving disk space", "event", "refresh", "path", generatedName, "bytes", requiredSize, "error", err)
 			return 0, "", err
 		}
 	}
 
 	tmpID, err := uuid.NewRandom()
 	if err != nil {
-		log.Printf("[ERROR:REFRESH:RANDOM] %s\n", err)
+		slog.ErrorContext(ctx, "Error generating temporary file name", "event", "refresh", "path", generatedName, "error", err)
 		return 0, "", err
 	}
 
-	tempPath := generatedName + "-dl-" + tmpID.String()
+	tempPath := c.inTempDirectory(generatedName + "-dl-" + tmpID.String())
 	cleanupTemp := true
 	defer func() {
 		if cleanupTemp {
@@ -324,44 +394,50 @@ func downloadResponseToFile(resp *http.Response, generatedName string) (int64, s
 		}
 	}()
 
-	file, err := os.Create(tempPath)
+	file, err := createCacheFile(tempPath)
 	if err != nil {
-		log.Printf("[ERROR:REFRESH:CREATE] %s\n", err)
+		slog.ErrorContext(ctx, "Error creating file", "event", "refresh", "path", tempPath, "error", err)
 		return 0, "", err
 	}
 
 	if err := preallocateFile(file, requiredSize); err != nil {
-		log.Printf("[ERROR:REFRESH:PREALLOCATE] %s\n", err)
+		slog.ErrorContext(ctx, "Error preallocating file", "event", "refresh", "path", tempPath, "bytes", requiredSize, "error", err)
 		file.Close()
 		return 0, "", err
 	}
 
 	wrb, err := io.Copy(file, resp.Body)
 	if err != nil {
-		log.Printf("[ERROR:REFRESH:WRITE] %s\n", err)
+		slog.ErrorContext(ctx, "Error writing file", "event", "refresh", "path", tempPath, "error", err)
 		file.Close()
 		return 0, "", err
 	}
 
 	if err := file.Close(); err != nil {
-		log.Printf("[ERROR:REFRESH:CLOSE] %s\n", err)
+		slog.ErrorContext(ctx, "Error closing file", "event", "refresh", "path", tempPath, "error", err)
 		return 0, "", err
 	}
 
 	if resp.ContentLength > 0 && resp.ContentLength != wrb {
 		err := fmt.Errorf("downloaded size mismatch: expected %d bytes, got %d", resp.ContentLength, wrb)
-		log.Printf("[ERROR:REFRESH:LENGTH] %s\n", err)
+		slog.ErrorContext(ctx, "Incomplete download", "event", "refresh", "path", tempPath, "expected_bytes", resp.ContentLength, "bytes", wrb)
 		return 0, "", err
 	}
 
 	newHash, err := GenerateSHA256Hash(tempPath)
 	if err != nil {
-		log.Printf("[ERROR:REFRESH:HASH] %s\n", err)
+		slog.ErrorContext(ctx, "Error generating SHA256 hash", "event", "refresh", "path", tempPath, "error", err)
+		return 0, "", err
+	}
+	if expectedSHA256 != "" && newHash != expectedSHA256 {
+		return 0, "", fmt.Errorf("%w: expected SHA256 %s, got %s", errReleaseMismatch, expectedSHA256, newHash)
+	}
+	if err := c.checkSignature(ctx, localFile, tempPath); err != nil {
 		return 0, "", err
 	}
 
-	if err := os.Rename(tempPath, generatedName); err != nil {
-		log.Printf("[ERROR:REFRESH:RENAME] %s\n", err)
+	if err := c.moveIntoCache(tempPath, generatedName); err != nil {
+		slog.ErrorContext(ctx, "Error renaming file", "event", "refresh", "path", generatedName, "error", err)
 		return 0, "", err
 	}
 	cleanupTemp = false
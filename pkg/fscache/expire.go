@@ -1,7 +1,7 @@
 package fscache
 
 import (
-	"log"
+	"log/slog"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -15,23 +15,23 @@ func (c *FSCache) expireUnusedFiles() {
 	time.Sleep(time.Second * 5)
 
 	for {
-		log.Printf("[INFO:EXPIRE] Starting file expiration\n")
+		slog.Info("Starting file expiration", "event", "expire")
 
 		// Get all files that have not been accessed for a long time
 		files, err := c.GetUnusedFiles(c.expirationInDays)
 		if err != nil {
-			log.Printf("[ERROR:EXPIRE] %s\n", err)
+			slog.Error("File expiration failed", "event", "expire", "error", err)
 		}
 
 		// Delete all files that have not been accessed for a long time
 		for _, file := range files {
 			err := c.DeleteFile(&file)
 			if err != nil {
-				log.Printf("[ERROR:EXPIRE] %s\n", err)
+				slog.Error("File expiration failed", "event", "expire", "error", err)
 			}
 		}
 
-		log.Printf("[INFO:EXPIRE] File expiration finished\n")
+		slog.Info("File expiration finished", "event", "expire")
 
 		// Sleep for a day
 		time.Sleep(time.Hour * 12)
@@ -59,7 +59,7 @@ func (c *FSCache) GetUnusedFiles(days uint64) ([]url.URL, error) {
 	cutoff := time.Now().AddDate(0, 0, -daysInt)
 	for _, record := range entries {
 		entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
-		if entry.LastAccessed.IsZero() {
+		if entry.LastAccessed.IsZero() || record.pinned {
 			continue
 		}
 		if entry.LastAccessed.Before(cutoff) {
@@ -72,7 +72,7 @@ func (c *FSCache) GetUnusedFiles(days uint64) ([]url.URL, error) {
 		}
 	}
 
-	log.Printf("[INFO:EXPIRE] Found %d files that have not been accessed for %d days. Total size: %d bytes\n", len(files), days, sizeTotal)
+	slog.Info("Found unused files", "event", "expire", "files", len(files), "days", days, "bytes", sizeTotal)
 
 	return files, nil
 }
@@ -110,7 +110,7 @@ func (c *FSCache) deleteUnreferencedFilesByMetadata() error {
 		}
 	}
 
-	log.Printf("[INFO:EXPIRE] Found %d files that are not on the filesystem but in the cache metadata. Total size: %d bytes\n", len(files), sizeTotal)
+	slog.Info("Found files missing on the filesystem but in the cache metadata", "event", "expire", "files", len(files), "bytes", sizeTotal)
 
 	return nil
 }
@@ -148,6 +148,7 @@ func (c *FSCache) deleteUnreferencedFilesByFilesystem() error {
 			if err != nil {
 				return err
 			}
+			c.removeEmptyParents(filepath.Dir(filepath.Join(c.CachePath, file)))
 		}
 	}
 
@@ -174,6 +175,11 @@ func (c *FSCache) getFilesInCacheDirectory() ([]string, error) {
 		if err != nil {
 			return err
 		}
+		// Cached files are stored below a host directory, files in the cache
+		// directory itself are the stats and the layout marker.
+		if !strings.ContainsRune(rel, filepath.Separator) {
+			return nil
+		}
 
 		files = append(files, rel)
 		return nil
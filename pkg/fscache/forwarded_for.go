@@ -0,0 +1,84 @@
+package fscache
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Ways the address of the client is passed to upstream servers in the
+// X-Forwarded-For header.
+const (
+	ForwardedForAppend    = "append"    // Appended to the chain sent by the client
+	ForwardedForAnonymize = "anonymize" // Like append, with the host part of all addresses zeroed (IPv4 /24, IPv6 /48)
+	ForwardedForOmit      = "omit"      // No X-Forwarded-For header at all
+)
+
+// SetForwardedFor sets how the address of the client is passed to upstream
+// servers, one of the ForwardedFor constants. It has to be called before
+// requests are served.
+func (c *FSCache) SetForwardedFor(mode string) {
+	c.forwardedFor = mode
+}
+
+// setForwardedFor sets the X-Forwarded-For header of the upstream request req
+// for the client request r. The chain sent by the client is kept and the
+// address of the client, without port, is appended to it.
+func (c *FSCache) setForwardedFor(req *http.Request, r *http.Request) {
+	req.Header.Del("X-Forwarded-For")
+	if c.forwardedFor == ForwardedForOmit {
+		return
+	}
+
+	var chain []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for hop := range strings.SplitSeq(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				chain = append(chain, hop)
+			}
+		}
+	}
+	if client := remoteHost(r.RemoteAddr); client != "" {
+		chain = append(chain, client)
+	}
+
+	if c.forwardedFor == ForwardedForAnonymize {
+		for i, hop := range chain {
+			chain[i] = anonymizeAddr(hop)
+		}
+	}
+	if len(chain) > 0 {
+		req.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+}
+
+// remoteHost returns the address of remoteAddr without port.
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// anonymizeAddr zeroes the host part of the IP address hop, IPv4 addresses
+// keep 24 bits and IPv6 addresses 48 bits. Values which are no IP address,
+// like "unknown" or obfuscated identifiers, are replaced by "unknown".
+func anonymizeAddr(hop string) string {
+	addr, err := netip.ParseAddr(hop)
+	if err != nil {
+		return "unknown"
+	}
+	addr = addr.Unmap()
+
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.WithZone("").Prefix(bits)
+	return prefix.Addr().String()
+}
@@ -0,0 +1,48 @@
+package fscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetForwardedFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		mode       string
+		remoteAddr string
+		chain      []string
+		want       string
+	}{
+		{name: "default strips port", remoteAddr: "192.0.2.10:51234", want: "192.0.2.10"},
+		{name: "append to chain", mode: ForwardedForAppend, remoteAddr: "192.0.2.10:51234", chain: []string{"198.51.100.1, 203.0.113.7"}, want: "198.51.100.1, 203.0.113.7, 192.0.2.10"},
+		{name: "multiple header lines", mode: ForwardedForAppend, remoteAddr: "[2001:db8::1]:443", chain: []string{"198.51.100.1", "203.0.113.7"}, want: "198.51.100.1, 203.0.113.7, 2001:db8::1"},
+		{name: "mapped IPv4", mode: ForwardedForAppend, remoteAddr: "[::ffff:192.0.2.10]:80", want: "192.0.2.10"},
+		{name: "anonymize", mode: ForwardedForAnonymize, remoteAddr: "[2001:db8:1:2::1]:443", chain: []string{"198.51.100.77, unknown"}, want: "198.51.100.0, unknown, 2001:db8:1::"},
+		{name: "omit", mode: ForwardedForOmit, remoteAddr: "192.0.2.10:51234", chain: []string{"198.51.100.1"}, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestFSCache(t)
+			cache.SetForwardedFor(tt.mode)
+
+			r := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/stable/InRelease", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.chain {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			req, err := cache.newCacheMissUpstreamRequest(r)
+			if err != nil {
+				t.Fatalf("newCacheMissUpstreamRequest() error = %v", err)
+			}
+			if got := req.Header.Values("X-Forwarded-For"); len(got) > 1 {
+				t.Fatalf("X-Forwarded-For sent %d times, want once", len(got))
+			}
+			if got := req.Header.Get("X-Forwarded-For"); got != tt.want {
+				t.Fatalf("X-Forwarded-For = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -9,14 +9,17 @@
 package fscache
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/asaskevich/govalidator"
@@ -35,6 +38,11 @@ type FSCache struct {
 	memoryFileReadLock     map[string]time.Time
 	memoryFileWriteLockMux sync.RWMutex
 	memoryFileWriteLock    map[string]time.Time
+	writeLockMaxAge        time.Duration // Write locks older than this are taken over, 0 = never
+
+	lockWait       LockWaitOptions          // Waiting of cache misses for other requests of the same file
+	lockWaitersMux sync.Mutex               // Guards lockWaiters
+	lockWaiters    map[string]chan struct{} // Closed once a lock of the file is released, by lock key
 
 	accessCacheMux           sync.RWMutex
 	accessCache              map[string]*accessCacheRecord
@@ -47,6 +55,53 @@ type FSCache struct {
 	statsStop          chan struct{}
 	statsDirty         bool
 	statsRevision      uint64
+	statsFlushMux      sync.Mutex // Serializes writes of the stats file
+
+	gauges  trafficGauges  // Hit ratio and traffic of the last minutes
+	repairs repairCounters // Broken cached files deleted to be fetched again, by reason
+
+	usage   cacheUsage   // Last result of GetCacheUsage
+	largest largestFiles // Last scan of LargestFiles and LargestFilesByDomain
+
+	writeOptions  WriteOptions // Buffering of downloads written to disk
+	tempDirectory string       // Directory downloads are written to before they are moved into the cache, empty for next to the target
+
+	parent *url.URL // Parent goaptcacher asked before the upstream server on cache misses, nil if unset
+
+	debugHeaders bool // Describe the caching decision in the X-Cache-Debug header
+
+	recheck       RecheckOptions              // Recheck intervals of repository index files
+	validUntilMux sync.Mutex                  // Guards validUntil
+	validUntil    map[string]validUntilRecord // Parsed Valid-Until dates by local path
+
+	deduplicate bool      // Hard link downloaded files to cached files with the same content
+	blobs       blobIndex // Cached files by SHA256, used for deduplication
+
+	cooldowns hostCooldowns // Upstream hosts which asked to retry later
+
+	neverCache PathPatterns // Requests which are passed to the upstream server without caching
+
+	compressionFallback bool // Convert index files not found upstream from another compression variant
+
+	upstreamHeaders func(host string) SecretHeaders // Headers added to requests to upstream hosts, nil if none
+	forwardedFor    string                          // How the client address is sent in X-Forwarded-For, see ForwardedForAppend
+
+	deletionGracePeriod  time.Duration // Time files stay marked for deletion before they are removed
+	deletionSweepStarted bool          // Set once files marked for deletion are removed in the background
+	pendingDeletions     atomic.Int64  // Files marked for deletion which aren't removed yet
+
+	equivalentProtocols func(domain string) bool            // Domains whose files are the same over HTTP and HTTPS, nil if none
+	immutableDomains    func(domain string) bool            // Domains whose files are never revalidated, nil if none
+	appendOnlyDomains   func(domain string) bool            // Domains whose grown files are refreshed by fetching the new end, nil if none
+	signedBy            func(u *url.URL) (string, []string) // Keyring and allowed key fingerprints release files of a repository have to be signed with, nil if none
+	verifiedSignatures  sync.Map                            // SHA256 of the release files verified since the start by local path
+
+	verifyMux sync.Mutex // Serializes source verification runs
+
+	refreshFlightsMux sync.Mutex
+	refreshFlights    map[string]*refreshFlight // Revalidations of metadata files in progress, by access cache key
+
+	closeOnce sync.Once // Stops the flush loops only once
 }
 
 // NewFSCache creates a new FSCache with the given cache path.
@@ -54,11 +109,6 @@ func NewFSCache(cachePath string) *FSCache {
 	cache := &FSCache{
 		client: &http.Client{
 			Timeout: time.Hour, // Timeout every extreme long requests
-			Transport: &http.Transport{
-				Proxy:                 nil,             // No proxy by default
-				MaxIdleConnsPerHost:   7,               // Maximum number of idle connections per host
-				ResponseHeaderTimeout: time.Minute * 5, // Timeout for response headers
-			},
 		},
 		CachePath:           cachePath,
 		memoryFileReadLock:  make(map[string]time.Time),
@@ -67,15 +117,23 @@ func NewFSCache(cachePath string) *FSCache {
 		accessCacheStop:     make(chan struct{}),
 		statsByDate:         make(map[string]*statsEntry),
 		statsStop:           make(chan struct{}),
+		refreshFlights:      make(map[string]*refreshFlight),
+		writeOptions:        DefaultWriteOptions(),
+		recheck:             DefaultRecheckOptions(),
+		writeLockMaxAge:     DefaultWriteLockMaxAge,
+		lockWait:            DefaultLockWaitOptions(),
+		deletionGracePeriod: DefaultDeletionGracePeriod,
 	}
 
+	cache.setUpstreamTransport(newUpstreamTransport(DefaultTransportOptions()))
 	cache.accessCacheFlushInterval = accessCacheFlushIntervalDefault
 	cache.startAccessCacheFlushLoop()
 	cache.statsFlushInterval = statsFlushIntervalDefault
 	if err := cache.loadStatsFromDisk(); err != nil {
-		log.Printf("[WARN:STATS] failed to load persisted stats: %v", err)
+		slog.Warn("Failed to load persisted stats", "event", "stats", "error", err)
 	}
 	cache.startStatsFlushLoop()
+	cache.startGaugeSampleLoop()
 
 	return cache
 }
@@ -88,17 +146,70 @@ func (c *FSCache) SetExpirationDays(days uint64) {
 	c.expirationInDays = days
 
 	if firstSet {
-		log.Printf("[INFO:EXPIRE] Activated file expiration\n")
+		slog.Info("Activated file expiration", "event", "expire", "days", days)
 		go c.expireUnusedFiles()
 	}
 }
 
+// Close waits until all active downloads are finished or ctx is done, stops
+// the background flush loops and writes the access cache and the stats to
+// disk. If ctx ends before the downloads are finished, the data is written
+// anyway and the error of ctx is returned.
+func (c *FSCache) Close(ctx context.Context) error {
+	waitErr := c.waitForDownloads(ctx)
+
+	c.closeOnce.Do(func() {
+		close(c.accessCacheStop)
+		close(c.statsStop)
+	})
+
+	c.flushAccessCache()
+	if err := c.flushStatsToDisk(); err != nil {
+		return fmt.Errorf("failed to persist stats: %w", err)
+	}
+
+	return waitErr
+}
+
+// waitForDownloads blocks until no download holds a write lock anymore.
+func (c *FSCache) waitForDownloads(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for c.ActiveDownloads() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// SetTransport replaces the transport used for upstream requests, e.g. to
+// route requests through a custom dialer.
+func (c *FSCache) SetTransport(transport http.RoundTripper) {
+	c.setUpstreamTransport(transport)
+}
+
+// setUpstreamTransport sends upstream requests through transport, with the
+// headers set by SetUpstreamHeaders.
+func (c *FSCache) setUpstreamTransport(transport http.RoundTripper) {
+	c.client.Transport = &upstreamHeaderTransport{cache: c, next: transport}
+}
+
 // buildLocalPath builds the local path for the given request.
 func (c *FSCache) buildLocalPath(rq *url.URL) string {
 	if c.CustomCachePath != nil {
 		return c.CustomCachePath(rq)
 	}
 
+	return c.flatLocalPath(rq)
+}
+
+// flatLocalPath returns the local path of rq in the flat layout, the host
+// directory followed by the path of the URL.
+func (c *FSCache) flatLocalPath(rq *url.URL) string {
 	base := filepath.Clean(c.CachePath)
 
 	host := rq.Hostname()
@@ -132,21 +243,68 @@ func (c *FSCache) validateRequest(r *http.Request) error {
 		r.URL.Host = r.Host
 	}
 
-	// Check if the used HTTP Host is a valid domain
-	if !govalidator.IsDNSName(r.URL.Host) {
+	// The host is part of the cache key, example.com and EXAMPLE.com:443
+	// must refer to the same entry.
+	r.URL.Host = CanonicalHost(r.URL.Scheme, r.URL.Host)
+	r.Host = r.URL.Host
+
+	// Check if the used HTTP Host is a valid domain or IP address (IPv6
+	// literals are bracketed in the URL) with an optional port
+	host := r.URL.Hostname()
+	if !govalidator.IsDNSName(host) && !govalidator.IsIP(host) {
 		return fmt.Errorf("invalid host")
 	}
+	if port := r.URL.Port(); port != "" && !govalidator.IsPort(port) {
+		return fmt.Errorf("invalid port")
+	}
 
 	return nil
 }
 
+// CanonicalHost returns host in the form used for cache keys: lowercase,
+// without trailing dot and without the default port of scheme. Other ports are
+// kept, IPv6 literals stay bracketed.
+func CanonicalHost(scheme, host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	hostname, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		hostname = host[1 : len(host)-1]
+	}
+	hostname = strings.TrimSuffix(hostname, ".")
+
+	switch {
+	case port == "443" && DetermineProtocol(scheme) == 1,
+		port == "80" && DetermineProtocol(scheme) == 0:
+		port = ""
+	}
+
+	if port != "" {
+		return net.JoinHostPort(hostname, port)
+	}
+	if strings.Contains(hostname, ":") {
+		return "[" + hostname + "]"
+	}
+	return hostname
+}
+
 // ServeFromRequest serves a file from cache if available and not expired. If
-// the file is not in the cache, it is downloaded from the internet.
+// the file is not in the cache, it is downloaded from the internet. PURGE and
+// DELETE requests remove the file from the cache, callers have to make sure
+// that only trusted clients can send them.
 func (c *FSCache) ServeFromRequest(r *http.Request, w http.ResponseWriter) {
+	// Log lines of the request and its background tasks carry the request
+	// ID. Requests passed by the proxy already have one.
+	if RequestIDFromContext(r.Context()) == "" {
+		r = r.WithContext(WithRequestID(r.Context(), c.GenerateUUID()))
+	}
+
 	// Check if the request is valid
 	if err := c.validateRequest(r); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		log.Printf("Invalid request: %s\n", err)
+		Error(w, r, http.StatusBadRequest, "invalid_request", "Invalid request")
+		slog.InfoContext(r.Context(), "Invalid request", "event", "request", "client", r.RemoteAddr, "host", r.Host, "path", r.URL.Path, "status", http.StatusBadRequest, "error", err)
 		return
 	}
 
@@ -155,11 +313,13 @@ func (c *FSCache) ServeFromRequest(r *http.Request, w http.ResponseWriter) {
 		c.serveGETRequest(r, w)
 	case http.MethodHead:
 		c.serveHEADRequest(r, w)
+	case MethodPurge, http.MethodDelete:
+		c.servePURGERequest(r, w)
 	// case http.MethodConnect:
 	// TODO: Implement CONNECT method
 	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		log.Printf("Method not allowed: %s\n", r.Method)
+		Error(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
+		slog.InfoContext(r.Context(), "Method not allowed", "event", "request", "client", r.RemoteAddr, "method", r.Method, "status", http.StatusMethodNotAllowed)
 	}
 }
 
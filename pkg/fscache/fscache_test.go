@@ -1,6 +1,9 @@
 package fscache
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
@@ -147,6 +150,34 @@ func TestValidateRequest(t *testing.T) {
 		}
 	})
 
+	t.Run("ip literals and ports", func(t *testing.T) {
+		for _, host := range []string{"example.com:8443", "192.0.2.1", "[2001:db8::1]", "[::1]:8443"} {
+			req := httptest.NewRequest("GET", "http://example.com/pkg.deb", nil)
+			req.URL.Host = host
+			if err := cache.validateRequest(req); err != nil {
+				t.Fatalf("validateRequest(%q) error = %v", host, err)
+			}
+		}
+	})
+
+	t.Run("default port is stripped", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "https://Example.COM:443/pkg.deb", nil)
+		if err := cache.validateRequest(req); err != nil {
+			t.Fatalf("validateRequest() error = %v", err)
+		}
+		if req.URL.Host != "example.com" || req.Host != "example.com" {
+			t.Fatalf("expected canonical host example.com, got URL host %q and host %q", req.URL.Host, req.Host)
+		}
+	})
+
+	t.Run("invalid port", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/pkg.deb", nil)
+		req.URL.Host = "example.com:99999"
+		if err := cache.validateRequest(req); err == nil {
+			t.Fatalf("expected error for invalid port")
+		}
+	})
+
 	t.Run("invalid host", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "http://example.com/pkg.deb", nil)
 		req.URL.Host = ""
@@ -157,6 +188,53 @@ func TestValidateRequest(t *testing.T) {
 	})
 }
 
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		scheme string
+		host   string
+		want   string
+	}{
+		{"http", "example.com", "example.com"},
+		{"http", "Example.COM", "example.com"},
+		{"http", "example.com:80", "example.com"},
+		{"https", "example.com:443", "example.com"},
+		{"https", "example.com.:443", "example.com"},
+		{"http", "example.com:443", "example.com:443"},
+		{"https", "example.com:80", "example.com:80"},
+		{"https", "example.com:8443", "example.com:8443"},
+		{"", "example.com:80", "example.com"},
+		{"https", "[2001:DB8::1]:443", "[2001:db8::1]"},
+		{"https", "[::1]:8443", "[::1]:8443"},
+		{"http", "[::1]", "[::1]"},
+		{"http", "192.0.2.1:80", "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		if got := CanonicalHost(tt.scheme, tt.host); got != tt.want {
+			t.Errorf("CanonicalHost(%q, %q) = %q, want %q", tt.scheme, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalHostSharesCacheEntry(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	first := httptest.NewRequest("GET", "https://example.com/pkg.deb", nil)
+	second := httptest.NewRequest("GET", "https://EXAMPLE.com:443/pkg.deb", nil)
+	for _, req := range []*http.Request{first, second} {
+		if err := cache.validateRequest(req); err != nil {
+			t.Fatalf("validateRequest() error = %v", err)
+		}
+	}
+
+	if err := cache.Set(DetermineProtocolFromURL(first.URL), first.URL.Host, first.URL.Path, AccessEntry{URL: first.URL}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, ok := cache.Get(DetermineProtocolFromURL(second.URL), second.URL.Host, second.URL.Path); !ok {
+		t.Fatalf("expected %q to use the cache entry of %q", second.URL, first.URL)
+	}
+}
+
 func TestEvaluateRefreshDefaultInterval(t *testing.T) {
 	cache := newTestFSCache(t)
 	now := time.Now()
@@ -351,6 +429,72 @@ func TestCreateExclusiveWriteLock(t *testing.T) {
 	cache.DeleteWriteLock(protocol, domain, path)
 }
 
+func TestActiveDownloads(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	if got := cache.ActiveDownloads(); got != 0 {
+		t.Fatalf("ActiveDownloads() = %d, want 0", got)
+	}
+
+	if err := cache.CreateWriteLock(1, "example.com", "/a"); err != nil {
+		t.Fatalf("CreateWriteLock failed: %v", err)
+	}
+	if err := cache.CreateWriteLock(1, "example.com", "/b"); err != nil {
+		t.Fatalf("CreateWriteLock failed: %v", err)
+	}
+	if got := cache.ActiveDownloads(); got != 2 {
+		t.Fatalf("ActiveDownloads() = %d, want 2", got)
+	}
+
+	cache.DeleteWriteLock(1, "example.com", "/a")
+	if got := cache.ActiveDownloads(); got != 1 {
+		t.Fatalf("ActiveDownloads() = %d, want 1", got)
+	}
+}
+
+func TestCloseFlushesStats(t *testing.T) {
+	cache := newTestFSCache(t)
+	if err := cache.TrackRequest(false, 12); err != nil {
+		t.Fatalf("TrackRequest() error = %v", err)
+	}
+
+	if err := cache.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := os.Stat(cache.statsFilePath()); err != nil {
+		t.Fatalf("expected stats file after Close: %v", err)
+	}
+
+	// Closing twice must not panic.
+	if err := cache.Close(context.Background()); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+}
+
+func TestCloseWaitsForActiveDownloads(t *testing.T) {
+	cache := newTestFSCache(t)
+	if err := cache.CreateWriteLock(1, "example.com", "/a"); err != nil {
+		t.Fatalf("CreateWriteLock failed: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cache.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cache.DeleteWriteLock(1, "example.com", "/a")
+	}()
+	if err := cache.Close(context.Background()); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if got := cache.ActiveDownloads(); got != 0 {
+		t.Fatalf("ActiveDownloads() = %d after Close, want 0", got)
+	}
+}
+
 func TestGenerateUUID(t *testing.T) {
 	cache := newTestFSCache(t)
 	id := cache.GenerateUUID()
@@ -0,0 +1,186 @@
+package fscache
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gaugeWindow         = 5 * time.Minute  // Period the rates of the gauges are averaged over
+	gaugeSampleInterval = 10 * time.Second // Interval the counters are sampled in
+)
+
+// Gauges are the current values of the cache for monitoring and alerting.
+// Hits, misses and traffic are counted over the last Window.
+type Gauges struct {
+	ActiveDownloads    int           // Files currently downloaded or refreshed
+	Window             time.Duration // Period the values are averaged over, shorter right after startup
+	Hits               uint64        // Cache hits within the window
+	Misses             uint64        // Cache misses within the window
+	HitRatio           float64       // Share of hits among hits and misses, 0 without requests
+	BytesDownPerSecond float64       // Traffic received from upstream
+	BytesUpPerSecond   float64       // Traffic sent to clients
+
+	// MetadataMaxAge is the longest time since a repository index file, which
+	// clients requested after its recheck was due, was revalidated upstream.
+	// It grows if refreshes keep failing, 0 if all requested files are fresh.
+	MetadataMaxAge    time.Duration
+	MetadataMaxAgeURL string // URL of the file with MetadataMaxAge
+
+	PendingDeletions int64 // Files marked for deletion waiting for their grace period or a confirmation
+}
+
+// gaugeSample holds the values of the traffic counters at a point in time.
+type gaugeSample struct {
+	time   time.Time
+	hits   uint64
+	misses uint64
+	down   uint64
+	up     uint64
+}
+
+// trafficGauges counts requests and traffic since startup. The counters are
+// increased in the serving path without locking, the rates are calculated
+// from the difference to a sample taken about one window ago.
+type trafficGauges struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	down   atomic.Uint64
+	up     atomic.Uint64
+
+	samplesMux sync.Mutex
+	samples    []gaugeSample // Oldest first, the first one is at most one window old
+}
+
+// add counts a request or tunnel with its traffic.
+func (g *trafficGauges) add(hits, misses, down, up uint64) {
+	g.hits.Add(hits)
+	g.misses.Add(misses)
+	g.down.Add(down)
+	g.up.Add(up)
+}
+
+func (g *trafficGauges) current(now time.Time) gaugeSample {
+	return gaugeSample{
+		time:   now,
+		hits:   g.hits.Load(),
+		misses: g.misses.Load(),
+		down:   g.down.Load(),
+		up:     g.up.Load(),
+	}
+}
+
+// sample records the counters and drops the samples which aren't needed to
+// cover the window anymore.
+func (g *trafficGauges) sample(now time.Time) {
+	g.samplesMux.Lock()
+	defer g.samplesMux.Unlock()
+
+	g.samples = append(g.samples, g.current(now))
+	cutoff := now.Add(-gaugeWindow)
+	for len(g.samples) > 1 && !g.samples[1].time.After(cutoff) {
+		g.samples = g.samples[1:]
+	}
+}
+
+// values returns the counters and rates since the oldest sample.
+func (g *trafficGauges) values(now time.Time) Gauges {
+	g.samplesMux.Lock()
+	base := gaugeSample{time: now}
+	if len(g.samples) > 0 {
+		base = g.samples[0]
+	}
+	g.samplesMux.Unlock()
+
+	current := g.current(now)
+	gauges := Gauges{
+		Window: now.Sub(base.time),
+		Hits:   current.hits - base.hits,
+		Misses: current.misses - base.misses,
+	}
+	if gauges.Hits+gauges.Misses > 0 {
+		gauges.HitRatio = float64(gauges.Hits) / float64(gauges.Hits+gauges.Misses)
+	}
+	if seconds := gauges.Window.Seconds(); seconds > 0 {
+		gauges.BytesDownPerSecond = float64(current.down-base.down) / seconds
+		gauges.BytesUpPerSecond = float64(current.up-base.up) / seconds
+	}
+
+	return gauges
+}
+
+// Gauges returns the active downloads and the hit ratio and traffic rates of
+// the last five minutes.
+func (c *FSCache) Gauges() Gauges {
+	gauges := c.gauges.values(time.Now())
+	gauges.ActiveDownloads = c.ActiveDownloads()
+	gauges.MetadataMaxAge, gauges.MetadataMaxAgeURL = c.metadataMaxAge(time.Now())
+	gauges.PendingDeletions = c.PendingDeletions()
+	return gauges
+}
+
+// metadataMaxAge returns the longest time since a repository index file was
+// checked upstream among the files requested after their recheck was due, and
+// the URL of this file. Only the metadata of files requested since startup is
+// held in memory, so files nobody uses don't count and no disk access is
+// needed.
+func (c *FSCache) metadataMaxAge(now time.Time) (time.Duration, string) {
+	var candidates []*url.URL
+	var entries []AccessEntry
+
+	c.accessCacheMux.RLock()
+	for _, record := range c.accessCache {
+		entry := record.entry
+		if record.markedForDeletion || entry.LastChecked.IsZero() || !entry.LastAccessed.After(entry.LastChecked) || !isRepositoryMetadataPath(record.path) {
+			continue
+		}
+
+		u := entry.URL
+		if u == nil {
+			u = c.buildAccessURL(record.protocol, record.domain, record.path)
+		}
+		candidates = append(candidates, u)
+		entries = append(entries, entry)
+	}
+	c.accessCacheMux.RUnlock()
+
+	// The recheck timeout may read Release files, so it is determined without
+	// holding the lock.
+	var maxAge time.Duration
+	var oldest string
+	for i, u := range candidates {
+		if c.isImmutable(u.Host) {
+			continue
+		}
+		recheckTimeout, _ := c.recheckTimeout(u)
+		due := entries[i].LastChecked.Add(recheckTimeout)
+		if !entries[i].LastAccessed.After(due) {
+			continue
+		}
+		if age := now.Sub(entries[i].LastChecked); age > maxAge {
+			maxAge, oldest = age, u.String()
+		}
+	}
+
+	return maxAge, oldest
+}
+
+func (c *FSCache) startGaugeSampleLoop() {
+	c.gauges.sample(time.Now())
+
+	go func() {
+		ticker := time.NewTicker(gaugeSampleInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				c.gauges.sample(now)
+			case <-c.statsStop:
+				return
+			}
+		}
+	}()
+}
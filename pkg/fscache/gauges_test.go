@@ -0,0 +1,93 @@
+package fscache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficGaugesWindow(t *testing.T) {
+	var g trafficGauges
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	g.sample(start)
+
+	// Before the window is filled, the values cover the time since startup
+	g.add(3, 1, 400, 1000)
+	values := g.values(start.Add(10 * time.Second))
+	if values.Window != 10*time.Second || values.Hits != 3 || values.Misses != 1 {
+		t.Fatalf("values = %+v, want 3 hits and 1 miss within 10s", values)
+	}
+	if values.HitRatio != 0.75 || values.BytesDownPerSecond != 40 || values.BytesUpPerSecond != 100 {
+		t.Fatalf("values = %+v, want hit ratio 0.75, 40 B/s down and 100 B/s up", values)
+	}
+
+	// Once the window has passed, older requests drop out
+	for offset := gaugeSampleInterval; offset <= gaugeWindow+gaugeSampleInterval; offset += gaugeSampleInterval {
+		g.sample(start.Add(offset))
+	}
+	g.add(0, 2, 0, 0)
+	values = g.values(start.Add(gaugeWindow + gaugeSampleInterval))
+	if values.Window != gaugeWindow || values.Hits != 0 || values.Misses != 2 || values.HitRatio != 0 {
+		t.Fatalf("values = %+v, want only the 2 misses of the last window", values)
+	}
+	if len(g.samples) != int(gaugeWindow/gaugeSampleInterval)+1 {
+		t.Fatalf("kept %d samples, want %d", len(g.samples), int(gaugeWindow/gaugeSampleInterval)+1)
+	}
+}
+
+func TestGaugesCountTrackedRequests(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	if err := cache.TrackDomainRequest("example.com", true, 100); err != nil {
+		t.Fatalf("TrackDomainRequest() error = %v", err)
+	}
+	if err := cache.TrackDomainRequest("example.com", false, 50); err != nil {
+		t.Fatalf("TrackDomainRequest() error = %v", err)
+	}
+	if err := cache.TrackTunnelRequest(10, 20); err != nil {
+		t.Fatalf("TrackTunnelRequest() error = %v", err)
+	}
+	if err := cache.CreateWriteLock(0, "example.com", "/pool/pkg.deb"); err != nil {
+		t.Fatalf("CreateWriteLock() error = %v", err)
+	}
+
+	gauges := cache.Gauges()
+	if gauges.Hits != 1 || gauges.Misses != 1 || gauges.HitRatio != 0.5 || gauges.ActiveDownloads != 1 {
+		t.Fatalf("Gauges() = %+v, want 1 hit, 1 miss and 1 active download", gauges)
+	}
+	if down, up := cache.gauges.down.Load(), cache.gauges.up.Load(); down != 80 || up != 180 {
+		t.Fatalf("traffic counters = %d down, %d up, want 80 and 180", down, up)
+	}
+}
+
+func TestGaugesMetadataMaxAge(t *testing.T) {
+	cache := newTestFSCache(t)
+	now := time.Now()
+
+	set := func(path string, lastChecked, lastAccessed time.Time) {
+		t.Helper()
+		if err := cache.Set(0, "deb.debian.org", path, AccessEntry{LastChecked: lastChecked, LastAccessed: lastAccessed}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	// Requested within the recheck interval, then not anymore.
+	set("/debian/dists/stable/InRelease", now.Add(-3*time.Hour), now.Add(-3*time.Hour+time.Minute))
+	// Not an index file.
+	set("/debian/pool/main/h/hello/hello_1.0_amd64.deb", now.Add(-30*24*time.Hour), now)
+
+	if gauges := cache.Gauges(); gauges.MetadataMaxAge != 0 || gauges.MetadataMaxAgeURL != "" {
+		t.Fatalf("Gauges() metadata age = %v %q, want 0 without overdue requested files", gauges.MetadataMaxAge, gauges.MetadataMaxAgeURL)
+	}
+
+	// Requested after the recheck was due, but not revalidated.
+	set("/debian/dists/stable/main/binary-amd64/Packages.xz", now.Add(-2*time.Hour), now.Add(-time.Minute))
+	set("/debian/dists/testing/main/binary-amd64/Packages.xz", now.Add(-time.Hour), now.Add(-time.Minute))
+
+	gauges := cache.Gauges()
+	if gauges.MetadataMaxAge < 2*time.Hour || gauges.MetadataMaxAge > 2*time.Hour+time.Minute {
+		t.Fatalf("Gauges() MetadataMaxAge = %v, want about 2h", gauges.MetadataMaxAge)
+	}
+	if want := "http://deb.debian.org/debian/dists/stable/main/binary-amd64/Packages.xz"; gauges.MetadataMaxAgeURL != want {
+		t.Fatalf("Gauges() MetadataMaxAgeURL = %q, want %q", gauges.MetadataMaxAgeURL, want)
+	}
+}
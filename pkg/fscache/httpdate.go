@@ -0,0 +1,21 @@
+package fscache
+
+import (
+	"net/http"
+	"time"
+)
+
+// parseHTTPTime parses an HTTP date like in the Last-Modified header. Besides
+// the three formats of http.ParseTime (RFC 1123 with GMT, RFC 850 and ANSI C
+// asctime), RFC 1123 dates with a numeric zone, which some servers send, are
+// accepted.
+func parseHTTPTime(value string) (time.Time, error) {
+	parsed, err := http.ParseTime(value)
+	if err == nil {
+		return parsed, nil
+	}
+	if parsed, zoneErr := time.Parse(time.RFC1123Z, value); zoneErr == nil {
+		return parsed.UTC(), nil
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,103 @@
+package fscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseHTTPTime(t *testing.T) {
+	want := time.Date(2024, time.October, 13, 13, 53, 11, 0, time.UTC)
+
+	tcs := []struct {
+		name  string
+		value string
+	}{
+		{"RFC1123", "Sun, 13 Oct 2024 13:53:11 GMT"},
+		{"RFC1123Z", "Sun, 13 Oct 2024 15:53:11 +0200"},
+		{"RFC850", "Sunday, 13-Oct-24 13:53:11 GMT"},
+		{"ANSIC", "Sun Oct 13 13:53:11 2024"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseHTTPTime(tc.value)
+			if err != nil {
+				t.Fatalf("parseHTTPTime(%q) error = %v", tc.value, err)
+			}
+			if !got.Equal(want) {
+				t.Fatalf("parseHTTPTime(%q) = %v, want %v", tc.value, got, want)
+			}
+		})
+	}
+
+	if _, err := parseHTTPTime("yesterday"); err == nil {
+		t.Fatalf("parseHTTPTime(yesterday) succeeded")
+	}
+}
+
+func TestSetConditionalCacheMissHeadersNormalizesLastModified(t *testing.T) {
+	for _, value := range []string{"Sun, 13 Oct 2024 15:53:11 +0200", "Sun Oct 13 13:53:11 2024"} {
+		rr := httptest.NewRecorder()
+		setConditionalCacheMissHeaders(rr, &http.Response{Header: http.Header{"Last-Modified": {value}}})
+		if got := rr.Header().Get("Last-Modified"); got != "Sun, 13 Oct 2024 13:53:11 GMT" {
+			t.Fatalf("Last-Modified for %q = %q, want HTTP date in GMT", value, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	setConditionalCacheMissHeaders(rr, &http.Response{Header: http.Header{"Last-Modified": {"invalid"}}})
+	if got := rr.Header().Get("Last-Modified"); got != "" {
+		t.Fatalf("Last-Modified for invalid value = %q, want none", got)
+	}
+}
+
+func TestParseLastModifiedForMetadataFormats(t *testing.T) {
+	want := time.Date(2024, time.October, 13, 13, 53, 11, 0, time.UTC)
+	for _, value := range []string{"Sun, 13 Oct 2024 13:53:11 GMT", "Sun, 13 Oct 2024 15:53:11 +0200", "Sunday, 13-Oct-24 13:53:11 GMT", "Sun Oct 13 13:53:11 2024"} {
+		if got := parseLastModifiedForMetadata(t.Context(), value); !got.Equal(want) {
+			t.Fatalf("parseLastModifiedForMetadata(%q) = %v, want %v", value, got, want)
+		}
+	}
+
+	// Unparsable dates fall back to the current time.
+	if got := parseLastModifiedForMetadata(t.Context(), "invalid"); time.Since(got) > time.Minute {
+		t.Fatalf("parseLastModifiedForMetadata(invalid) = %v, want now", got)
+	}
+}
+
+func TestServeCachedFileIfModifiedSinceFormats(t *testing.T) {
+	const payload = "package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	localPath := downloadPackage(t, cache, mirror.URL, payload)
+	modTime := time.Date(2024, time.October, 13, 13, 53, 11, 0, time.UTC)
+	if err := os.Chtimes(localPath, modTime, modTime); err != nil {
+		t.Fatalf("Chtimes() error = %v", err)
+	}
+
+	tcs := []struct {
+		value string
+		want  int
+	}{
+		{"Sun, 13 Oct 2024 13:53:11 GMT", http.StatusNotModified},
+		{"Sunday, 13-Oct-24 13:53:11 GMT", http.StatusNotModified},
+		{"Sun Oct 13 13:53:11 2024", http.StatusNotModified},
+		{"Sat, 12 Oct 2024 13:53:11 GMT", http.StatusOK},
+		{"not a date", http.StatusOK},
+	}
+	for _, tc := range tcs {
+		req := httptest.NewRequest(http.MethodGet, mirror.URL+"/debian/pool/main/h/hello/hello_1.0_amd64.deb", nil)
+		req.Header.Set("If-Modified-Since", tc.value)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != tc.want {
+			t.Fatalf("If-Modified-Since %q: status = %d, want %d", tc.value, rr.Code, tc.want)
+		}
+		if tc.want == http.StatusOK && rr.Body.String() != payload {
+			t.Fatalf("If-Modified-Since %q: body = %q, want cached file", tc.value, rr.Body.String())
+		}
+	}
+}
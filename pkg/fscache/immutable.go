@@ -0,0 +1,15 @@
+package fscache
+
+// SetImmutable sets which domains serve files which never change once
+// published, e.g. snapshot.debian.org or pinned mirrors. Cached files of these
+// domains are never revalidated upstream, neither before serving nor in the
+// background. Purging them works as usual. It has to be called before
+// requests are served.
+func (c *FSCache) SetImmutable(match func(domain string) bool) {
+	c.immutableDomains = match
+}
+
+// isImmutable reports if the files of domain are never revalidated.
+func (c *FSCache) isImmutable(domain string) bool {
+	return c.immutableDomains != nil && c.immutableDomains(domain)
+}
@@ -0,0 +1,87 @@
+package fscache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func immutableSnapshot(domain string) bool {
+	return domain == "snapshot.debian.org"
+}
+
+func TestImmutableDomainsAreNeverRefreshed(t *testing.T) {
+	const content = "cached index"
+
+	var requests atomic.Int64
+	cache := newTestFSCache(t)
+	cache.SetImmutable(immutableSnapshot)
+	cache.client = &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requests.Add(1)
+			return &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	}
+
+	// Both files were checked upstream a month ago, so both are due.
+	cacheFile := func(rawURL string) {
+		t.Helper()
+		u := mustParseURL(t, rawURL)
+		localPath := cache.buildLocalPath(u)
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		lastChecked := time.Now().Add(-30 * 24 * time.Hour)
+		if err := cache.Set(0, u.Host, u.Path, AccessEntry{URL: u, Size: int64(len(content)), LastChecked: lastChecked, LastAccessed: lastChecked}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	immutableURL := "http://snapshot.debian.org/archive/debian/20240101T000000Z/dists/bookworm/main/binary-amd64/Packages.gz"
+	mutableURL := "http://deb.debian.org/debian/dists/bookworm/main/binary-amd64/Packages.gz"
+	cacheFile(immutableURL)
+	cacheFile(mutableURL)
+
+	entry, _ := cache.Get(0, "snapshot.debian.org", mustParseURL(t, immutableURL).Path)
+	if cache.evaluateRefresh(mustParseURL(t, immutableURL), entry) {
+		t.Fatalf("evaluateRefresh() = true for immutable domain")
+	}
+
+	rr := httptest.NewRecorder()
+	cache.serveGETRequest(httptest.NewRequest(http.MethodGet, immutableURL, nil), rr)
+	if rr.Code != http.StatusOK || rr.Body.String() != content || rr.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("response = %d %q, X-Cache %q, want cached file", rr.Code, rr.Body.String(), rr.Header().Get("X-Cache"))
+	}
+	cache.backgroundFileTasks(t.Context(), mustParseURL(t, immutableURL))
+	time.Sleep(50 * time.Millisecond)
+	if got := requests.Load(); got != 0 {
+		t.Fatalf("upstream requests = %d, want 0 for immutable domain", got)
+	}
+	if gauges := cache.Gauges(); gauges.MetadataMaxAge != 0 {
+		t.Fatalf("MetadataMaxAge = %v, want 0 for immutable domain", gauges.MetadataMaxAge)
+	}
+
+	// Other domains are revalidated before serving.
+	cache.serveGETRequest(httptest.NewRequest(http.MethodGet, mutableURL, nil), httptest.NewRecorder())
+	if got := requests.Load(); got != 1 {
+		t.Fatalf("upstream requests = %d, want 1 for other domain", got)
+	}
+
+	// Immutable files can still be purged.
+	rr = httptest.NewRecorder()
+	cache.ServeFromRequest(httptest.NewRequest(MethodPurge, immutableURL, nil), rr)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PURGE status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if _, err := os.Stat(cache.buildLocalPath(mustParseURL(t, immutableURL))); !os.IsNotExist(err) {
+		t.Fatalf("purged file still exists: %v", err)
+	}
+}
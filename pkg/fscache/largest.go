@@ -0,0 +1,194 @@
+package fscache
+
+import (
+	"container/heap"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// largestFilesTTL is how long the result of a scan for the largest files is
+// reused, so repeated loads of the report don't read all metadata again.
+const largestFilesTTL = 30 * time.Second
+
+// DomainUsage summarizes the cached files of a domain.
+type DomainUsage struct {
+	Domain  string
+	Files   int
+	Size    int64
+	Largest []CachedFile // Largest files of the domain, biggest first
+}
+
+// largestFiles is the last scan of LargestFiles and LargestFilesByDomain.
+type largestFiles struct {
+	mux       sync.Mutex    // Held during a scan, so concurrent callers share its result
+	limit     int           // Number of files kept of all domains and per domain
+	files     []CachedFile  // Largest files of all domains, biggest first
+	total     int           // Number of cached files
+	domains   []DomainUsage // Domains with the most cached data first
+	scannedAt time.Time
+}
+
+// LargestFiles returns the limit largest cached files, biggest first, and the
+// number of cached files. The files are selected by the sizes recorded in the
+// metadata and the scan is reused for largestFilesTTL. Files removed from disk
+// since are left out.
+func (c *FSCache) LargestFiles(limit int) ([]CachedFile, int, error) {
+	c.largest.mux.Lock()
+	defer c.largest.mux.Unlock()
+
+	if err := c.scanLargestFiles(limit); err != nil {
+		return nil, 0, err
+	}
+	return c.existingCachedFiles(c.largest.files, limit), c.largest.total, nil
+}
+
+// LargestFilesByDomain returns the cached files grouped by domain, domains
+// with the most cached data first. For every domain, the limit largest files
+// are returned. Like LargestFiles, the scan is reused for largestFilesTTL.
+func (c *FSCache) LargestFilesByDomain(limit int) ([]DomainUsage, error) {
+	c.largest.mux.Lock()
+	defer c.largest.mux.Unlock()
+
+	if err := c.scanLargestFiles(limit); err != nil {
+		return nil, err
+	}
+
+	result := make([]DomainUsage, len(c.largest.domains))
+	for i, usage := range c.largest.domains {
+		usage.Largest = c.existingCachedFiles(usage.Largest, limit)
+		result[i] = usage
+	}
+	return result, nil
+}
+
+// scanLargestFiles selects the limit largest files of all domains and of each
+// domain from the metadata, unless a scan with at least limit files is younger
+// than largestFilesTTL. c.largest.mux has to be held.
+func (c *FSCache) scanLargestFiles(limit int) error {
+	if !c.largest.scannedAt.IsZero() && time.Since(c.largest.scannedAt) < largestFilesTTL && limit <= c.largest.limit {
+		return nil
+	}
+
+	entries, err := c.collectAccessCacheRecords()
+	if err != nil {
+		return err
+	}
+
+	var (
+		seen     = make(map[string]struct{}, len(entries))
+		all      cachedFileHeap
+		total    int
+		byDomain = map[string]*DomainUsage{}
+		largest  = map[string]*cachedFileHeap{}
+	)
+	for _, record := range entries {
+		if record.markedForDeletion {
+			continue
+		}
+
+		entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
+		localPath := c.buildLocalPath(entry.URL)
+		if _, ok := seen[localPath]; ok {
+			continue
+		}
+		seen[localPath] = struct{}{}
+
+		size, ok := recordedSize(entry, localPath)
+		if !ok {
+			continue
+		}
+
+		file := CachedFile{
+			URL:          entry.URL.String(),
+			Domain:       record.domain,
+			Path:         record.path,
+			Size:         size,
+			LastAccessed: entry.LastAccessed,
+			LastChecked:  entry.LastChecked,
+			Hits:         entry.Hits,
+			Pinned:       record.pinned,
+		}
+		total++
+		all.keep(file, limit)
+
+		usage, ok := byDomain[record.domain]
+		if !ok {
+			usage = &DomainUsage{Domain: record.domain}
+			byDomain[record.domain] = usage
+			largest[record.domain] = &cachedFileHeap{}
+		}
+		usage.Files++
+		usage.Size += size
+		largest[record.domain].keep(file, limit)
+	}
+
+	domains := make([]DomainUsage, 0, len(byDomain))
+	for domain, usage := range byDomain {
+		usage.Largest = largest[domain].sorted()
+		domains = append(domains, *usage)
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		if domains[i].Size != domains[j].Size {
+			return domains[i].Size > domains[j].Size
+		}
+		return domains[i].Domain < domains[j].Domain
+	})
+
+	c.largest.limit = limit
+	c.largest.files = all.sorted()
+	c.largest.total = total
+	c.largest.domains = domains
+	c.largest.scannedAt = time.Now()
+	return nil
+}
+
+// cachedFileHeap is a min-heap of files ordered by size, so the smallest of the
+// kept files is replaced first.
+type cachedFileHeap []CachedFile
+
+func (h cachedFileHeap) Len() int      { return len(h) }
+func (h cachedFileHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h cachedFileHeap) Less(i, j int) bool {
+	return cachedFileBySize(h[i], h[j])
+}
+
+func (h *cachedFileHeap) Push(x any) {
+	*h = append(*h, x.(CachedFile))
+}
+
+func (h *cachedFileHeap) Pop() any {
+	old := *h
+	file := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return file
+}
+
+// keep adds file if it is one of the limit largest files added so far.
+func (h *cachedFileHeap) keep(file CachedFile, limit int) {
+	if h.Len() < limit {
+		heap.Push(h, file)
+		return
+	}
+	if h.Len() > 0 && cachedFileBySize((*h)[0], file) {
+		(*h)[0] = file
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted returns the kept files, biggest first.
+func (h cachedFileHeap) sorted() []CachedFile {
+	files := slices.Clone([]CachedFile(h))
+	sortCachedFiles(files, ListSortSize, true)
+	return files
+}
+
+// cachedFileBySize orders files by size, files of the same size by domain and
+// path like sortCachedFiles.
+func cachedFileBySize(a, b CachedFile) bool {
+	if a.Size != b.Size {
+		return a.Size < b.Size
+	}
+	return cachedFileByPath(a, b)
+}
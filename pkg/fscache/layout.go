@@ -0,0 +1,149 @@
+package fscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Layouts of the files in the cache directory.
+const (
+	LayoutFlat    = "flat"    // <host>/<path>, as requested
+	LayoutSharded = "sharded" // <host>/<dir>/<shard>/<name>, see ShardPath
+)
+
+// layoutFileName is the file in the cache directory which records the layout
+// the cached files are stored in.
+const layoutFileName = ".layout"
+
+// ShardPath inserts a directory named after the first byte of the SHA-256 of
+// the file name, in hex, between the directory and the file name of path. A
+// directory with many files, like the pool of a repository, is split into
+// 256 directories this way.
+func ShardPath(path string) string {
+	dir, name := filepath.Split(path)
+	sum := sha256.Sum256([]byte(name))
+	return filepath.Join(dir, hex.EncodeToString(sum[:1]), name)
+}
+
+// ShardedCachePath returns the local path of rq in the sharded layout, it is
+// meant to be set as CustomCachePath. Files below a dists directory, the
+// index files of APT repositories, are kept in the flat layout, so
+// repositories in the cache can still be found and verified.
+func (c *FSCache) ShardedCachePath(rq *url.URL) string {
+	localPath := c.flatLocalPath(rq)
+	if isRepositoryIndexPath(rq.Path) {
+		return localPath
+	}
+	return ShardPath(localPath)
+}
+
+// isRepositoryIndexPath reports whether the URL path is below a dists
+// directory. Directories within the pool are named after source packages,
+// which may be called dists as well.
+func isRepositoryIndexPath(urlPath string) bool {
+	segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+	for _, segment := range segments[:len(segments)-1] {
+		switch segment {
+		case "pool":
+			return false
+		case "dists":
+			return true
+		}
+	}
+	return false
+}
+
+// MigrateLayout moves cached files and their metadata to the location of the
+// current layout (CustomCachePath) and records layout in the cache directory.
+// If the recorded layout matches, nothing is done. A cache without recorded
+// layout is treated as flat. It returns the number of moved files and has to
+// be called before the cache is used.
+func (c *FSCache) MigrateLayout(layout string) (int, error) {
+	layoutPath := filepath.Join(c.CachePath, layoutFileName)
+	previous := LayoutFlat
+	if data, err := os.ReadFile(layoutPath); err == nil {
+		previous = strings.TrimSpace(string(data))
+	} else if !os.IsNotExist(err) {
+		return 0, fmt.Errorf("reading layout: %w", err)
+	}
+
+	moved := 0
+	if previous != layout {
+		slog.Info("Migrating cache layout", "event", "layout", "path", c.CachePath, "from", previous, "to", layout)
+
+		var err error
+		moved, err = c.moveToLayout()
+		if err != nil {
+			return moved, err
+		}
+
+		slog.Info("Cache layout migrated", "event", "layout", "path", c.CachePath, "files", moved)
+	}
+
+	if err := os.MkdirAll(c.CachePath, 0o755); err != nil {
+		return moved, err
+	}
+	if err := os.WriteFile(layoutPath, []byte(layout+"\n"), 0o644); err != nil {
+		return moved, fmt.Errorf("writing layout: %w", err)
+	}
+
+	return moved, nil
+}
+
+// moveToLayout moves every file with metadata to the path returned by
+// buildLocalPath. Files without metadata are left in place.
+func (c *FSCache) moveToLayout() (int, error) {
+	if _, err := os.Stat(c.CachePath); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	moves := map[string]string{}
+	err := filepath.WalkDir(c.CachePath, func(metaPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(metaPath, accessCacheMetaSuffix) {
+			return nil
+		}
+
+		record, ok := c.loadAccessCacheRecordFromFile(metaPath)
+		if !ok {
+			return nil
+		}
+
+		entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
+		current := strings.TrimSuffix(metaPath, accessCacheMetaSuffix)
+		if target := c.buildLocalPath(entry.URL); target != current {
+			moves[current] = target
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for current, target := range moves {
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(current, target); err != nil && !os.IsNotExist(err) {
+			return moved, err
+		}
+		if err := os.Rename(current+accessCacheMetaSuffix, target+accessCacheMetaSuffix); err != nil {
+			return moved, err
+		}
+		// Shard directories of the sharded layout are empty afterwards
+		_ = os.Remove(filepath.Dir(current))
+		moved++
+	}
+
+	return moved, nil
+}
@@ -0,0 +1,112 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShardPath(t *testing.T) {
+	path := filepath.Join("cache", "example.com", "pool", "main", "pkg_1.0_amd64.deb")
+
+	got := ShardPath(path)
+	dir, name := filepath.Split(got)
+	if name != "pkg_1.0_amd64.deb" {
+		t.Fatalf("ShardPath() file name = %q, want pkg_1.0_amd64.deb", name)
+	}
+	shard := filepath.Base(dir)
+	if filepath.Dir(filepath.Clean(dir)) != filepath.Join("cache", "example.com", "pool", "main") || len(shard) != 2 {
+		t.Fatalf("ShardPath() = %q, want a two character shard below the pool directory", got)
+	}
+	if again := ShardPath(path); again != got {
+		t.Fatalf("ShardPath() is not stable: %q != %q", again, got)
+	}
+}
+
+func TestShardedCachePathKeepsRepositoryIndexes(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	index := mustParseURL(t, "http://deb.debian.org/debian/dists/stable/InRelease")
+	if got, want := cache.ShardedCachePath(index), cache.flatLocalPath(index); got != want {
+		t.Fatalf("ShardedCachePath(%q) = %q, want %q", index, got, want)
+	}
+
+	pkg := mustParseURL(t, "http://deb.debian.org/debian/pool/main/d/dists/dists_1.0_all.deb")
+	if got, want := cache.ShardedCachePath(pkg), ShardPath(cache.flatLocalPath(pkg)); got != want {
+		t.Fatalf("ShardedCachePath(%q) = %q, want %q", pkg, got, want)
+	}
+}
+
+func TestMigrateLayout(t *testing.T) {
+	cache := newTestFSCache(t)
+	u := mustParseURL(t, "http://example.com/pool/main/p/pkg.deb")
+
+	flatPath := cache.buildLocalPath(u)
+	if err := os.MkdirAll(filepath.Dir(flatPath), 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(flatPath, []byte("payload"), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := cache.Set(DetermineProtocolFromURL(u), u.Host, u.Path, AccessEntry{URL: u, Size: 7}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	cache.flushAccessCache()
+
+	// An existing cache without recorded layout is flat
+	cache.CustomCachePath = cache.ShardedCachePath
+	moved, err := cache.MigrateLayout(LayoutSharded)
+	if err != nil {
+		t.Fatalf("MigrateLayout(sharded) error = %v", err)
+	}
+	if moved != 1 {
+		t.Fatalf("MigrateLayout(sharded) moved %d files, want 1", moved)
+	}
+
+	shardedPath := cache.buildLocalPath(u)
+	if data, err := os.ReadFile(shardedPath); err != nil || string(data) != "payload" {
+		t.Fatalf("expected file at %q, got %q, %v", shardedPath, data, err)
+	}
+	if _, err := os.Stat(shardedPath + accessCacheMetaSuffix); err != nil {
+		t.Fatalf("expected metadata next to the sharded file: %v", err)
+	}
+	if _, err := os.Stat(flatPath); !os.IsNotExist(err) {
+		t.Fatalf("expected flat file to be moved, stat error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(cache.CachePath, layoutFileName)); err != nil || strings.TrimSpace(string(data)) != LayoutSharded {
+		t.Fatalf("layout file = %q, %v, want %q", data, err, LayoutSharded)
+	}
+
+	// The recorded layout matches, nothing is moved
+	if moved, err := cache.MigrateLayout(LayoutSharded); err != nil || moved != 0 {
+		t.Fatalf("MigrateLayout(sharded) again = %d, %v, want 0, nil", moved, err)
+	}
+
+	// Back to the flat layout, the emptied shard directory is removed
+	cache.CustomCachePath = nil
+	if moved, err := cache.MigrateLayout(LayoutFlat); err != nil || moved != 1 {
+		t.Fatalf("MigrateLayout(flat) = %d, %v, want 1, nil", moved, err)
+	}
+	if _, err := os.Stat(flatPath); err != nil {
+		t.Fatalf("expected file back at %q: %v", flatPath, err)
+	}
+	if _, err := os.Stat(filepath.Dir(shardedPath)); !os.IsNotExist(err) {
+		t.Fatalf("expected shard directory to be removed, stat error = %v", err)
+	}
+}
+
+func TestGetFilesInCacheDirectorySkipsRootFiles(t *testing.T) {
+	cache := newTestFSCache(t)
+	if _, err := cache.MigrateLayout(LayoutFlat); err != nil {
+		t.Fatalf("MigrateLayout() error = %v", err)
+	}
+
+	files, err := cache.getFilesInCacheDirectory()
+	if err != nil {
+		t.Fatalf("getFilesInCacheDirectory() error = %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("getFilesInCacheDirectory() = %v, want no files", files)
+	}
+}
@@ -0,0 +1,206 @@
+package fscache
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort orders supported by ListFiles.
+const (
+	ListSortPath       = "path"
+	ListSortSize       = "size"
+	ListSortLastAccess = "last_access"
+)
+
+// ListFilesOptions selects, orders and paginates the files returned by
+// ListFiles.
+type ListFilesOptions struct {
+	Domain     string // Only return files of this domain, empty = all domains
+	Search     string // Only return files whose path contains this text (case-insensitive)
+	SortBy     string // ListSortPath (default), ListSortSize or ListSortLastAccess
+	Descending bool   // Reverse the sort order
+	Offset     int    // Number of matching files to skip
+	Limit      int    // Maximum number of files to return, 0 = unlimited
+}
+
+// CachedFile describes a file stored in the cache.
+type CachedFile struct {
+	URL          string
+	Domain       string
+	Path         string
+	Size         int64
+	LastAccessed time.Time
+	LastChecked  time.Time
+	Hits         uint64
+	Pinned       bool
+	Missing      bool // Recorded in the metadata, but no longer on disk
+}
+
+// FileList is a page of cached files returned by ListFiles.
+type FileList struct {
+	Files   []CachedFile
+	Total   int      // Number of files matching the filters
+	Domains []string // All domains with cached files, sorted
+}
+
+// ListFiles returns the files stored in the cache matching the given options.
+// Files are selected and sorted by the sizes recorded in the metadata, only
+// the files of the returned page are looked up on disk. Files which no longer
+// exist are marked as Missing instead of being skipped, so the page boundaries
+// stay stable.
+func (c *FSCache) ListFiles(opts ListFilesOptions) (FileList, error) {
+	entries, err := c.collectAccessCacheRecords()
+	if err != nil {
+		return FileList{}, err
+	}
+
+	search := strings.ToLower(opts.Search)
+	seen := make(map[string]struct{}, len(entries))
+	domains := map[string]struct{}{}
+	files := make([]CachedFile, 0, len(entries))
+
+	for _, record := range entries {
+		if record.markedForDeletion {
+			continue
+		}
+
+		entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
+		localPath := c.buildLocalPath(entry.URL)
+		if _, ok := seen[localPath]; ok {
+			continue
+		}
+		seen[localPath] = struct{}{}
+
+		size, ok := recordedSize(entry, localPath)
+		if !ok {
+			continue
+		}
+
+		domains[record.domain] = struct{}{}
+		if opts.Domain != "" && !strings.EqualFold(record.domain, opts.Domain) {
+			continue
+		}
+		if search != "" && !strings.Contains(strings.ToLower(record.path), search) {
+			continue
+		}
+
+		files = append(files, CachedFile{
+			URL:          entry.URL.String(),
+			Domain:       record.domain,
+			Path:         record.path,
+			Size:         size,
+			LastAccessed: entry.LastAccessed,
+			LastChecked:  entry.LastChecked,
+			Hits:         entry.Hits,
+			Pinned:       record.pinned,
+		})
+	}
+
+	sortCachedFiles(files, opts.SortBy, opts.Descending)
+
+	list := FileList{
+		Total:   len(files),
+		Domains: make([]string, 0, len(domains)),
+	}
+	for domain := range domains {
+		list.Domains = append(list.Domains, domain)
+	}
+	sort.Strings(list.Domains)
+
+	start := min(max(opts.Offset, 0), len(files))
+	end := len(files)
+	if opts.Limit > 0 {
+		end = min(start+opts.Limit, end)
+	}
+	list.Files = files[start:end]
+	for i, file := range list.Files {
+		if size, ok := c.cachedFileSize(file); ok {
+			list.Files[i].Size = size
+		} else {
+			list.Files[i].Missing = true
+		}
+	}
+
+	return list, nil
+}
+
+// existingCachedFiles returns up to limit files of files which exist on disk,
+// 0 returns all. The sizes are taken from the files.
+func (c *FSCache) existingCachedFiles(files []CachedFile, limit int) []CachedFile {
+	result := make([]CachedFile, 0, min(len(files), max(limit, 0)))
+	for _, file := range files {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+
+		size, ok := c.cachedFileSize(file)
+		if !ok {
+			continue
+		}
+		file.Size = size
+		result = append(result, file)
+	}
+	return result
+}
+
+// cachedFileSize returns the size of file on disk, false if it doesn't exist.
+func (c *FSCache) cachedFileSize(file CachedFile) (int64, bool) {
+	fileURL, err := url.Parse(file.URL)
+	if err != nil {
+		return 0, false
+	}
+	info, err := os.Stat(c.buildLocalPath(fileURL))
+	if err != nil || info.IsDir() {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// recordedSize returns the size of a cached file recorded in its metadata
+// entry. Records written before sizes were tracked have no size, their file is
+// looked up on disk. false is returned if that file doesn't exist.
+func recordedSize(entry AccessEntry, localPath string) (int64, bool) {
+	if entry.Size > 0 {
+		return entry.Size, true
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil || info.IsDir() {
+		return 0, false
+	}
+	return info.Size(), true
+}
+
+// sortCachedFiles sorts files by the given order. Files which compare equal
+// are ordered by domain and path, so pagination is stable.
+func sortCachedFiles(files []CachedFile, sortBy string, descending bool) {
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if descending {
+			a, b = b, a
+		}
+
+		switch sortBy {
+		case ListSortSize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case ListSortLastAccess:
+			if !a.LastAccessed.Equal(b.LastAccessed) {
+				return a.LastAccessed.Before(b.LastAccessed)
+			}
+		}
+		return cachedFileByPath(a, b)
+	})
+}
+
+// cachedFileByPath orders files by domain and path.
+func cachedFileByPath(a, b CachedFile) bool {
+	if a.Domain != b.Domain {
+		return a.Domain < b.Domain
+	}
+	return a.Path < b.Path
+}
@@ -0,0 +1,196 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addCachedTestFile stores a file of the given size together with its access
+// metadata in the cache.
+func addCachedTestFile(t *testing.T, cache *FSCache, rawURL string, size int, lastAccessed time.Time, hits uint64) {
+	t.Helper()
+
+	u := mustParseURL(t, rawURL)
+	localPath := cache.buildLocalPath(u)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(strings.Repeat("x", size)), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	entry := AccessEntry{URL: u, LastAccessed: lastAccessed, Size: int64(size), Hits: hits}
+	if err := cache.Set(DetermineProtocolFromURL(u), u.Host, u.Path, entry); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	cache := newTestFSCache(t)
+	now := time.Now()
+
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/dists/stable/Release", 30, now.Add(-time.Hour), 4)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/a/a.deb", 100, now.Add(-2*time.Hour), 1)
+	addCachedTestFile(t, cache, "https://archive.ubuntu.com/ubuntu/pool/main/b/b.deb", 50, now, 0)
+
+	// Metadata without a file on disk is not listed.
+	missing := mustParseURL(t, "http://deb.debian.org/debian/pool/main/c/c.deb")
+	if err := cache.Set(0, missing.Host, missing.Path, AccessEntry{URL: missing}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	paths := func(files []CachedFile) []string {
+		result := make([]string, len(files))
+		for i, file := range files {
+			result[i] = file.Path
+		}
+		return result
+	}
+
+	tcs := []struct {
+		name  string
+		opts  ListFilesOptions
+		total int
+		want  []string
+	}{
+		{"all by path", ListFilesOptions{}, 3, []string{"/ubuntu/pool/main/b/b.deb", "/debian/dists/stable/Release", "/debian/pool/main/a/a.deb"}},
+		{"domain filter", ListFilesOptions{Domain: "deb.debian.org"}, 2, []string{"/debian/dists/stable/Release", "/debian/pool/main/a/a.deb"}},
+		{"search", ListFilesOptions{Search: "POOL"}, 2, []string{"/ubuntu/pool/main/b/b.deb", "/debian/pool/main/a/a.deb"}},
+		{"size descending", ListFilesOptions{SortBy: ListSortSize, Descending: true}, 3, []string{"/debian/pool/main/a/a.deb", "/ubuntu/pool/main/b/b.deb", "/debian/dists/stable/Release"}},
+		{"last access", ListFilesOptions{SortBy: ListSortLastAccess}, 3, []string{"/debian/pool/main/a/a.deb", "/debian/dists/stable/Release", "/ubuntu/pool/main/b/b.deb"}},
+		{"paginated", ListFilesOptions{SortBy: ListSortSize, Offset: 1, Limit: 1}, 3, []string{"/ubuntu/pool/main/b/b.deb"}},
+		{"offset beyond end", ListFilesOptions{Offset: 10, Limit: 5}, 3, []string{}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			list, err := cache.ListFiles(tc.opts)
+			if err != nil {
+				t.Fatalf("ListFiles() error = %v", err)
+			}
+			if list.Total != tc.total {
+				t.Fatalf("Total = %d, want %d", list.Total, tc.total)
+			}
+			if got := paths(list.Files); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Fatalf("paths = %v, want %v", got, tc.want)
+			}
+			if strings.Join(list.Domains, ",") != "archive.ubuntu.com,deb.debian.org" {
+				t.Fatalf("Domains = %v", list.Domains)
+			}
+		})
+	}
+
+	list, err := cache.ListFiles(ListFilesOptions{Search: "Release"})
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if len(list.Files) != 1 || list.Files[0].Size != 30 || list.Files[0].Hits != 4 || list.Files[0].URL != "http://deb.debian.org/debian/dists/stable/Release" {
+		t.Fatalf("Files = %+v", list.Files)
+	}
+}
+
+func TestListFilesMarksRemovedFiles(t *testing.T) {
+	cache := newTestFSCache(t)
+	now := time.Now()
+
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/a/a.deb", 300, now, 0)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/b/b.deb", 200, now, 0)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/c/c.deb", 100, now, 0)
+
+	// The metadata still records the size of the removed file.
+	removed := mustParseURL(t, "http://deb.debian.org/debian/pool/main/a/a.deb")
+	if err := os.Remove(cache.buildLocalPath(removed)); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	// The removed file keeps its place, so no file moves to another page.
+	first, err := cache.ListFiles(ListFilesOptions{SortBy: ListSortSize, Descending: true, Limit: 2})
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if first.Total != 3 || len(first.Files) != 2 || first.Files[0].Path != "/debian/pool/main/a/a.deb" || first.Files[1].Path != "/debian/pool/main/b/b.deb" {
+		t.Fatalf("first page = %+v, want a.deb and b.deb of 3 files", first)
+	}
+	if !first.Files[0].Missing || first.Files[1].Missing {
+		t.Fatalf("Missing = %v, %v, want only a.deb to be missing", first.Files[0].Missing, first.Files[1].Missing)
+	}
+
+	second, err := cache.ListFiles(ListFilesOptions{SortBy: ListSortSize, Descending: true, Offset: 2, Limit: 2})
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	if len(second.Files) != 1 || second.Files[0].Path != "/debian/pool/main/c/c.deb" || second.Files[0].Missing {
+		t.Fatalf("second page = %+v, want c.deb", second.Files)
+	}
+}
+
+func TestLargestFiles(t *testing.T) {
+	cache := newTestFSCache(t)
+	now := time.Now()
+
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/a/a.deb", 100, now, 0)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/b/b.deb", 10, now, 0)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/c/c.deb", 50, now, 0)
+	addCachedTestFile(t, cache, "https://archive.ubuntu.com/ubuntu/pool/main/d/d.deb", 300, now, 0)
+
+	sizes := func(files []CachedFile) []int64 {
+		result := make([]int64, len(files))
+		for i, file := range files {
+			result[i] = file.Size
+		}
+		return result
+	}
+
+	files, total, err := cache.LargestFiles(2)
+	if err != nil {
+		t.Fatalf("LargestFiles() error = %v", err)
+	}
+	if total != 4 || !slices.Equal(sizes(files), []int64{300, 100}) {
+		t.Fatalf("LargestFiles(2) = %v of %d files, want [300 100] of 4", sizes(files), total)
+	}
+
+	// A scan with at least as many files is reused.
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/e/e.deb", 200, now, 0)
+	if files, _, _ := cache.LargestFiles(1); !slices.Equal(sizes(files), []int64{300}) {
+		t.Fatalf("LargestFiles(1) = %v, want [300]", sizes(files))
+	}
+	files, total, err = cache.LargestFiles(3)
+	if err != nil {
+		t.Fatalf("LargestFiles() error = %v", err)
+	}
+	if total != 5 || !slices.Equal(sizes(files), []int64{300, 200, 100}) {
+		t.Fatalf("LargestFiles(3) = %v of %d files, want [300 200 100] of 5", sizes(files), total)
+	}
+}
+
+func TestLargestFilesByDomain(t *testing.T) {
+	cache := newTestFSCache(t)
+	now := time.Now()
+
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/a/a.deb", 100, now, 0)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/b/b.deb", 10, now, 0)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/c/c.deb", 50, now, 0)
+	addCachedTestFile(t, cache, "https://archive.ubuntu.com/ubuntu/pool/main/d/d.deb", 300, now, 0)
+
+	usages, err := cache.LargestFilesByDomain(2)
+	if err != nil {
+		t.Fatalf("LargestFilesByDomain() error = %v", err)
+	}
+	if len(usages) != 2 {
+		t.Fatalf("LargestFilesByDomain() returned %d domains, want 2", len(usages))
+	}
+
+	if usages[0].Domain != "archive.ubuntu.com" || usages[0].Files != 1 || usages[0].Size != 300 {
+		t.Fatalf("first domain = %+v, want archive.ubuntu.com with 1 file and 300 bytes", usages[0])
+	}
+	debian := usages[1]
+	if debian.Domain != "deb.debian.org" || debian.Files != 3 || debian.Size != 160 {
+		t.Fatalf("second domain = %+v, want deb.debian.org with 3 files and 160 bytes", debian)
+	}
+	if len(debian.Largest) != 2 || debian.Largest[0].Size != 100 || debian.Largest[1].Size != 50 {
+		t.Fatalf("largest files of deb.debian.org = %+v, want the files with 100 and 50 bytes", debian.Largest)
+	}
+}
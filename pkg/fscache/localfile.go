@@ -3,9 +3,12 @@ package fscache
 import (
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
-// DeleteFile deletes a file from the cache including references in the metadata.
+// DeleteFile deletes a file from the cache including references in the
+// metadata. Directories left empty are removed up to the cache directory.
 func (c *FSCache) DeleteFile(file *url.URL) error {
 	// Get the local path of the file
 	localPath := c.buildLocalPath(file)
@@ -16,6 +19,7 @@ func (c *FSCache) DeleteFile(file *url.URL) error {
 		if os.IsNotExist(err) {
 			// File does not exist, delete the metadata entry anyway.
 			c.Delete(DetermineProtocolFromURL(file), file.Host, file.Path)
+			c.removeEmptyParents(filepath.Dir(localPath))
 			return nil
 		}
 		return err
@@ -23,6 +27,32 @@ func (c *FSCache) DeleteFile(file *url.URL) error {
 
 	// Delete the file metadata entry.
 	c.Delete(DetermineProtocolFromURL(file), file.Host, file.Path)
+	c.removeEmptyParents(filepath.Dir(localPath))
 
 	return nil
 }
+
+// removeEmptyParents removes dir and its parent directories as long as they
+// are empty, stopping below the cache directory. Removing a directory which
+// still holds files or metadata fails, which ends the walk.
+func (c *FSCache) removeEmptyParents(dir string) {
+	root := filepath.Clean(c.CachePath)
+	for dir = filepath.Clean(dir); strings.HasPrefix(dir, root+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// createCacheFile creates the file at path. Its directory is created again if
+// it was removed as empty after a delete since the download started.
+func createCacheFile(path string) (*os.File, error) {
+	file, err := os.Create(path)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		file, err = os.Create(path)
+	}
+	return file, err
+}
@@ -1,6 +1,7 @@
 package fscache
 
 import (
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
@@ -74,3 +75,62 @@ func TestDeleteFileReturnsUnexpectedRemoveError(t *testing.T) {
 		t.Fatalf("expected metadata entry to remain when delete fails")
 	}
 }
+
+func TestDeleteFileRemovesEmptyParentDirectories(t *testing.T) {
+	cache := newTestFSCache(t)
+	first := mustParseURL(t, "http://deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb")
+	second := mustParseURL(t, "http://deb.debian.org/debian/pool/main/h/hello/hello_1.1_amd64.deb")
+	other := mustParseURL(t, "http://deb.debian.org/debian/dists/stable/InRelease")
+
+	for _, u := range []*url.URL{first, second, other} {
+		localPath := cache.buildLocalPath(u)
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			t.Fatalf("failed creating parent directory: %v", err)
+		}
+		if err := os.WriteFile(localPath, []byte("payload"), 0o644); err != nil {
+			t.Fatalf("failed writing cached file: %v", err)
+		}
+		if err := cache.Set(0, u.Host, u.Path, AccessEntry{URL: u}); err != nil {
+			t.Fatalf("Set() returned error: %v", err)
+		}
+	}
+	cache.flushAccessCache()
+
+	dir := filepath.Dir(cache.buildLocalPath(first))
+	if err := cache.DeleteFile(first); err != nil {
+		t.Fatalf("DeleteFile() returned error: %v", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("directory with another cached file was removed: %v", err)
+	}
+
+	if err := cache.DeleteFile(second); err != nil {
+		t.Fatalf("DeleteFile() returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cache.CachePath, "deb.debian.org", "debian", "pool")); !os.IsNotExist(err) {
+		t.Fatalf("expected empty pool directories to be removed, stat err=%v", err)
+	}
+	if _, err := os.Stat(cache.buildLocalPath(other)); err != nil {
+		t.Fatalf("other cached file was removed: %v", err)
+	}
+
+	if err := cache.DeleteFile(other); err != nil {
+		t.Fatalf("DeleteFile() returned error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cache.CachePath, "deb.debian.org")); !os.IsNotExist(err) {
+		t.Fatalf("expected empty host directory to be removed, stat err=%v", err)
+	}
+	if _, err := os.Stat(cache.CachePath); err != nil {
+		t.Fatalf("cache directory was removed: %v", err)
+	}
+}
+
+func TestCreateCacheFileRecreatesRemovedDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "host", "pool", "pkg.deb.partial")
+
+	file, err := createCacheFile(path)
+	if err != nil {
+		t.Fatalf("createCacheFile() returned error: %v", err)
+	}
+	_ = file.Close()
+}
@@ -0,0 +1,73 @@
+package fscache
+
+import (
+	"time"
+)
+
+// LockWaitOptions configures how a cache miss waits while another request
+// downloads or serves the same file.
+type LockWaitOptions struct {
+	// Retries is the number of attempts to take the download lock after the
+	// first one, afterwards the request fails with 500. 0 fails at once.
+	Retries int
+	// Interval is the longest time between two attempts. Releasing the lock
+	// of the file ends the wait earlier.
+	Interval time.Duration
+}
+
+// DefaultLockWaitOptions returns the lock wait options used if none are set.
+func DefaultLockWaitOptions() LockWaitOptions {
+	return LockWaitOptions{
+		Retries:  25,
+		Interval: time.Second,
+	}
+}
+
+// SetLockWaitOptions sets how cache misses wait for other requests of the
+// same file. It has to be called before requests are served.
+func (c *FSCache) SetLockWaitOptions(options LockWaitOptions) {
+	c.lockWait = options
+}
+
+// lockReleased returns a channel which is closed once a read or write lock of
+// the file is released.
+func (c *FSCache) lockReleased(protocol int, domain, path string) <-chan struct{} {
+	key := c.lockKey(protocol, domain, path)
+
+	c.lockWaitersMux.Lock()
+	defer c.lockWaitersMux.Unlock()
+
+	released, ok := c.lockWaiters[key]
+	if !ok {
+		if c.lockWaiters == nil {
+			c.lockWaiters = make(map[string]chan struct{})
+		}
+		released = make(chan struct{})
+		c.lockWaiters[key] = released
+	}
+	return released
+}
+
+// notifyLockReleased wakes the requests waiting for a lock of the file.
+func (c *FSCache) notifyLockReleased(protocol int, domain, path string) {
+	key := c.lockKey(protocol, domain, path)
+
+	c.lockWaitersMux.Lock()
+	defer c.lockWaitersMux.Unlock()
+
+	if released, ok := c.lockWaiters[key]; ok {
+		close(released)
+		delete(c.lockWaiters, key)
+	}
+}
+
+// waitForLockRelease blocks until released is closed or interval passed.
+func waitForLockRelease(released <-chan struct{}, interval time.Duration) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	select {
+	case <-released:
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,86 @@
+package fscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockReleasedIsClosedOnRelease(t *testing.T) {
+	cache := newTestFSCache(t)
+	protocol := DetermineProtocolFromURL(mustParseURL(t, "https://example.com/"))
+
+	if err := cache.CreateWriteLock(protocol, "example.com", "/dists/stable/Release"); err != nil {
+		t.Fatalf("CreateWriteLock() error = %v", err)
+	}
+	released := cache.lockReleased(protocol, "example.com", "/dists/stable/Release")
+	other := cache.lockReleased(protocol, "example.com", "/dists/stable/InRelease")
+
+	cache.DeleteWriteLock(protocol, "example.com", "/dists/stable/Release")
+
+	select {
+	case <-released:
+	default:
+		t.Fatalf("expected release channel to be closed")
+	}
+	select {
+	case <-other:
+		t.Fatalf("expected release channel of another file to stay open")
+	default:
+	}
+}
+
+func TestServeGETRequestCacheMissWakesOnLockRelease(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.SetLockWaitOptions(LockWaitOptions{Retries: 3, Interval: time.Minute})
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/dists/stable/Release", nil)
+	protocol := DetermineProtocolFromURL(req.URL)
+	localPath := cache.buildLocalPath(req.URL)
+
+	if err := cache.CreateWriteLock(protocol, req.URL.Host, req.URL.Path); err != nil {
+		t.Fatalf("CreateWriteLock() error = %v", err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = os.MkdirAll(filepath.Dir(localPath), 0o755)
+		_ = os.WriteFile(localPath, []byte("release-data"), 0o644)
+		cache.DeleteWriteLock(protocol, req.URL.Host, req.URL.Path)
+	}()
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	cache.serveGETRequestCacheMiss(req, rr, 0)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("request waited %v, expected it to end on release", elapsed)
+	}
+}
+
+func TestServeGETRequestCacheMissWithoutRetries(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.SetLockWaitOptions(LockWaitOptions{Retries: 0, Interval: time.Minute})
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/dists/stable/InRelease", nil)
+	protocol := DetermineProtocolFromURL(req.URL)
+
+	if err := cache.CreateWriteLock(protocol, req.URL.Host, req.URL.Path); err != nil {
+		t.Fatalf("CreateWriteLock() error = %v", err)
+	}
+	defer cache.DeleteWriteLock(protocol, req.URL.Host, req.URL.Path)
+
+	waited := false
+	rr := httptest.NewRecorder()
+	cache.serveGETRequestCacheMissWithSleep(req, rr, 0, func(<-chan struct{}, time.Duration) { waited = true })
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	if waited {
+		t.Fatalf("expected request to fail without waiting")
+	}
+}
@@ -0,0 +1,153 @@
+package fscache
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+	"unicode"
+)
+
+// ManifestEntry describes a cached file in a cache manifest. Manifests are
+// used to seed a cache from another cache.
+type ManifestEntry struct {
+	URL          string    `json:"url"`
+	Size         int64     `json:"size"`
+	SHA256       string    `json:"sha256,omitempty"`
+	LastModified time.Time `json:"last_modified,omitzero"`
+}
+
+// ExportManifest writes a manifest of all cached files to w as NDJSON, one
+// ManifestEntry per line. Missing SHA256 hashes are calculated and stored in
+// the cache metadata.
+func (c *FSCache) ExportManifest(w io.Writer) error {
+	entries, err := c.collectAccessCacheRecords()
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	seen := make(map[string]struct{}, len(entries))
+
+	for _, record := range entries {
+		if record.markedForDeletion {
+			continue
+		}
+
+		entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
+		localPath := c.buildLocalPath(entry.URL)
+		if _, ok := seen[localPath]; ok {
+			continue
+		}
+		seen[localPath] = struct{}{}
+
+		info, err := os.Stat(localPath)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		hash := entry.SHA256
+		if hash == "" {
+			hash, err = sha256File(localPath)
+			if err != nil {
+				continue
+			}
+			_ = c.SetSHA256(record.protocol, record.domain, record.path, hash)
+		}
+
+		lastModified := entry.RemoteLastModified
+		if lastModified.IsZero() {
+			lastModified = info.ModTime()
+		}
+
+		if err := encoder.Encode(ManifestEntry{
+			URL:          entry.URL.String(),
+			Size:         info.Size(),
+			SHA256:       hash,
+			LastModified: lastModified.UTC(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadManifest parses a manifest written by ExportManifest. Besides NDJSON, a
+// JSON array of entries is accepted. Entries without a valid HTTP(S) URL are
+// rejected.
+func ReadManifest(r io.Reader) ([]ManifestEntry, error) {
+	reader := bufio.NewReader(r)
+
+	// Skip leading whitespace to detect the format.
+	var first []byte
+	for {
+		var err error
+		first, err = reader.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !unicode.IsSpace(rune(first[0])) {
+			break
+		}
+		_, _ = reader.Discard(1)
+	}
+
+	var entries []ManifestEntry
+	decoder := json.NewDecoder(reader)
+
+	if first[0] == '[' {
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("invalid manifest: %w", err)
+		}
+	} else {
+		for {
+			var entry ManifestEntry
+			err := decoder.Decode(&entry)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid manifest entry %d: %w", len(entries)+1, err)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	for i, entry := range entries {
+		parsed, err := url.Parse(entry.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q in manifest entry %d", entry.URL, i+1)
+		}
+	}
+
+	return entries, nil
+}
+
+// HasManifestEntry reports if the file of the manifest entry is already
+// cached. If the entry carries a SHA256 hash, the cached file must match it,
+// otherwise the size is compared.
+func (c *FSCache) HasManifestEntry(entry ManifestEntry) bool {
+	parsed, err := url.Parse(entry.URL)
+	if err != nil {
+		return false
+	}
+
+	info, err := os.Stat(c.buildLocalPath(parsed))
+	if err != nil || info.IsDir() || info.Size() != entry.Size {
+		return false
+	}
+	if entry.SHA256 == "" {
+		return true
+	}
+
+	hash, err := sha256File(c.buildLocalPath(parsed))
+	return err == nil && hash == entry.SHA256
+}
@@ -0,0 +1,105 @@
+package fscache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportManifest(t *testing.T) {
+	cache := newTestFSCache(t)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/a/a.deb", 10, time.Now(), 0)
+	addCachedTestFile(t, cache, "https://archive.ubuntu.com/ubuntu/dists/noble/InRelease", 5, time.Now(), 0)
+
+	var buf bytes.Buffer
+	if err := cache.ExportManifest(&buf); err != nil {
+		t.Fatalf("ExportManifest() error = %v", err)
+	}
+	if lines := strings.Count(buf.String(), "\n"); lines != 2 {
+		t.Fatalf("ExportManifest() wrote %d lines, want 2:\n%s", lines, buf.String())
+	}
+
+	entries, err := ReadManifest(&buf)
+	if err != nil {
+		t.Fatalf("ReadManifest() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("ReadManifest() returned %d entries, want 2", len(entries))
+	}
+
+	sum := sha256.Sum256([]byte(strings.Repeat("x", 10)))
+	for _, entry := range entries {
+		if entry.URL != "http://deb.debian.org/debian/pool/main/a/a.deb" {
+			continue
+		}
+		if entry.Size != 10 || entry.SHA256 != hex.EncodeToString(sum[:]) || entry.LastModified.IsZero() {
+			t.Fatalf("unexpected manifest entry %+v", entry)
+		}
+		if !cache.HasManifestEntry(entry) {
+			t.Fatalf("HasManifestEntry(%+v) = false, want true", entry)
+		}
+
+		// The calculated hash is stored in the metadata.
+		if hash, _ := cache.GetSHA256(0, "deb.debian.org", "/debian/pool/main/a/a.deb"); hash != entry.SHA256 {
+			t.Fatalf("stored SHA256 = %q, want %q", hash, entry.SHA256)
+		}
+		return
+	}
+	t.Fatalf("manifest is missing the deb file: %+v", entries)
+}
+
+func TestReadManifest(t *testing.T) {
+	ndjson := `{"url":"http://deb.debian.org/debian/pool/main/a/a.deb","size":10}
+{"url":"http://deb.debian.org/debian/pool/main/b/b.deb","size":20}
+`
+	array := `  [{"url":"http://deb.debian.org/debian/pool/main/a/a.deb","size":10}]`
+
+	for input, want := range map[string]int{ndjson: 2, array: 1, "": 0, " \n": 0} {
+		entries, err := ReadManifest(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("ReadManifest(%q) error = %v", input, err)
+		}
+		if len(entries) != want {
+			t.Fatalf("ReadManifest(%q) returned %d entries, want %d", input, len(entries), want)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"url":"ftp://deb.debian.org/debian/a.deb"}`,
+		`{"url":"/debian/a.deb"}`,
+		`{"url":`,
+		`[{"url":"http://deb.debian.org/a.deb"}`,
+	} {
+		if _, err := ReadManifest(strings.NewReader(invalid)); err == nil {
+			t.Fatalf("ReadManifest(%q) expected error", invalid)
+		}
+	}
+}
+
+func TestHasManifestEntry(t *testing.T) {
+	cache := newTestFSCache(t)
+	addCachedTestFile(t, cache, "http://deb.debian.org/debian/pool/main/a/a.deb", 10, time.Now(), 0)
+
+	sum := sha256.Sum256([]byte(strings.Repeat("x", 10)))
+	tcs := []struct {
+		name  string
+		entry ManifestEntry
+		want  bool
+	}{
+		{"matching hash", ManifestEntry{URL: "http://deb.debian.org/debian/pool/main/a/a.deb", Size: 10, SHA256: hex.EncodeToString(sum[:])}, true},
+		{"size only", ManifestEntry{URL: "http://deb.debian.org/debian/pool/main/a/a.deb", Size: 10}, true},
+		{"different hash", ManifestEntry{URL: "http://deb.debian.org/debian/pool/main/a/a.deb", Size: 10, SHA256: strings.Repeat("0", 64)}, false},
+		{"different size", ManifestEntry{URL: "http://deb.debian.org/debian/pool/main/a/a.deb", Size: 11}, false},
+		{"missing", ManifestEntry{URL: "http://deb.debian.org/debian/pool/main/b/b.deb", Size: 10}, false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := cache.HasManifestEntry(tc.entry); got != tc.want {
+				t.Fatalf("HasManifestEntry() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
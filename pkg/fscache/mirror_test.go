@@ -0,0 +1,53 @@
+package fscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// testMirror is an upstream server for cache tests. It is reachable under two
+// hostnames and counts the requests it received.
+type testMirror struct {
+	URL      string // base URL using 127.0.0.1
+	AltURL   string // base URL of the same server using localhost
+	requests atomic.Int64
+}
+
+// newTestMirror starts a testMirror serving payload for every path.
+func newTestMirror(t *testing.T, payload string) *testMirror {
+	return startTestMirror(t, func(string) ([]byte, bool) {
+		return []byte(payload), true
+	})
+}
+
+// newTestMirrorFiles starts a testMirror serving files by URL path and
+// answering other requests with 404.
+func newTestMirrorFiles(t *testing.T, files map[string][]byte) *testMirror {
+	return startTestMirror(t, func(path string) ([]byte, bool) {
+		data, ok := files[path]
+		return data, ok
+	})
+}
+
+func startTestMirror(t *testing.T, lookup func(path string) ([]byte, bool)) *testMirror {
+	t.Helper()
+
+	mirror := &testMirror{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirror.requests.Add(1)
+		data, ok := lookup(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(upstream.Close)
+
+	port := mustParseURL(t, upstream.URL).Port()
+	mirror.URL = "http://127.0.0.1:" + port
+	mirror.AltURL = "http://localhost:" + port
+	return mirror
+}
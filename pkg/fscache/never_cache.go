@@ -0,0 +1,111 @@
+package fscache
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// PathPatterns matches request URLs against glob patterns and regular
+// expressions. The zero value matches nothing.
+type PathPatterns struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// ParsePathPatterns compiles patterns. Patterns starting with "~" are regular
+// expressions matched against the full URL, e.g. "~^https://vendor\.example/token/".
+// Other patterns are globs (see path.Match) matched against the URL path, e.g.
+// "/debian/dists/*/InRelease". Globs without "/" match the file name, e.g.
+// "InRelease" or "*.token".
+func ParsePathPatterns(patterns []string) (PathPatterns, error) {
+	var p PathPatterns
+	for _, pattern := range patterns {
+		if expr, ok := strings.CutPrefix(pattern, "~"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return PathPatterns{}, fmt.Errorf("invalid regular expression %q: %w", expr, err)
+			}
+			p.regexps = append(p.regexps, re)
+			continue
+		}
+		if pattern == "" {
+			return PathPatterns{}, fmt.Errorf("empty pattern")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return PathPatterns{}, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+		p.globs = append(p.globs, pattern)
+	}
+	return p, nil
+}
+
+// Match reports if u matches one of the patterns.
+func (p PathPatterns) Match(u *url.URL) bool {
+	for _, pattern := range p.globs {
+		name := u.Path
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(u.Path)
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(u.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetNeverCache sets the patterns of requests which are always fetched from
+// the upstream server and never stored. It has to be called before requests
+// are served.
+func (c *FSCache) SetNeverCache(patterns PathPatterns) {
+	c.neverCache = patterns
+}
+
+// serveUncachedRequest passes r to the upstream server and the response to the
+// client without reading or writing the cache.
+func (c *FSCache) serveUncachedRequest(r *http.Request, w http.ResponseWriter) {
+	c.addCacheDebug(w, "result=bypass (never_cache)")
+	if c.rejectDuringCooldown(w, r) {
+		return
+	}
+
+	req, err := c.newCacheMissUpstreamRequest(r)
+	if err != nil {
+		Error(w, r, http.StatusInternalServerError, "upstream_request_failed", "Error creating request")
+		return
+	}
+	req.Method = r.Method
+	req = req.WithContext(r.Context())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		Error(w, r, http.StatusBadGateway, "upstream_unreachable", "Error fetching file")
+		slog.ErrorContext(r.Context(), "Error fetching uncached file", "event", "bypass", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	c.noteUpstreamResponse(r.Context(), r.URL.Host, resp)
+
+	copyResponseHeaders(w.Header(), resp.Header)
+	w.Header().Set("X-Cache", "BYPASS")
+	w.WriteHeader(resp.StatusCode)
+
+	bw, err := io.Copy(responseWriterWithFlush(w), resp.Body)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error streaming uncached file", "event", "bypass", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "bytes", bw, "error", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Served uncached file", "event", "bypass", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "status", resp.StatusCode, "bytes", bw)
+	c.trackRequestAsync(r.Context(), r.URL.Host, false, bw)
+}
@@ -0,0 +1,84 @@
+package fscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestPathPatternsMatch(t *testing.T) {
+	patterns, err := ParsePathPatterns([]string{"InRelease", "/debian/dists/*/main/Contents-*", `~^https://vendor\.example/auth/`})
+	if err != nil {
+		t.Fatalf("ParsePathPatterns() error = %v", err)
+	}
+
+	tcs := []struct {
+		url  string
+		want bool
+	}{
+		{"http://deb.debian.org/debian/dists/bookworm/InRelease", true},
+		{"http://deb.debian.org/debian/dists/bookworm/main/Contents-amd64.gz", true},
+		{"https://vendor.example/auth/token/pool/a.deb", true},
+		{"http://deb.debian.org/debian/dists/bookworm/Release", false},
+		{"http://deb.debian.org/debian/dists/bookworm/main/binary-amd64/Contents-amd64.gz", false},
+		{"http://vendor.example/auth/token/pool/a.deb", false},
+	}
+
+	for _, tc := range tcs {
+		if got := patterns.Match(mustParseURL(t, tc.url)); got != tc.want {
+			t.Errorf("Match(%s) = %v, want %v", tc.url, got, tc.want)
+		}
+	}
+
+	for _, invalid := range [][]string{{"["}, {"~("}, {""}} {
+		if _, err := ParsePathPatterns(invalid); err == nil {
+			t.Errorf("ParsePathPatterns(%q) error = nil, want error", invalid)
+		}
+	}
+}
+
+func TestServeGETRequestNeverCache(t *testing.T) {
+	const payload = "release content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	patterns, err := ParsePathPatterns([]string{"InRelease"})
+	if err != nil {
+		t.Fatalf("ParsePathPatterns() error = %v", err)
+	}
+	cache.SetNeverCache(patterns)
+
+	t.Run("matching", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, mirror.URL+"/debian/dists/bookworm/InRelease", nil)
+		for i := range 2 {
+			rr := httptest.NewRecorder()
+			cache.serveGETRequest(req, rr)
+			if rr.Code != http.StatusOK || rr.Body.String() != payload || rr.Header().Get("X-Cache") != "BYPASS" {
+				t.Fatalf("request %d = %d %q, X-Cache %q, want 200 %q, BYPASS", i, rr.Code, rr.Body.String(), rr.Header().Get("X-Cache"), payload)
+			}
+		}
+		if mirror.requests.Load() != 2 {
+			t.Fatalf("upstream requests = %d, want 2", mirror.requests.Load())
+		}
+		if _, err := os.Stat(cache.buildLocalPath(req.URL)); !os.IsNotExist(err) {
+			t.Fatalf("uncached file was written to disk: %v", err)
+		}
+		if _, ok := cache.Get(0, req.URL.Host, req.URL.Path); ok {
+			t.Fatalf("uncached file has metadata")
+		}
+	})
+
+	t.Run("not matching", func(t *testing.T) {
+		mirror.requests.Store(0)
+		req := httptest.NewRequest(http.MethodGet, mirror.URL+"/debian/dists/bookworm/Release", nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusOK || rr.Header().Get("X-Cache") != "MISS" {
+			t.Fatalf("response = %d, X-Cache %q, want 200, MISS", rr.Code, rr.Header().Get("X-Cache"))
+		}
+		if _, err := os.Stat(cache.buildLocalPath(req.URL)); err != nil {
+			t.Fatalf("expected file to be cached: %v", err)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+package fscache
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// SetParent sets a parent goaptcacher which is asked for files before the
+// upstream server on cache misses, nil disables it. It has to be called before
+// requests are served.
+func (c *FSCache) SetParent(parent *url.URL) {
+	c.parent = parent
+}
+
+// newParentRequest creates the request for r to the parent cache. The target
+// URL is sent in absolute form like to any HTTP proxy, so the parent caches
+// the file under the same URL, also for HTTPS upstream servers.
+func (c *FSCache) newParentRequest(r *http.Request) (*http.Request, error) {
+	req, err := c.newCacheMissUpstreamRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req.URL = &url.URL{Scheme: c.parent.Scheme, Host: c.parent.Host, Opaque: r.URL.String()}
+	req.Host = r.URL.Host
+	if c.parent.User != nil {
+		password, _ := c.parent.User.Password()
+		auth := &http.Request{Header: make(http.Header)}
+		auth.SetBasicAuth(c.parent.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", auth.Header.Get("Authorization"))
+	}
+	return req, nil
+}
+
+// fetchFromParent requests r from the parent cache. If no parent is set, it
+// can't be reached or doesn't answer with the file, false is returned and the
+// file has to be fetched from the upstream server.
+func (c *FSCache) fetchFromParent(r *http.Request) (*http.Response, bool) {
+	if c.parent == nil {
+		return nil, false
+	}
+
+	req, err := c.newParentRequest(r)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error creating parent request", "event", "parent", "host", r.URL.Host, "path", r.URL.Path, "error", err)
+		return nil, false
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Error fetching file from parent cache, using upstream server", "event", "parent", "parent", c.parent.Host, "host", r.URL.Host, "path", r.URL.Path, "error", err)
+		return nil, false
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		slog.WarnContext(r.Context(), "Parent cache didn't return file, using upstream server", "event", "parent", "parent", c.parent.Host, "host", r.URL.Host, "path", r.URL.Path, "status", resp.StatusCode)
+		return nil, false
+	}
+
+	// The request ID of the parent would be added to the one of this request.
+	resp.Header.Del("X-Request-ID")
+	slog.DebugContext(r.Context(), "Fetching file from parent cache", "event", "parent", "parent", c.parent.Host, "host", r.URL.Host, "path", r.URL.Path, "parent_cache", resp.Header.Get("X-Cache"))
+	return resp, true
+}
@@ -0,0 +1,104 @@
+package fscache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServeGETRequestCacheMissUsesParent(t *testing.T) {
+	const payload = "parent-payload"
+	const target = "https://deb.example.org/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	var gotRequestURI, gotHost, gotAuth, gotProxyServer string
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRequestURI = r.RequestURI
+		gotHost = r.Host
+		gotAuth = r.Header.Get("Proxy-Authorization")
+		gotProxyServer = r.Header.Get("X-Proxy-Server")
+		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("X-Request-ID", "parent-id")
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer parent.Close()
+
+	parentURL := mustParseURL(t, parent.URL)
+	parentURL.User = url.UserPassword("child", "secret")
+	cache := newTestFSCache(t)
+	cache.SetParent(parentURL)
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	rr := httptest.NewRecorder()
+	cache.serveGETRequestCacheMiss(req, rr, 0)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != payload {
+		t.Fatalf("response = %d %q, want 200 %q", rr.Code, rr.Body.String(), payload)
+	}
+	if got := rr.Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("X-Cache = %q, want MISS", got)
+	}
+	if got := rr.Header().Values("X-Request-ID"); len(got) != 0 {
+		t.Fatalf("X-Request-ID = %v, want none", got)
+	}
+	if gotRequestURI != target {
+		t.Fatalf("parent request URI = %q, want %q", gotRequestURI, target)
+	}
+	if gotHost != "deb.example.org" {
+		t.Fatalf("parent Host = %q, want deb.example.org", gotHost)
+	}
+	if gotAuth != "Basic Y2hpbGQ6c2VjcmV0" {
+		t.Fatalf("Proxy-Authorization = %q, want basic credentials", gotAuth)
+	}
+	if gotProxyServer == "" {
+		t.Fatalf("expected X-Proxy-Server to be sent to the parent")
+	}
+
+	entry, ok := cache.Get(DetermineProtocolFromURL(req.URL), req.URL.Host, req.URL.Path)
+	if !ok {
+		t.Fatalf("expected metadata entry after download")
+	}
+	if entry.Origin != parentURL.Host {
+		t.Fatalf("entry origin = %q, want %q", entry.Origin, parentURL.Host)
+	}
+}
+
+func TestServeGETRequestCacheMissFallsBackToUpstream(t *testing.T) {
+	const payload = "upstream-payload"
+
+	var parentRequests atomic.Int32
+	parent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parentRequests.Add(1)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}))
+	defer parent.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	cache := newTestFSCache(t)
+	cache.SetParent(mustParseURL(t, parent.URL))
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL+"/debian/pool/main/h/hello/hello_1.0_amd64.deb", nil)
+	rr := httptest.NewRecorder()
+	cache.serveGETRequestCacheMiss(req, rr, 0)
+
+	if rr.Code != http.StatusOK || rr.Body.String() != payload {
+		t.Fatalf("response = %d %q, want 200 %q", rr.Code, rr.Body.String(), payload)
+	}
+	if got := parentRequests.Load(); got != 1 {
+		t.Fatalf("parent requests = %d, want 1", got)
+	}
+
+	entry, ok := cache.Get(DetermineProtocolFromURL(req.URL), req.URL.Host, req.URL.Path)
+	if !ok {
+		t.Fatalf("expected metadata entry after download")
+	}
+	if entry.Origin != "" {
+		t.Fatalf("entry origin = %q, want empty", entry.Origin)
+	}
+}
@@ -0,0 +1,82 @@
+package fscache
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// Pin protects the cached file from expiration and from removal after source
+// verification, e.g. a known-good package kept as rollback target. Purging
+// the file still removes it. It returns false if the file isn't cached.
+func (c *FSCache) Pin(protocol int, domain, path string) bool {
+	return c.setPinned(protocol, domain, path, true)
+}
+
+// Unpin removes the protection of Pin. It returns false if the file isn't
+// cached.
+func (c *FSCache) Unpin(protocol int, domain, path string) bool {
+	return c.setPinned(protocol, domain, path, false)
+}
+
+// IsPinned reports whether the cached file is pinned.
+func (c *FSCache) IsPinned(protocol int, domain, path string) bool {
+	record, ok := c.getAccessCacheRecord(protocol, domain, path)
+	if !ok {
+		return false
+	}
+
+	c.accessCacheMux.RLock()
+	defer c.accessCacheMux.RUnlock()
+	return record.pinned
+}
+
+// PinPrefix pins all cached files of domain whose path starts with prefix and
+// returns the number of files. Files cached later are not pinned.
+func (c *FSCache) PinPrefix(protocol int, domain, prefix string) (int, error) {
+	return c.setPinnedPrefix(protocol, domain, prefix, true)
+}
+
+// UnpinPrefix unpins all cached files of domain whose path starts with prefix
+// and returns the number of files.
+func (c *FSCache) UnpinPrefix(protocol int, domain, prefix string) (int, error) {
+	return c.setPinnedPrefix(protocol, domain, prefix, false)
+}
+
+func (c *FSCache) setPinnedPrefix(protocol int, domain, prefix string, pinned bool) (int, error) {
+	records, err := c.collectAccessCacheRecords()
+	if err != nil {
+		return 0, err
+	}
+
+	protocol = c.canonicalProtocol(protocol, domain)
+	count := 0
+	for _, record := range records {
+		if record.protocol != protocol || !strings.EqualFold(record.domain, domain) || !strings.HasPrefix(record.path, prefix) {
+			continue
+		}
+		if c.setPinned(record.protocol, record.domain, record.path, pinned) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (c *FSCache) setPinned(protocol int, domain, path string, pinned bool) bool {
+	record, ok := c.getAccessCacheRecord(protocol, domain, path)
+	if !ok {
+		return false
+	}
+
+	c.accessCacheMux.Lock()
+	changed := record.pinned != pinned
+	record.pinned = pinned
+	if changed {
+		record.dirty = true
+	}
+	c.accessCacheMux.Unlock()
+
+	if changed {
+		slog.Info("Changed pin of cached file", "event", "pin", "host", domain, "path", path, "pinned", pinned)
+	}
+	return true
+}
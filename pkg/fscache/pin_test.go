@@ -0,0 +1,95 @@
+package fscache
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPinnedFileIsNotDeleted(t *testing.T) {
+	const rawURL = "http://deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	cache := newTestFSCache(t)
+	cache.deletionGracePeriod = time.Hour
+	localPath := writeMarkedTestFile(t, cache, rawURL)
+	u := mustParseURL(t, rawURL)
+
+	if !cache.Pin(0, u.Host, u.Path) || !cache.IsPinned(0, u.Host, u.Path) {
+		t.Fatalf("expected file to be pinned")
+	}
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	cache.MarkForDeletion(0, u.Host, u.Path)
+	ageDeletionMark(t, cache, rawURL, 2*time.Hour)
+
+	if deleted, pending, err := cache.DeleteMarkedFiles(); err != nil || deleted != 0 || pending != 1 {
+		t.Fatalf("DeleteMarkedFiles() = %d, %d, %v, want pinned file kept", deleted, pending, err)
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		t.Fatalf("pinned file was removed: %v", err)
+	}
+
+	if !cache.Unpin(0, u.Host, u.Path) {
+		t.Fatalf("expected file to be unpinned")
+	}
+	if deleted, _, err := cache.DeleteMarkedFiles(); err != nil || deleted != 1 {
+		t.Fatalf("DeleteMarkedFiles() = %d, %v, want unpinned file removed", deleted, err)
+	}
+}
+
+func TestPinnedFileIsNotExpired(t *testing.T) {
+	cache := newTestFSCache(t)
+	old := time.Now().AddDate(0, 0, -30)
+	for _, path := range []string{"/debian/pool/main/a/a.deb", "/debian/pool/main/b/b.deb"} {
+		u := mustParseURL(t, "http://deb.debian.org"+path)
+		if err := cache.Set(0, u.Host, u.Path, AccessEntry{URL: u, LastAccessed: old}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	cache.Pin(0, "deb.debian.org", "/debian/pool/main/a/a.deb")
+
+	files, err := cache.GetUnusedFiles(7)
+	if err != nil {
+		t.Fatalf("GetUnusedFiles() error = %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "/debian/pool/main/b/b.deb" {
+		t.Fatalf("GetUnusedFiles() = %v, want only the unpinned file", files)
+	}
+}
+
+func TestPinPrefix(t *testing.T) {
+	cache := newTestFSCache(t)
+	for _, rawURL := range []string{
+		"http://deb.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb",
+		"http://deb.debian.org/debian/pool/main/h/hello/hello_1.1_amd64.deb",
+		"http://deb.debian.org/debian/pool/main/c/curl/curl_8.0_amd64.deb",
+		"http://security.debian.org/debian/pool/main/h/hello/hello_1.0_amd64.deb",
+	} {
+		writeMarkedTestFile(t, cache, rawURL)
+	}
+	cache.flushAccessCache()
+
+	count, err := cache.PinPrefix(0, "deb.debian.org", "/debian/pool/main/h/hello/")
+	if err != nil || count != 2 {
+		t.Fatalf("PinPrefix() = %d, %v, want 2 files", count, err)
+	}
+	if cache.IsPinned(0, "deb.debian.org", "/debian/pool/main/c/curl/curl_8.0_amd64.deb") || cache.IsPinned(0, "security.debian.org", "/debian/pool/main/h/hello/hello_1.0_amd64.deb") {
+		t.Fatalf("files outside the prefix were pinned")
+	}
+
+	// Pins survive a restart.
+	cache.flushAccessCache()
+	record, ok := cache.loadAccessCacheRecord(0, "deb.debian.org", "/debian/pool/main/h/hello/hello_1.1_amd64.deb")
+	if !ok || !record.pinned {
+		t.Fatalf("loaded record = %+v, want pinned", record)
+	}
+
+	if count, err := cache.UnpinPrefix(0, "deb.debian.org", "/debian/pool/main/h/"); err != nil || count != 2 {
+		t.Fatalf("UnpinPrefix() = %d, %v, want 2 files", count, err)
+	}
+	if cache.IsPinned(0, "deb.debian.org", "/debian/pool/main/h/hello/hello_1.0_amd64.deb") {
+		t.Fatalf("expected file to be unpinned")
+	}
+	if cache.Pin(0, "deb.debian.org", "/debian/pool/main/x/x.deb") {
+		t.Fatalf("Pin() of an uncached file = true, want false")
+	}
+}
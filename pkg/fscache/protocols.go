@@ -0,0 +1,53 @@
+package fscache
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// SetEquivalentProtocols sets which domains serve the same content over HTTP
+// and HTTPS. Files of these domains share their metadata and locks for both
+// protocols, so a file fetched over one protocol is a hit for the other, and
+// refreshes prefer HTTPS. Hosts with an explicit port are never treated as
+// equivalent. It has to be called before requests are served.
+func (c *FSCache) SetEquivalentProtocols(match func(domain string) bool) {
+	c.equivalentProtocols = match
+}
+
+// protocolsEquivalent reports if HTTP and HTTPS of domain are the same cache
+// key.
+func (c *FSCache) protocolsEquivalent(domain string) bool {
+	if c.equivalentProtocols == nil {
+		return false
+	}
+	if _, port, err := net.SplitHostPort(domain); err == nil && port != "" {
+		return false
+	}
+	return c.equivalentProtocols(domain)
+}
+
+// canonicalProtocol returns the protocol used in cache keys of domain, HTTPS
+// for domains with equivalent protocols.
+func (c *FSCache) canonicalProtocol(protocol int, domain string) int {
+	if c.protocolsEquivalent(domain) {
+		return 1 // HTTPS
+	}
+	return protocol
+}
+
+// preferHTTPS returns u with the HTTPS scheme if its domain has equivalent
+// protocols, so refreshes are sent over HTTPS.
+func (c *FSCache) preferHTTPS(u *url.URL) *url.URL {
+	if u == nil || u.Scheme != "http" || !c.protocolsEquivalent(u.Host) {
+		return u
+	}
+	upgraded := *u
+	upgraded.Scheme = "https"
+	return &upgraded
+}
+
+// lockKey returns the key of the read and write locks of a file.
+func (c *FSCache) lockKey(protocol int, domain, path string) string {
+	return strconv.Itoa(c.canonicalProtocol(protocol, domain)) + domain + path
+}
@@ -0,0 +1,99 @@
+package fscache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func equivalentExampleCom(domain string) bool {
+	return domain == "example.com"
+}
+
+func TestEquivalentProtocolsShareMetadataAndLocks(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.SetEquivalentProtocols(equivalentExampleCom)
+
+	httpURL := mustParseURL(t, "http://example.com/debian/pool/main/a/a.deb")
+	if err := cache.Set(0, httpURL.Host, httpURL.Path, AccessEntry{URL: httpURL, ETag: `"v1"`}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	entry, ok := cache.Get(1, httpURL.Host, httpURL.Path)
+	if !ok || entry.ETag != `"v1"` {
+		t.Fatalf("Get(https) = %+v, %v, want entry stored over HTTP", entry, ok)
+	}
+	if entry.URL.String() != "https://example.com/debian/pool/main/a/a.deb" {
+		t.Fatalf("URL = %s, want HTTPS", entry.URL)
+	}
+
+	if !cache.CreateExclusiveWriteLock(0, httpURL.Host, httpURL.Path) {
+		t.Fatalf("CreateExclusiveWriteLock(http) failed")
+	}
+	defer cache.DeleteWriteLock(0, httpURL.Host, httpURL.Path)
+	if cache.CreateExclusiveWriteLock(1, httpURL.Host, httpURL.Path) {
+		t.Fatalf("CreateExclusiveWriteLock(https) succeeded while HTTP holds the lock")
+	}
+
+	// Other domains and hosts with explicit port keep separate keys.
+	for _, rawURL := range []string{"http://example.org/debian/pool/main/a/a.deb", "http://example.com:8080/debian/pool/main/a/a.deb"} {
+		u := mustParseURL(t, rawURL)
+		if err := cache.Set(0, u.Host, u.Path, AccessEntry{URL: u}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+		if _, ok := cache.Get(1, u.Host, u.Path); ok {
+			t.Fatalf("Get(https) of %s found the HTTP entry", rawURL)
+		}
+	}
+}
+
+func TestEquivalentProtocolsServeAndRefresh(t *testing.T) {
+	const content = "cached package"
+
+	var requests []*http.Request
+	cache := newTestFSCache(t)
+	cache.SetEquivalentProtocols(equivalentExampleCom)
+	cache.client = &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			requests = append(requests, r)
+			return &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("")), Request: r}, nil
+		}),
+	}
+
+	httpURL := mustParseURL(t, "http://example.com/debian/dists/bookworm/main/binary-amd64/Packages.gz")
+	localPath := cache.buildLocalPath(httpURL)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := cache.Set(0, httpURL.Host, httpURL.Path, AccessEntry{URL: httpURL, ETag: `"v1"`, Size: int64(len(content)), LastChecked: time.Now()}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	// The file cached over HTTP is a hit for HTTPS.
+	rr := httptest.NewRecorder()
+	cache.serveGETRequest(httptest.NewRequest(http.MethodGet, "https://example.com/debian/dists/bookworm/main/binary-amd64/Packages.gz", nil), rr)
+	if rr.Code != http.StatusOK || rr.Body.String() != content || rr.Header().Get("X-Cache") != "HIT" {
+		t.Fatalf("HTTPS response = %d %q, X-Cache %q, want cached file", rr.Code, rr.Body.String(), rr.Header().Get("X-Cache"))
+	}
+	if len(requests) != 0 {
+		t.Fatalf("upstream requests = %d, want 0", len(requests))
+	}
+
+	// Refreshes use HTTPS with the validators of the HTTP download.
+	entry, _ := cache.Get(0, httpURL.Host, httpURL.Path)
+	if _, err := cache.refreshFile(context.Background(), localPath, httpURL, entry); err != nil {
+		t.Fatalf("refreshFile() error = %v", err)
+	}
+	if len(requests) != 1 || requests[0].URL.Scheme != "https" || requests[0].Header.Get("If-None-Match") != `"v1"` {
+		t.Fatalf("refresh requests = %v, want one HTTPS request with If-None-Match", requests)
+	}
+}
@@ -0,0 +1,88 @@
+package fscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamSupportsRanges(t *testing.T) {
+	tcs := []struct {
+		values []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"none"}, false},
+		{[]string{"bytes"}, true},
+		{[]string{"Bytes"}, true},
+		{[]string{"none, bytes"}, true},
+		{[]string{"none", "bytes"}, true},
+	}
+	for _, tc := range tcs {
+		if got := upstreamSupportsRanges(http.Header{"Accept-Ranges": tc.values}); got != tc.want {
+			t.Errorf("upstreamSupportsRanges(%q) = %v, want %v", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestRangesOnMissAndHit(t *testing.T) {
+	const payload = "0123456789"
+	const packagePath = "/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	for _, upstreamRanges := range []bool{true, false} {
+		var rangeRequests atomic.Int64
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "" {
+				rangeRequests.Add(1)
+			}
+			if upstreamRanges {
+				http.ServeContent(w, r, "hello.deb", time.Now(), strings.NewReader(payload))
+				return
+			}
+			_, _ = w.Write([]byte(payload))
+		}))
+		t.Cleanup(upstream.Close)
+		cache := newTestFSCache(t)
+
+		// The miss streams the whole file, so no range support is announced.
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+packagePath, nil)
+		req.Header.Set("Range", "bytes=2-4")
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusOK || rr.Body.String() != payload {
+			t.Fatalf("upstream ranges %v: miss response = %d %q, want 200 %q", upstreamRanges, rr.Code, rr.Body.String(), payload)
+		}
+		if got := rr.Header().Get("Accept-Ranges"); got != "none" {
+			t.Fatalf("upstream ranges %v: miss Accept-Ranges = %q, want none", upstreamRanges, got)
+		}
+		if got := rangeRequests.Load(); got != 0 {
+			t.Fatalf("upstream ranges %v: %d range requests sent upstream, want 0", upstreamRanges, got)
+		}
+
+		u := mustParseURL(t, upstream.URL+packagePath)
+		entry, ok := cache.Get(0, u.Host, u.Path)
+		if !ok || entry.UpstreamRanges != upstreamRanges {
+			t.Fatalf("upstream ranges %v: metadata = %+v, %v", upstreamRanges, entry, ok)
+		}
+
+		// The cached file supports ranges regardless of upstream.
+		rr = httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusPartialContent || rr.Body.String() != "234" {
+			t.Fatalf("upstream ranges %v: hit response = %d %q, want 206 %q", upstreamRanges, rr.Code, rr.Body.String(), "234")
+		}
+		if got := rr.Header().Get("Accept-Ranges"); got != "bytes" {
+			t.Fatalf("upstream ranges %v: hit Accept-Ranges = %q, want bytes", upstreamRanges, got)
+		}
+
+		// The metadata survives a restart.
+		cache.flushAccessCache()
+		reloaded := NewFSCache(cache.CachePath)
+		if entry, ok := reloaded.Get(0, u.Host, u.Path); !ok || entry.UpstreamRanges != upstreamRanges {
+			t.Fatalf("upstream ranges %v: reloaded metadata = %+v, %v", upstreamRanges, entry, ok)
+		}
+	}
+}
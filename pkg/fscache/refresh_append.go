@@ -0,0 +1,193 @@
+package fscache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// appendOverlap is the number of bytes at the end of a cached file which are
+// fetched again by an append refresh to check that the file only grew.
+const appendOverlap = 4096
+
+// SetAppendOnly sets which domains serve large files which only grow, e.g.
+// logs or archives which are appended to. If a cached file of these domains
+// changed and upstream supports byte ranges, a refresh only fetches the new
+// end of the file and appends it; if the old content changed, the whole file
+// is downloaded. It has to be called before requests are served.
+func (c *FSCache) SetAppendOnly(match func(domain string) bool) {
+	c.appendOnlyDomains = match
+}
+
+// isAppendOnly reports if the files of domain are refreshed by appending.
+func (c *FSCache) isAppendOnly(domain string) bool {
+	return c.appendOnlyDomains != nil && c.appendOnlyDomains(domain)
+}
+
+// refreshAppended refreshes the file of an append-only domain by requesting
+// the data after the cached part, starting appendOverlap bytes before its end
+// to check the cached content is still the same. done is false if the file
+// has to be downloaded completely, because upstream doesn't answer with a
+// matching range or the cached content changed.
+func (c *FSCache) refreshAppended(ctx context.Context, generatedName string, localFile *url.URL, lastAccess AccessEntry, expectedSHA256 string) (refreshed, done bool, err error) {
+	if !lastAccess.UpstreamRanges || lastAccess.Size <= 0 {
+		return false, false, nil
+	}
+	if info, err := os.Stat(generatedName); err != nil || info.Size() != lastAccess.Size {
+		return false, false, nil
+	}
+
+	overlap := min(lastAccess.Size, appendOverlap)
+	start := lastAccess.Size - overlap
+
+	req, err := buildRefreshRequest(lastAccess)
+	if err != nil {
+		return false, false, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, true, err
+	}
+	defer resp.Body.Close()
+	c.noteUpstreamResponse(ctx, localFile.Host, resp)
+
+	protocol := DetermineProtocolFromURL(lastAccess.URL)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusNotModified, http.StatusNotFound:
+		c.handleRefreshStatus(ctx, resp.StatusCode, protocol, localFile)
+		return false, true, nil
+	default:
+		// The range was ignored or the file shrank.
+		return false, false, nil
+	}
+
+	first, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || first != start || total <= lastAccess.Size {
+		return false, false, nil
+	}
+
+	// The end of the cached part has to be unchanged.
+	received := make([]byte, overlap)
+	if _, err := io.ReadFull(resp.Body, received); err != nil {
+		return false, true, err
+	}
+	cached := make([]byte, overlap)
+	file, err := os.Open(generatedName)
+	if err != nil {
+		return false, false, nil
+	}
+	_, err = file.ReadAt(cached, start)
+	file.Close()
+	if err != nil || !bytes.Equal(cached, received) {
+		slog.InfoContext(ctx, "Cached part of append-only file changed, downloading it completely", "event", "refresh", "host", localFile.Host, "path", localFile.Path)
+		return false, false, nil
+	}
+
+	size, hash, err := c.appendToCachedFile(ctx, generatedName, resp.Body, total)
+	if err != nil {
+		return false, true, err
+	}
+	if expectedSHA256 != "" && hash != expectedSHA256 {
+		return false, true, fmt.Errorf("%w: expected SHA256 %s, got %s", errReleaseMismatch, expectedSHA256, hash)
+	}
+
+	lastModified := lastAccess.RemoteLastModified
+	if parsed, err := parseHTTPTime(resp.Header.Get("Last-Modified")); err == nil {
+		lastModified = parsed
+	}
+	c.storeRefreshedFile(ctx, protocol, localFile, lastAccess, lastModified, resp.Header.Get("ETag"), size, hash, true)
+	c.trackRequestAsync(ctx, localFile.Host, false, size-lastAccess.Size)
+
+	slog.InfoContext(ctx, "File has grown, appended new data", "event", "refresh", "host", localFile.Host, "path", localFile.Path, "status", http.StatusPartialContent, "bytes", size, "appended_bytes", size-lastAccess.Size)
+	return true, true, nil
+}
+
+// appendToCachedFile writes a copy of the cached file at generatedName with
+// tail appended to a temporary file, which replaces the cached file if it has
+// total bytes. It returns the size and SHA256 checksum of the whole file.
+func (c *FSCache) appendToCachedFile(ctx context.Context, generatedName string, tail io.Reader, total int64) (int64, string, error) {
+	if err := c.ensureDownloadSpace(generatedName, total); err != nil {
+		slog.ErrorContext(ctx, "Error reserving disk space", "event", "refresh", "path", generatedName, "bytes", total, "error", err)
+		return 0, "", err
+	}
+
+	cached, err := os.Open(generatedName)
+	if err != nil {
+		return 0, "", err
+	}
+	defer cached.Close()
+
+	tempPath := c.inTempDirectory(generatedName + "-dl-" + uuid.New().String())
+	file, err := createCacheFile(tempPath)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error creating file", "event", "refresh", "path", tempPath, "error", err)
+		return 0, "", err
+	}
+	defer os.Remove(tempPath)
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hasher), io.MultiReader(cached, tail))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error writing file", "event", "refresh", "path", tempPath, "error", err)
+		return 0, "", err
+	}
+	if size != total {
+		slog.ErrorContext(ctx, "Incomplete download", "event", "refresh", "path", tempPath, "expected_bytes", total, "bytes", size)
+		return 0, "", fmt.Errorf("downloaded size mismatch: expected %d bytes, got %d", total, size)
+	}
+
+	if err := c.moveIntoCache(tempPath, generatedName); err != nil {
+		slog.ErrorContext(ctx, "Error renaming file", "event", "refresh", "path", generatedName, "error", err)
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes <first>-<last>/<total>" and returns the first byte and the total
+// size. The range has to reach the end of the file.
+func parseContentRange(value string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(value, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	byteRange, totalValue, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	firstValue, lastValue, ok := strings.Cut(byteRange, "-")
+	if !ok {
+		return 0, 0, false
+	}
+
+	first, err := strconv.ParseInt(firstValue, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	last, err := strconv.ParseInt(lastValue, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total, err := strconv.ParseInt(totalValue, 10, 64)
+	if err != nil || first > last || last != total-1 {
+		return 0, 0, false
+	}
+	return first, total, true
+}
@@ -0,0 +1,112 @@
+package fscache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// refreshAppendOnly caches cached as file of an append-only domain, refreshes
+// it while upstream serves current and returns the cached file afterwards and
+// the Range headers of the upstream requests.
+func refreshAppendOnly(t *testing.T, cached, current string) (string, []string) {
+	t.Helper()
+
+	var mux sync.Mutex
+	var ranges []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mux.Unlock()
+		http.ServeContent(w, r, "Contents-all", time.Now(), strings.NewReader(current))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cache := newTestFSCache(t)
+	cache.SetAppendOnly(func(domain string) bool { return strings.HasPrefix(domain, "127.0.0.1") })
+
+	localFile := mustParseURL(t, upstream.URL+"/archive/Contents-all")
+	localPath := cache.buildLocalPath(localFile)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(cached), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	entry := AccessEntry{URL: localFile, Size: int64(len(cached)), SHA256: checksumHex(cached), UpstreamRanges: true, LastChecked: time.Now().Add(-48 * time.Hour)}
+	if err := cache.Set(0, localFile.Host, localFile.Path, entry); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	refreshed, err := cache.refreshFile(context.Background(), localPath, localFile, entry)
+	if err != nil || !refreshed {
+		t.Fatalf("refreshFile() = %v, %v, want refreshed", refreshed, err)
+	}
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	got, ok := cache.Get(0, localFile.Host, localFile.Path)
+	if !ok || got.Size != int64(len(current)) || got.SHA256 != checksumHex(current) {
+		t.Fatalf("entry = %+v, want size %d and SHA256 of the new file", got, len(current))
+	}
+	return string(data), ranges
+}
+
+func TestRefreshAppendOnlyFetchesNewEnd(t *testing.T) {
+	cached := strings.Repeat("line of an append-only file\n", 500)
+	current := cached + "appended line\n"
+
+	data, ranges := refreshAppendOnly(t, cached, current)
+	if data != current {
+		t.Fatalf("cached file has %d bytes, want %d", len(data), len(current))
+	}
+	want := fmt.Sprintf("bytes=%d-", len(cached)-appendOverlap)
+	if len(ranges) != 1 || ranges[0] != want {
+		t.Fatalf("upstream ranges = %q, want only %q", ranges, want)
+	}
+}
+
+func TestRefreshAppendOnlyDownloadsChangedFile(t *testing.T) {
+	cached := strings.Repeat("line of an append-only file\n", 500)
+	current := strings.Repeat("line of a rewritten file\n", 600)
+
+	data, ranges := refreshAppendOnly(t, cached, current)
+	if data != current {
+		t.Fatalf("cached file has %d bytes, want %d", len(data), len(current))
+	}
+	if len(ranges) != 2 || ranges[1] != "" {
+		t.Fatalf("upstream ranges = %q, want a range request followed by a full download", ranges)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value        string
+		first, total int64
+		ok           bool
+	}{
+		{value: "bytes 100-199/200", first: 100, total: 200, ok: true},
+		{value: "bytes 0-0/1", first: 0, total: 1, ok: true},
+		{value: "bytes 100-149/200"},
+		{value: "bytes 100-199/*"},
+		{value: "bytes */200"},
+		{value: "items 100-199/200"},
+		{value: ""},
+	}
+
+	for _, tt := range tests {
+		first, total, ok := parseContentRange(tt.value)
+		if first != tt.first || total != tt.total || ok != tt.ok {
+			t.Errorf("parseContentRange(%q) = %d, %d, %v, want %d, %d, %v", tt.value, first, total, ok, tt.first, tt.total, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package fscache
+
+import (
+	"context"
+	"net/url"
+	"time"
+)
+
+// refreshWaitTimeout limits how long a request waits for the revalidation of a
+// metadata file started by another request. Afterwards the cached file is
+// served as it is.
+const refreshWaitTimeout = 30 * time.Second
+
+// refreshFlight is a revalidation of a metadata file in progress, done is
+// closed once it is finished.
+type refreshFlight struct {
+	done chan struct{}
+}
+
+// joinRefresh returns the revalidation in progress for the file or starts a
+// new one. If leader is true, the caller revalidates the file and has to call
+// finishRefresh afterwards; otherwise it may wait for the returned flight.
+func (c *FSCache) joinRefresh(protocol int, requestURL *url.URL) (flight *refreshFlight, leader bool) {
+	key := c.accessCacheKey(protocol, requestURL.Host, requestURL.Path)
+
+	c.refreshFlightsMux.Lock()
+	defer c.refreshFlightsMux.Unlock()
+
+	if flight, ok := c.refreshFlights[key]; ok {
+		return flight, false
+	}
+	if c.refreshFlights == nil {
+		c.refreshFlights = make(map[string]*refreshFlight)
+	}
+	flight = &refreshFlight{done: make(chan struct{})}
+	c.refreshFlights[key] = flight
+	return flight, true
+}
+
+// finishRefresh ends the revalidation started by joinRefresh and releases the
+// requests waiting for it.
+func (c *FSCache) finishRefresh(protocol int, requestURL *url.URL, flight *refreshFlight) {
+	key := c.accessCacheKey(protocol, requestURL.Host, requestURL.Path)
+
+	c.refreshFlightsMux.Lock()
+	if c.refreshFlights[key] == flight {
+		delete(c.refreshFlights, key)
+	}
+	c.refreshFlightsMux.Unlock()
+
+	close(flight.done)
+}
+
+// waitForRefresh blocks until flight is finished. It returns false if ctx was
+// canceled or refreshWaitTimeout passed before.
+func waitForRefresh(ctx context.Context, flight *refreshFlight) bool {
+	timer := time.NewTimer(refreshWaitTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-flight.done:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return false
+	}
+}
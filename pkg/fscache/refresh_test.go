@@ -1,6 +1,7 @@
 package fscache
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"os"
@@ -89,7 +90,7 @@ func TestRefreshFileStoresLastModifiedWithoutPreviousRemoteTime(t *testing.T) {
 		t.Fatalf("failed to seed access cache entry: %v", err)
 	}
 
-	refreshed, err := cache.refreshFile(generatedName, localFile, previousEntry)
+	refreshed, err := cache.refreshFile(context.Background(), generatedName, localFile, previousEntry)
 	if err != nil {
 		t.Fatalf("refreshFile returned error: %v", err)
 	}
@@ -190,7 +191,7 @@ func TestCacheRefreshRefreshesConnectedFilesAtCachePath(t *testing.T) {
 		t.Fatalf("failed to seed packages entry: %v", err)
 	}
 
-	cache.cacheRefresh(releaseURL, releaseEntry)
+	cache.cacheRefresh(context.Background(), releaseURL, releaseEntry)
 
 	data, err := os.ReadFile(packagesPath)
 	if err != nil {
@@ -228,7 +229,7 @@ func TestRefreshFileNotModifiedUpdatesLastChecked(t *testing.T) {
 		t.Fatalf("failed to seed access cache entry: %v", err)
 	}
 
-	refreshed, err := cache.refreshFile(generatedName, localFile, previousEntry)
+	refreshed, err := cache.refreshFile(context.Background(), generatedName, localFile, previousEntry)
 	if err != nil {
 		t.Fatalf("refreshFile returned error: %v", err)
 	}
@@ -289,7 +290,7 @@ func TestRefreshFileSkipsDownloadWhenETagIsUnchanged(t *testing.T) {
 		t.Fatalf("failed to seed access cache entry: %v", err)
 	}
 
-	refreshed, err := cache.refreshFile(generatedName, localFile, previousEntry)
+	refreshed, err := cache.refreshFile(context.Background(), generatedName, localFile, previousEntry)
 	if err != nil {
 		t.Fatalf("refreshFile returned error: %v", err)
 	}
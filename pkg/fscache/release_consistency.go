@@ -0,0 +1,51 @@
+package fscache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"os"
+)
+
+// errReleaseMismatch is returned by refreshes of connected files whose
+// download doesn't match the checksum of the refreshed Release file. The
+// cached file is kept in this case.
+var errReleaseMismatch = errors.New("checksum doesn't match the release file")
+
+// releaseChecksums returns the SHA256 checksums the Release or InRelease file
+// at localPath declares, by path relative to its directory. It returns nil for
+// other files or if the file can't be read.
+func releaseChecksums(localPath, filename string) map[string]string {
+	if filename != "InRelease" && filename != "Release" {
+		return nil
+	}
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil
+	}
+
+	checksums := map[string]string{}
+	for _, entry := range parseReleaseSHA256(string(data)) {
+		checksums[entry.file] = entry.hash
+	}
+	return checksums
+}
+
+// checkConnectedFile warns if the cached connected file doesn't match the
+// checksum expected by the refreshed release after the upstream server
+// reported it unchanged. This happens if the release and the connected file
+// were served by mirrors with a different state of the repository.
+func (c *FSCache) checkConnectedFile(ctx context.Context, release, connectedFile *url.URL, protocol int, expected string) {
+	if expected == "" {
+		return
+	}
+
+	entry, ok := c.Get(protocol, connectedFile.Host, connectedFile.Path)
+	if !ok || entry.SHA256 == "" || entry.SHA256 == expected {
+		return
+	}
+
+	slog.WarnContext(ctx, "Cached file doesn't match refreshed release, mirrors may be inconsistent", "event", "refresh", "host", connectedFile.Host, "path", connectedFile.Path, "release", release.String(), "expected_sha256", expected, "sha256", entry.SHA256)
+}
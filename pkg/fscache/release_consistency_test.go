@@ -0,0 +1,98 @@
+package fscache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// refreshWithRelease refreshes the cached InRelease of mirror.example, whose
+// new version declares releasedPackages as content of Packages.gz, while the
+// upstream server serves servedPackages. It returns the cached Packages.gz
+// afterwards.
+func refreshWithRelease(t *testing.T, releasedPackages, servedPackages string) string {
+	t.Helper()
+
+	release := fmt.Sprintf("-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA512\n\nSuite: stable\nSHA256:\n %s %d main/binary-amd64/Packages.gz\n %s 0 main/binary-amd64/Packages\n-----BEGIN PGP SIGNATURE-----\n",
+		checksumHex(releasedPackages), len(releasedPackages), checksumHex(""))
+
+	cache := newTestFSCache(t)
+	cache.client = &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			body := release
+			if r.URL.Path == "/debian/dists/stable/main/binary-amd64/Packages.gz" {
+				body = servedPackages
+			}
+			return &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{},
+				Body:          io.NopCloser(strings.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       r,
+			}, nil
+		}),
+	}
+
+	releaseURL := mustParseURL(t, "http://mirror.example/debian/dists/stable/InRelease")
+	packagesURL := mustParseURL(t, "http://mirror.example/debian/dists/stable/main/binary-amd64/Packages.gz")
+	for _, u := range []string{releaseURL.String(), packagesURL.String()} {
+		localPath := cache.buildLocalPath(mustParseURL(t, u))
+		if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+			t.Fatalf("failed to create cache directory: %v", err)
+		}
+		if err := os.WriteFile(localPath, []byte("old"), 0o644); err != nil {
+			t.Fatalf("failed to write cached file: %v", err)
+		}
+	}
+
+	releaseEntry := AccessEntry{LastChecked: time.Now().Add(-time.Hour), URL: releaseURL, Size: 3}
+	if err := cache.Set(0, releaseURL.Host, releaseURL.Path, releaseEntry); err != nil {
+		t.Fatalf("failed to seed release entry: %v", err)
+	}
+	if err := cache.Set(0, packagesURL.Host, packagesURL.Path, AccessEntry{LastChecked: time.Now().Add(-time.Hour), URL: packagesURL, Size: 3, SHA256: checksumHex("old")}); err != nil {
+		t.Fatalf("failed to seed packages entry: %v", err)
+	}
+
+	cache.cacheRefresh(context.Background(), releaseURL, releaseEntry)
+
+	data, err := os.ReadFile(cache.buildLocalPath(packagesURL))
+	if err != nil {
+		t.Fatalf("failed reading packages cache file: %v", err)
+	}
+	return string(data)
+}
+
+func TestCacheRefreshAcceptsConnectedFileMatchingRelease(t *testing.T) {
+	if got := refreshWithRelease(t, "new packages", "new packages"); got != "new packages" {
+		t.Fatalf("packages cache = %q, want %q", got, "new packages")
+	}
+}
+
+func TestCacheRefreshKeepsConnectedFileNotMatchingRelease(t *testing.T) {
+	if got := refreshWithRelease(t, "new packages", "packages of another mirror"); got != "old" {
+		t.Fatalf("packages cache = %q, want the old file to be kept", got)
+	}
+}
+
+func TestReleaseChecksums(t *testing.T) {
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "InRelease")
+	data := "Suite: stable\nMD5Sum:\n 0123 10 main/binary-amd64/Packages\nSHA256:\n abcd 10 main/binary-amd64/Packages\n ef01 5 main/binary-amd64/Packages.xz\n"
+	if err := os.WriteFile(localPath, []byte(data), 0o644); err != nil {
+		t.Fatalf("failed to write release: %v", err)
+	}
+
+	got := releaseChecksums(localPath, "InRelease")
+	if len(got) != 2 || got["main/binary-amd64/Packages"] != "abcd" || got["main/binary-amd64/Packages.xz"] != "ef01" {
+		t.Fatalf("releaseChecksums() = %v", got)
+	}
+	if got := releaseChecksums(localPath, "Release.gpg"); got != nil {
+		t.Fatalf("releaseChecksums() of a signature = %v, want nil", got)
+	}
+}
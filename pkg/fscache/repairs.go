@@ -0,0 +1,45 @@
+package fscache
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// Reasons of cache repairs, a cached file which was found broken and is
+// deleted to be fetched again.
+const (
+	RepairMissingFile          = "missing_file"          // Metadata without cached file
+	RepairSizeMismatch         = "size_mismatch"         // Cached file with another size than recorded
+	RepairChecksumMismatch     = "checksum_mismatch"     // Cached file not matching the checksum requested by X-Verify-Checksum
+	RepairVerificationMismatch = "verification_mismatch" // Cached package not matching the package index in the sources verification
+	RepairInvalidSignature     = "invalid_signature"     // Cached release file not signed by the keyring of its repository
+)
+
+// repairReasons are the reasons counted by repairCounters, in this order.
+var repairReasons = []string{RepairMissingFile, RepairSizeMismatch, RepairChecksumMismatch, RepairVerificationMismatch, RepairInvalidSignature}
+
+// repairCounters counts the cache repairs since startup by reason.
+type repairCounters [5]atomic.Uint64
+
+// noteRepair counts a repair of the cached file of host and path and logs it,
+// so frequent repairs caused by a bad disk or a flaky mirror stand out.
+func (c *FSCache) noteRepair(ctx context.Context, reason, host, path string) {
+	for i, known := range repairReasons {
+		if known == reason {
+			c.repairs[i].Add(1)
+		}
+	}
+	slog.WarnContext(ctx, "Repairing broken cached file", "event", "repair", "reason", reason, "host", host, "path", path)
+}
+
+// Repairs returns the number of cached files found broken and deleted to be
+// fetched again since startup, by reason (RepairMissingFile, ...). All reasons
+// are included, also without repairs.
+func (c *FSCache) Repairs() map[string]uint64 {
+	repairs := make(map[string]uint64, len(repairReasons))
+	for i, reason := range repairReasons {
+		repairs[reason] = c.repairs[i].Load()
+	}
+	return repairs
+}
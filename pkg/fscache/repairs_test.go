@@ -0,0 +1,45 @@
+package fscache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeGETRequestCountsRepairs(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.client = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("upstream down")
+	})}
+
+	sizeMismatch := httptest.NewRequest(http.MethodGet, "https://example.com/dists/stable/Release", nil)
+	localPath := cache.buildLocalPath(sizeMismatch.URL)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte("truncated"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	missingFile := httptest.NewRequest(http.MethodGet, "https://example.com/pool/main/h/hello/hello.deb", nil)
+
+	for _, req := range []*http.Request{sizeMismatch, missingFile} {
+		if err := cache.Set(1, req.URL.Host, req.URL.Path, AccessEntry{URL: req.URL, Size: 99}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+		cache.serveGETRequest(req, httptest.NewRecorder())
+	}
+
+	want := map[string]uint64{RepairMissingFile: 1, RepairSizeMismatch: 1, RepairChecksumMismatch: 0, RepairVerificationMismatch: 0, RepairInvalidSignature: 0}
+	got := cache.Repairs()
+	if len(got) != len(want) {
+		t.Fatalf("Repairs() = %v, want %v", got, want)
+	}
+	for reason, count := range want {
+		if got[reason] != count {
+			t.Fatalf("Repairs() = %v, want %v", got, want)
+		}
+	}
+}
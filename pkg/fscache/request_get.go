@@ -1,11 +1,13 @@
 package fscache
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,6 +18,9 @@ import (
 	"github.com/google/uuid"
 
 	"gitlab.com/bella.network/goaptcacher/pkg/buildinfo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // hopByHopHeaders lists headers that must not be forwarded to the client when
@@ -36,22 +41,39 @@ var hopByHopHeaders = map[string]struct{}{
 func (c *FSCache) serveGETRequest(r *http.Request, w http.ResponseWriter) {
 	protocol := DetermineProtocolFromURL(r.URL)
 
+	// Uncompressed index files are compressed for clients which accept it.
+	if compressibleResponse(r) {
+		gw := newGzipResponseWriter(w)
+		defer gw.Close()
+		w = gw
+	}
+
 	// Set basic headers for the response
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("X-Proxy-Server", fmt.Sprintf("GoAptCacher/%s", buildinfo.Version))
 
+	// Files which must always be fresh are neither served from nor written
+	// to the cache.
+	if c.neverCache.Match(r.URL) {
+		c.serveUncachedRequest(r, w)
+		return
+	}
+
 	// If a file from path /pool/ is requested, check at first if the file is
 	// available on the local file system to be directly served. This speeds up
 	// requests for Debian packages significantly. If some weird URL is used
 	// which also contains /dists/, skip this optimization as this could freeze
-	// updates permanently.
+	// updates permanently. Files which have to be verified are looked up in the
+	// access cache, which holds the stored checksums.
 	localPath := c.buildLocalPath(r.URL)
-	if _, err := os.Stat(localPath); strings.Contains(localPath, "/pool/") && !strings.Contains(localPath, "/dists/") && err == nil {
+	verify := r.Header.Get(verifyChecksumHeader)
+	if _, err := os.Stat(localPath); verify == "" && strings.Contains(localPath, "/pool/") && !strings.Contains(localPath, "/dists/") && err == nil {
 		// File exists, serve it directly to the client.
+		c.addCacheDebug(w, "result=hit (pool file on disk, metadata not checked)")
 		c.serveLocalFile(w, r, localPath)
 
 		// Perform background tasks for the cached file.
-		go c.backgroundFileTasks(r.URL)
+		go c.backgroundFileTasks(context.WithoutCancel(r.Context()), r.URL)
 		return
 	}
 
@@ -59,50 +81,176 @@ func (c *FSCache) serveGETRequest(r *http.Request, w http.ResponseWriter) {
 	// which then allows a direct cache hit and serving the file directly.
 	lastAccess, ok := c.Get(protocol, r.URL.Host, r.URL.Path)
 	if ok {
-		if info, err := os.Stat(localPath); err != nil || (lastAccess.Size > 0 && info.Size() != lastAccess.Size) {
+		if info, err := os.Stat(localPath); err != nil || !fileMatchesEntry(info, lastAccess) {
 			if err != nil {
 				if !os.IsNotExist(err) {
-					log.Printf("[WARN:GET:STALE] %s%s stat failed: %v\n", r.URL.Host, r.URL.Path, err)
+					slog.WarnContext(r.Context(), "Stat of cached file failed", "event", "get_stale", "host", r.URL.Host, "path", r.URL.Path, "error", err)
 				}
+				c.addCacheDebug(w, "result=stale (metadata without file)")
+				c.noteRepair(r.Context(), RepairMissingFile, r.URL.Host, r.URL.Path)
 			} else {
-				log.Printf("[WARN:GET:STALE] %s%s size mismatch: expected %d bytes, got %d\n", r.URL.Host, r.URL.Path, lastAccess.Size, info.Size())
+				slog.WarnContext(r.Context(), "Cached file size mismatch", "event", "get_stale", "host", r.URL.Host, "path", r.URL.Path, "expected_bytes", lastAccess.Size, "bytes", info.Size())
+				c.addCacheDebug(w, "result=stale (size mismatch, expected %d bytes, file has %d bytes)", lastAccess.Size, info.Size())
+				c.noteRepair(r.Context(), RepairSizeMismatch, r.URL.Host, r.URL.Path)
+			}
+			// If the file is in use, the cache miss waits until the file is
+			// released and checks it again.
+			c.removeStaleFile(r.Context(), protocol, r.URL, localPath)
+			c.serveGETRequestCacheMiss(r, w, 0)
+			return
+		}
+
+		c.addCacheDebug(w, "result=hit")
+		if lastAccess.Size > 0 {
+			c.addCacheDebug(w, "size=matched (%d bytes)", lastAccess.Size)
+		} else {
+			c.addCacheDebug(w, "size=not recorded")
+		}
+		c.addCacheDebug(w, "%s", c.describeRecheck(r.URL, lastAccess))
+
+		if verify != "" {
+			algorithm, expected, valid := parseVerifyChecksum(verify)
+			if !valid {
+				Error(w, r, http.StatusBadRequest, "unsupported_checksum", "Unsupported checksum algorithm")
+				return
+			}
+			if !c.verifyChecksumBeforeServe(r.Context(), protocol, r.URL, localPath, lastAccess, algorithm, expected) {
+				c.addCacheDebug(w, "verify=%s mismatch, fetching again", algorithm)
+				c.noteRepair(r.Context(), RepairChecksumMismatch, r.URL.Host, r.URL.Path)
+				if !c.removeMismatchedFile(protocol, r.URL, localPath) {
+					Error(w, r, http.StatusServiceUnavailable, "file_in_use", "Cached file is in use, try again later")
+					return
+				}
+				c.serveGETRequestCacheMiss(r, w, 0)
+				return
+			}
+			c.addCacheDebug(w, "verify=%s matched", algorithm)
+		}
+
+		// Release files cached before a keyring was configured for their
+		// repository are verified once before they are served.
+		if err := c.checkCachedSignature(r.Context(), r.URL, localPath, lastAccess); err != nil {
+			c.addCacheDebug(w, "signature=invalid, fetching again")
+			c.noteRepair(r.Context(), RepairInvalidSignature, r.URL.Host, r.URL.Path)
+			if !c.removeMismatchedFile(protocol, r.URL, localPath) {
+				Error(w, r, http.StatusServiceUnavailable, "file_in_use", "Cached file is in use, try again later")
+				return
 			}
-			c.Delete(protocol, r.URL.Host, r.URL.Path)
-			_ = os.Remove(localPath)
 			c.serveGETRequestCacheMiss(r, w, 0)
 			return
 		}
 
-		c.refreshStaleMetadataBeforeServe(protocol, r.URL, lastAccess)
+		if refresh := c.refreshStaleMetadataBeforeServe(r.Context(), protocol, r.URL, lastAccess); refresh != "" {
+			c.addCacheDebug(w, "refresh=%s", refresh)
+		} else if c.evaluateRefresh(r.URL, lastAccess) {
+			c.addCacheDebug(w, "refresh=background after serving")
+		}
 
 		// Serve the file
 		c.serveLocalFile(w, r, localPath)
 
 		// Perform background tasks for the cached file.
-		go c.backgroundFileTasks(r.URL)
+		go c.backgroundFileTasks(context.WithoutCancel(r.Context()), r.URL)
 
 		return
 	}
 
 	// Cache was missed, download the file from the internet and serve it to the client.
+	c.addCacheDebug(w, "result=miss (no metadata)")
 	c.serveGETRequestCacheMiss(r, w, 0)
 }
 
+// fileMatchesEntry reports if the size of a cached file matches its metadata.
+// Entries without size match every file.
+func fileMatchesEntry(info os.FileInfo, entry AccessEntry) bool {
+	return entry.Size <= 0 || info.Size() == entry.Size
+}
+
+// removeStaleFile deletes a cached file which doesn't match its metadata,
+// together with the metadata. While a download writes or a client reads the
+// file, the mismatch may be caused by a file which is just being replaced, so
+// the file is kept and false is returned.
+func (c *FSCache) removeStaleFile(ctx context.Context, protocol int, requestURL *url.URL, localPath string) bool {
+	if !c.CreateExclusiveWriteLock(protocol, requestURL.Host, requestURL.Path) {
+		slog.InfoContext(ctx, "Cached file is in use, skipping deletion", "event", "get_stale", "host", requestURL.Host, "path", requestURL.Path)
+		return false
+	}
+	defer c.DeleteWriteLock(protocol, requestURL.Host, requestURL.Path)
+
+	// The download which held the lock may have replaced the file meanwhile.
+	if entry, ok := c.Get(protocol, requestURL.Host, requestURL.Path); ok {
+		if info, err := os.Stat(localPath); err == nil && fileMatchesEntry(info, entry) {
+			return false
+		}
+	}
+
+	c.deleteStaleFile(protocol, requestURL, localPath)
+	return true
+}
+
+// removeMismatchedFile deletes a cached file which failed checksum
+// verification, together with the metadata. It returns false if the file is
+// in use by a download.
+func (c *FSCache) removeMismatchedFile(protocol int, requestURL *url.URL, localPath string) bool {
+	if !c.CreateExclusiveWriteLock(protocol, requestURL.Host, requestURL.Path) {
+		return false
+	}
+	defer c.DeleteWriteLock(protocol, requestURL.Host, requestURL.Path)
+
+	c.deleteStaleFile(protocol, requestURL, localPath)
+	return true
+}
+
+// deleteStaleFile deletes a cached file and its metadata. The caller must hold
+// the write lock of the file.
+func (c *FSCache) deleteStaleFile(protocol int, requestURL *url.URL, localPath string) {
+	c.Delete(protocol, requestURL.Host, requestURL.Path)
+	_ = os.Remove(localPath)
+}
+
 // refreshStaleMetadataBeforeServe checks if the metadata of a cached file is
-// stale and refreshes it before serving the file to the client.
-func (c *FSCache) refreshStaleMetadataBeforeServe(protocol int, requestURL *url.URL, lastAccess AccessEntry) {
+// stale and refreshes it before serving the file to the client. Concurrent
+// requests for the same file, e.g. of many clients running apt update at
+// once, share a single revalidation and are served its result. The outcome
+// is returned for the X-Cache-Debug header, empty if no refresh was needed.
+func (c *FSCache) refreshStaleMetadataBeforeServe(ctx context.Context, protocol int, requestURL *url.URL, lastAccess AccessEntry) string {
 	if !isRepositoryMetadataPath(requestURL.Path) || !c.evaluateRefresh(requestURL, lastAccess) {
-		return
+		return ""
+	}
+
+	flight, leader := c.joinRefresh(protocol, requestURL)
+	if !leader {
+		if !waitForRefresh(ctx, flight) {
+			slog.InfoContext(ctx, "Refresh of other request didn't finish in time, serving cached file", "event", "get_refresh", "host", requestURL.Host, "path", requestURL.Path)
+			return "timed out waiting for other request, serving cached file"
+		}
+		return "shared with other request"
+	}
+	defer c.finishRefresh(protocol, requestURL, flight)
+
+	// A revalidation which finished after lastAccess was read is used as well.
+	lastAccess, ok := c.Get(protocol, requestURL.Host, requestURL.Path)
+	if !ok || !c.evaluateRefresh(requestURL, lastAccess) {
+		return "already done by other request"
 	}
 
 	if !c.CreateExclusiveWriteLock(protocol, requestURL.Host, requestURL.Path) {
-		log.Printf("[INFO:GET:REFRESH:SKIP] %s%s is already being used\n", requestURL.Host, requestURL.Path)
-		return
+		slog.InfoContext(ctx, "File is already being used, skipping refresh", "event", "get_refresh", "host", requestURL.Host, "path", requestURL.Path)
+		return "skipped, file in use"
 	}
 	defer c.DeleteWriteLock(protocol, requestURL.Host, requestURL.Path)
 
-	if _, err := c.refreshFile(c.buildLocalPath(requestURL), requestURL, lastAccess); err != nil {
-		log.Printf("[WARN:GET:REFRESH] %s%s refresh before serve failed: %v\n", requestURL.Host, requestURL.Path, err)
+	refreshed, err := c.refreshFile(ctx, c.buildLocalPath(requestURL), requestURL, lastAccess)
+	switch {
+	case errors.Is(err, errUpstreamCoolingDown):
+		return "skipped, upstream asked to retry later, serving cached file"
+	case err != nil:
+		slog.WarnContext(ctx, "Refresh before serve failed", "event", "get_refresh", "host", requestURL.Host, "path", requestURL.Path, "error", err)
+		return "failed, serving cached file"
+	case refreshed:
+		return "before serving, file changed upstream"
+	default:
+		return "before serving, file unchanged upstream"
 	}
 }
 
@@ -115,31 +263,45 @@ func (c *FSCache) serveLocalFile(w http.ResponseWriter, r *http.Request, localPa
 	// Remove the file lock
 	defer c.RemoveFileLock(protocol, r.URL.Host, r.URL.Path)
 
+	_, span := tracer.Start(r.Context(), "serve cached file", trace.WithAttributes(attribute.String("goaptcacher.path", localPath)))
+	defer span.End()
+
 	// Get file info
 	info, err := os.Stat(localPath)
 	if err != nil {
-		http.Error(w, "Error accessing cached file", http.StatusInternalServerError)
-		log.Printf("[ERROR:GET:STAT] %s - Error accessing cached file: %v\n", r.URL.String(), err)
+		span.SetStatus(codes.Error, err.Error())
+		Error(w, r, http.StatusInternalServerError, "cache_read_failed", "Error accessing cached file")
+		slog.ErrorContext(r.Context(), "Error accessing cached file", "event", "get", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "status", http.StatusInternalServerError, "error", err)
 		return
 	}
 
-	// Set headers
+	// Set headers, cached files are served with range support regardless of
+	// upstream
 	w.Header().Set("X-Cache", "HIT")
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	// With the ETag of upstream, If-None-Match requests are answered with 304
+	// as well. Clients can check the file against the stored checksums.
+	if entry, ok := c.Get(protocol, r.URL.Host, r.URL.Path); ok {
+		if entry.ETag != "" {
+			w.Header().Set("ETag", entry.ETag)
+		}
+		setChecksumHeaders(w.Header(), entry)
+	}
 
 	// Serve the file
 	http.ServeFile(w, r, localPath)
 
 	// Log the cache hit
-	log.Printf("[INFO:GET:HIT:%s] %s\n", r.RemoteAddr, r.URL.String())
-	c.trackRequestAsync(true, info.Size())
+	slog.InfoContext(r.Context(), "Cache hit", "event", "hit", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "bytes", info.Size())
+	c.trackRequestAsync(r.Context(), r.URL.Host, true, info.Size())
 }
 
 // backgroundFileTasks performs background tasks for a cached file, determines
 // if upstream is checked for updates and updates local tracking info.
-func (c *FSCache) backgroundFileTasks(request *url.URL) {
+func (c *FSCache) backgroundFileTasks(ctx context.Context, request *url.URL) {
 	// Perform background tasks to update access cache, hit count, URL list and refresh
 	protocol := DetermineProtocolFromURL(request)
 
@@ -153,21 +315,21 @@ func (c *FSCache) backgroundFileTasks(request *url.URL) {
 	if c.evaluateRefresh(request, lastAccess) {
 		// File should be checked if a new version is available on the
 		// internet for cache refresh.
-		go c.cacheRefresh(request, lastAccess)
+		go c.cacheRefresh(ctx, request, lastAccess)
 	}
 
-	c.hitAsync(protocol, request.Host, request.Path)
-	c.addURLIfNotExistsAsync(protocol, request.Host, request.Path, request.String())
+	c.hitAsync(ctx, protocol, request.Host, request.Path)
+	c.addURLIfNotExistsAsync(ctx, protocol, request.Host, request.Path, request.String())
 }
 
 // serveGETRequestCacheMiss is the function to serve a GET request for a client if the cache was missed.
 func (c *FSCache) serveGETRequestCacheMiss(r *http.Request, w http.ResponseWriter, retry uint64) {
-	c.serveGETRequestCacheMissWithSleep(r, w, retry, time.Sleep)
+	c.serveGETRequestCacheMissWithSleep(r, w, retry, waitForLockRelease)
 }
 
-func (c *FSCache) serveGETRequestCacheMissWithSleep(r *http.Request, w http.ResponseWriter, retry uint64, sleepFn func(time.Duration)) {
+func (c *FSCache) serveGETRequestCacheMissWithSleep(r *http.Request, w http.ResponseWriter, retry uint64, sleepFn func(<-chan struct{}, time.Duration)) {
 	if sleepFn == nil {
-		sleepFn = time.Sleep
+		sleepFn = waitForLockRelease
 	}
 
 	protocol := DetermineProtocolFromURL(r.URL)
@@ -180,6 +342,9 @@ func (c *FSCache) serveGETRequestCacheMissWithSleep(r *http.Request, w http.Resp
 		return
 	}
 	defer c.DeleteWriteLock(protocol, r.URL.Host, r.URL.Path)
+	if retry > 0 {
+		c.addCacheDebug(w, "waited=%d times for other download", retry)
+	}
 
 	if c.serveRecoveredCacheMiss(protocol, r, w) {
 		return
@@ -189,15 +354,17 @@ func (c *FSCache) serveGETRequestCacheMissWithSleep(r *http.Request, w http.Resp
 }
 
 func (c *FSCache) retryLimitReached(r *http.Request, w http.ResponseWriter, retry uint64) bool {
-	if retry <= 25 {
+	if retry <= uint64(max(c.lockWait.Retries, 0)) {
 		return false
 	}
 
-	log.Printf("[ERROR:GET:RETRY:%d] %s%s - Too many retries, giving up\n", retry, r.URL.Host, r.URL.Path)
-	http.Error(
+	slog.ErrorContext(r.Context(), "Too many retries, giving up", "event", "get_retry", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "retry", retry)
+	Error(
 		w,
-		"File is currently being downloaded, please try again later",
+		r,
 		http.StatusInternalServerError,
+		"download_in_progress",
+		"File is currently being downloaded, please try again later",
 	)
 	return true
 }
@@ -207,25 +374,43 @@ func (c *FSCache) acquireWriteLockOrRetry(
 	r *http.Request,
 	w http.ResponseWriter,
 	retry uint64,
-	sleepFn func(time.Duration),
+	sleepFn func(<-chan struct{}, time.Duration),
 ) bool {
+	// The channel is taken before the attempt, so a release right after it
+	// isn't missed.
+	released := c.lockReleased(protocol, r.URL.Host, r.URL.Path)
 	created := c.CreateExclusiveWriteLock(protocol, r.URL.Host, r.URL.Path)
 	if created {
 		return true
 	}
 
-	sleepFn(time.Second)
+	// After the last attempt, the request fails without waiting.
+	if retry < uint64(max(c.lockWait.Retries, 0)) {
+		sleepFn(released, c.lockWait.Interval)
+	}
 	c.serveGETRequestCacheMissWithSleep(r, w, retry+1, sleepFn)
 	return false
 }
 
 func (c *FSCache) serveRecoveredCacheMiss(protocol int, r *http.Request, w http.ResponseWriter) bool {
-	if _, ok := c.Get(protocol, r.URL.Host, r.URL.Path); ok {
-		c.serveGETRequest(r, w)
-		return true
+	localPath := c.buildLocalPath(r.URL)
+
+	// Another download may have cached the file while waiting for the lock.
+	if entry, ok := c.Get(protocol, r.URL.Host, r.URL.Path); ok {
+		if info, err := os.Stat(localPath); err == nil && fileMatchesEntry(info, entry) {
+			c.addCacheDebug(w, "recovered=cached by other download")
+			c.serveGETRequest(r, w)
+			return true
+		}
+
+		// The write lock is held, so no download writes the file anymore and
+		// the mismatch is permanent.
+		slog.WarnContext(r.Context(), "Removing stale cached file", "event", "get_stale", "host", r.URL.Host, "path", r.URL.Path)
+		c.addCacheDebug(w, "removed=stale file")
+		c.deleteStaleFile(protocol, r.URL, localPath)
+		return false
 	}
 
-	localPath := c.buildLocalPath(r.URL)
 	fileInfo, err := os.Stat(localPath)
 	if err != nil {
 		return false
@@ -233,8 +418,8 @@ func (c *FSCache) serveRecoveredCacheMiss(protocol int, r *http.Request, w http.
 
 	hash, err := GenerateSHA256Hash(localPath)
 	if err != nil {
-		log.Printf("Error generating SHA256 hash: %v\n", err)
-		http.Error(w, "Error generating file hash", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error generating SHA256 hash", "event", "get", "host", r.URL.Host, "path", r.URL.Path, "error", err)
+		Error(w, r, http.StatusInternalServerError, "cache_write_failed", "Error generating file hash")
 		return true
 	}
 
@@ -246,38 +431,76 @@ func (c *FSCache) serveRecoveredCacheMiss(protocol int, r *http.Request, w http.
 		SHA256:             hash,
 	})
 	if err != nil {
-		log.Printf("Error updating access cache: %v\n", err)
-		http.Error(w, "Error updating cache metadata", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error updating access cache", "event", "get", "host", r.URL.Host, "path", r.URL.Path, "error", err)
+		Error(w, r, http.StatusInternalServerError, "cache_write_failed", "Error updating cache metadata")
 		return true
 	}
 
 	w.Header().Add("X-Cache", "ROUNDTRIP")
+	c.addCacheDebug(w, "recovered=file without metadata, sha256 %s recorded", hash)
 	c.serveGETRequest(r, w)
 	return true
 }
 
 func (c *FSCache) fetchAndServeCacheMiss(protocol int, r *http.Request, w http.ResponseWriter) {
+	if resp, ok := c.fetchFromParent(r); ok {
+		defer resp.Body.Close()
+		c.addCacheDebug(w, "origin=parent %s", c.parent.Host)
+		if parentDebug := resp.Header.Get(cacheDebugHeader); parentDebug != "" {
+			resp.Header.Del(cacheDebugHeader)
+			c.addCacheDebug(w, "parent=[%s]", parentDebug)
+		}
+		c.streamCacheMissResponse(protocol, r, w, resp, c.parent.Host)
+		return
+	}
+
+	// Upstream servers which throttle requests aren't asked again before the
+	// time given by Retry-After.
+	if c.rejectDuringCooldown(w, r) {
+		return
+	}
+
 	req, err := c.newCacheMissUpstreamRequest(r)
 	if err != nil {
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
+		Error(w, r, http.StatusInternalServerError, "upstream_request_failed", "Error creating request")
 		return
 	}
 
+	_, span := tracer.Start(r.Context(), "upstream fetch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("url.full", r.URL.String()),
+	))
 	resp, err := c.client.Do(req)
 	if err != nil {
-		http.Error(w, "Error fetching file", http.StatusInternalServerError)
-		log.Printf("[ERROR:GET:FETCH] %s%s - Error fetching file: %v\n", r.URL.Host, r.URL.Path, err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		Error(w, r, http.StatusInternalServerError, "upstream_unreachable", "Error fetching file")
+		slog.ErrorContext(r.Context(), "Error fetching file", "event", "miss", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "error", err)
 		return
 	}
 	defer resp.Body.Close()
+	c.noteUpstreamResponse(r.Context(), r.URL.Host, resp)
 
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 	if resp.StatusCode != http.StatusOK {
-		http.Error(w, "Error fetching file", http.StatusNotFound)
-		log.Printf("[ERROR:GET:STATUS:%d] %s%s - Error fetching file: received status code %d\n", resp.StatusCode, r.URL.Host, r.URL.Path, resp.StatusCode)
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	span.End()
+
+	if resp.StatusCode != http.StatusOK {
+		// Throttling is passed on, so clients retry after the cooldown.
+		if c.rejectDuringCooldown(w, r) {
+			return
+		}
+		if resp.StatusCode == http.StatusNotFound && c.serveCompressionFallback(protocol, r, w) {
+			return
+		}
+		upstreamError(w, r, http.StatusNotFound, resp.StatusCode, "upstream_error", "Error fetching file")
+		slog.ErrorContext(r.Context(), "Error fetching file", "event", "miss", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "status", resp.StatusCode)
 		return
 	}
 
-	c.streamCacheMissResponse(protocol, r, w, resp)
+	c.addCacheDebug(w, "origin=upstream")
+	c.streamCacheMissResponse(protocol, r, w, resp, "")
 }
 
 func (c *FSCache) newCacheMissUpstreamRequest(r *http.Request) (*http.Request, error) {
@@ -295,7 +518,10 @@ func (c *FSCache) newCacheMissUpstreamRequest(r *http.Request) (*http.Request, e
 		}
 	}
 
-	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	c.setForwardedFor(req, r)
+	// The cache stores the files as published, a compressed response of the
+	// upstream server would be cached compressed.
+	req.Header.Set("Accept-Encoding", "identity")
 	req.Header.Set(
 		"X-Proxy-Server",
 		fmt.Sprintf("GoAptCacher/%s (+https://gitlab.com/bella.network/goaptcacher)", buildinfo.Version),
@@ -307,45 +533,75 @@ func skipRequestHeaderForCacheMiss(key string) bool {
 	if key == "If-Modified-Since" || key == "If-None-Match" || key == "E-Tag" {
 		return true
 	}
+	// The whole file is fetched to be cached.
+	if key == "Range" || key == "If-Range" {
+		return true
+	}
 
 	_, skip := hopByHopHeaders[http.CanonicalHeaderKey(key)]
 	return skip
 }
 
-func (c *FSCache) streamCacheMissResponse(protocol int, r *http.Request, w http.ResponseWriter, resp *http.Response) {
+// streamCacheMissResponse streams resp to the client and caches it. origin is
+// the host of the parent cache resp was fetched from, empty for the upstream
+// server.
+func (c *FSCache) streamCacheMissResponse(protocol int, r *http.Request, w http.ResponseWriter, resp *http.Response, origin string) {
 	targetPath := c.buildLocalPath(r.URL)
+
+	// The span covers streaming the body to the client and writing it to disk.
+	_, span := tracer.Start(r.Context(), "cache write", trace.WithAttributes(attribute.String("goaptcacher.path", targetPath)))
+	defer span.End()
+
+	// A release file whose signature is checked is only sent to the
+	// client once it is verified.
+	var held *heldResponse
+	if c.checksSignature(r.URL) {
+		held = newHeldResponse(w, r)
+		defer held.release()
+		w = held
+	}
+
 	requiredSize, ok := c.prepareCacheMissTarget(targetPath, r, w, resp)
 	if !ok {
 		return
 	}
 
-	tempPath := buildTempCachePath(targetPath)
+	tempPath := c.inTempDirectory(buildTempCachePath(targetPath))
 	defer func() {
 		if tempPath != "" {
 			_ = os.Remove(tempPath)
 		}
 	}()
 
-	file, ok := c.createCacheMissTempFile(tempPath, requiredSize, w)
+	file, ok := c.createCacheMissTempFile(r, tempPath, requiredSize, w)
 	if !ok {
 		return
 	}
 
-	bw, hash, ok := streamResponseToClientAndCache(w, resp, file)
+	bw, hash, ok := c.streamResponseToClientAndCache(r.Context(), w, resp, file, r.URL.Path)
 	if !ok {
 		return
 	}
 
 	if resp.ContentLength > 0 && resp.ContentLength != bw {
-		log.Printf("Error writing file: expected %d bytes, got %d\n", resp.ContentLength, bw)
+		slog.ErrorContext(r.Context(), "Incomplete download", "event", "miss", "host", r.URL.Host, "path", r.URL.Path, "expected_bytes", resp.ContentLength, "bytes", bw)
+		abortResponse(w)
 		return
 	}
+	if held != nil {
+		if err := c.checkSignature(r.Context(), r.URL, tempPath); err != nil {
+			held.discard()
+			Error(held.w, r, http.StatusBadGateway, "invalid_signature", "Invalid repository signature")
+			return
+		}
+	}
 
-	lastModifiedTime := parseLastModifiedForMetadata(resp.Header.Get("Last-Modified"))
-	if !c.finalizeCacheMissFile(tempPath, targetPath, lastModifiedTime, w) {
+	lastModifiedTime := parseLastModifiedForMetadata(r.Context(), resp.Header.Get("Last-Modified"))
+	if !c.finalizeCacheMissFile(r, tempPath, targetPath, lastModifiedTime, w) {
 		return
 	}
 	tempPath = ""
+	c.deduplicateFile(r.Context(), targetPath, hash, bw)
 
 	if err := c.Set(protocol, r.URL.Host, r.URL.Path, AccessEntry{
 		RemoteLastModified: lastModifiedTime,
@@ -355,12 +611,14 @@ func (c *FSCache) streamCacheMissResponse(protocol int, r *http.Request, w http.
 		URL:                r.URL,
 		Size:               bw,
 		SHA256:             hash,
+		Origin:             origin,
+		UpstreamRanges:     upstreamSupportsRanges(resp.Header),
 	}); err != nil {
-		log.Printf("Error updating access cache: %v\n", err)
+		slog.ErrorContext(r.Context(), "Error updating access cache", "event", "miss", "host", r.URL.Host, "path", r.URL.Path, "error", err)
 	}
 
-	log.Printf("[INFO:DL:CREATED] %s%s - Wrote %d bytes\n", r.URL.Host, r.URL.Path, bw)
-	c.trackRequestAsync(false, bw)
+	slog.InfoContext(r.Context(), "Cache miss, downloaded file", "event", "miss", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "bytes", bw, "origin", origin)
+	c.trackRequestAsync(r.Context(), r.URL.Host, false, bw)
 }
 
 func (c *FSCache) prepareCacheMissTarget(
@@ -370,22 +628,25 @@ func (c *FSCache) prepareCacheMissTarget(
 	resp *http.Response,
 ) (int64, bool) {
 	if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
-		log.Printf("Error creating cache directory: %v\n", err)
-		http.Error(w, "Error creating cache directory", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating cache directory", "event", "miss", "path", filepath.Dir(targetPath), "error", err)
+		Error(w, r, http.StatusInternalServerError, "cache_write_failed", "Error creating cache directory")
 		return 0, false
 	}
 
 	requiredSize := resp.ContentLength
 	if requiredSize > 0 {
-		if err := ensureDiskSpace(targetPath, requiredSize); err != nil {
-			log.Printf("[ERROR:GET:DISK] Error reserving disk space for %s%s: %v\n", r.URL.Host, r.URL.Path, err)
-			http.Error(w, "Insufficient storage on cache server", http.StatusInsufficientStorage)
+		if err := c.ensureDownloadSpace(targetPath, requiredSize); err != nil {
+			slog.ErrorContext(r.Context(), "Error reserving disk space", "event", "miss", "host", r.URL.Host, "path", r.URL.Path, "bytes", requiredSize, "error", err)
+			Error(w, r, http.StatusInsufficientStorage, "insufficient_storage", "Insufficient storage on cache server")
 			return 0, false
 		}
 	}
 
 	copyResponseHeaders(w.Header(), resp.Header)
 	w.Header().Set("X-Cache", "MISS")
+	// The body is streamed while it is downloaded, so ranges can't be served
+	// before the file is cached, whatever upstream supports.
+	w.Header().Set("Accept-Ranges", "none")
 	setConditionalCacheMissHeaders(w, resp)
 	return requiredSize, true
 }
@@ -393,11 +654,11 @@ func (c *FSCache) prepareCacheMissTarget(
 func setConditionalCacheMissHeaders(w http.ResponseWriter, resp *http.Response) {
 	lastModified := resp.Header.Get("Last-Modified")
 	if lastModified != "" {
-		parsed, err := time.Parse(time.RFC1123, lastModified)
+		parsed, err := parseHTTPTime(lastModified)
 		if err != nil {
-			log.Printf("Invalid Last-Modified header: %s (%v)", lastModified, err)
+			slog.Warn("Invalid Last-Modified header", "event", "miss", "value", lastModified, "error", err)
 		} else {
-			w.Header().Set("Last-Modified", parsed.UTC().Format(time.RFC1123))
+			w.Header().Set("Last-Modified", parsed.UTC().Format(http.TimeFormat))
 		}
 	}
 
@@ -411,18 +672,19 @@ func buildTempCachePath(targetPath string) string {
 	return targetPath + "." + randomName + ".partial"
 }
 
-func (c *FSCache) createCacheMissTempFile(tempPath string, requiredSize int64, w http.ResponseWriter) (*os.File, bool) {
-	file, err := os.Create(tempPath)
+func (c *FSCache) createCacheMissTempFile(r *http.Request, tempPath string, requiredSize int64, w http.ResponseWriter) (*os.File, bool) {
+	ctx := r.Context()
+	file, err := createCacheFile(tempPath)
 	if err != nil {
-		log.Printf("Error creating file: %v\n", err)
+		slog.ErrorContext(ctx, "Error creating file", "event", "miss", "path", tempPath, "error", err)
 		return nil, false
 	}
 
 	if requiredSize > 0 {
 		if err := preallocateFile(file, requiredSize); err != nil {
-			log.Printf("Error preallocating file: %v\n", err)
+			slog.WarnContext(ctx, "Error preallocating file", "event", "miss", "path", tempPath, "bytes", requiredSize, "error", err)
 			_ = file.Close()
-			http.Error(w, "Error reserving storage", http.StatusInternalServerError)
+			Error(w, r, http.StatusInternalServerError, "cache_write_failed", "Error reserving storage")
 			return nil, false
 		}
 	}
@@ -430,7 +692,14 @@ func (c *FSCache) createCacheMissTempFile(tempPath string, requiredSize int64, w
 	return file, true
 }
 
-func streamResponseToClientAndCache(w http.ResponseWriter, resp *http.Response, file *os.File) (int64, string, bool) {
+// streamResponseToClientAndCache copies the response body to the client and
+// to file. With a write buffer, the disk is written in the background and a
+// slow disk only slows down the download once the buffer is full. An error
+// writing the file doesn't abort the response, the file is just not cached.
+// If the body can't be copied completely, the response to the client is
+// aborted. Written data is dropped from the page cache depending on the type of the
+// file at urlPath.
+func (c *FSCache) streamResponseToClientAndCache(ctx context.Context, w http.ResponseWriter, resp *http.Response, file *os.File, urlPath string) (int64, string, bool) {
 	w.WriteHeader(resp.StatusCode)
 	if flusher, ok := w.(http.Flusher); ok {
 		flusher.Flush()
@@ -438,26 +707,72 @@ func streamResponseToClientAndCache(w http.ResponseWriter, resp *http.Response,
 
 	clientWriter := responseWriterWithFlush(w)
 	hasher := sha256.New()
-	cacheDropper := newCacheDropWriter(file, cacheDropThreshold, cacheDropChunk)
-	multiWriter := io.MultiWriter(clientWriter, cacheDropper, hasher)
-	copyBuf := make([]byte, 32*1024)
+	var diskWriter io.Writer = file
+	dropCache := func() {}
+	if threshold := c.writeOptions.dropCacheThreshold(urlPath); threshold > 0 {
+		cacheDropper := newCacheDropWriter(file, threshold, c.writeOptions.DropCacheChunk)
+		diskWriter, dropCache = cacheDropper, cacheDropper.DropCache
+	}
+	cacheWriter := diskWriter
+	closeCacheWriter := func() error { return nil }
+	if chunks := c.writeOptions.bufferChunks(); chunks > 0 {
+		asyncWriter := newAsyncFileWriter(diskWriter, chunks)
+		cacheWriter, closeCacheWriter = asyncWriter, asyncWriter.Close
+	}
+	multiWriter := io.MultiWriter(clientWriter, cacheWriter, hasher)
+	copyBuf := make([]byte, copyBufferSize)
 	reader := readerOnly{r: resp.Body}
 
 	bw, err := io.CopyBuffer(multiWriter, reader, copyBuf)
+	writeErr := closeCacheWriter()
 	if err != nil {
-		log.Printf("Error writing file: %v\n", err)
+		slog.ErrorContext(ctx, "Error writing file", "event", "miss", "path", file.Name(), "error", err)
+		_ = file.Close()
+		abortResponse(w)
+		return 0, "", false
+	}
+	if writeErr != nil {
+		slog.ErrorContext(ctx, "Error writing file", "event", "miss", "path", file.Name(), "error", writeErr)
+		_ = file.Close()
 		return 0, "", false
 	}
-	cacheDropper.DropCache()
+	dropCache()
 
 	if err := file.Close(); err != nil {
-		log.Printf("Error closing file: %v\n", err)
+		slog.ErrorContext(ctx, "Error closing file", "event", "miss", "path", file.Name(), "error", err)
 		return 0, "", false
 	}
 
 	return bw, hex.EncodeToString(hasher.Sum(nil)), true
 }
 
+// ResponseAborter is implemented by response writers which aren't served by
+// an http.Server, e.g. for requests read from an intercepted CONNECT tunnel.
+// Abort is called instead of finishing a response whose body is incomplete.
+type ResponseAborter interface {
+	Abort()
+}
+
+// abortResponse signals the client that the body it received is incomplete,
+// e.g. because upstream sent less data than its Content-Length announced. A
+// response which is finished normally could look complete, e.g. if it is
+// chunked. Wrapping response writers are unwrapped like by
+// http.ResponseController; an http.Server closes the connection once the
+// handler panics with http.ErrAbortHandler.
+func abortResponse(w http.ResponseWriter) {
+	for {
+		switch aborter := w.(type) {
+		case ResponseAborter:
+			aborter.Abort()
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = aborter.Unwrap()
+		default:
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
 func responseWriterWithFlush(w http.ResponseWriter) io.Writer {
 	if flusher, ok := w.(http.Flusher); ok {
 		return flushWriter{w: w, flusher: flusher}
@@ -465,15 +780,15 @@ func responseWriterWithFlush(w http.ResponseWriter) io.Writer {
 	return w
 }
 
-func parseLastModifiedForMetadata(lastModified string) time.Time {
+func parseLastModifiedForMetadata(ctx context.Context, lastModified string) time.Time {
 	lastModifiedTime := time.Now()
 	if lastModified == "" {
 		return lastModifiedTime
 	}
 
-	parsed, err := time.Parse(time.RFC1123, lastModified)
+	parsed, err := parseHTTPTime(lastModified)
 	if err != nil {
-		log.Printf("Error parsing Last-Modified header: %v\n", err)
+		slog.WarnContext(ctx, "Error parsing Last-Modified header", "event", "miss", "value", lastModified, "error", err)
 		return lastModifiedTime
 	}
 
@@ -481,20 +796,21 @@ func parseLastModifiedForMetadata(lastModified string) time.Time {
 }
 
 func (c *FSCache) finalizeCacheMissFile(
+	r *http.Request,
 	tempPath string,
 	targetPath string,
 	lastModifiedTime time.Time,
 	w http.ResponseWriter,
 ) bool {
-	if err := os.Rename(tempPath, targetPath); err != nil {
-		log.Printf("Error renaming file: %v\n", err)
-		http.Error(w, "Error renaming file", http.StatusInternalServerError)
+	if err := c.moveIntoCache(tempPath, targetPath); err != nil {
+		slog.ErrorContext(r.Context(), "Error renaming file", "event", "miss", "path", targetPath, "error", err)
+		Error(w, r, http.StatusInternalServerError, "cache_write_failed", "Error renaming file")
 		return false
 	}
 
 	if !lastModifiedTime.IsZero() && lastModifiedTime.Year() > 2000 {
 		if err := os.Chtimes(targetPath, time.Now(), lastModifiedTime); err != nil {
-			log.Printf("Error setting file times: %v\n", err)
+			slog.WarnContext(r.Context(), "Error setting file times", "event", "miss", "path", targetPath, "error", err)
 		}
 	}
 
@@ -514,6 +830,18 @@ func copyResponseHeaders(dst, src http.Header) {
 	}
 }
 
+// upstreamSupportsRanges reports if header announces byte range support.
+func upstreamSupportsRanges(header http.Header) bool {
+	for _, value := range header.Values("Accept-Ranges") {
+		for unit := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // readerOnly hides optional interfaces (like io.WriterTo) to keep io.CopyBuffer
 // using the provided buffer size.
 type readerOnly struct {
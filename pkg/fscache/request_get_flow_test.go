@@ -1,6 +1,7 @@
 package fscache
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -8,6 +9,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -58,7 +61,7 @@ func TestServeLocalFileMissingFile(t *testing.T) {
 
 func TestBackgroundFileTasksNoEntry(t *testing.T) {
 	cache := newTestFSCache(t)
-	cache.backgroundFileTasks(mustParseURL(t, "https://example.com/pool/main/p/pkg.deb"))
+	cache.backgroundFileTasks(context.Background(), mustParseURL(t, "https://example.com/pool/main/p/pkg.deb"))
 }
 
 func TestBackgroundFileTasksUpdatesAccessData(t *testing.T) {
@@ -76,7 +79,7 @@ func TestBackgroundFileTasksUpdatesAccessData(t *testing.T) {
 		t.Fatalf("Set() error = %v", err)
 	}
 
-	cache.backgroundFileTasks(reqURL)
+	cache.backgroundFileTasks(context.Background(), reqURL)
 
 	deadline := time.Now().Add(2 * time.Second)
 	updated := false
@@ -252,7 +255,7 @@ func TestServeGETRequestCacheMissLockContentionPath(t *testing.T) {
 	defer cache.DeleteWriteLock(protocol, req.URL.Host, req.URL.Path)
 
 	rr := httptest.NewRecorder()
-	cache.serveGETRequestCacheMissWithSleep(req, rr, 25, func(time.Duration) {})
+	cache.serveGETRequestCacheMissWithSleep(req, rr, 25, func(<-chan struct{}, time.Duration) {})
 
 	if rr.Code != http.StatusInternalServerError {
 		t.Fatalf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
@@ -386,6 +389,160 @@ func TestServeGETRequestCacheMissDownloadAndCache(t *testing.T) {
 	}
 }
 
+func TestServeGETRequestCacheMissContentLengthMismatch(t *testing.T) {
+	const filePath = "/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	tests := []struct {
+		name      string
+		transport http.RoundTripper
+	}{
+		{
+			// The body ends cleanly, only its size shows the missing data.
+			// Without Content-Length header, the response to the client is
+			// chunked and would look complete if it was finished.
+			name: "short body",
+			transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{},
+					Body:          io.NopCloser(strings.NewReader("only part of it")),
+					ContentLength: 100,
+					Request:       r,
+				}, nil
+			}),
+		},
+		{
+			name:      "connection closed",
+			transport: http.DefaultTransport,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "100")
+				_, _ = io.WriteString(w, "only part of it")
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					_ = conn.Close()
+				}
+			}))
+			defer upstream.Close()
+
+			cache := newTestFSCache(t)
+			cache.client = &http.Client{Transport: tt.transport}
+			fileURL := mustParseURL(t, upstream.URL+filePath)
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.URL = fileURL
+				cache.serveGETRequest(r, w)
+			}))
+			defer proxy.Close()
+
+			resp, err := http.Get(proxy.URL + filePath)
+			if err != nil {
+				t.Fatalf("GET error = %v", err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil {
+				t.Fatalf("client received a complete response with %d bytes, want the response to be aborted", len(body))
+			}
+
+			if _, ok := cache.Get(0, fileURL.Host, fileURL.Path); ok {
+				t.Fatal("incomplete download has a metadata entry")
+			}
+			if _, err := os.Stat(cache.buildLocalPath(fileURL)); !os.IsNotExist(err) {
+				t.Fatalf("incomplete download was cached, Stat() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestServeGETRequestCacheMissWriteOptions(t *testing.T) {
+	payload := strings.Repeat("0123456789abcdef", 16*1024)
+	upstream := newTestMirror(t, payload)
+
+	tests := []struct {
+		name string
+		opts WriteOptions
+	}{
+		{name: "synchronous", opts: WriteOptions{}},
+		{name: "single chunk buffer", opts: WriteOptions{BufferSize: 1, DropCacheThreshold: copyBufferSize, DropCacheChunk: copyBufferSize}},
+		{name: "default", opts: DefaultWriteOptions()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newTestFSCache(t)
+			cache.SetWriteOptions(tt.opts)
+
+			req := httptest.NewRequest(http.MethodGet, upstream.URL+"/debian/pool/main/h/hello/hello_1.0_amd64.deb", nil)
+			rr := httptest.NewRecorder()
+			cache.serveGETRequestCacheMiss(req, rr, 0)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rr.Code, http.StatusOK)
+			}
+			if rr.Body.String() != payload {
+				t.Fatalf("body length = %d, want %d", rr.Body.Len(), len(payload))
+			}
+
+			cached, err := os.ReadFile(cache.buildLocalPath(req.URL))
+			if err != nil {
+				t.Fatalf("ReadFile(cached) error = %v", err)
+			}
+			if string(cached) != payload {
+				t.Fatalf("cached length = %d, want %d", len(cached), len(payload))
+			}
+		})
+	}
+}
+
+func TestWriteOptionsBufferChunks(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{size: 0, want: 0},
+		{size: -1, want: 0},
+		{size: 1, want: 1},
+		{size: copyBufferSize, want: 1},
+		{size: copyBufferSize + 1, want: 2},
+		{size: 1 << 20, want: 32},
+	}
+
+	for _, tt := range tests {
+		if got := (WriteOptions{BufferSize: tt.size}).bufferChunks(); got != tt.want {
+			t.Errorf("bufferChunks(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestWriteOptionsDropCacheThreshold(t *testing.T) {
+	opts := WriteOptions{DropCacheThreshold: 128, MetadataDropCacheThreshold: 0}
+
+	tests := []struct {
+		path string
+		want int64
+	}{
+		{path: "/debian/pool/main/h/hello/hello_1.0_amd64.deb", want: 128},
+		{path: "/debian/dists/stable/InRelease", want: 0},
+		{path: "/debian/dists/stable/main/binary-amd64/Packages.xz", want: 0},
+		{path: "/debian/dists/stable/main/Contents-amd64.gz", want: 128},
+	}
+
+	for _, tt := range tests {
+		if got := opts.dropCacheThreshold(tt.path); got != tt.want {
+			t.Errorf("dropCacheThreshold(%q) = %d, want %d", tt.path, got, tt.want)
+		}
+	}
+
+	opts.MetadataDropCacheThreshold = 64
+	if got := opts.dropCacheThreshold("/debian/dists/stable/InRelease"); got != 64 {
+		t.Errorf("dropCacheThreshold(InRelease) = %d, want 64", got)
+	}
+}
+
 func TestServeGETRequestCacheMissUpstreamStatusError(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -406,3 +563,190 @@ func TestServeGETRequestCacheMissUpstreamStatusError(t *testing.T) {
 		t.Fatalf("unexpected body: %q", rr.Body.String())
 	}
 }
+
+func TestServeGETRequestKeepsMismatchedFileWhileWriting(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.client = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("upstream must not be contacted")
+	})}
+
+	const content = "0123456789"
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/files/data.bin", nil)
+	protocol := DetermineProtocolFromURL(req.URL)
+	localPath := cache.buildLocalPath(req.URL)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+
+	// A download is about to replace the file, its metadata is already
+	// updated while the old file is still on disk.
+	if err := os.WriteFile(localPath, []byte("old"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := cache.Set(protocol, req.URL.Host, req.URL.Path, AccessEntry{
+		URL:         req.URL,
+		Size:        int64(len(content)),
+		LastChecked: time.Now(),
+	}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if err := cache.CreateWriteLock(protocol, req.URL.Host, req.URL.Path); err != nil {
+		t.Fatalf("CreateWriteLock() error = %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.serveGETRequest(req, rr)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(localPath); err != nil {
+		t.Fatalf("expected file in use to be kept: %v", err)
+	}
+	if _, ok := cache.Get(protocol, req.URL.Host, req.URL.Path); !ok {
+		t.Fatal("expected metadata of file in use to be kept")
+	}
+
+	// The download finishes and releases the lock.
+	if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	cache.DeleteWriteLock(protocol, req.URL.Host, req.URL.Path)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("request didn't finish after the download released the lock")
+	}
+
+	if rr.Code != http.StatusOK || rr.Body.String() != content {
+		t.Fatalf("status = %d, body = %q, want the downloaded file", rr.Code, rr.Body.String())
+	}
+	if entry, ok := cache.Get(protocol, req.URL.Host, req.URL.Path); !ok || entry.Size != int64(len(content)) {
+		t.Fatalf("entry = %+v, %v, want metadata of the downloaded file", entry, ok)
+	}
+}
+
+func TestServeGETRequestRemovesMismatchedFileAfterWaiting(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.client = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("upstream down")
+	})}
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/files/data.bin", nil)
+	protocol := DetermineProtocolFromURL(req.URL)
+	localPath := cache.buildLocalPath(req.URL)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte("old"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := cache.Set(protocol, req.URL.Host, req.URL.Path, AccessEntry{URL: req.URL, Size: 99}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	// A client reads the file, it is released without being replaced.
+	cache.CreateFileLock(protocol, req.URL.Host, req.URL.Path)
+	time.AfterFunc(100*time.Millisecond, func() {
+		cache.RemoveFileLock(protocol, req.URL.Host, req.URL.Path)
+	})
+
+	rr := httptest.NewRecorder()
+	cache.serveGETRequest(req, rr)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want %d from the failed download", rr.Code, http.StatusInternalServerError)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("expected orphaned file to be removed, stat err = %v", err)
+	}
+	if _, ok := cache.Get(protocol, req.URL.Host, req.URL.Path); ok {
+		t.Fatal("expected orphaned metadata to be removed")
+	}
+}
+
+// serveConcurrentMetadataRequests caches a stale metadata file with the ETag
+// "old" and serves it to parallel client requests with If-None-Match: "old".
+// It returns the responses and the number of upstream requests.
+func serveConcurrentMetadataRequests(t *testing.T, clients int, upstreamHandler http.HandlerFunc) ([]*httptest.ResponseRecorder, int32) {
+	t.Helper()
+
+	var upstreamRequests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		// Keep the revalidation running until all clients are waiting for it
+		time.Sleep(200 * time.Millisecond)
+		upstreamHandler(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	cache := newTestFSCache(t)
+	requestURL := upstream.URL + "/dists/stable/InRelease"
+	probe := httptest.NewRequest(http.MethodGet, requestURL, nil)
+	localPath := cache.buildLocalPath(probe.URL)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte("old release"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := cache.Set(DetermineProtocolFromURL(probe.URL), probe.URL.Host, probe.URL.Path, AccessEntry{
+		LastChecked: time.Now().Add(-time.Hour),
+		ETag:        "\"old\"",
+		URL:         probe.URL,
+		Size:        int64(len("old release")),
+	}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	responses := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, requestURL, nil)
+		req.Header.Set("If-None-Match", "\"old\"")
+		wg.Go(func() {
+			cache.serveGETRequest(req, responses[i])
+		})
+	}
+	wg.Wait()
+
+	return responses, upstreamRequests.Load()
+}
+
+func TestServeGETRequestSharesRevalidationOfUnchangedMetadata(t *testing.T) {
+	responses, upstreamRequests := serveConcurrentMetadataRequests(t, 8, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "\"old\"" {
+			t.Errorf("refresh If-None-Match = %q, want %q", r.Header.Get("If-None-Match"), "\"old\"")
+		}
+		w.WriteHeader(http.StatusNotModified)
+	})
+
+	if upstreamRequests != 1 {
+		t.Fatalf("upstream requests = %d, want 1", upstreamRequests)
+	}
+	for i, rr := range responses {
+		if rr.Code != http.StatusNotModified {
+			t.Fatalf("client %d status = %d, want %d", i, rr.Code, http.StatusNotModified)
+		}
+	}
+}
+
+func TestServeGETRequestSharesRevalidationOfChangedMetadata(t *testing.T) {
+	responses, upstreamRequests := serveConcurrentMetadataRequests(t, 8, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("ETag", "\"new\"")
+		_, _ = io.WriteString(w, "new release")
+	})
+
+	if upstreamRequests != 1 {
+		t.Fatalf("upstream requests = %d, want 1", upstreamRequests)
+	}
+	for i, rr := range responses {
+		if rr.Code != http.StatusOK || rr.Body.String() != "new release" || rr.Header().Get("ETag") != "\"new\"" {
+			t.Fatalf("client %d got %d %q with ETag %q, want the new release", i, rr.Code, rr.Body.String(), rr.Header().Get("ETag"))
+		}
+	}
+}
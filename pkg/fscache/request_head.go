@@ -9,6 +9,10 @@ import (
 // serveHEADRequest serves a HEAD request for a file from cache if available and not expired. If
 // the file is not in the cache, it is downloaded from the internet.
 func (c *FSCache) serveHEADRequest(r *http.Request, w http.ResponseWriter) {
+	if c.neverCache.Match(r.URL) {
+		c.serveUncachedRequest(r, w)
+		return
+	}
 	c.serveHEADRequestWithDeps(r, w, os.Stat, c.downloadFileSimple)
 }
 
@@ -32,6 +36,7 @@ func (c *FSCache) serveHEADRequestWithDeps(
 	if fi, err := statFile(localFile); err == nil {
 		// Add header that describes the cache hit
 		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("Accept-Ranges", "bytes")
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()))
 		w.Header().Set("Content-Type", "application/octet-stream")
 		w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
@@ -41,19 +46,20 @@ func (c *FSCache) serveHEADRequestWithDeps(
 	// If the file is not in the cache, download it
 	err := downloadFile(r.URL.String(), localFile)
 	if err != nil {
-		http.Error(w, "Error downloading file", http.StatusInternalServerError)
+		Error(w, r, http.StatusInternalServerError, "upstream_unreachable", "Error downloading file")
 		return
 	}
 
 	// Serve the file from the cache
 	fi, err := statFile(localFile)
 	if err != nil {
-		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		Error(w, r, http.StatusInternalServerError, "cache_read_failed", "Error reading file")
 		return
 	}
 
 	// Add header that describes the cache miss
 	w.Header().Set("X-Cache", "MISS")
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", fi.Size()))
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
@@ -0,0 +1,47 @@
+package fscache
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// MethodPurge is the non-standard method used by HTTP caches to invalidate a
+// cached object. It is handled like DELETE.
+const MethodPurge = "PURGE"
+
+// servePURGERequest removes the requested file from the cache and reports the
+// size of the removed file, or 404 if it isn't cached. The caller has to check
+// if the client may purge files.
+func (c *FSCache) servePURGERequest(r *http.Request, w http.ResponseWriter) {
+	protocol := DetermineProtocolFromURL(r.URL)
+	localPath := c.buildLocalPath(r.URL)
+
+	if _, ok := c.Get(protocol, r.URL.Host, r.URL.Path); !ok {
+		Error(w, r, http.StatusNotFound, "not_cached", "File not cached")
+		return
+	}
+
+	// Files which are downloaded or served right now are kept.
+	if !c.CreateExclusiveWriteLock(protocol, r.URL.Host, r.URL.Path) {
+		Error(w, r, http.StatusConflict, "file_in_use", "File is in use, try again later")
+		return
+	}
+	defer c.DeleteWriteLock(protocol, r.URL.Host, r.URL.Path)
+
+	var size int64
+	if info, err := os.Stat(localPath); err == nil {
+		size = info.Size()
+	}
+
+	if err := c.DeleteFile(r.URL); err != nil {
+		slog.ErrorContext(r.Context(), "Error purging file", "event", "purge", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "error", err)
+		Error(w, r, http.StatusInternalServerError, "purge_failed", "Error purging file")
+		return
+	}
+	slog.InfoContext(r.Context(), "Purged file", "event", "purge", "client", r.RemoteAddr, "host", r.URL.Host, "path", r.URL.Path, "bytes", size)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]any{"purged": r.URL.String(), "bytes": size})
+}
@@ -0,0 +1,67 @@
+package fscache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServeFromRequestPurge(t *testing.T) {
+	const payload = "package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	localPath := downloadPackage(t, cache, mirror.URL, payload)
+	target := mirror.URL + "/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	rr := httptest.NewRecorder()
+	cache.ServeFromRequest(httptest.NewRequest(MethodPurge, target, nil), rr)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PURGE status = %d, want %d", rr.Code, http.StatusOK)
+	}
+	var response struct {
+		Purged string `json:"purged"`
+		Bytes  int64  `json:"bytes"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if response.Purged != target || response.Bytes != int64(len(payload)) {
+		t.Fatalf("response = %+v, want %s with %d bytes", response, target, len(payload))
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("purged file still exists: %v", err)
+	}
+	if _, ok := cache.Get(0, mustParseURL(t, target).Host, mustParseURL(t, target).Path); ok {
+		t.Fatalf("metadata of purged file still exists")
+	}
+
+	rr = httptest.NewRecorder()
+	cache.ServeFromRequest(httptest.NewRequest(http.MethodDelete, target, nil), rr)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("DELETE of uncached file status = %d, want %d", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestServeFromRequestPurgeFileInUse(t *testing.T) {
+	const payload = "package content"
+
+	mirror := newTestMirror(t, payload)
+	cache := newTestFSCache(t)
+	localPath := downloadPackage(t, cache, mirror.URL, payload)
+	target := mustParseURL(t, mirror.URL+"/debian/pool/main/h/hello/hello_1.0_amd64.deb")
+
+	cache.CreateFileLock(0, target.Host, target.Path)
+	defer cache.RemoveFileLock(0, target.Host, target.Path)
+
+	rr := httptest.NewRecorder()
+	cache.ServeFromRequest(httptest.NewRequest(MethodPurge, target.String(), nil), rr)
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("PURGE status = %d, want %d", rr.Code, http.StatusConflict)
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		t.Fatalf("file in use was removed: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package fscache
+
+import "context"
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID. Log lines of
+// the request and of background tasks spawned for it include the ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID stored in ctx or an empty string
+// if ctx doesn't carry one.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,139 @@
+package fscache
+
+import (
+	"compress/gzip"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest response which is compressed, smaller ones
+// don't save enough to be worth it.
+const gzipMinSize = 1024
+
+// gzipWriters are reused between responses, a gzip.Writer allocates several
+// hundred KB.
+var gzipWriters = sync.Pool{
+	New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
+// compressibleResponse reports whether the response to r may be compressed
+// on the fly. All files are served as application/octet-stream, so the
+// content is told by the path: uncompressed repository index files like
+// Packages, Sources or Contents-amd64 are text, files with an extension
+// (.gz, .xz, .gpg) and by-hash files, which may be either, are left alone.
+func compressibleResponse(r *http.Request) bool {
+	if r.Header.Get("Range") != "" || !acceptsGzip(r.Header) {
+		return false
+	}
+	if !isRepositoryIndexPath(r.URL.Path) || strings.Contains(r.URL.Path, "/by-hash/") {
+		return false
+	}
+	return path.Ext(r.URL.Path) == ""
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip.
+func acceptsGzip(header http.Header) bool {
+	for _, value := range header.Values("Accept-Encoding") {
+		for coding := range strings.SplitSeq(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.TrimSpace(name) != "*" {
+				continue
+			}
+			// q=0 explicitly refuses the coding.
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses the body of 200 responses with gzip. The
+// decision is made once the status is written: other responses, responses
+// already carrying a Content-Encoding and small responses pass unchanged.
+// The ETag of the compressed and of the 304 responses is made weak, as the
+// bytes differ from the uncompressed file, while If-None-Match still matches
+// with weak comparison.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func newGzipResponseWriter(w http.ResponseWriter) *gzipResponseWriter {
+	return &gzipResponseWriter{ResponseWriter: w}
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+
+	header := w.Header()
+	if (status == http.StatusOK || status == http.StatusNotModified) && header.Get("Content-Encoding") == "" {
+		header.Add("Vary", "Accept-Encoding")
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+	}
+
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	small := err == nil && size < gzipMinSize
+	if status == http.StatusOK && header.Get("Content-Encoding") == "" && !small {
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", "gzip")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz != nil {
+		return w.gz.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends the data compressed so far to the client.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the compressed body and returns the gzip.Writer to the
+// pool. It has to be called once the handler is done.
+func (w *gzipResponseWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz.Reset(nil)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+	return err
+}
+
+// Unwrap returns the original writer for http.ResponseController.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,139 @@
+package fscache
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"GZIP", true},
+		{"*", true},
+		{"gzip;q=0", false},
+		{"br, identity", false},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.value != "" {
+			header.Set("Accept-Encoding", tt.value)
+		}
+		if got := acceptsGzip(header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCompressibleResponse(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/debian/dists/stable/main/binary-amd64/Packages", true},
+		{"/debian/dists/stable/main/Contents-amd64", true},
+		{"/debian/dists/stable/InRelease", true},
+		{"/debian/dists/stable/main/binary-amd64/Packages.xz", false},
+		{"/debian/dists/stable/main/binary-amd64/by-hash/SHA256/0123abcd", false},
+		{"/debian/pool/main/h/hello/hello_1.0_amd64.deb", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org"+tt.path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if got := compressibleResponse(req); got != tt.want {
+			t.Errorf("compressibleResponse(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://deb.debian.org/debian/dists/stable/main/binary-amd64/Packages", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=0-99")
+	if compressibleResponse(req) {
+		t.Errorf("expected range requests not to be compressed")
+	}
+}
+
+func TestServeGETRequestCompressesIndexFiles(t *testing.T) {
+	payload := strings.Repeat("Package: hello\nVersion: 1.0\n\n", 200)
+	var upstreamEncoding string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("ETag", `"packages-1"`)
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer upstream.Close()
+
+	cache := newTestFSCache(t)
+	rawURL := upstream.URL + "/debian/dists/stable/main/binary-amd64/Packages"
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, rawURL, nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		return rr
+	}
+	gunzip := func(rr *httptest.ResponseRecorder) string {
+		t.Helper()
+		zr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("gzip.NewReader() error = %v", err)
+		}
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("ReadAll() error = %v", err)
+		}
+		return string(data)
+	}
+
+	// The cache miss is compressed for the client, the file is cached as
+	// published.
+	rr := get(http.Header{"Accept-Encoding": {"gzip"}})
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("miss = %d, Content-Encoding %q, want gzip", rr.Code, rr.Header().Get("Content-Encoding"))
+	}
+	if got := gunzip(rr); got != payload {
+		t.Fatalf("decompressed miss body differs from the upstream file")
+	}
+	if upstreamEncoding != "identity" {
+		t.Fatalf("upstream Accept-Encoding = %q, want identity", upstreamEncoding)
+	}
+
+	rr = get(http.Header{"Accept-Encoding": {"gzip"}})
+	if rr.Header().Get("Content-Encoding") != "gzip" || rr.Header().Get("Content-Length") != "" {
+		t.Fatalf("hit headers = %v, want gzip without Content-Length", rr.Header())
+	}
+	if got := rr.Header().Get("ETag"); got != `W/"packages-1"` {
+		t.Fatalf("ETag = %q, want weak ETag", got)
+	}
+	if got := rr.Header().Get("Vary"); got != "Accept-Encoding" {
+		t.Fatalf("Vary = %q, want Accept-Encoding", got)
+	}
+	if got := gunzip(rr); got != payload {
+		t.Fatalf("decompressed hit body differs from the cached file")
+	}
+
+	rr = get(http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {`W/"packages-1"`}})
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("conditional request status = %d, want %d", rr.Code, http.StatusNotModified)
+	}
+
+	rr = get(nil)
+	if rr.Header().Get("Content-Encoding") != "" || rr.Body.String() != payload {
+		t.Fatalf("response without Accept-Encoding was compressed")
+	}
+	if got := rr.Header().Get("ETag"); got != `"packages-1"` {
+		t.Fatalf("ETag = %q, want the upstream ETag", got)
+	}
+}
@@ -0,0 +1,95 @@
+package fscache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// selfTestProbe is written to the probe file of the self test.
+var selfTestProbe = []byte("goaptcacher self test\n")
+
+// SelfTest verifies that downloads can be stored in the cache directory: a
+// probe file is created, written, renamed like a finished download and
+// removed again, and at least minFreeBytes have to be available. With a temp
+// directory, the probe is written there and moved into the cache. Network
+// filesystems, whose rename and locking semantics may break the cache, are
+// reported as warning.
+func (c *FSCache) SelfTest(minFreeBytes int64) error {
+	if err := os.MkdirAll(c.CachePath, 0o755); err != nil {
+		return fmt.Errorf("creating cache directory: %w", err)
+	}
+
+	tempPath := filepath.Join(c.CachePath, ".goaptcacher-selftest.partial")
+	if c.tempDirectory != "" {
+		if err := os.MkdirAll(c.tempDirectory, 0o755); err != nil {
+			return fmt.Errorf("creating temp directory: %w", err)
+		}
+		tempPath = filepath.Join(c.tempDirectory, ".goaptcacher-selftest.partial")
+	}
+	probePath := filepath.Join(c.CachePath, ".goaptcacher-selftest")
+	defer func() {
+		_ = os.Remove(tempPath)
+		_ = os.Remove(probePath)
+	}()
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("creating probe file: %w", err)
+	}
+	if _, err := file.Write(selfTestProbe); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("writing probe file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("syncing probe file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing probe file: %w", err)
+	}
+
+	if err := c.moveIntoCache(tempPath, probePath); err != nil {
+		return fmt.Errorf("renaming probe file: %w", err)
+	}
+	data, err := os.ReadFile(probePath)
+	if err != nil {
+		return fmt.Errorf("reading probe file: %w", err)
+	}
+	if !bytes.Equal(data, selfTestProbe) {
+		return fmt.Errorf("probe file has unexpected content after rename")
+	}
+	if err := os.Remove(probePath); err != nil {
+		return fmt.Errorf("removing probe file: %w", err)
+	}
+
+	if err := ensureDiskSpace(c.CachePath, minFreeBytes); err != nil {
+		return err
+	}
+	if c.tempDirectory != "" {
+		if err := ensureDiskSpace(c.tempDirectory, minFreeBytes); err != nil {
+			return err
+		}
+	}
+
+	if fsType, err := networkFilesystem(c.CachePath); err != nil {
+		slog.Warn("Unable to determine filesystem of cache directory", "event", "startup", "path", c.CachePath, "error", err)
+	} else if fsType != "" {
+		slog.Warn("Cache directory is on a network filesystem, atomic renames and file locking may not work reliably", "event", "startup", "path", c.CachePath, "filesystem", fsType)
+	}
+
+	return nil
+}
+
+// CheckWritable verifies that files can be created in the cache directory. It
+// is cheap enough to be called by readiness probes.
+func (c *FSCache) CheckWritable() error {
+	file, err := os.CreateTemp(c.CachePath, ".goaptcacher-health-*")
+	if err != nil {
+		return err
+	}
+	_ = file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,79 @@
+package fscache
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestSucceedsAndCleansUp(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.CachePath = filepath.Join(t.TempDir(), "new", "cache")
+
+	if err := cache.SelfTest(1); err != nil {
+		t.Fatalf("SelfTest() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(cache.CachePath)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected probe files to be removed, found %v", entries)
+	}
+}
+
+func TestSelfTestFailsWithoutFreeSpace(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	err := cache.SelfTest(math.MaxInt64)
+	if err == nil || !strings.Contains(err.Error(), "insufficient disk space") {
+		t.Fatalf("SelfTest() error = %v, want insufficient disk space", err)
+	}
+}
+
+func TestSelfTestFailsOnReadOnlyDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+
+	cache := newTestFSCache(t)
+	if err := os.Chmod(cache.CachePath, 0o555); err != nil {
+		t.Fatalf("Chmod() error = %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chmod(cache.CachePath, 0o755) })
+
+	if err := cache.SelfTest(1); err == nil || !strings.Contains(err.Error(), "creating probe file") {
+		t.Fatalf("SelfTest() error = %v, want probe file error", err)
+	}
+}
+
+func TestSelfTestFailsWhenPathIsAFile(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.CachePath = filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(cache.CachePath, nil, 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	if err := cache.SelfTest(1); err == nil {
+		t.Fatal("expected error when the cache directory is a file")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	if err := cache.CheckWritable(); err != nil {
+		t.Fatalf("CheckWritable() error = %v", err)
+	}
+	if entries, _ := os.ReadDir(cache.CachePath); len(entries) != 0 {
+		t.Fatalf("expected probe file to be removed, found %v", entries)
+	}
+
+	cache.CachePath = filepath.Join(cache.CachePath, "missing")
+	if err := cache.CheckWritable(); err == nil {
+		t.Fatal("expected error for a missing cache directory")
+	}
+}
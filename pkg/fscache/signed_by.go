@@ -0,0 +1,339 @@
+package fscache
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// errInvalidSignature is returned for release files which aren't signed by a
+// key of the keyring configured for their repository. They are not cached.
+var errInvalidSignature = errors.New("invalid repository signature")
+
+// SetSignedBy sets the function returning the keyring the release files at
+// the given URL have to be signed with, empty if its repository isn't checked.
+// InRelease files carry their signature, Release files are checked against
+// the detached signature in Release.gpg and the other way round.
+// Like apt's Signed-By option, the keyring is a binary or ASCII armored
+// OpenPGP key file; signatures are checked with gpgv, which has to be
+// installed. If fingerprints are returned as well, only a signature by one of
+// these keys (or a subkey of them) is accepted, even if other keys of the
+// keyring made valid signatures. It has to be called before requests are
+// served.
+func (c *FSCache) SetSignedBy(keyring func(u *url.URL) (keyring string, fingerprints []string)) error {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		return fmt.Errorf("gpgv is required to verify signatures: %w", err)
+	}
+	c.signedBy = keyring
+	return nil
+}
+
+// signingKeyring returns the keyring of the file at u, empty if it isn't a
+// release file or no keyring is configured for its repository, and the
+// fingerprints of the keys allowed to sign it, all keys of the keyring if
+// empty.
+func (c *FSCache) signingKeyring(u *url.URL) (string, []string) {
+	if c.signedBy == nil {
+		return "", nil
+	}
+	switch path.Base(u.Path) {
+	case "InRelease", "Release", "Release.gpg":
+		return c.signedBy(u)
+	default:
+		return "", nil
+	}
+}
+
+// checksSignature reports if the signature of the file at u is verified.
+func (c *FSCache) checksSignature(u *url.URL) bool {
+	keyring, _ := c.signingKeyring(u)
+	return keyring != ""
+}
+
+// checkSignature verifies the downloaded release file at localPath for the
+// URL u against the keyring of its repository and its pinned fingerprints.
+// Other files are accepted. Verified files are remembered, see
+// checkCachedSignature.
+func (c *FSCache) checkSignature(ctx context.Context, u *url.URL, localPath string) error {
+	keyring, pinned := c.signingKeyring(u)
+	if keyring == "" {
+		return nil
+	}
+
+	fingerprints, err := c.verifyReleaseFile(ctx, u, keyring, localPath)
+	if err != nil {
+		slog.ErrorContext(ctx, "Rejected release file, signature doesn't match the keyring", "event", "signature", "host", u.Host, "path", u.Path, "keyring", keyring, "error", err)
+		return err
+	}
+	// A valid signature by another key of the keyring may come from a key
+	// which shouldn't sign this repository, e.g. a compromised one.
+	if len(pinned) > 0 && !slices.ContainsFunc(fingerprints, func(fingerprint string) bool {
+		return slices.Contains(pinned, fingerprint)
+	}) {
+		err := fmt.Errorf("%w: signed by unexpected key %s", errInvalidSignature, strings.Join(fingerprints, ", "))
+		slog.ErrorContext(ctx, "Rejected release file, signed by a key which isn't pinned", "event", "signature", "host", u.Host, "path", u.Path, "keyring", keyring, "fingerprints", fingerprints, "pinned", pinned)
+		return err
+	}
+	slog.DebugContext(ctx, "Verified release file signature", "event", "signature", "host", u.Host, "path", u.Path, "keyring", keyring, "fingerprints", fingerprints)
+
+	if hash, err := GenerateSHA256Hash(localPath); err == nil {
+		c.verifiedSignatures.Store(c.buildLocalPath(u), hash)
+	}
+	return nil
+}
+
+// checkCachedSignature verifies the cached release file at localPath for the
+// URL u, unless it was verified since the start with the content described by
+// entry. This covers files cached before a keyring was configured for their
+// repository. Other files are accepted.
+func (c *FSCache) checkCachedSignature(ctx context.Context, u *url.URL, localPath string, entry AccessEntry) error {
+	if !c.checksSignature(u) {
+		return nil
+	}
+
+	hash := entry.SHA256
+	if hash == "" {
+		var err error
+		if hash, err = GenerateSHA256Hash(localPath); err != nil {
+			return err
+		}
+	}
+	if verified, ok := c.verifiedSignatures.Load(localPath); ok && verified == hash {
+		return nil
+	}
+	return c.checkSignature(ctx, u, localPath)
+}
+
+// verifyReleaseFile checks the signature of the release file at localPath for
+// the URL u. The counterpart of a Release file or its detached signature
+// Release.gpg is fetched from upstream, so both are of the same release.
+func (c *FSCache) verifyReleaseFile(ctx context.Context, u *url.URL, keyring, localPath string) ([]string, error) {
+	var counterpart string
+	switch path.Base(u.Path) {
+	case "Release":
+		counterpart = "Release.gpg"
+	case "Release.gpg":
+		counterpart = "Release"
+	default:
+		return verifySignature(ctx, keyring, localPath)
+	}
+
+	counterpartPath, err := c.fetchReleaseCounterpart(ctx, u, counterpart)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(counterpartPath)
+
+	// gpgv expects the detached signature first.
+	if counterpart == "Release.gpg" {
+		return verifySignature(ctx, keyring, counterpartPath, localPath)
+	}
+	return verifySignature(ctx, keyring, localPath, counterpartPath)
+}
+
+// fetchReleaseCounterpart downloads the file name next to the release file at
+// u from upstream into a temporary file and returns its path.
+func (c *FSCache) fetchReleaseCounterpart(ctx context.Context, u *url.URL, name string) (string, error) {
+	counterpartURL := *u
+	counterpartURL.Path = path.Join(path.Dir(u.Path), name)
+	counterpartURL.RawPath = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, counterpartURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %w", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: fetching %s: status %d", errInvalidSignature, name, resp.StatusCode)
+	}
+
+	file, err := os.CreateTemp("", "goaptcacher-release-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("fetching %s: %w", name, err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// verifySignature checks the signature of files with gpgv against the keys in
+// keyring, files being an InRelease file or a detached signature followed by
+// the signed file. It returns the fingerprints of the keys which made a valid
+// signature, followed by their primary key if signed by a subkey. As in apt,
+// at least one valid signature is required and a bad signature rejects the
+// file.
+func verifySignature(ctx context.Context, keyring string, files ...string) ([]string, error) {
+	data, err := os.ReadFile(keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	// gpgv neither reads armored keyrings nor should it use the keys of the
+	// user, so the keyring is written to an empty home directory.
+	home, err := os.MkdirTemp("", "goaptcacher-gpgv-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(home)
+
+	if keys, ok := dearmorKeyring(data); ok {
+		data = keys
+	}
+	keyringPath := filepath.Join(home, "keyring.gpg")
+	if err := os.WriteFile(keyringPath, data, 0600); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "gpgv", append([]string{"--homedir", home, "--status-fd", "1", "--keyring", keyringPath}, files...)...)
+	output, err := cmd.Output()
+	// gpgv exits with an error if any signature can't be verified, which is
+	// evaluated from the status lines.
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return nil, err
+	}
+
+	var fingerprints, missing []string
+	for line := range strings.Lines(string(output)) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+		switch fields[1] {
+		case "VALIDSIG":
+			fingerprints = append(fingerprints, fields[2])
+			// The fingerprint of the primary key is the last field.
+			if primary := fields[len(fields)-1]; len(fields) >= 12 && primary != fields[2] {
+				fingerprints = append(fingerprints, primary)
+			}
+		case "BADSIG":
+			return nil, fmt.Errorf("%w: bad signature by key %s", errInvalidSignature, fields[2])
+		case "NO_PUBKEY":
+			missing = append(missing, fields[2])
+		}
+	}
+
+	switch {
+	case len(fingerprints) > 0:
+		return fingerprints, nil
+	case len(missing) > 0:
+		return nil, fmt.Errorf("%w: signed by key %s which is not in the keyring", errInvalidSignature, strings.Join(missing, ", "))
+	default:
+		return nil, fmt.Errorf("%w: no valid signature", errInvalidSignature)
+	}
+}
+
+// dearmorKeyring returns the binary keys of an ASCII armored key file. ok is
+// false if data isn't armored.
+func dearmorKeyring(data []byte) (keys []byte, ok bool) {
+	const begin, end = "-----BEGIN PGP PUBLIC KEY BLOCK-----", "-----END PGP PUBLIC KEY BLOCK-----"
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	for {
+		_, block, found := strings.Cut(text, begin)
+		if !found {
+			return keys, ok
+		}
+		block, text, found = strings.Cut(block, end)
+		if !found {
+			return keys, ok
+		}
+
+		// The armor headers end with an empty line, the data with the
+		// checksum line starting with "=".
+		_, body, found := strings.Cut(block, "\n\n")
+		if !found {
+			continue
+		}
+		var encoded strings.Builder
+		for line := range strings.Lines(body) {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "=") {
+				break
+			}
+			encoded.WriteString(line)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded.String())
+		if err != nil {
+			continue
+		}
+		keys, ok = append(keys, decoded...), true
+	}
+}
+
+// heldResponse buffers a response until it is released, so a downloaded
+// release file can be verified before the client receives it.
+type heldResponse struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newHeldResponse(w http.ResponseWriter, r *http.Request) *heldResponse {
+	return &heldResponse{w: w, r: r, header: http.Header{}}
+}
+
+func (h *heldResponse) Header() http.Header {
+	return h.header
+}
+
+func (h *heldResponse) WriteHeader(status int) {
+	if h.status == 0 {
+		h.status = status
+	}
+}
+
+func (h *heldResponse) Write(p []byte) (int, error) {
+	h.WriteHeader(http.StatusOK)
+	return h.body.Write(p)
+}
+
+// discard drops the buffered response, so another one can be sent.
+func (h *heldResponse) discard() {
+	h.status = 0
+	h.body.Reset()
+}
+
+// Abort drops the buffered response of an incomplete download. Nothing was
+// sent yet, so the client gets an error instead.
+func (h *heldResponse) Abort() {
+	h.discard()
+	Error(h.w, h.r, http.StatusBadGateway, "incomplete_download", "Incomplete download")
+}
+
+// release sends the buffered response to the client.
+func (h *heldResponse) release() {
+	if h.status == 0 {
+		return
+	}
+	for name, values := range h.header {
+		h.w.Header()[name] = values
+	}
+	h.w.WriteHeader(h.status)
+	_, _ = h.body.WriteTo(h.w)
+}
@@ -0,0 +1,428 @@
+package fscache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSigningKey is an OpenPGP key in its own gpg home directory.
+type testSigningKey struct {
+	home  string
+	email string
+}
+
+func newTestSigningKey(t *testing.T, name string) testSigningKey {
+	t.Helper()
+	for _, tool := range []string{"gpg", "gpgv"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+
+	// A short path keeps the socket of the gpg agent below the length limit.
+	home, err := os.MkdirTemp("", "gpg")
+	if err != nil {
+		t.Fatalf("failed to create gpg home: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+		_ = os.RemoveAll(home)
+	})
+
+	key := testSigningKey{home: home, email: name + "@example.com"}
+	key.run(t, "", "--quick-gen-key", name+" <"+key.email+">", "ed25519", "sign", "never")
+	return key
+}
+
+func (k testSigningKey) run(t *testing.T, stdin string, args ...string) []byte {
+	t.Helper()
+	cmd := exec.Command("gpg", append([]string{"--homedir", k.home, "--batch", "--quiet", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("gpg %v failed: %v: %s", args, err, stderr.String())
+	}
+	return output
+}
+
+// keyring writes the public key to a file and returns its path.
+func (k testSigningKey) keyring(t *testing.T, armor bool) string {
+	t.Helper()
+	args := []string{"--export", k.email}
+	name := "keyring.gpg"
+	if armor {
+		args = []string{"--armor", "--export", k.email}
+		name = "keyring.asc"
+	}
+	keyringPath := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(keyringPath, k.run(t, "", args...), 0o644); err != nil {
+		t.Fatalf("failed to write keyring: %v", err)
+	}
+	return keyringPath
+}
+
+// fingerprint returns the fingerprint of the key.
+func (k testSigningKey) fingerprint(t *testing.T) string {
+	t.Helper()
+	for line := range strings.Lines(string(k.run(t, "", "--with-colons", "--fingerprint", k.email))) {
+		if fields := strings.Split(line, ":"); fields[0] == "fpr" && len(fields) > 9 {
+			return fields[9]
+		}
+	}
+	t.Fatalf("no fingerprint found for %s", k.email)
+	return ""
+}
+
+// sign returns release as InRelease file signed by the key.
+func (k testSigningKey) sign(t *testing.T, release string) string {
+	t.Helper()
+	return string(k.run(t, release, "--local-user", k.email, "--clearsign"))
+}
+
+// signDetached returns the ASCII armored detached signature of release by the
+// key, as published in Release.gpg.
+func (k testSigningKey) signDetached(t *testing.T, release string) string {
+	t.Helper()
+	return string(k.run(t, release, "--local-user", k.email, "--armor", "--detach-sign"))
+}
+
+// signedMirror serves the release files in releases by path.
+type signedMirror struct {
+	mu       sync.Mutex
+	releases map[string]string
+}
+
+func (m *signedMirror) set(path, release string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.releases[path] = release
+}
+
+func (m *signedMirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	release, ok := m.releases[r.URL.Path]
+	m.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = w.Write([]byte(release))
+}
+
+// newSignedByCache returns a cache which checks the InRelease files of
+// /repo-a/ with the armored keyring of a and those of /repo-b/ with the
+// binary keyring of b, and the URL of the mirror serving them.
+func newSignedByCache(t *testing.T, a, b testSigningKey) (*FSCache, *signedMirror, string) {
+	t.Helper()
+
+	mirror := &signedMirror{releases: map[string]string{}}
+	upstream := httptest.NewServer(mirror)
+	t.Cleanup(upstream.Close)
+
+	keyringA, keyringB := a.keyring(t, true), b.keyring(t, false)
+	cache := newTestFSCache(t)
+	if err := cache.SetSignedBy(func(u *url.URL) (string, []string) {
+		switch {
+		case strings.HasPrefix(u.Path, "/repo-a/"):
+			return keyringA, nil
+		case strings.HasPrefix(u.Path, "/repo-b/"):
+			return keyringB, nil
+		default:
+			return "", nil
+		}
+	}); err != nil {
+		t.Fatalf("SetSignedBy() error = %v", err)
+	}
+	return cache, mirror, upstream.URL
+}
+
+func TestSignedByChecksEachRepositoryWithItsKeyring(t *testing.T) {
+	a, b := newTestSigningKey(t, "repo-a"), newTestSigningKey(t, "repo-b")
+	cache, mirror, upstream := newSignedByCache(t, a, b)
+
+	releaseA := a.sign(t, "Origin: A\nSuite: stable\n")
+	mirror.set("/repo-a/dists/stable/InRelease", releaseA)
+	mirror.set("/repo-b/dists/stable/InRelease", a.sign(t, "Origin: B\nSuite: stable\n"))
+
+	fetch := func(path string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(http.MethodGet, upstream+path, nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequestCacheMiss(req, rr, 0)
+		return rr, cache.buildLocalPath(req.URL)
+	}
+
+	rr, localPath := fetch("/repo-a/dists/stable/InRelease")
+	if rr.Code != http.StatusOK || rr.Body.String() != releaseA {
+		t.Fatalf("repo-a response = %d %q, want 200 with the signed release", rr.Code, rr.Body.String())
+	}
+	if _, err := os.Stat(localPath); err != nil {
+		t.Fatalf("repo-a InRelease not cached: %v", err)
+	}
+
+	// repo-b signed by the key of repo-a is rejected.
+	rr, localPath = fetch("/repo-b/dists/stable/InRelease")
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("repo-b response = %d, want %d", rr.Code, http.StatusBadGateway)
+	}
+	if strings.Contains(rr.Body.String(), "Origin: B") {
+		t.Fatalf("rejected release was sent to the client: %q", rr.Body.String())
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("rejected InRelease was cached, Stat() error = %v", err)
+	}
+
+	releaseB := b.sign(t, "Origin: B\nSuite: stable\n")
+	mirror.set("/repo-b/dists/stable/InRelease", releaseB)
+	rr, _ = fetch("/repo-b/dists/stable/InRelease")
+	if rr.Code != http.StatusOK || rr.Body.String() != releaseB {
+		t.Fatalf("repo-b response = %d %q, want 200 with the signed release", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSignedByRejectsUnpinnedKey(t *testing.T) {
+	pinned, other := newTestSigningKey(t, "pinned"), newTestSigningKey(t, "other")
+
+	// The keyring holds both keys, only one of them may sign.
+	keyringPath := filepath.Join(t.TempDir(), "keyring.gpg")
+	keys := append(pinned.run(t, "", "--export", pinned.email), other.run(t, "", "--export", other.email)...)
+	if err := os.WriteFile(keyringPath, keys, 0o644); err != nil {
+		t.Fatalf("failed to write keyring: %v", err)
+	}
+
+	mirror := &signedMirror{releases: map[string]string{}}
+	upstream := httptest.NewServer(mirror)
+	defer upstream.Close()
+
+	cache := newTestFSCache(t)
+	if err := cache.SetSignedBy(func(*url.URL) (string, []string) {
+		return keyringPath, []string{pinned.fingerprint(t)}
+	}); err != nil {
+		t.Fatalf("SetSignedBy() error = %v", err)
+	}
+
+	fetch := func() (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+"/debian/dists/stable/InRelease", nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequestCacheMiss(req, rr, 0)
+		return rr, cache.buildLocalPath(req.URL)
+	}
+
+	mirror.set("/debian/dists/stable/InRelease", other.sign(t, "Origin: Debian\nSuite: stable\n"))
+	rr, localPath := fetch()
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("response for unpinned key = %d, want %d", rr.Code, http.StatusBadGateway)
+	}
+	if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+		t.Fatalf("release signed by unpinned key was cached, Stat() error = %v", err)
+	}
+
+	release := pinned.sign(t, "Origin: Debian\nSuite: stable\n")
+	mirror.set("/debian/dists/stable/InRelease", release)
+	rr, _ = fetch()
+	if rr.Code != http.StatusOK || rr.Body.String() != release {
+		t.Fatalf("response for pinned key = %d %q, want 200 with the signed release", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSignedByRejectsUnpinnedKeyOnReleaseFallback(t *testing.T) {
+	pinned, other := newTestSigningKey(t, "pinned"), newTestSigningKey(t, "other")
+
+	keyringPath := filepath.Join(t.TempDir(), "keyring.gpg")
+	keys := append(pinned.run(t, "", "--export", pinned.email), other.run(t, "", "--export", other.email)...)
+	if err := os.WriteFile(keyringPath, keys, 0o644); err != nil {
+		t.Fatalf("failed to write keyring: %v", err)
+	}
+
+	mirror := &signedMirror{releases: map[string]string{}}
+	upstream := httptest.NewServer(mirror)
+	defer upstream.Close()
+
+	cache := newTestFSCache(t)
+	if err := cache.SetSignedBy(func(*url.URL) (string, []string) {
+		return keyringPath, []string{pinned.fingerprint(t)}
+	}); err != nil {
+		t.Fatalf("SetSignedBy() error = %v", err)
+	}
+
+	fetch := func(path string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(http.MethodGet, upstream.URL+path, nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequestCacheMiss(req, rr, 0)
+		return rr, cache.buildLocalPath(req.URL)
+	}
+
+	// A client falling back from InRelease to Release and Release.gpg gets
+	// neither if they are signed by a key which isn't pinned.
+	release := "Origin: Debian\nSuite: stable\n"
+	mirror.set("/debian/dists/stable/Release", release)
+	mirror.set("/debian/dists/stable/Release.gpg", other.signDetached(t, release))
+	for _, path := range []string{"/debian/dists/stable/Release", "/debian/dists/stable/Release.gpg"} {
+		rr, localPath := fetch(path)
+		if rr.Code != http.StatusBadGateway {
+			t.Fatalf("%s response for unpinned key = %d, want %d", path, rr.Code, http.StatusBadGateway)
+		}
+		if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+			t.Fatalf("%s signed by unpinned key was cached, Stat() error = %v", path, err)
+		}
+	}
+
+	mirror.set("/debian/dists/stable/Release.gpg", pinned.signDetached(t, release))
+	for _, path := range []string{"/debian/dists/stable/Release", "/debian/dists/stable/Release.gpg"} {
+		if rr, _ := fetch(path); rr.Code != http.StatusOK {
+			t.Fatalf("%s response for pinned key = %d, want 200", path, rr.Code)
+		}
+	}
+}
+
+func TestSignedByKeepsCachedReleaseOnInvalidRefresh(t *testing.T) {
+	a, b := newTestSigningKey(t, "repo-a"), newTestSigningKey(t, "repo-b")
+	cache, mirror, upstream := newSignedByCache(t, a, b)
+
+	releaseURL := mustParseURL(t, upstream+"/repo-a/dists/stable/InRelease")
+	cached := a.sign(t, "Origin: A\nSuite: stable\nVersion: 1\n")
+	localPath := cache.buildLocalPath(releaseURL)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("failed to create cache directory: %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(cached), 0o644); err != nil {
+		t.Fatalf("failed to write cached file: %v", err)
+	}
+	entry := AccessEntry{LastChecked: time.Now().Add(-time.Hour), URL: releaseURL, Size: int64(len(cached))}
+	if err := cache.Set(0, releaseURL.Host, releaseURL.Path, entry); err != nil {
+		t.Fatalf("failed to seed release entry: %v", err)
+	}
+
+	mirror.set(releaseURL.Path, b.sign(t, "Origin: A\nSuite: stable\nVersion: 2\n"))
+	refreshed, err := cache.refreshFile(context.Background(), localPath, releaseURL, entry)
+	if refreshed || !errors.Is(err, errInvalidSignature) {
+		t.Fatalf("refreshFile() = %v, %v, want errInvalidSignature", refreshed, err)
+	}
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		t.Fatalf("failed reading cached release: %v", err)
+	}
+	if string(data) != cached {
+		t.Fatalf("cached release was replaced by %q", data)
+	}
+}
+
+func TestSignedByChecksReleaseAgainstReleaseGPG(t *testing.T) {
+	a, b := newTestSigningKey(t, "repo-a"), newTestSigningKey(t, "repo-b")
+	cache, mirror, upstream := newSignedByCache(t, a, b)
+
+	release := "Origin: A\nSuite: stable\n"
+	mirror.set("/repo-a/dists/stable/Release", release)
+	mirror.set("/repo-a/dists/stable/Release.gpg", a.signDetached(t, release))
+	// The detached signature of testing is made by the key of repo-b.
+	mirror.set("/repo-a/dists/testing/Release", "Origin: A\nSuite: testing\n")
+	mirror.set("/repo-a/dists/testing/Release.gpg", b.signDetached(t, "Origin: A\nSuite: testing\n"))
+	// unsigned has no Release.gpg.
+	mirror.set("/repo-a/dists/unsigned/Release", "Origin: A\nSuite: unsigned\n")
+
+	fetch := func(path string) (*httptest.ResponseRecorder, string) {
+		req := httptest.NewRequest(http.MethodGet, upstream+path, nil)
+		rr := httptest.NewRecorder()
+		cache.serveGETRequestCacheMiss(req, rr, 0)
+		return rr, cache.buildLocalPath(req.URL)
+	}
+
+	for _, path := range []string{"/repo-a/dists/stable/Release", "/repo-a/dists/stable/Release.gpg"} {
+		rr, localPath := fetch(path)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s response = %d, want 200", path, rr.Code)
+		}
+		if _, err := os.Stat(localPath); err != nil {
+			t.Fatalf("%s not cached: %v", path, err)
+		}
+	}
+
+	for _, path := range []string{"/repo-a/dists/testing/Release", "/repo-a/dists/testing/Release.gpg", "/repo-a/dists/unsigned/Release"} {
+		rr, localPath := fetch(path)
+		if rr.Code != http.StatusBadGateway {
+			t.Fatalf("%s response = %d, want %d", path, rr.Code, http.StatusBadGateway)
+		}
+		if strings.Contains(rr.Body.String(), "Origin: A") {
+			t.Fatalf("%s: rejected release was sent to the client: %q", path, rr.Body.String())
+		}
+		if _, err := os.Stat(localPath); !os.IsNotExist(err) {
+			t.Fatalf("%s: rejected file was cached, Stat() error = %v", path, err)
+		}
+	}
+}
+
+func TestSignedByVerifiesCachedReleaseOnFirstHit(t *testing.T) {
+	a, b := newTestSigningKey(t, "repo-a"), newTestSigningKey(t, "repo-b")
+	cache, mirror, upstream := newSignedByCache(t, a, b)
+
+	// The file was cached before signed_by was configured.
+	releaseURL := mustParseURL(t, upstream+"/repo-a/dists/stable/InRelease")
+	cached := b.sign(t, "Origin: A\nSuite: stable\nVersion: 1\n")
+	localPath := cache.buildLocalPath(releaseURL)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("failed to create cache directory: %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(cached), 0o644); err != nil {
+		t.Fatalf("failed to write cached file: %v", err)
+	}
+	entry := AccessEntry{LastChecked: time.Now(), URL: releaseURL, Size: int64(len(cached))}
+	if err := cache.Set(0, releaseURL.Host, releaseURL.Path, entry); err != nil {
+		t.Fatalf("failed to seed release entry: %v", err)
+	}
+
+	release := a.sign(t, "Origin: A\nSuite: stable\nVersion: 2\n")
+	mirror.set(releaseURL.Path, release)
+
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(httptest.NewRequest(http.MethodGet, releaseURL.String(), nil), rr)
+		return rr
+	}
+
+	if rr := get(); rr.Code != http.StatusOK || rr.Body.String() != release {
+		t.Fatalf("first hit = %d %q, want 200 with the release signed by repo-a", rr.Code, rr.Body.String())
+	}
+	if got := cache.Repairs()[RepairInvalidSignature]; got != 1 {
+		t.Fatalf("invalid_signature repairs = %d, want 1", got)
+	}
+
+	// The verified file is served from the cache without checking it again.
+	mirror.set(releaseURL.Path, a.sign(t, "Origin: A\nSuite: stable\nVersion: 3\n"))
+	if rr := get(); rr.Code != http.StatusOK || rr.Body.String() != release {
+		t.Fatalf("second hit = %d %q, want 200 with the cached release", rr.Code, rr.Body.String())
+	}
+}
+
+func TestDearmorKeyring(t *testing.T) {
+	key := newTestSigningKey(t, "repo-a")
+
+	armored, err := os.ReadFile(key.keyring(t, true))
+	if err != nil {
+		t.Fatalf("failed reading armored keyring: %v", err)
+	}
+	binary, err := os.ReadFile(key.keyring(t, false))
+	if err != nil {
+		t.Fatalf("failed reading binary keyring: %v", err)
+	}
+
+	got, ok := dearmorKeyring(armored)
+	if !ok || !bytes.Equal(got, binary) {
+		t.Fatalf("dearmorKeyring() = %d bytes, %v, want the %d bytes of the binary keyring", len(got), ok, len(binary))
+	}
+	if _, ok := dearmorKeyring(binary); ok {
+		t.Fatal("dearmorKeyring() of a binary keyring reported armored data")
+	}
+}
@@ -2,20 +2,17 @@ package fscache
 
 import (
 	"bufio"
-	"compress/bzip2"
-	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"time"
-
-	"github.com/ulikunitz/xz"
 )
 
 // StartSourcesVerification starts a background goroutine which
@@ -30,16 +27,23 @@ func (c *FSCache) runSourcesVerification() {
 	// initial delay
 	time.Sleep(time.Minute * 5)
 	for {
-		log.Printf("[INFO:VERIFY] Starting source verification")
-		if err := c.verifySources(); err != nil {
-			log.Printf("[ERROR:VERIFY] %v", err)
+		slog.Info("Starting source verification", "event", "verify")
+		if result, err := c.VerifySources(); err != nil {
+			slog.Error("Source verification failed", "event", "verify", "error", err)
 		} else {
-			log.Printf("[INFO:VERIFY] Source verification completed successfully")
+			slog.Info("Source verification completed successfully", "event", "verify", "files_checked", result.FilesChecked, "marked_for_deletion", result.MarkedForDeletion)
 		}
 		time.Sleep(12 * time.Hour)
 	}
 }
 
+// VerifyResult summarizes a single source verification run.
+type VerifyResult struct {
+	ReleasesChecked   int `json:"releases_checked"`    // Number of InRelease files used as reference
+	FilesChecked      int `json:"files_checked"`       // Number of cached .deb files verified
+	MarkedForDeletion int `json:"marked_for_deletion"` // Number of .deb files marked for deletion
+}
+
 type verificationRecord struct {
 	protocol int
 	domain   string
@@ -52,20 +56,32 @@ type releaseReference struct {
 	url    string
 }
 
+// VerifySources performs a single verification run and returns its result.
+// Concurrent runs are serialized, a second call waits for the running one to
+// finish.
+func (c *FSCache) VerifySources() (VerifyResult, error) {
+	c.verifyMux.Lock()
+	defer c.verifyMux.Unlock()
+
+	return c.verifySources()
+}
+
 // verifySources performs a single verification run.
-func (c *FSCache) verifySources() error {
+func (c *FSCache) verifySources() (VerifyResult, error) {
 	entries, err := c.collectAccessCacheRecords()
 	if err != nil {
-		return err
+		return VerifyResult{}, err
 	}
 
 	// Normalize once so the remaining steps can be simple, focused passes.
 	records := c.normalizeVerificationRecords(entries)
 	releases := collectReleaseReferences(records)
 	packageChecksums := c.collectPackageChecksums(releases)
-	c.verifyDebEntries(records, packageChecksums)
 
-	return nil
+	result := c.verifyDebEntries(records, packageChecksums)
+	result.ReleasesChecked = len(releases)
+
+	return result, nil
 }
 
 func (c *FSCache) normalizeVerificationRecords(records []accessCacheRecord) []verificationRecord {
@@ -130,14 +146,14 @@ func (c *FSCache) collectPackageChecksums(releases []releaseReference) map[strin
 func (c *FSCache) collectReleasePackageChecksums(release releaseReference, checksums map[string]string) {
 	sums, err := fetchReleaseSHA256(c.client, release.url)
 	if err != nil {
-		log.Printf("[WARN:VERIFY] failed to fetch release %s: %v", release.url, err)
+		slog.Warn("Failed to fetch release", "event", "verify", "url", release.url, "error", err)
 		return
 	}
 
 	releaseBase := strings.TrimSuffix(release.url, "InRelease")
 	packagesRootPath, err := resolvePackagesRootPath(releaseBase)
 	if err != nil {
-		log.Printf("[WARN:VERIFY] failed to parse base URL %s: %v", releaseBase, err)
+		slog.Warn("Failed to parse base URL", "event", "verify", "url", releaseBase, "error", err)
 		return
 	}
 
@@ -149,7 +165,7 @@ func (c *FSCache) collectReleasePackageChecksums(release releaseReference, check
 		packagesURL := releaseBase + sum.file
 		packages, err := fetchPackagesIndex(c.client, packagesURL)
 		if err != nil {
-			log.Printf("[WARN:VERIFY] failed to fetch packages %s: %v", packagesURL, err)
+			slog.Warn("Failed to fetch packages", "event", "verify", "url", packagesURL, "error", err)
 			continue
 		}
 
@@ -177,41 +193,46 @@ func isPackagesIndexFile(file string) bool {
 		strings.HasSuffix(file, "Packages.bz2")
 }
 
-func (c *FSCache) verifyDebEntries(records []verificationRecord, packageChecksums map[string]string) {
+func (c *FSCache) verifyDebEntries(records []verificationRecord, packageChecksums map[string]string) VerifyResult {
+	var result VerifyResult
 	for _, record := range records {
 		if !strings.HasSuffix(record.path, ".deb") {
 			continue
 		}
-		c.verifyDebEntry(record, packageChecksums)
+		result.FilesChecked++
+		if c.verifyDebEntry(record, packageChecksums) {
+			result.MarkedForDeletion++
+		}
 	}
+	return result
 }
 
-func (c *FSCache) verifyDebEntry(record verificationRecord, packageChecksums map[string]string) {
+// verifyDebEntry verifies a single .deb file and reports if it was marked for
+// deletion.
+func (c *FSCache) verifyDebEntry(record verificationRecord, packageChecksums map[string]string) bool {
 	expectedChecksum, found := packageChecksums[record.domain+record.path]
 	if !found {
-		log.Printf("[INFO:VERIFY] %s%s not found in packages index, marking for deletion", record.domain, record.path)
+		slog.Info("File not found in packages index, marking for deletion", "event", "verify", "host", record.domain, "path", record.path)
 		c.MarkForDeletion(record.protocol, record.domain, record.path)
-		return
+		return true
 	}
 
 	localPath := c.buildLocalPath(record.entry.URL)
 	actualChecksum, err := sha256File(localPath)
 	if err != nil {
-		return
+		return false
 	}
 
 	if actualChecksum == expectedChecksum {
-		return
+		// A mark of an earlier run, e.g. with an incomplete index, is revoked.
+		c.UnmarkForDeletion(record.protocol, record.domain, record.path)
+		return false
 	}
 
-	log.Printf(
-		"[INFO:VERIFY] %s%s checksum mismatch: expected %s, got %s, marking for deletion",
-		record.domain,
-		record.path,
-		expectedChecksum,
-		actualChecksum,
-	)
+	slog.Info("Checksum mismatch, marking for deletion", "event", "verify", "host", record.domain, "path", record.path, "expected", expectedChecksum, "actual", actualChecksum)
+	c.noteRepair(context.Background(), RepairVerificationMismatch, record.domain, record.path)
 	c.MarkForDeletion(record.protocol, record.domain, record.path)
+	return true
 }
 
 func sha256File(p string) (string, error) {
@@ -292,31 +313,10 @@ func fetchPackagesIndex(client *http.Client, u string) (map[string]string, error
 		return nil, errors.New("failed to fetch packages index: " + resp.Status)
 	}
 
-	var reader io.Reader = resp.Body
-
-	switch {
-	case strings.HasSuffix(u, ".gz"):
-		gz, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		defer gz.Close()
-		reader = gz
-
-	case strings.HasSuffix(u, ".bz2"):
-		bz2a := bzip2.NewReader(resp.Body)
-		if bz2a == nil {
-			return nil, errors.New("failed to create bzip2 reader")
-		}
-		reader = bz2a
-
-	case strings.HasSuffix(u, ".xz"):
-		xza, err := xz.NewReader(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		reader = xza
-
+	_, ext := splitCompression(u)
+	reader, err := decompressReader(ext, resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
 	return parsePackages(reader), nil
@@ -47,8 +47,12 @@ func TestVerifySourcesMarksDebMissingFromPackagesIndex(t *testing.T) {
 		t.Fatalf("failed to seed deb entry: %v", err)
 	}
 
-	if err := cache.verifySources(); err != nil {
-		t.Fatalf("verifySources() returned error: %v", err)
+	result, err := cache.VerifySources()
+	if err != nil {
+		t.Fatalf("VerifySources() returned error: %v", err)
+	}
+	if want := (VerifyResult{ReleasesChecked: 1, FilesChecked: 1, MarkedForDeletion: 1}); result != want {
+		t.Fatalf("VerifySources() = %+v, want %+v", result, want)
 	}
 
 	record, ok := cache.getAccessCacheRecord(protocol, missingDebURL.Host, missingDebURL.Path)
@@ -104,7 +108,7 @@ func TestVerifySourcesMarksDebChecksumMismatch(t *testing.T) {
 		t.Fatalf("failed to write local deb file: %v", err)
 	}
 
-	if err := cache.verifySources(); err != nil {
+	if _, err := cache.verifySources(); err != nil {
 		t.Fatalf("verifySources() returned error: %v", err)
 	}
 
@@ -167,9 +171,13 @@ func TestVerifySourcesKeepsDebWhenChecksumMatches(t *testing.T) {
 		t.Fatalf("failed to write local deb file: %v", err)
 	}
 
-	if err := cache.verifySources(); err != nil {
+	result, err := cache.verifySources()
+	if err != nil {
 		t.Fatalf("verifySources() returned error: %v", err)
 	}
+	if want := (VerifyResult{ReleasesChecked: 1, FilesChecked: 1}); result != want {
+		t.Fatalf("verifySources() = %+v, want %+v", result, want)
+	}
 
 	record, ok := cache.getAccessCacheRecord(protocol, debURL.Host, debURL.Path)
 	if !ok {
@@ -2,11 +2,13 @@ package fscache
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -23,6 +25,38 @@ type statsEntry struct {
 	TrafficDown    uint64 `json:"traffic_down"`
 	TrafficUp      uint64 `json:"traffic_up"`
 	TunnelTransfer uint64 `json:"tunnel_transfer"`
+	TunnelUpload   uint64 `json:"tunnel_upload"`
+	TunnelDownload uint64 `json:"tunnel_download"`
+
+	TunnelDialTimeouts uint64 `json:"tunnel_dial_timeouts"`
+	TunnelDialRefused  uint64 `json:"tunnel_dial_refused"`
+	TunnelDialErrors   uint64 `json:"tunnel_dial_errors"`
+
+	UpstreamStatus map[int]uint64 `json:"upstream_status,omitempty"`
+
+	Domains map[string]statsDomainEntry `json:"domains,omitempty"`
+}
+
+type statsDomainEntry struct {
+	Requests    uint64 `json:"requests"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	TrafficDown uint64 `json:"traffic_down"`
+	TrafficUp   uint64 `json:"traffic_up"`
+
+	UpstreamStatus map[int]uint64 `json:"upstream_status,omitempty"`
+}
+
+// clone returns a copy of the entry which doesn't share any map.
+func (e *statsEntry) clone() statsEntry {
+	entry := *e
+	entry.UpstreamStatus = maps.Clone(e.UpstreamStatus)
+	entry.Domains = maps.Clone(e.Domains)
+	for domain, domainEntry := range entry.Domains {
+		domainEntry.UpstreamStatus = maps.Clone(domainEntry.UpstreamStatus)
+		entry.Domains[domain] = domainEntry
+	}
+	return entry
 }
 
 type persistedStats struct {
@@ -39,6 +73,16 @@ type StatsDay struct {
 	TrafficDown    uint64
 	TrafficUp      uint64
 	TunnelTransfer uint64
+	TunnelUpload   uint64 // Tunnel traffic sent from clients to upstream
+	TunnelDownload uint64 // Tunnel traffic sent from upstream to clients
+
+	TunnelDialTimeouts uint64 // Tunnels which failed because the target didn't answer in time
+	TunnelDialRefused  uint64 // Tunnels which failed because the target refused the connection
+	TunnelDialErrors   uint64 // Tunnels which failed for other reasons, e.g. DNS errors
+
+	UpstreamStatus map[int]uint64 // Responses of upstream servers by status code
+
+	Domains map[string]StatsDomain // Cached requests per upstream domain
 }
 
 type StatsTotals struct {
@@ -49,6 +93,54 @@ type StatsTotals struct {
 	TrafficDown    uint64
 	TrafficUp      uint64
 	TunnelTransfer uint64
+	TunnelUpload   uint64 // Tunnel traffic sent from clients to upstream
+	TunnelDownload uint64 // Tunnel traffic sent from upstream to clients
+
+	TunnelDialTimeouts uint64 // Tunnels which failed because the target didn't answer in time
+	TunnelDialRefused  uint64 // Tunnels which failed because the target refused the connection
+	TunnelDialErrors   uint64 // Tunnels which failed for other reasons, e.g. DNS errors
+
+	UpstreamStatus map[int]uint64 // Responses of upstream servers by status code
+
+	Domains map[string]StatsDomain // Cached requests per upstream domain
+}
+
+// StatsDomain holds the statistics of cached requests of a single domain.
+type StatsDomain struct {
+	Requests    uint64
+	Hits        uint64
+	Misses      uint64
+	TrafficDown uint64
+	TrafficUp   uint64
+
+	UpstreamStatus map[int]uint64 // Responses of the upstream server by status code
+}
+
+// addTo adds the counters of the entry to the domain statistics in target.
+func (e statsDomainEntry) addTo(target map[string]StatsDomain, domain string) {
+	stats := target[domain]
+	stats.Requests += e.Requests
+	stats.Hits += e.Hits
+	stats.Misses += e.Misses
+	stats.TrafficDown += e.TrafficDown
+	stats.TrafficUp += e.TrafficUp
+	stats.UpstreamStatus = addStatusCounts(stats.UpstreamStatus, e.UpstreamStatus)
+	target[domain] = stats
+}
+
+// addStatusCounts adds the counters of source to target, which is created if
+// necessary.
+func addStatusCounts(target, source map[int]uint64) map[int]uint64 {
+	if len(source) == 0 {
+		return target
+	}
+	if target == nil {
+		target = make(map[int]uint64, len(source))
+	}
+	for status, count := range source {
+		target[status] += count
+	}
+	return target
 }
 
 type StatsSnapshot struct {
@@ -60,7 +152,7 @@ type StatsSnapshot struct {
 func (s StatsSnapshot) ToJSON() ([]byte, error) {
 	daily := make([]any, len(s.Daily))
 	for i, day := range s.Daily {
-		daily[i] = map[string]any{
+		dayData := map[string]any{
 			"date":            day.Date.Format("2006-01-02"),
 			"requests":        day.Requests,
 			"hits":            day.Hits,
@@ -69,19 +161,46 @@ func (s StatsSnapshot) ToJSON() ([]byte, error) {
 			"traffic_down":    day.TrafficDown,
 			"traffic_up":      day.TrafficUp,
 			"tunnel_transfer": day.TunnelTransfer,
+			"tunnel_upload":   day.TunnelUpload,
+			"tunnel_download": day.TunnelDownload,
+
+			"tunnel_dial_timeouts": day.TunnelDialTimeouts,
+			"tunnel_dial_refused":  day.TunnelDialRefused,
+			"tunnel_dial_errors":   day.TunnelDialErrors,
 		}
+		if len(day.UpstreamStatus) > 0 {
+			dayData["upstream_status"] = day.UpstreamStatus
+		}
+		if len(day.Domains) > 0 {
+			dayData["domains"] = domainsToJSON(day.Domains)
+		}
+		daily[i] = dayData
+	}
+
+	totals := map[string]any{
+		"requests":        s.Totals.Requests,
+		"hits":            s.Totals.Hits,
+		"misses":          s.Totals.Misses,
+		"tunnel":          s.Totals.Tunnel,
+		"traffic_down":    s.Totals.TrafficDown,
+		"traffic_up":      s.Totals.TrafficUp,
+		"tunnel_transfer": s.Totals.TunnelTransfer,
+		"tunnel_upload":   s.Totals.TunnelUpload,
+		"tunnel_download": s.Totals.TunnelDownload,
+
+		"tunnel_dial_timeouts": s.Totals.TunnelDialTimeouts,
+		"tunnel_dial_refused":  s.Totals.TunnelDialRefused,
+		"tunnel_dial_errors":   s.Totals.TunnelDialErrors,
+	}
+	if len(s.Totals.UpstreamStatus) > 0 {
+		totals["upstream_status"] = s.Totals.UpstreamStatus
+	}
+	if len(s.Totals.Domains) > 0 {
+		totals["domains"] = domainsToJSON(s.Totals.Domains)
 	}
 
 	data := map[string]any{
-		"totals": map[string]any{
-			"requests":        s.Totals.Requests,
-			"hits":            s.Totals.Hits,
-			"misses":          s.Totals.Misses,
-			"tunnel":          s.Totals.Tunnel,
-			"traffic_down":    s.Totals.TrafficDown,
-			"traffic_up":      s.Totals.TrafficUp,
-			"tunnel_transfer": s.Totals.TunnelTransfer,
-		},
+		"totals":     totals,
 		"daily":      daily,
 		"oldest_day": s.OldestDay.Format("2006-01-02"),
 	}
@@ -89,6 +208,24 @@ func (s StatsSnapshot) ToJSON() ([]byte, error) {
 	return json.Marshal(data)
 }
 
+func domainsToJSON(domains map[string]StatsDomain) map[string]any {
+	result := make(map[string]any, len(domains))
+	for domain, stats := range domains {
+		domainData := map[string]any{
+			"requests":     stats.Requests,
+			"hits":         stats.Hits,
+			"misses":       stats.Misses,
+			"traffic_down": stats.TrafficDown,
+			"traffic_up":   stats.TrafficUp,
+		}
+		if len(stats.UpstreamStatus) > 0 {
+			domainData["upstream_status"] = stats.UpstreamStatus
+		}
+		result[domain] = domainData
+	}
+	return result
+}
+
 func (c *FSCache) statsFilePath() string {
 	return filepath.Join(c.CachePath, statsFileName)
 }
@@ -107,7 +244,7 @@ func (c *FSCache) startStatsFlushLoop() {
 			select {
 			case <-ticker.C:
 				if err := c.flushStatsToDisk(); err != nil {
-					log.Printf("[WARN:STATS] failed to persist stats: %v", err)
+					slog.Warn("Failed to persist stats", "event", "stats", "error", err)
 				}
 			case <-c.statsStop:
 				return
@@ -148,7 +285,17 @@ func (c *FSCache) loadStatsFromDisk() error {
 	return nil
 }
 
+// FlushStats writes the stats to disk immediately instead of waiting for the
+// next periodic flush.
+func (c *FSCache) FlushStats() error {
+	return c.flushStatsToDisk()
+}
+
 func (c *FSCache) flushStatsToDisk() error {
+	// Concurrent flushes would write the same temporary file.
+	c.statsFlushMux.Lock()
+	defer c.statsFlushMux.Unlock()
+
 	c.statsMux.RLock()
 	if !c.statsDirty {
 		c.statsMux.RUnlock()
@@ -158,7 +305,7 @@ func (c *FSCache) flushStatsToDisk() error {
 	revision := c.statsRevision
 	daily := make(map[string]statsEntry, len(c.statsByDate))
 	for day, entry := range c.statsByDate {
-		daily[day] = *entry
+		daily[day] = entry.clone()
 	}
 	c.statsMux.RUnlock()
 
@@ -205,19 +352,48 @@ func (c *FSCache) dayStatsLocked(day string) *statsEntry {
 
 // TrackRequest updates request statistics for cache hits and misses.
 func (c *FSCache) TrackRequest(cacheHit bool, transferred int64) error {
+	return c.TrackDomainRequest("", cacheHit, transferred)
+}
+
+// TrackDomainRequest updates request statistics for cache hits and misses and
+// additionally accounts the request to the given upstream domain.
+func (c *FSCache) TrackDomainRequest(domain string, cacheHit bool, transferred int64) error {
 	transferredBytes := nonNegativeInt64ToUint64(transferred)
+	if cacheHit {
+		c.gauges.add(1, 0, 0, transferredBytes)
+	} else {
+		c.gauges.add(0, 1, transferredBytes, transferredBytes)
+	}
 
 	c.statsMux.Lock()
 	day := time.Now().Format("2006-01-02")
 	entry := c.dayStatsLocked(day)
+	var domainEntry statsDomainEntry
+	if domain != "" {
+		domainEntry = entry.Domains[domain]
+	}
+
 	entry.Requests++
+	domainEntry.Requests++
 	if cacheHit {
 		entry.Hits++
 		entry.TrafficUp += transferredBytes
+		domainEntry.Hits++
+		domainEntry.TrafficUp += transferredBytes
 	} else {
 		entry.Misses++
 		entry.TrafficDown += transferredBytes
 		entry.TrafficUp += transferredBytes
+		domainEntry.Misses++
+		domainEntry.TrafficDown += transferredBytes
+		domainEntry.TrafficUp += transferredBytes
+	}
+
+	if domain != "" {
+		if entry.Domains == nil {
+			entry.Domains = map[string]statsDomainEntry{}
+		}
+		entry.Domains[domain] = domainEntry
 	}
 	c.statsDirty = true
 	c.statsRevision++
@@ -226,9 +402,14 @@ func (c *FSCache) TrackRequest(cacheHit bool, transferred int64) error {
 	return nil
 }
 
-// TrackTunnelRequest updates statistics for tunnel traffic.
-func (c *FSCache) TrackTunnelRequest(transferred int64) error {
-	transferredBytes := nonNegativeInt64ToUint64(transferred)
+// TrackTunnelRequest updates statistics for tunnel traffic. upload is the
+// number of bytes sent from the client to upstream, download the number of
+// bytes sent from upstream to the client.
+func (c *FSCache) TrackTunnelRequest(upload, download int64) error {
+	uploadBytes := nonNegativeInt64ToUint64(upload)
+	downloadBytes := nonNegativeInt64ToUint64(download)
+	transferredBytes := uploadBytes + downloadBytes
+	c.gauges.add(0, 0, transferredBytes, transferredBytes)
 
 	c.statsMux.Lock()
 	day := time.Now().Format("2006-01-02")
@@ -238,6 +419,8 @@ func (c *FSCache) TrackTunnelRequest(transferred int64) error {
 	entry.TrafficDown += transferredBytes
 	entry.TrafficUp += transferredBytes
 	entry.TunnelTransfer += transferredBytes
+	entry.TunnelUpload += uploadBytes
+	entry.TunnelDownload += downloadBytes
 	c.statsDirty = true
 	c.statsRevision++
 	c.statsMux.Unlock()
@@ -245,6 +428,63 @@ func (c *FSCache) TrackTunnelRequest(transferred int64) error {
 	return nil
 }
 
+// TunnelDialFailure describes why a tunnel to the target host couldn't be
+// established.
+type TunnelDialFailure int
+
+const (
+	TunnelDialTimeout TunnelDialFailure = iota // The target didn't answer in time
+	TunnelDialRefused                          // The target refused the connection
+	TunnelDialError                            // Any other error, e.g. DNS resolution
+)
+
+// TrackTunnelDialFailure counts a tunnel which couldn't be established.
+func (c *FSCache) TrackTunnelDialFailure(failure TunnelDialFailure) error {
+	c.statsMux.Lock()
+	day := time.Now().Format("2006-01-02")
+	entry := c.dayStatsLocked(day)
+	switch failure {
+	case TunnelDialTimeout:
+		entry.TunnelDialTimeouts++
+	case TunnelDialRefused:
+		entry.TunnelDialRefused++
+	default:
+		entry.TunnelDialErrors++
+	}
+	c.statsDirty = true
+	c.statsRevision++
+	c.statsMux.Unlock()
+
+	return nil
+}
+
+// trackUpstreamStatus counts a response of the upstream server host with the
+// status code status, in total and for the host.
+func (c *FSCache) trackUpstreamStatus(host string, status int) {
+	c.statsMux.Lock()
+	defer c.statsMux.Unlock()
+
+	entry := c.dayStatsLocked(time.Now().Format("2006-01-02"))
+	if entry.UpstreamStatus == nil {
+		entry.UpstreamStatus = map[int]uint64{}
+	}
+	entry.UpstreamStatus[status]++
+
+	if host != "" {
+		if entry.Domains == nil {
+			entry.Domains = map[string]statsDomainEntry{}
+		}
+		domainEntry := entry.Domains[host]
+		if domainEntry.UpstreamStatus == nil {
+			domainEntry.UpstreamStatus = map[int]uint64{}
+		}
+		domainEntry.UpstreamStatus[status]++
+		entry.Domains[host] = domainEntry
+	}
+	c.statsDirty = true
+	c.statsRevision++
+}
+
 func nonNegativeInt64ToUint64(v int64) uint64 {
 	if v <= 0 {
 		return 0
@@ -263,7 +503,7 @@ func (c *FSCache) GetStatsSnapshot(limit int) StatsSnapshot {
 	c.statsMux.RLock()
 	snapshotDaily := make(map[string]statsEntry, len(c.statsByDate))
 	for day, entry := range c.statsByDate {
-		snapshotDaily[day] = *entry
+		snapshotDaily[day] = entry.clone()
 	}
 	c.statsMux.RUnlock()
 
@@ -286,6 +526,18 @@ func (c *FSCache) GetStatsSnapshot(limit int) StatsSnapshot {
 		stats.Totals.TrafficDown += entry.TrafficDown
 		stats.Totals.TrafficUp += entry.TrafficUp
 		stats.Totals.TunnelTransfer += entry.TunnelTransfer
+		stats.Totals.TunnelUpload += entry.TunnelUpload
+		stats.Totals.TunnelDownload += entry.TunnelDownload
+		stats.Totals.TunnelDialTimeouts += entry.TunnelDialTimeouts
+		stats.Totals.TunnelDialRefused += entry.TunnelDialRefused
+		stats.Totals.TunnelDialErrors += entry.TunnelDialErrors
+		stats.Totals.UpstreamStatus = addStatusCounts(stats.Totals.UpstreamStatus, entry.UpstreamStatus)
+		for domain, domainEntry := range entry.Domains {
+			if stats.Totals.Domains == nil {
+				stats.Totals.Domains = map[string]StatsDomain{}
+			}
+			domainEntry.addTo(stats.Totals.Domains, domain)
+		}
 	}
 
 	if len(keys) > 0 {
@@ -308,6 +560,13 @@ func (c *FSCache) GetStatsSnapshot(limit int) StatsSnapshot {
 		}
 
 		entry := snapshotDaily[day]
+		var domains map[string]StatsDomain
+		if len(entry.Domains) > 0 {
+			domains = make(map[string]StatsDomain, len(entry.Domains))
+			for domain, domainEntry := range entry.Domains {
+				domainEntry.addTo(domains, domain)
+			}
+		}
 		stats.Daily = append(stats.Daily, StatsDay{
 			Date:           parsedDay,
 			Requests:       entry.Requests,
@@ -317,43 +576,119 @@ func (c *FSCache) GetStatsSnapshot(limit int) StatsSnapshot {
 			TrafficDown:    entry.TrafficDown,
 			TrafficUp:      entry.TrafficUp,
 			TunnelTransfer: entry.TunnelTransfer,
+			TunnelUpload:   entry.TunnelUpload,
+			TunnelDownload: entry.TunnelDownload,
+
+			TunnelDialTimeouts: entry.TunnelDialTimeouts,
+			TunnelDialRefused:  entry.TunnelDialRefused,
+			TunnelDialErrors:   entry.TunnelDialErrors,
+
+			UpstreamStatus: entry.UpstreamStatus,
+
+			Domains: domains,
 		})
 	}
 
 	return stats
 }
 
-// GetCacheUsage returns number and total size of cached files tracked by metadata.
+const (
+	// cacheUsageTTL is how long the result of GetCacheUsage is reused, so
+	// repeated loads of the stats page don't scan the cache again.
+	cacheUsageTTL = 30 * time.Second
+
+	// cacheUsageWorkers is the number of files stat'ed at once by
+	// GetCacheUsage.
+	cacheUsageWorkers = 16
+)
+
+// cacheUsage is the last result of GetCacheUsage.
+type cacheUsage struct {
+	mux       sync.Mutex // Held during a scan, so concurrent callers share its result
+	files     uint64
+	size      uint64
+	scannedAt time.Time
+}
+
+// GetCacheUsage returns number and total size of cached files tracked by
+// metadata. Files hard linked by deduplication count once for the size. The
+// result is reused for cacheUsageTTL.
 func (c *FSCache) GetCacheUsage() (uint64, uint64, error) {
-	entries, err := c.collectAccessCacheRecords()
+	c.usage.mux.Lock()
+	defer c.usage.mux.Unlock()
+
+	if !c.usage.scannedAt.IsZero() && time.Since(c.usage.scannedAt) < cacheUsageTTL {
+		return c.usage.files, c.usage.size, nil
+	}
+
+	files, size, err := c.scanCacheUsage()
 	if err != nil {
 		return 0, 0, err
 	}
+	c.usage.files, c.usage.size, c.usage.scannedAt = files, size, time.Now()
+	return files, size, nil
+}
 
-	seen := make(map[string]struct{}, len(entries))
-	var filesCached uint64
-	var totalSize uint64
+// scanCacheUsage stats all files tracked by metadata with cacheUsageWorkers
+// workers. Records resolving to the same local file, e.g. of HTTP and HTTPS
+// URLs, count once.
+func (c *FSCache) scanCacheUsage() (uint64, uint64, error) {
+	entries, err := c.collectAccessCacheRecords()
+	if err != nil {
+		return 0, 0, err
+	}
 
-	for _, record := range entries {
-		entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
-		if entry.URL == nil {
-			continue
-		}
+	var (
+		mux         sync.Mutex
+		seen        = make(map[string]struct{}, len(entries))
+		seenIDs     = make(map[[2]uint64]struct{})
+		filesCached uint64
+		totalSize   uint64
+	)
+
+	next := make(chan accessCacheRecord)
+	var wg sync.WaitGroup
+	for range min(cacheUsageWorkers, len(entries)) {
+		wg.Go(func() {
+			for record := range next {
+				entry := c.normalizeAccessEntry(record.protocol, record.domain, record.path, record.entry)
+				if entry.URL == nil {
+					continue
+				}
 
-		localPath := c.buildLocalPath(entry.URL)
-		if _, ok := seen[localPath]; ok {
-			continue
-		}
-		seen[localPath] = struct{}{}
+				localPath := c.buildLocalPath(entry.URL)
+				mux.Lock()
+				_, duplicate := seen[localPath]
+				seen[localPath] = struct{}{}
+				mux.Unlock()
+				if duplicate {
+					continue
+				}
 
-		info, err := os.Stat(localPath)
-		if err != nil {
-			continue
-		}
+				info, err := os.Stat(localPath)
+				if err != nil {
+					continue
+				}
 
-		filesCached++
-		totalSize += nonNegativeInt64ToUint64(info.Size())
+				mux.Lock()
+				filesCached++
+				id, ok := fileID(info)
+				_, linked := seenIDs[id]
+				if ok {
+					seenIDs[id] = struct{}{}
+				}
+				if !ok || !linked {
+					totalSize += nonNegativeInt64ToUint64(info.Size())
+				}
+				mux.Unlock()
+			}
+		})
+	}
+	for _, record := range entries {
+		next <- record
 	}
+	close(next)
+	wg.Wait()
 
 	return filesCached, totalSize, nil
 }
@@ -1,9 +1,16 @@
 package fscache
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestTrackAndSnapshotIncludesTunnelTraffic(t *testing.T) {
@@ -15,7 +22,7 @@ func TestTrackAndSnapshotIncludesTunnelTraffic(t *testing.T) {
 	if err := cache.TrackRequest(false, 20); err != nil {
 		t.Fatalf("TrackRequest(miss) error = %v", err)
 	}
-	if err := cache.TrackTunnelRequest(30); err != nil {
+	if err := cache.TrackTunnelRequest(10, 20); err != nil {
 		t.Fatalf("TrackTunnelRequest() error = %v", err)
 	}
 
@@ -41,11 +48,125 @@ func TestTrackAndSnapshotIncludesTunnelTraffic(t *testing.T) {
 	if snapshot.Totals.TunnelTransfer != 30 {
 		t.Fatalf("TunnelTransfer = %d, want 30", snapshot.Totals.TunnelTransfer)
 	}
+	if snapshot.Totals.TunnelUpload != 10 || snapshot.Totals.TunnelDownload != 20 {
+		t.Fatalf("TunnelUpload/TunnelDownload = %d/%d, want 10/20", snapshot.Totals.TunnelUpload, snapshot.Totals.TunnelDownload)
+	}
 	if len(snapshot.Daily) != 1 {
 		t.Fatalf("Daily len = %d, want 1", len(snapshot.Daily))
 	}
 }
 
+func TestTrackDomainRequest(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	if err := cache.TrackDomainRequest("deb.debian.org", true, 10); err != nil {
+		t.Fatalf("TrackDomainRequest(hit) error = %v", err)
+	}
+	if err := cache.TrackDomainRequest("deb.debian.org", false, 20); err != nil {
+		t.Fatalf("TrackDomainRequest(miss) error = %v", err)
+	}
+	if err := cache.TrackDomainRequest("archive.ubuntu.com", false, 5); err != nil {
+		t.Fatalf("TrackDomainRequest(miss) error = %v", err)
+	}
+	if err := cache.TrackRequest(true, 1); err != nil {
+		t.Fatalf("TrackRequest() error = %v", err)
+	}
+
+	snapshot := cache.GetStatsSnapshot(1)
+	if snapshot.Totals.Requests != 4 {
+		t.Fatalf("Requests = %d, want 4", snapshot.Totals.Requests)
+	}
+	want := StatsDomain{Requests: 2, Hits: 1, Misses: 1, TrafficDown: 20, TrafficUp: 30}
+	if got := snapshot.Totals.Domains["deb.debian.org"]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Domains[deb.debian.org] = %+v, want %+v", got, want)
+	}
+	if len(snapshot.Totals.Domains) != 2 {
+		t.Fatalf("Domains = %+v, want 2 domains", snapshot.Totals.Domains)
+	}
+	if len(snapshot.Daily) != 1 || snapshot.Daily[0].Domains["archive.ubuntu.com"].Misses != 1 {
+		t.Fatalf("Daily = %+v, want per-domain daily entry", snapshot.Daily)
+	}
+
+	// Domain statistics survive a restart.
+	if err := cache.flushStatsToDisk(); err != nil {
+		t.Fatalf("flushStatsToDisk() error = %v", err)
+	}
+	reloaded := NewFSCache(cache.CachePath)
+	if got := reloaded.GetStatsSnapshot(1).Totals.Domains["deb.debian.org"]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded Domains[deb.debian.org] = %+v, want %+v", got, want)
+	}
+}
+
+func TestTrackTunnelDialFailure(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	for _, failure := range []TunnelDialFailure{TunnelDialTimeout, TunnelDialRefused, TunnelDialRefused, TunnelDialError} {
+		if err := cache.TrackTunnelDialFailure(failure); err != nil {
+			t.Fatalf("TrackTunnelDialFailure(%d) error = %v", failure, err)
+		}
+	}
+
+	snapshot := cache.GetStatsSnapshot(1)
+	if snapshot.Totals.TunnelDialTimeouts != 1 || snapshot.Totals.TunnelDialRefused != 2 || snapshot.Totals.TunnelDialErrors != 1 {
+		t.Fatalf("dial failures = %d/%d/%d, want 1/2/1", snapshot.Totals.TunnelDialTimeouts, snapshot.Totals.TunnelDialRefused, snapshot.Totals.TunnelDialErrors)
+	}
+	if snapshot.Totals.Requests != 0 || snapshot.Totals.Tunnel != 0 {
+		t.Fatalf("Requests/Tunnel = %d/%d, want 0/0", snapshot.Totals.Requests, snapshot.Totals.Tunnel)
+	}
+	if len(snapshot.Daily) != 1 || snapshot.Daily[0].TunnelDialRefused != 2 {
+		t.Fatalf("Daily = %+v, want one day with 2 refused dials", snapshot.Daily)
+	}
+}
+
+func TestTrackUpstreamStatus(t *testing.T) {
+	mirror := newTestMirrorFiles(t, map[string][]byte{"/debian/pool/main/h/hello/hello_1.0_amd64.deb": []byte("package")}).URL
+	cache := newTestFSCache(t)
+
+	for _, urlPath := range []string{"/debian/pool/main/h/hello/hello_1.0_amd64.deb", "/debian/pool/main/m/missing/missing_1.0_amd64.deb"} {
+		cache.serveGETRequest(httptest.NewRequest(http.MethodGet, mirror+urlPath, nil), httptest.NewRecorder())
+	}
+	host := mustParseURL(t, mirror).Host
+	cache.trackUpstreamStatus(host, http.StatusBadGateway)
+	cache.trackUpstreamStatus(host, http.StatusBadGateway)
+
+	want := map[int]uint64{http.StatusOK: 1, http.StatusNotFound: 1, http.StatusBadGateway: 2}
+	snapshot := cache.GetStatsSnapshot(1)
+	if !reflect.DeepEqual(snapshot.Totals.UpstreamStatus, want) {
+		t.Fatalf("UpstreamStatus = %v, want %v", snapshot.Totals.UpstreamStatus, want)
+	}
+	if got := snapshot.Totals.Domains[host].UpstreamStatus; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Domains[%s].UpstreamStatus = %v, want %v", host, got, want)
+	}
+	if len(snapshot.Daily) != 1 || !reflect.DeepEqual(snapshot.Daily[0].UpstreamStatus, want) {
+		t.Fatalf("Daily = %+v, want one day with %v", snapshot.Daily, want)
+	}
+
+	data, err := snapshot.ToJSON()
+	if err != nil {
+		t.Fatalf("ToJSON() error = %v", err)
+	}
+	var decoded struct {
+		Totals struct {
+			UpstreamStatus map[string]uint64 `json:"upstream_status"`
+		} `json:"totals"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if decoded.Totals.UpstreamStatus["502"] != 2 {
+		t.Fatalf("JSON upstream_status = %v, want 2 responses with 502", decoded.Totals.UpstreamStatus)
+	}
+
+	// The counters survive a restart.
+	if err := cache.flushStatsToDisk(); err != nil {
+		t.Fatalf("flushStatsToDisk() error = %v", err)
+	}
+	reloaded := NewFSCache(cache.CachePath)
+	if got := reloaded.GetStatsSnapshot(1).Totals.Domains[host].UpstreamStatus; !reflect.DeepEqual(got, want) {
+		t.Fatalf("reloaded UpstreamStatus = %v, want %v", got, want)
+	}
+}
+
 func TestFlushAndLoadStatsFromDisk(t *testing.T) {
 	cache := newTestFSCache(t)
 	if err := cache.TrackRequest(false, 12); err != nil {
@@ -121,3 +242,90 @@ func TestGetCacheUsageDeduplicatesSameLocalFile(t *testing.T) {
 		t.Fatalf("size = %d, want %d", size, len("payload"))
 	}
 }
+
+// writeCachedFile writes a cached file with metadata for rawURL.
+func writeCachedFile(t *testing.T, cache *FSCache, rawURL, content string) {
+	t.Helper()
+
+	u := mustParseURL(t, rawURL)
+	localPath := cache.buildLocalPath(u)
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(content), 0o644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := cache.Set(DetermineProtocolFromURL(u), u.Host, u.Path, AccessEntry{URL: u}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+}
+
+func TestGetCacheUsageManyFiles(t *testing.T) {
+	cache := newTestFSCache(t)
+	for i := range 200 {
+		writeCachedFile(t, cache, fmt.Sprintf("https://example.com/pool/main/p/pkg%d.deb", i), "payload")
+		// The HTTP URL resolves to the same local file.
+		u := mustParseURL(t, fmt.Sprintf("http://example.com/pool/main/p/pkg%d.deb", i))
+		if err := cache.Set(0, u.Host, u.Path, AccessEntry{URL: u}); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	// Metadata without file isn't counted.
+	missing := mustParseURL(t, "http://example.com/pool/main/m/missing.deb")
+	if err := cache.Set(0, missing.Host, missing.Path, AccessEntry{URL: missing}); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	files, size, err := cache.GetCacheUsage()
+	if err != nil {
+		t.Fatalf("GetCacheUsage() error = %v", err)
+	}
+	if files != 200 || size != 200*uint64(len("payload")) {
+		t.Fatalf("GetCacheUsage() = %d files, %d bytes, want 200 files, %d bytes", files, size, 200*len("payload"))
+	}
+}
+
+func TestGetCacheUsageReusesResult(t *testing.T) {
+	cache := newTestFSCache(t)
+	writeCachedFile(t, cache, "http://example.com/pool/main/a/a.deb", "payload")
+
+	if files, _, err := cache.GetCacheUsage(); err != nil || files != 1 {
+		t.Fatalf("GetCacheUsage() = %d files, %v, want 1 file", files, err)
+	}
+
+	// Files added within cacheUsageTTL are counted by the next scan.
+	writeCachedFile(t, cache, "http://example.com/pool/main/b/b.deb", "payload")
+	if files, _, err := cache.GetCacheUsage(); err != nil || files != 1 {
+		t.Fatalf("GetCacheUsage() = %d files, %v, want cached result of 1 file", files, err)
+	}
+
+	cache.usage.scannedAt = time.Now().Add(-cacheUsageTTL)
+	if files, _, err := cache.GetCacheUsage(); err != nil || files != 2 {
+		t.Fatalf("GetCacheUsage() = %d files, %v, want 2 files after the TTL", files, err)
+	}
+}
+
+func TestFlushStatsConcurrently(t *testing.T) {
+	cache := newTestFSCache(t)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			if err := cache.TrackRequest(i%2 == 0, 1); err != nil {
+				t.Errorf("TrackRequest() error = %v", err)
+			}
+			if err := cache.FlushStats(); err != nil {
+				t.Errorf("FlushStats() error = %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	loaded := &FSCache{CachePath: cache.CachePath, statsByDate: make(map[string]*statsEntry)}
+	if err := loaded.loadStatsFromDisk(); err != nil {
+		t.Fatalf("loadStatsFromDisk() error = %v", err)
+	}
+	if requests := loaded.GetStatsSnapshot(1).Totals.Requests; requests != 8 {
+		t.Fatalf("loaded Requests = %d, want 8", requests)
+	}
+}
@@ -5,6 +5,7 @@ package fscache
 import (
 	"fmt"
 	"os"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 )
@@ -27,6 +28,41 @@ func platformPreallocate(file *os.File, required int64) error {
 	return nil
 }
 
+// fileID returns the device and inode of info, which are shared by hard links.
+func fileID(info os.FileInfo) ([2]uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return [2]uint64{}, false
+	}
+	return [2]uint64{uint64(stat.Dev), uint64(stat.Ino)}, true
+}
+
 func platformDropCacheRange(file *os.File, offset, length int64) error {
 	return unix.Fadvise(int(file.Fd()), offset, length, unix.FADV_DONTNEED)
 }
+
+// networkFilesystems maps the statfs magic numbers of network filesystems to
+// their names.
+var networkFilesystems = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+	0x5346414f: "afs",
+	0x47504653: "gpfs",
+	0x0bd00bd0: "lustre",
+}
+
+// networkFilesystem returns the name of the network filesystem path is on,
+// or an empty string for local filesystems.
+func networkFilesystem(path string) (string, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return "", fmt.Errorf("statfs %s: %w", path, err)
+	}
+
+	return networkFilesystems[uint32(stat.Type)], nil
+}
@@ -12,6 +12,16 @@ func platformPreallocate(file *os.File, required int64) error {
 	return file.Truncate(required)
 }
 
+// fileID can't identify hard links on this platform.
+func fileID(info os.FileInfo) ([2]uint64, bool) {
+	return [2]uint64{}, false
+}
+
 func platformDropCacheRange(file *os.File, offset, length int64) error {
 	return nil
 }
+
+// networkFilesystem can't detect network filesystems on this platform.
+func networkFilesystem(path string) (string, error) {
+	return "", nil
+}
@@ -0,0 +1,121 @@
+package fscache
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// SetTempDirectory sets the directory downloads are written to before they
+// are moved into the cache, e.g. local scratch space for a cache directory on
+// a slow network filesystem. If it is empty (the default), downloads are
+// written next to their target, so they are moved into the cache by an atomic
+// rename. Partial downloads left behind by an earlier run are removed. It has
+// to be called before requests are served.
+func (c *FSCache) SetTempDirectory(dir string) {
+	c.tempDirectory = dir
+	if dir == "" {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isPartialDownloadName(entry.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			slog.Warn("Error removing partial download", "event", "startup", "path", filepath.Join(dir, entry.Name()), "error", err)
+		}
+	}
+}
+
+// isPartialDownloadName reports whether name is the name of a temporary
+// download file, <file>.<id>.partial for cache misses and <file>-dl-<id> for
+// refreshes.
+func isPartialDownloadName(name string) bool {
+	if rest, ok := strings.CutSuffix(name, ".partial"); ok {
+		return isUUIDSuffix(rest, ".")
+	}
+	return isUUIDSuffix(name, "-dl-")
+}
+
+// isUUIDSuffix reports whether name ends with separator and a UUID.
+func isUUIDSuffix(name, separator string) bool {
+	i := strings.LastIndex(name, separator)
+	if i < 0 {
+		return false
+	}
+	_, err := uuid.Parse(name[i+len(separator):])
+	return err == nil
+}
+
+// inTempDirectory returns the path tempPath, a temporary file next to the
+// download target, is written to: the same file name in the temp directory
+// if one is set.
+func (c *FSCache) inTempDirectory(tempPath string) string {
+	if c.tempDirectory == "" {
+		return tempPath
+	}
+	return filepath.Join(c.tempDirectory, filepath.Base(tempPath))
+}
+
+// ensureDownloadSpace checks that a download of required bytes fits into the
+// cache at targetPath and into the temp directory if one is set.
+func (c *FSCache) ensureDownloadSpace(targetPath string, required int64) error {
+	if err := ensureDiskSpace(targetPath, required); err != nil {
+		return err
+	}
+	if c.tempDirectory == "" {
+		return nil
+	}
+	return ensureDiskSpace(c.tempDirectory, required)
+}
+
+// moveIntoCache moves the finished download at tempPath to targetPath. If the
+// temp directory is on another filesystem, the file is copied next to the
+// target first, so it still appears in the cache by an atomic rename.
+func (c *FSCache) moveIntoCache(tempPath, targetPath string) error {
+	err := os.Rename(tempPath, targetPath)
+	if err == nil || c.tempDirectory == "" {
+		return err
+	}
+
+	if err := copyIntoCache(tempPath, targetPath); err != nil {
+		return err
+	}
+	return os.Remove(tempPath)
+}
+
+// copyIntoCache copies the file at sourcePath to a temporary file next to
+// targetPath and renames it to targetPath.
+func copyIntoCache(sourcePath, targetPath string) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	localPath := buildTempCachePath(targetPath)
+	file, err := createCacheFile(localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+
+	_, err = io.Copy(file, source)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(localPath, targetPath)
+}
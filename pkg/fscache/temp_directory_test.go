@@ -0,0 +1,104 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPartialDownloadName(t *testing.T) {
+	tests := map[string]bool{
+		"hello_1.0_amd64.deb.0b6bd7f4-5b0a-4b8c-9c5c-0b8f3a3f6a41.partial": true,
+		"InRelease-dl-0b6bd7f4-5b0a-4b8c-9c5c-0b8f3a3f6a41":                true,
+		"hello_1.0_amd64.deb":       false,
+		"notes.partial":             false,
+		"backup-dl-2024.tar":        false,
+		".goaptcacher-selftest.log": false,
+	}
+
+	for name, want := range tests {
+		if got := isPartialDownloadName(name); got != want {
+			t.Errorf("isPartialDownloadName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSetTempDirectoryRemovesPartialDownloads(t *testing.T) {
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "hello_1.0_amd64.deb.0b6bd7f4-5b0a-4b8c-9c5c-0b8f3a3f6a41.partial")
+	other := filepath.Join(dir, "notes.txt")
+	for _, path := range []string{partial, other} {
+		if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	newTestFSCache(t).SetTempDirectory(dir)
+
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatalf("partial download was kept, stat error = %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("other file was removed: %v", err)
+	}
+}
+
+func TestCacheMissUsesTempDirectory(t *testing.T) {
+	const payload = "package content"
+	mirror := newTestMirror(t, payload)
+
+	cache := newTestFSCache(t)
+	tempDir := filepath.Join(t.TempDir(), "scratch")
+	cache.SetTempDirectory(tempDir)
+
+	localPath := downloadPackage(t, cache, mirror.URL, payload)
+	data, err := os.ReadFile(localPath)
+	if err != nil || string(data) != payload {
+		t.Fatalf("cached file = %q, %v, want %q", data, err, payload)
+	}
+
+	// The temp directory is created for the download.
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("temp directory not empty after download: %v", entries)
+	}
+}
+
+func TestSelfTestCreatesTempDirectory(t *testing.T) {
+	cache := newTestFSCache(t)
+	tempDir := filepath.Join(t.TempDir(), "scratch")
+	cache.SetTempDirectory(tempDir)
+
+	if err := cache.SelfTest(1); err != nil {
+		t.Fatalf("SelfTest() error = %v", err)
+	}
+	entries, err := os.ReadDir(tempDir)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("temp directory = %v, %v, want an empty directory", entries, err)
+	}
+}
+
+func TestCopyIntoCache(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "download.partial")
+	if err := os.WriteFile(source, []byte("content"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	targetDir := t.TempDir()
+	target := filepath.Join(targetDir, "file.deb")
+
+	if err := copyIntoCache(source, target); err != nil {
+		t.Fatalf("copyIntoCache() error = %v", err)
+	}
+
+	data, err := os.ReadFile(target)
+	if err != nil || string(data) != "content" {
+		t.Fatalf("target = %q, %v, want %q", data, err, "content")
+	}
+	entries, err := os.ReadDir(targetDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("target directory = %v, %v, want only the target", entries, err)
+	}
+}
@@ -0,0 +1,7 @@
+package fscache
+
+import "go.opentelemetry.io/otel"
+
+// tracer creates the spans of the cache. Unless the program configures a
+// tracer provider, the spans are no-ops.
+var tracer = otel.Tracer("gitlab.com/bella.network/goaptcacher/pkg/fscache")
@@ -0,0 +1,93 @@
+package fscache
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TransportOptions control the connections to upstream servers.
+type TransportOptions struct {
+	// ForceHTTP1 disables HTTP/2, all upstream servers are contacted with
+	// HTTP/1.1.
+	ForceHTTP1 bool
+	// HTTP1Hosts are host names which are contacted with HTTP/1.1, e.g.
+	// mirrors with a broken HTTP/2 implementation.
+	HTTP1Hosts []string
+	// MaxIdleConnsPerHost is the number of idle connections kept per host.
+	// With HTTP/2, a single connection carries parallel requests.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout closes idle connections after this time, 0 keeps them
+	// open.
+	IdleConnTimeout time.Duration
+}
+
+// DefaultTransportOptions returns the transport options used if none are
+// set.
+func DefaultTransportOptions() TransportOptions {
+	return TransportOptions{
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
+
+// SetTransportOptions replaces the transport used for upstream requests with
+// one built from opts. It has to be called before requests are served.
+func (c *FSCache) SetTransportOptions(opts TransportOptions) {
+	c.setUpstreamTransport(newUpstreamTransport(opts))
+}
+
+// newUpstreamTransport returns the transport for upstream requests. HTTP/2 is
+// negotiated with HTTPS upstream servers unless it is disabled for all or
+// the requested host.
+func newUpstreamTransport(opts TransportOptions) http.RoundTripper {
+	http1 := newHTTPTransport(opts, false)
+	if opts.ForceHTTP1 {
+		return http1
+	}
+
+	transport := newHTTPTransport(opts, true)
+	if len(opts.HTTP1Hosts) == 0 {
+		return transport
+	}
+
+	hosts := make(map[string]struct{}, len(opts.HTTP1Hosts))
+	for _, host := range opts.HTTP1Hosts {
+		hosts[strings.ToLower(strings.TrimSuffix(host, "."))] = struct{}{}
+	}
+	return &hostProtocolTransport{http2: transport, http1: http1, http1Hosts: hosts}
+}
+
+// newHTTPTransport returns a transport speaking HTTP/1.1 and optionally
+// HTTP/2.
+func newHTTPTransport(opts TransportOptions, http2 bool) *http.Transport {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(http2)
+
+	return &http.Transport{
+		Proxy:                 nil, // No proxy by default
+		Protocols:             protocols,
+		ForceAttemptHTTP2:     http2,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute * 5, // Timeout for response headers
+	}
+}
+
+// hostProtocolTransport sends requests to the hosts in http1Hosts with
+// HTTP/1.1 and all others with HTTP/2 if the server supports it.
+type hostProtocolTransport struct {
+	http2      http.RoundTripper
+	http1      http.RoundTripper
+	http1Hosts map[string]struct{}
+}
+
+func (t *hostProtocolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if _, ok := t.http1Hosts[strings.ToLower(r.URL.Hostname())]; ok {
+		return t.http1.RoundTrip(r)
+	}
+	return t.http2.RoundTrip(r)
+}
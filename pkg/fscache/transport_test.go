@@ -0,0 +1,61 @@
+package fscache
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// trustServer makes the transports of rt trust the certificate of server.
+func trustServer(t *testing.T, rt http.RoundTripper, server *httptest.Server) {
+	t.Helper()
+
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig
+	switch transport := rt.(type) {
+	case *http.Transport:
+		transport.TLSClientConfig = config.Clone()
+	case *hostProtocolTransport:
+		trustServer(t, transport.http1, server)
+		trustServer(t, transport.http2, server)
+	default:
+		t.Fatalf("unexpected transport %T", rt)
+	}
+}
+
+func TestUpstreamTransportProtocols(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{}
+	server.StartTLS()
+	defer server.Close()
+
+	tcs := []struct {
+		name  string
+		opts  TransportOptions
+		proto int
+	}{
+		{"default", DefaultTransportOptions(), 2},
+		{"force HTTP/1.1", TransportOptions{ForceHTTP1: true}, 1},
+		{"HTTP/1.1 host", TransportOptions{HTTP1Hosts: []string{"127.0.0.1"}}, 1},
+		{"other HTTP/1.1 host", TransportOptions{HTTP1Hosts: []string{"mirror.example.com"}}, 2},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := newUpstreamTransport(tc.opts)
+			trustServer(t, transport, server)
+
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			resp.Body.Close()
+			if resp.ProtoMajor != tc.proto {
+				t.Fatalf("protocol = %s, want HTTP/%d", resp.Proto, tc.proto)
+			}
+		})
+	}
+}
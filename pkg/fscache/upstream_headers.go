@@ -0,0 +1,59 @@
+package fscache
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// SecretHeaders are headers added to requests to an upstream server, e.g. the
+// credentials of a private repository. Their values are redacted in logs.
+type SecretHeaders http.Header
+
+// LogValue lists the header names only.
+func (h SecretHeaders) LogValue() slog.Value {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	attrs := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		attrs = append(attrs, slog.String(name, "[redacted]"))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// SetUpstreamHeaders sets the function returning the headers added to
+// requests to an upstream host, nil if none. The headers are only sent to the
+// upstream server, not to a parent cache and not to clients. It has to be
+// called before requests are served.
+func (c *FSCache) SetUpstreamHeaders(headers func(host string) SecretHeaders) {
+	c.upstreamHeaders = headers
+}
+
+// upstreamHeaderTransport adds the configured headers of the requested host
+// to the requests passed to next. Redirects to another host don't get the
+// headers of the original host.
+type upstreamHeaderTransport struct {
+	cache *FSCache
+	next  http.RoundTripper
+}
+
+func (t *upstreamHeaderTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if t.cache.upstreamHeaders == nil {
+		return t.next.RoundTrip(r)
+	}
+	headers := t.cache.upstreamHeaders(r.URL.Hostname())
+	if len(headers) == 0 {
+		return t.next.RoundTrip(r)
+	}
+
+	// A RoundTripper must not modify the request.
+	r = r.Clone(r.Context())
+	for name, values := range headers {
+		r.Header[name] = slices.Clone(values)
+	}
+	return t.next.RoundTrip(r)
+}
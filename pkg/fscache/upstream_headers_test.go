@@ -0,0 +1,65 @@
+package fscache
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpstreamHeaders(t *testing.T) {
+	const payload = "package content"
+
+	var mux sync.Mutex
+	var tokens []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		tokens = append(tokens, r.Header.Get("X-Repo-Token"))
+		mux.Unlock()
+		_, _ = io.WriteString(w, payload)
+	}))
+	t.Cleanup(upstream.Close)
+	port := mustParseURL(t, upstream.URL).Port()
+
+	cache := newTestFSCache(t)
+	cache.SetTransportOptions(DefaultTransportOptions())
+	cache.SetUpstreamHeaders(func(host string) SecretHeaders {
+		if host != "127.0.0.1" {
+			return nil
+		}
+		return SecretHeaders{"X-Repo-Token": {"s3cr3t"}}
+	})
+
+	for _, mirror := range []string{"http://127.0.0.1:" + port, "http://localhost:" + port} {
+		req := httptest.NewRequest(http.MethodGet, mirror+"/debian/pool/main/h/hello/hello_1.0_amd64.deb", nil)
+		req.Header.Set("X-Repo-Token", "from client")
+		rr := httptest.NewRecorder()
+		cache.serveGETRequest(req, rr)
+		if rr.Code != http.StatusOK || rr.Body.String() != payload {
+			t.Fatalf("response = %d %q, want 200 %q", rr.Code, rr.Body.String(), payload)
+		}
+		if got := rr.Header().Get("X-Repo-Token"); got != "" {
+			t.Fatalf("configured header sent to client: %q", got)
+		}
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if want := []string{"s3cr3t", "from client"}; strings.Join(tokens, ",") != strings.Join(want, ",") {
+		t.Fatalf("upstream tokens = %q, want %q", tokens, want)
+	}
+}
+
+func TestSecretHeadersLogValue(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	logger.Info("headers", "headers", SecretHeaders{"Authorization": {"Bearer s3cr3t"}})
+
+	if out := buf.String(); strings.Contains(out, "s3cr3t") || !strings.Contains(out, "headers.Authorization=[redacted]") {
+		t.Fatalf("log output = %q, want redacted Authorization", out)
+	}
+}
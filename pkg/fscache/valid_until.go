@@ -0,0 +1,113 @@
+package fscache
+
+import (
+	"log/slog"
+	"os"
+	"time"
+
+	"gitlab.com/bella.network/goaptcacher/pkg/debrepocleaner"
+)
+
+const (
+	// validUntilMinInterval is the shortest recheck interval of files with
+	// Valid-Until, used close to and after the deadline.
+	validUntilMinInterval = time.Minute
+	// validUntilDivisor splits the time left until Valid-Until, so a file is
+	// checked about this many times before it expires.
+	validUntilDivisor = 10
+)
+
+// RecheckOptions control how often repository index files are checked
+// upstream for changes.
+type RecheckOptions struct {
+	// Metadata is the interval of repository index files listed in
+	// RefreshFiles.
+	Metadata time.Duration
+	// ValidUntilMax is the longest interval of InRelease and Release files
+	// which declare Valid-Until. The interval shrinks as the deadline
+	// approaches. 0 uses Metadata for these files as well.
+	ValidUntilMax time.Duration
+}
+
+// DefaultRecheckOptions returns the recheck options used if none are set.
+func DefaultRecheckOptions() RecheckOptions {
+	return RecheckOptions{
+		Metadata:      5 * time.Minute,
+		ValidUntilMax: 15 * time.Minute,
+	}
+}
+
+// SetRecheckOptions replaces the recheck options of the cache. It has to be
+// called before requests are served.
+func (c *FSCache) SetRecheckOptions(opts RecheckOptions) {
+	if opts.Metadata <= 0 {
+		opts.Metadata = DefaultRecheckOptions().Metadata
+	}
+	c.recheck = opts
+}
+
+// validUntilRecord is the Valid-Until date parsed from a version of a cached
+// file.
+type validUntilRecord struct {
+	modTime    time.Time
+	size       int64
+	validUntil time.Time
+}
+
+// validUntilInterval returns the recheck interval of a file which expires at
+// validUntil: a fraction of the remaining time, at least
+// validUntilMinInterval and at most maxInterval.
+func validUntilInterval(validUntil, now time.Time, maxInterval time.Duration) time.Duration {
+	interval := validUntil.Sub(now) / validUntilDivisor
+	return max(min(interval, maxInterval), validUntilMinInterval)
+}
+
+// validUntilRecheck returns the recheck interval of the InRelease or Release
+// file at localPath based on its Valid-Until date. false is returned if the
+// file doesn't declare one or dynamic intervals are disabled.
+func (c *FSCache) validUntilRecheck(localPath, filename string) (time.Duration, bool) {
+	if c.recheck.ValidUntilMax <= 0 || (filename != "InRelease" && filename != "Release") {
+		return 0, false
+	}
+
+	validUntil := c.cachedValidUntil(localPath)
+	if validUntil.IsZero() {
+		return 0, false
+	}
+	return validUntilInterval(validUntil, time.Now(), c.recheck.ValidUntilMax), true
+}
+
+// cachedValidUntil returns the Valid-Until date of the file at localPath, or
+// the zero time if it has none. The date is parsed once per version of the
+// file.
+func (c *FSCache) cachedValidUntil(localPath string) time.Time {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return time.Time{}
+	}
+
+	c.validUntilMux.Lock()
+	record, ok := c.validUntil[localPath]
+	c.validUntilMux.Unlock()
+	if ok && record.modTime.Equal(info.ModTime()) && record.size == info.Size() {
+		return record.validUntil
+	}
+
+	record = validUntilRecord{modTime: info.ModTime(), size: info.Size()}
+	if contents, err := os.ReadFile(localPath); err == nil {
+		if release, err := debrepocleaner.ParseRelease(contents); err == nil {
+			record.validUntil = release.ValidUntil
+		} else {
+			slog.Debug("Error parsing release file", "event", "refresh", "path", localPath, "error", err)
+		}
+	}
+
+	c.validUntilMux.Lock()
+	if c.validUntil == nil {
+		c.validUntil = make(map[string]validUntilRecord)
+	}
+	c.validUntil[localPath] = record
+	c.validUntilMux.Unlock()
+
+	return record.validUntil
+}
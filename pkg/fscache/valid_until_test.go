@@ -0,0 +1,67 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidUntilInterval(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		validUntil time.Time
+		want       time.Duration
+	}{
+		{name: "fresh", validUntil: now.Add(7 * 24 * time.Hour), want: 15 * time.Minute},
+		{name: "approaching", validUntil: now.Add(time.Hour), want: 6 * time.Minute},
+		{name: "close", validUntil: now.Add(5 * time.Minute), want: time.Minute},
+		{name: "expired", validUntil: now.Add(-time.Hour), want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := validUntilInterval(tt.validUntil, now, 15*time.Minute); got != tt.want {
+			t.Errorf("%s: validUntilInterval() = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// writeRelease writes the cached file of rawURL.
+func writeRelease(t *testing.T, cache *FSCache, rawURL, contents string) {
+	t.Helper()
+
+	localPath := cache.buildLocalPath(mustParseURL(t, rawURL))
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	if err := os.WriteFile(localPath, []byte(contents), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+}
+
+func TestRecheckTimeoutUsesValidUntil(t *testing.T) {
+	const target = "http://security.example/debian-security/dists/stable-security/InRelease"
+
+	cache := newTestFSCache(t)
+	validUntil := time.Now().UTC().Add(2 * time.Hour).Format("Mon, 2 Jan 2006 15:04:05 UTC")
+	writeRelease(t, cache, target, "Origin: Debian\nValid-Until: "+validUntil+"\n")
+
+	timeout, rule := cache.recheckTimeout(mustParseURL(t, target))
+	if rule != "valid-until" || timeout < 11*time.Minute || timeout > 12*time.Minute {
+		t.Fatalf("recheckTimeout() = %s, %q, want about 12m by valid-until", timeout, rule)
+	}
+
+	// A new version of the file without Valid-Until uses the flat interval.
+	writeRelease(t, cache, target, "Origin: Debian\nSuite: stable-security\n")
+	if timeout, rule := cache.recheckTimeout(mustParseURL(t, target)); timeout != 5*time.Minute || rule != "repository index" {
+		t.Fatalf("recheckTimeout() without Valid-Until = %s, %q, want 5m by repository index", timeout, rule)
+	}
+
+	cache.SetRecheckOptions(RecheckOptions{Metadata: 2 * time.Minute})
+	writeRelease(t, cache, target, "Valid-Until: "+validUntil+"\n")
+	if timeout, rule := cache.recheckTimeout(mustParseURL(t, target)); timeout != 2*time.Minute || rule != "repository index" {
+		t.Fatalf("recheckTimeout() with disabled Valid-Until = %s, %q, want 2m by repository index", timeout, rule)
+	}
+}
@@ -0,0 +1,67 @@
+package fscache
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultWriteLockMaxAge is the age from which a write lock is considered
+// left behind by a crashed download. It is longer than the one hour timeout
+// of upstream requests, so running downloads keep their lock.
+const DefaultWriteLockMaxAge = 90 * time.Minute
+
+// SetWriteLockMaxAge sets the age from which write locks are taken over by
+// new downloads, 0 keeps locks until they are released. It has to be called
+// before requests are served.
+func (c *FSCache) SetWriteLockMaxAge(maxAge time.Duration) {
+	c.writeLockMaxAge = maxAge
+}
+
+// takeOverStaleWriteLock renews the write lock of a file if it is older than
+// the maximum age and removes the temporary files of the download which held
+// it. It returns false if the lock is still valid.
+func (c *FSCache) takeOverStaleWriteLock(protocol int, domain, path string) bool {
+	if c.writeLockMaxAge <= 0 {
+		return false
+	}
+
+	key := c.lockKey(protocol, domain, path)
+	c.memoryFileWriteLockMux.Lock()
+	lockTime, ok := c.memoryFileWriteLock[key]
+	if !ok || time.Since(lockTime) < c.writeLockMaxAge {
+		c.memoryFileWriteLockMux.Unlock()
+		return false
+	}
+	c.memoryFileWriteLock[key] = time.Now()
+	c.memoryFileWriteLockMux.Unlock()
+
+	slog.Warn("Taking over stale write lock", "event", "lock", "host", domain, "path", path, "locked_since", lockTime)
+	removePartialFiles(c.buildLocalPath(c.buildAccessURL(protocol, domain, path)))
+	return true
+}
+
+// removePartialFiles deletes the temporary files of downloads of the file at
+// localPath, named <file>.<id>.partial for cache misses and <file>-dl-<id> for
+// refreshes.
+func removePartialFiles(localPath string) {
+	dir, base := filepath.Split(localPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), base)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if (strings.HasPrefix(suffix, ".") && strings.HasSuffix(suffix, ".partial")) || strings.HasPrefix(suffix, "-dl-") {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				slog.Warn("Error removing partial download", "event", "lock", "path", filepath.Join(dir, entry.Name()), "error", err)
+			}
+		}
+	}
+}
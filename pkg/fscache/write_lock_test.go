@@ -0,0 +1,69 @@
+package fscache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateExclusiveWriteLockTakesOverStaleLock(t *testing.T) {
+	cache := newTestFSCache(t)
+	const domain, path = "deb.debian.org", "/debian/pool/main/h/hello/hello_1.0_amd64.deb"
+
+	localPath := cache.buildLocalPath(cache.buildAccessURL(0, domain, path))
+	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+		t.Fatalf("MkdirAll() error = %v", err)
+	}
+	partials := []string{localPath + ".0f8fad5b.partial", localPath + "-dl-7c9e6679"}
+	other := localPath + ".sig"
+	for _, name := range append(partials, other) {
+		if err := os.WriteFile(name, []byte("data"), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	if !cache.CreateExclusiveWriteLock(0, domain, path) {
+		t.Fatalf("CreateExclusiveWriteLock() = false, want true")
+	}
+	if cache.CreateExclusiveWriteLock(0, domain, path) {
+		t.Fatalf("CreateExclusiveWriteLock() took over a fresh lock")
+	}
+
+	// Age the lock as if the download crashed long ago.
+	cache.memoryFileWriteLockMux.Lock()
+	cache.memoryFileWriteLock[cache.lockKey(0, domain, path)] = time.Now().Add(-2 * DefaultWriteLockMaxAge)
+	cache.memoryFileWriteLockMux.Unlock()
+
+	if !cache.CreateExclusiveWriteLock(0, domain, path) {
+		t.Fatalf("CreateExclusiveWriteLock() = false, want stale lock to be taken over")
+	}
+	if ok, lockTime := cache.HasWriteLock(0, domain, path); !ok || time.Since(lockTime) > time.Minute {
+		t.Fatalf("HasWriteLock() = %v, %v, want renewed lock", ok, lockTime)
+	}
+	for _, name := range partials {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("partial file %s still exists, err = %v", name, err)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("unrelated file removed: %v", err)
+	}
+}
+
+func TestCreateExclusiveWriteLockKeepsStaleLockWithoutMaxAge(t *testing.T) {
+	cache := newTestFSCache(t)
+	cache.SetWriteLockMaxAge(0)
+	const domain, path = "deb.debian.org", "/debian/dists/stable/InRelease"
+
+	if !cache.CreateExclusiveWriteLock(0, domain, path) {
+		t.Fatalf("CreateExclusiveWriteLock() = false, want true")
+	}
+	cache.memoryFileWriteLockMux.Lock()
+	cache.memoryFileWriteLock[cache.lockKey(0, domain, path)] = time.Now().Add(-24 * time.Hour)
+	cache.memoryFileWriteLockMux.Unlock()
+
+	if cache.CreateExclusiveWriteLock(0, domain, path) {
+		t.Fatalf("CreateExclusiveWriteLock() took over a lock although the maximum age is disabled")
+	}
+}
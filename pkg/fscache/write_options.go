@@ -0,0 +1,65 @@
+package fscache
+
+import (
+	"path"
+	"slices"
+)
+
+// copyBufferSize is the size of the chunks a download is read in.
+const copyBufferSize = 32 * 1024
+
+// WriteOptions control how downloaded files are written to the cache
+// directory while they are streamed to the client.
+type WriteOptions struct {
+	// BufferSize is the number of bytes of a single download kept in memory
+	// until they are written to disk. Once the buffer is full, reading from
+	// the upstream server waits for the disk. 0 writes synchronously.
+	BufferSize int64
+	// DropCacheThreshold is the file size from which written data is dropped
+	// from the page cache, so large downloads don't evict hot files. 0
+	// disables dropping.
+	DropCacheThreshold int64
+	// MetadataDropCacheThreshold replaces DropCacheThreshold for repository
+	// index files listed in RefreshFiles. These are read by every client after
+	// an update, so by default they stay in the page cache. 0 disables
+	// dropping.
+	MetadataDropCacheThreshold int64
+	// DropCacheChunk is the amount of written data dropped at once.
+	DropCacheChunk int64
+}
+
+// DefaultWriteOptions returns the write options used if none are set.
+func DefaultWriteOptions() WriteOptions {
+	return WriteOptions{
+		BufferSize:         32 * copyBufferSize,
+		DropCacheThreshold: cacheDropThreshold,
+		DropCacheChunk:     cacheDropChunk,
+	}
+}
+
+// SetWriteOptions replaces the write options of the cache. It has to be
+// called before requests are served.
+func (c *FSCache) SetWriteOptions(opts WriteOptions) {
+	if opts.DropCacheChunk <= 0 {
+		opts.DropCacheChunk = cacheDropChunk
+	}
+	c.writeOptions = opts
+}
+
+// dropCacheThreshold returns the threshold from which written data of the
+// file at urlPath is dropped from the page cache, 0 if it is kept.
+func (o WriteOptions) dropCacheThreshold(urlPath string) int64 {
+	if slices.Contains(RefreshFiles, path.Base(urlPath)) {
+		return max(0, o.MetadataDropCacheThreshold)
+	}
+	return max(0, o.DropCacheThreshold)
+}
+
+// bufferChunks returns the number of read chunks which fit into the write
+// buffer, 0 if downloads are written synchronously.
+func (o WriteOptions) bufferChunks() int {
+	if o.BufferSize <= 0 {
+		return 0
+	}
+	return int(max(1, (o.BufferSize+copyBufferSize-1)/copyBufferSize))
+}
@@ -0,0 +1,127 @@
+package httpsintercept
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultCAKeyType and DefaultCAValidity are used by GenerateCA if the
+// options leave them empty.
+const (
+	DefaultCAKeyType  = "ecdsa-p256"
+	DefaultCAValidity = 10 * 365 * 24 * time.Hour
+)
+
+// CAKeyTypes are the key types GenerateCA supports.
+var CAKeyTypes = []string{"ecdsa-p256", "ecdsa-p384", "rsa-2048", "rsa-3072", "rsa-4096"}
+
+// CAOptions configures the CA created by GenerateCA.
+type CAOptions struct {
+	CommonName string        // Common name of the CA (default: GoAPTCacher Interception CA)
+	KeyType    string        // One of CAKeyTypes (default: DefaultCAKeyType)
+	Validity   time.Duration // Time the certificate is valid (default: DefaultCAValidity)
+}
+
+// GenerateCA creates a self-signed CA which can be used for interception. It
+// returns the PEM encoded certificate and the unencrypted PKCS #8 private key.
+func GenerateCA(options CAOptions) ([]byte, []byte, error) {
+	if options.CommonName == "" {
+		options.CommonName = "GoAPTCacher Interception CA"
+	}
+	if options.KeyType == "" {
+		options.KeyType = DefaultCAKeyType
+	}
+	if options.Validity == 0 {
+		options.Validity = DefaultCAValidity
+	}
+	if options.Validity < 0 {
+		return nil, nil, errors.New("validity must be positive")
+	}
+
+	key, err := generateCAKey(options.KeyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	subjectKeyID, err := keyIdentifier(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := newCertificateSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:   options.CommonName,
+			Organization: []string{"GoAPTCacher"},
+		},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(options.Validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		SubjectKeyId:          subjectKeyID,
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// generateCAKey creates a private key of keyType.
+func generateCAKey(keyType string) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "ecdsa-p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "rsa-2048":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa-3072":
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case "rsa-4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	default:
+		return nil, fmt.Errorf("unsupported key type %q, supported: %s", keyType, strings.Join(CAKeyTypes, ", "))
+	}
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the PEM encoded certificate
+// certPEM in the colon separated form openssl prints.
+func Fingerprint(certPEM []byte) (string, error) {
+	cert, err := parsePublicKey(certPEM)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":"), nil
+}
@@ -0,0 +1,72 @@
+package httpsintercept
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateCA(t *testing.T) {
+	for _, keyType := range []string{"ecdsa-p256", "ecdsa-p384", "rsa-2048"} {
+		t.Run(keyType, func(t *testing.T) {
+			certPEM, keyPEM, err := GenerateCA(CAOptions{CommonName: "Test CA", KeyType: keyType, Validity: 48 * time.Hour})
+			if err != nil {
+				t.Fatalf("GenerateCA returned error: %v", err)
+			}
+
+			ca, err := parsePublicKey(certPEM)
+			if err != nil {
+				t.Fatalf("failed to parse certificate: %v", err)
+			}
+			if !ca.IsCA || !ca.BasicConstraintsValid {
+				t.Fatalf("certificate is no CA")
+			}
+			if ca.KeyUsage&x509.KeyUsageCertSign == 0 {
+				t.Fatalf("certificate lacks certSign key usage: %v", ca.KeyUsage)
+			}
+			if ca.Subject.CommonName != "Test CA" {
+				t.Fatalf("common name = %q, want %q", ca.Subject.CommonName, "Test CA")
+			}
+			if validity := time.Until(ca.NotAfter); validity < 47*time.Hour || validity > 48*time.Hour {
+				t.Fatalf("certificate expires in %v, want 48h", validity)
+			}
+
+			// The CA has to be usable for interception.
+			intercept, err := New(certPEM, keyPEM, "", nil)
+			if err != nil {
+				t.Fatalf("New returned error: %v", err)
+			}
+			leaf, err := intercept.generateProxyCertificate("deb.debian.org")
+			if err != nil {
+				t.Fatalf("failed to issue certificate: %v", err)
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(ca)
+			if _, err := leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "deb.debian.org", Roots: roots}); err != nil {
+				t.Fatalf("issued certificate doesn't verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestGenerateCAUnsupportedKeyType(t *testing.T) {
+	if _, _, err := GenerateCA(CAOptions{KeyType: "dsa-1024"}); err == nil || !strings.Contains(err.Error(), "unsupported key type") {
+		t.Fatalf("GenerateCA error = %v, want unsupported key type", err)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	ca := newTestCA(t, "ecdsa", nil)
+
+	fingerprint, err := Fingerprint(ca.certPEM)
+	if err != nil {
+		t.Fatalf("Fingerprint returned error: %v", err)
+	}
+	if len(fingerprint) != 32*3-1 || strings.Count(fingerprint, ":") != 31 {
+		t.Fatalf("fingerprint %q has unexpected format", fingerprint)
+	}
+	if _, err := Fingerprint([]byte("invalid")); err == nil {
+		t.Fatalf("expected error for invalid certificate")
+	}
+}
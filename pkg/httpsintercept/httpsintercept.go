@@ -6,13 +6,14 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // required for RFC 5280 key identifiers
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
 	"errors"
-	"log"
+	"log/slog"
 	"math/big"
 	"net"
 	"os"
@@ -188,14 +189,14 @@ func (c *Intercept) GetCertificate(domain string) *tls.Certificate {
 
 	if !ok {
 		if err := c.CreateCertificate(domain); err != nil {
-			log.Printf("Failed to create certificate for %s: %v", domain, err)
+			slog.Error("Failed to create certificate", "event", "certificate", "host", domain, "error", err)
 		}
 
 		c.certStorage.mutex.RLock()
 		val, ok = c.certStorage.Certificates[domain]
 		c.certStorage.mutex.RUnlock()
 		if !ok {
-			log.Printf("Failed to get certificate for %s", domain)
+			slog.Error("Failed to get certificate", "event", "certificate", "host", domain)
 			return nil
 		}
 	}
@@ -231,7 +232,7 @@ func (c *certificateStorage) IsInOperation(domain string) bool {
 // CreateCertificate creates a new certificate for a given domain
 func (c *Intercept) CreateCertificate(domain string) error {
 	if c.certStorage.IsInOperation(domain) {
-		log.Printf("Operation for %s is already in progress, waiting for completion", domain)
+		slog.Debug("Certificate operation already in progress, waiting for completion", "event", "certificate", "host", domain)
 		time.Sleep(time.Second)
 		return c.CreateCertificate(domain)
 	}
@@ -250,7 +251,7 @@ func (c *Intercept) CreateCertificate(domain string) error {
 		OperationInProgress: false,
 	}
 	c.certStorage.mutex.Unlock()
-	log.Printf("Generated new certificate for %s", domain)
+	slog.Info("Generated new certificate", "event", "certificate", "host", domain)
 
 	return nil
 }
@@ -267,10 +268,10 @@ func (c *Intercept) GC() {
 		}
 	}
 	for _, domain := range toDelete {
-		log.Println("CertificateStorage GC: Removing", domain, "from generated certificates")
+		slog.Debug("Removing certificate from storage", "event", "certificate_gc", "host", domain)
 		delete(c.certStorage.Certificates, domain)
 	}
-	log.Printf("CertificateStorage GC: Removed %d certificates, %d remain", len(toDelete), len(c.certStorage.Certificates))
+	slog.Info("Certificate storage cleaned up", "event", "certificate_gc", "removed", len(toDelete), "remaining", len(c.certStorage.Certificates))
 }
 
 // ReturnCert is called by TLS server including provided SNI name
@@ -288,7 +289,7 @@ func (c *Intercept) ReturnCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate
 	if domain == "" {
 		domain = c.domain
 	}
-	log.Println("New incoming request for", domain)
+	slog.Debug("New incoming TLS connection", "event", "certificate", "host", domain)
 
 	certFromStore := c.GetCertificate(domain)
 	return certFromStore, nil
@@ -306,6 +307,17 @@ func (c *Intercept) generateProxyCertificate(requestedHostname string) (*tls.Cer
 		return nil, err
 	}
 
+	// Strict TLS stacks use SKI/AKI to build the chain, so the leaf must carry
+	// its own key identifier and reference the identifier of the issuing CA.
+	template.SubjectKeyId, err = keyIdentifier(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	template.AuthorityKeyId, err = c.authorityKeyIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
 	x, err := x509.CreateCertificate(rand.Reader, &template, c.publicKey, key.Public(), c.signingPrivateKey())
 	if err != nil {
 		return nil, err
@@ -314,11 +326,41 @@ func (c *Intercept) generateProxyCertificate(requestedHostname string) (*tls.Cer
 	return c.buildTLSCertificate(x, key)
 }
 
+// keyIdentifier computes a key identifier as described in RFC 5280 section
+// 4.2.1.2 (method 1): the SHA-1 hash of the subjectPublicKey bit string.
+func keyIdentifier(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, err
+	}
+
+	sum := sha1.Sum(spki.SubjectPublicKey.Bytes) //nolint:gosec // SHA-1 is mandated by RFC 5280 for key identifiers
+	return sum[:], nil
+}
+
+// authorityKeyIdentifier returns the SubjectKeyId of the issuing CA. If the CA
+// certificate does not carry one, it is derived from the CA public key.
+func (c *Intercept) authorityKeyIdentifier() ([]byte, error) {
+	if len(c.publicKey.SubjectKeyId) > 0 {
+		return c.publicKey.SubjectKeyId, nil
+	}
+
+	return keyIdentifier(c.publicKey.PublicKey)
+}
+
 func newCertificateSerialNumber() (*big.Int, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		log.Printf("Failed to generate serial number: %v", err)
+		slog.Error("Failed to generate serial number", "event", "certificate", "error", err)
 		return nil, err
 	}
 	return serialNumber, nil
@@ -456,6 +456,56 @@ func TestGenerateProxyCertificateNormalizesBracketedIPv6WithPort(t *testing.T) {
 	}
 }
 
+func TestGenerateProxyCertificateSetsKeyIdentifiers(t *testing.T) {
+	root := newTestCA(t, "rsa", nil)
+	intermediate := newTestCA(t, "ecdsa", root)
+	intercept, err := createIntercept(intermediate.cert, intermediate.key, root.cert)
+	if err != nil {
+		t.Fatalf("createIntercept returned error: %v", err)
+	}
+
+	cert, err := intercept.generateProxyCertificate("www.example.com")
+	if err != nil {
+		t.Fatalf("generateProxyCertificate returned error: %v", err)
+	}
+
+	wantSKI, err := keyIdentifier(cert.Leaf.PublicKey)
+	if err != nil {
+		t.Fatalf("keyIdentifier returned error: %v", err)
+	}
+	if len(cert.Leaf.SubjectKeyId) == 0 || !bytes.Equal(cert.Leaf.SubjectKeyId, wantSKI) {
+		t.Fatalf("unexpected SubjectKeyId %x, want %x", cert.Leaf.SubjectKeyId, wantSKI)
+	}
+	if len(intermediate.cert.SubjectKeyId) == 0 {
+		t.Fatalf("expected test intermediate to carry a SubjectKeyId")
+	}
+	if !bytes.Equal(cert.Leaf.AuthorityKeyId, intermediate.cert.SubjectKeyId) {
+		t.Fatalf("AuthorityKeyId %x does not match issuer SubjectKeyId %x", cert.Leaf.AuthorityKeyId, intermediate.cert.SubjectKeyId)
+	}
+}
+
+func TestAuthorityKeyIdentifierFallsBackToPublicKey(t *testing.T) {
+	ca := newTestCA(t, "rsa", nil)
+	caCert := *ca.cert
+	caCert.SubjectKeyId = nil
+	intercept, err := createIntercept(&caCert, ca.key, nil)
+	if err != nil {
+		t.Fatalf("createIntercept returned error: %v", err)
+	}
+
+	got, err := intercept.authorityKeyIdentifier()
+	if err != nil {
+		t.Fatalf("authorityKeyIdentifier returned error: %v", err)
+	}
+	want, err := keyIdentifier(ca.key.Public())
+	if err != nil {
+		t.Fatalf("keyIdentifier returned error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("authorityKeyIdentifier() = %x, want %x", got, want)
+	}
+}
+
 func TestCreateCertificateStoresAndResetsOperation(t *testing.T) {
 	root := newTestCA(t, "rsa", nil)
 	intermediate := newTestCA(t, "ecdsa", root)